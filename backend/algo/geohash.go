@@ -0,0 +1,125 @@
+package algo
+
+import (
+	"errors"
+	"strings"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+var errInvalidGeohash = errors.New("invalid geohash")
+
+// Cell is the rectangle a geohash stands for
+type Cell struct {
+	Hash   string
+	MinLat float64
+	MinLng float64
+	MaxLat float64
+	MaxLng float64
+}
+
+// Center returns the middle of the cell
+func (c Cell) Center() Point {
+	return Point{Lat: (c.MinLat + c.MaxLat) / 2, Lng: (c.MinLng + c.MaxLng) / 2}
+}
+
+// EncodeGeohash returns the geohash of the given length (1-12) containing the point.
+// Each extra character shrinks the cell about 32 times; length 5 is roughly 5x5 km.
+func EncodeGeohash(lat, lng float64, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+
+	var hash strings.Builder
+	bit, ch, even := 0, 0, true // Bits alternate longitude, latitude
+	for hash.Len() < precision {
+		if even {
+			mid := (minLng + maxLng) / 2
+			if lng >= mid {
+				ch |= 1 << (4 - bit)
+				minLng = mid
+			} else {
+				maxLng = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch |= 1 << (4 - bit)
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+		even = !even
+
+		if bit++; bit == 5 {
+			hash.WriteByte(geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return hash.String()
+}
+
+// DecodeGeohash returns the cell of a geohash
+func DecodeGeohash(hash string) (Cell, error) {
+	cell := Cell{Hash: hash, MinLat: -90, MaxLat: 90, MinLng: -180, MaxLng: 180}
+	if hash == "" {
+		return cell, errInvalidGeohash
+	}
+
+	even := true
+	for _, r := range strings.ToLower(hash) {
+		idx := strings.IndexRune(geohashAlphabet, r)
+		if idx < 0 {
+			return cell, errInvalidGeohash
+		}
+		for bit := 4; bit >= 0; bit-- {
+			set := idx&(1<<bit) != 0
+			if even {
+				mid := (cell.MinLng + cell.MaxLng) / 2
+				if set {
+					cell.MinLng = mid
+				} else {
+					cell.MaxLng = mid
+				}
+			} else {
+				mid := (cell.MinLat + cell.MaxLat) / 2
+				if set {
+					cell.MinLat = mid
+				} else {
+					cell.MaxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return cell, nil
+}
+
+// GeohashNeighbours returns the cell of hash and the cells around it, row by row
+// from the north-west corner. Cells past the poles are left out.
+func GeohashNeighbours(hash string) ([]string, error) {
+	cell, err := DecodeGeohash(hash)
+	if err != nil {
+		return nil, err
+	}
+	center := cell.Center()
+	height, width := cell.MaxLat-cell.MinLat, cell.MaxLng-cell.MinLng
+
+	var hashes []string
+	for dy := 1; dy >= -1; dy-- {
+		lat := center.Lat + float64(dy)*height
+		if lat > 90 || lat < -90 {
+			continue
+		}
+		for dx := -1; dx <= 1; dx++ {
+			lng := center.Lng + float64(dx)*width
+			if lng >= 180 { // Wrap around the antimeridian
+				lng -= 360
+			} else if lng < -180 {
+				lng += 360
+			}
+			hashes = append(hashes, EncodeGeohash(lat, lng, len(hash)))
+		}
+	}
+	return hashes, nil
+}
@@ -0,0 +1,78 @@
+package algo
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeGeohash(t *testing.T) {
+	tests := []struct {
+		lat, lng  float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{42.6, -5.6, 5, "ezs42"},
+		{37.7749, -122.4194, 6, "9q8yyk"},
+		{-33.8688, 151.2093, 7, "r3gx2f7"},
+		{0, 0, 1, "s"},
+		{-90, -180, 3, "000"},
+		{90, 180, 3, "zzz"},
+	}
+	for _, tt := range tests {
+		if got := EncodeGeohash(tt.lat, tt.lng, tt.precision); got != tt.want {
+			t.Errorf("EncodeGeohash(%v, %v, %d) = %q, want %q", tt.lat, tt.lng, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeGeohash(t *testing.T) {
+	cell, err := DecodeGeohash("ezs42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Cell{Hash: "ezs42", MinLat: 42.583008, MinLng: -5.625, MaxLat: 42.626953, MaxLng: -5.581055}
+	for _, pair := range [][2]float64{
+		{cell.MinLat, want.MinLat}, {cell.MinLng, want.MinLng}, {cell.MaxLat, want.MaxLat}, {cell.MaxLng, want.MaxLng},
+	} {
+		if math.Abs(pair[0]-pair[1]) > 1e-6 {
+			t.Fatalf("DecodeGeohash(ezs42) = %+v, want %+v", cell, want)
+		}
+	}
+	if c := cell.Center(); EncodeGeohash(c.Lat, c.Lng, 5) != "ezs42" {
+		t.Errorf("center %v encodes outside the cell", c)
+	}
+
+	for _, bad := range []string{"", "ezs4a", "ezs 2"} {
+		if _, err := DecodeGeohash(bad); err == nil {
+			t.Errorf("DecodeGeohash(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestGeohashNeighbours(t *testing.T) {
+	tests := []struct {
+		hash string
+		want []string
+	}{
+		{"ezs42", []string{
+			"ezefx", "ezs48", "ezs49",
+			"ezefr", "ezs42", "ezs43",
+			"ezefp", "ezs40", "ezs41",
+		}},
+		// West of the antimeridian wraps to the far east
+		{"2", []string{"x", "8", "9", "r", "2", "3", "p", "0", "1"}},
+		// Nothing north of the pole
+		{"zzz", []string{"zzy", "zzz", "bpb", "zzw", "zzx", "bp8"}},
+	}
+	for _, tt := range tests {
+		got, err := GeohashNeighbours(tt.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GeohashNeighbours(%q) = %v, want %v", tt.hash, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package algo
+
+import (
+	"math"
+)
+
+// unassignable stands in for an infinite cost so the solver stays in finite arithmetic
+const unassignable = 1e12
+
+// hungarianMatcher solves the rider/driver assignment problem exactly with the
+// Hungarian (Kuhn-Munkres) algorithm. For a single request it degrades to ranking.
+type hungarianMatcher struct {
+	cost CostFunc
+}
+
+// NewHungarianMatcher returns a batch matcher minimising the summed cost of a round
+func NewHungarianMatcher(cost CostFunc) BatchMatcher {
+	return &hungarianMatcher{cost: cost}
+}
+
+func (m *hungarianMatcher) Name() string { return StrategyHungarian }
+
+func (m *hungarianMatcher) Rank(req Request, candidates []Candidate) ([]Candidate, error) {
+	return rankByCost(req, candidates, m.cost)
+}
+
+// Assign returns at most one driver per request and one request per driver, pairing as
+// many requests as there are feasible pairs for at the least total cost. When there are
+// more requests than drivers, the requests left out are whichever ones that cheapest
+// pairing has no driver for; a left-out request is not necessarily the costliest to
+// serve on its own. Requests with no feasible driver are always left out.
+func (m *hungarianMatcher) Assign(reqs []Request, candidates []Candidate) ([]Assignment, error) {
+	if len(reqs) == 0 || len(candidates) == 0 {
+		return nil, nil
+	}
+
+	costs := make([][]float64, len(reqs))
+	for i, req := range reqs {
+		costs[i] = make([]float64, len(candidates))
+		for j, c := range candidates {
+			v, err := m.cost(req, c)
+			if err != nil || math.IsInf(v, 0) || math.IsNaN(v) || v > unassignable {
+				v = unassignable
+			}
+			costs[i][j] = v
+		}
+	}
+
+	var pairs [][2]int
+	if len(reqs) <= len(candidates) {
+		for i, j := range solveAssignment(costs) {
+			pairs = append(pairs, [2]int{i, j})
+		}
+	} else {
+		// The solver needs rows <= columns, so solve the transposed problem
+		for j, i := range solveAssignment(transpose(costs)) {
+			pairs = append(pairs, [2]int{i, j})
+		}
+	}
+
+	var out []Assignment
+	for _, p := range pairs {
+		c := costs[p[0]][p[1]]
+		if c >= unassignable {
+			continue
+		}
+		out = append(out, Assignment{
+			RequestID:   reqs[p[0]].ID,
+			CandidateID: candidates[p[1]].ID,
+			Cost:        c,
+		})
+	}
+	return out, nil
+}
+
+func transpose(a [][]float64) [][]float64 {
+	t := make([][]float64, len(a[0]))
+	for j := range t {
+		t[j] = make([]float64, len(a))
+		for i := range a {
+			t[j][i] = a[i][j]
+		}
+	}
+	return t
+}
+
+// solveAssignment returns, for each row, the column assigned to it. It requires
+// len(rows) <= len(columns) and runs in O(n^2 m) using row/column potentials.
+func solveAssignment(cost [][]float64) []int {
+	n, m := len(cost), len(cost[0])
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1) // p[j] = row matched to column j (1-based, 0 = free)
+	way := make([]int, m+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, m+1)
+		used := make([]bool, m+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for {
+			used[j0] = true
+			i0, delta, j1 := p[j0], math.Inf(1), 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	rows := make([]int, n)
+	for j := 1; j <= m; j++ {
+		if p[j] != 0 {
+			rows[p[j]-1] = j - 1
+		}
+	}
+	return rows
+}
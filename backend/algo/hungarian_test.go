@@ -0,0 +1,234 @@
+package algo
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// matrixCost serves costs from a table indexed by request and candidate ID
+func matrixCost(costs [][]float64) CostFunc {
+	return func(req Request, c Candidate) (float64, error) {
+		i, _ := strconv.Atoi(req.ID)
+		j, _ := strconv.Atoi(c.ID)
+		return costs[i][j], nil
+	}
+}
+
+func fixture(rows, cols int) ([]Request, []Candidate) {
+	reqs := make([]Request, rows)
+	for i := range reqs {
+		reqs[i] = Request{ID: strconv.Itoa(i)}
+	}
+	candidates := make([]Candidate, cols)
+	for j := range candidates {
+		candidates[j] = Candidate{ID: strconv.Itoa(j)}
+	}
+	return reqs, candidates
+}
+
+// bruteForce returns the cheapest total over every way of giving each row of the
+// smaller side a distinct partner, counting only feasible pairs, and how many
+// feasible pairs it uses
+func bruteForce(costs [][]float64) (float64, int) {
+	rows, cols := len(costs), len(costs[0])
+	if rows > cols {
+		costs = transpose(costs)
+		rows, cols = cols, rows
+	}
+	best, bestPairs := math.Inf(1), 0
+	used := make([]bool, cols)
+	var walk func(i int, total float64, pairs int)
+	walk = func(i int, total float64, pairs int) {
+		if i == rows {
+			if pairs > bestPairs || pairs == bestPairs && total < best {
+				best, bestPairs = total, pairs
+			}
+			return
+		}
+		for j := 0; j < cols; j++ {
+			if used[j] {
+				continue
+			}
+			used[j] = true
+			if c := costs[i][j]; c >= unassignable || math.IsInf(c, 1) {
+				walk(i+1, total, pairs)
+			} else {
+				walk(i+1, total+c, pairs+1)
+			}
+			used[j] = false
+		}
+	}
+	walk(0, 0, 0)
+	return best, bestPairs
+}
+
+func checkAssignments(t *testing.T, out []Assignment, costs [][]float64) float64 {
+	t.Helper()
+	reqSeen, candSeen := map[string]bool{}, map[string]bool{}
+	total := 0.0
+	for _, a := range out {
+		if reqSeen[a.RequestID] || candSeen[a.CandidateID] {
+			t.Fatalf("request %s or candidate %s assigned twice in %v", a.RequestID, a.CandidateID, out)
+		}
+		reqSeen[a.RequestID], candSeen[a.CandidateID] = true, true
+		i, _ := strconv.Atoi(a.RequestID)
+		j, _ := strconv.Atoi(a.CandidateID)
+		if a.Cost != costs[i][j] {
+			t.Errorf("assignment %v reports cost %v, table has %v", a, a.Cost, costs[i][j])
+		}
+		total += a.Cost
+	}
+	return total
+}
+
+func TestHungarianAssign(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name  string
+		costs [][]float64
+		want  map[string]string // request -> candidate
+	}{
+		{
+			name:  "greedy is not optimal",
+			costs: [][]float64{{1, 2}, {2, 10}},
+			want:  map[string]string{"0": "1", "1": "0"},
+		},
+		{
+			name:  "more drivers than requests",
+			costs: [][]float64{{4, 1, 3}, {2, 0, 5}},
+			want:  map[string]string{"0": "1", "1": "0"},
+		},
+		{
+			name:  "more requests than drivers leaves the costliest out",
+			costs: [][]float64{{1}, {5}, {3}},
+			want:  map[string]string{"0": "0"},
+		},
+		{
+			name:  "infeasible pairs are never assigned",
+			costs: [][]float64{{inf, 2}, {inf, 3}},
+			want:  map[string]string{"0": "1"},
+		},
+		{
+			name:  "nothing feasible",
+			costs: [][]float64{{inf, inf}},
+			want:  map[string]string{},
+		},
+		{
+			name:  "a pair above the unassignable cap counts as infeasible",
+			costs: [][]float64{{2 * unassignable, 1}, {1, 2 * unassignable}},
+			want:  map[string]string{"0": "1", "1": "0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqs, candidates := fixture(len(tt.costs), len(tt.costs[0]))
+			out, err := NewHungarianMatcher(matrixCost(tt.costs)).Assign(reqs, candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkAssignments(t, out, tt.costs)
+			got := make(map[string]string, len(out))
+			for _, a := range out {
+				got[a.RequestID] = a.CandidateID
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for req, cand := range tt.want {
+				if got[req] != cand {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHungarianAssignTies(t *testing.T) {
+	// Every assignment costs the same; any perfect matching is optimal
+	costs := [][]float64{{1, 1, 1}, {1, 1, 1}, {1, 1, 1}}
+	reqs, candidates := fixture(3, 3)
+	out, err := NewHungarianMatcher(matrixCost(costs)).Assign(reqs, candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := checkAssignments(t, out, costs); len(out) != 3 || total != 3 {
+		t.Fatalf("got %v, want 3 assignments costing 3", out)
+	}
+}
+
+func TestHungarianAssignMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		rows, cols := 1+rng.Intn(5), 1+rng.Intn(5)
+		costs := make([][]float64, rows)
+		for i := range costs {
+			costs[i] = make([]float64, cols)
+			for j := range costs[i] {
+				costs[i][j] = float64(rng.Intn(20))
+				if rng.Intn(6) == 0 {
+					costs[i][j] = math.Inf(1)
+				}
+			}
+		}
+
+		reqs, candidates := fixture(rows, cols)
+		out, err := NewHungarianMatcher(matrixCost(costs)).Assign(reqs, candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := checkAssignments(t, out, costs)
+		want, pairs := bruteForce(costs)
+		if len(out) != pairs || total != want {
+			t.Fatalf("costs %v: got %d pairs costing %v, want %d costing %v", costs, len(out), total, pairs, want)
+		}
+	}
+}
+
+func TestHungarianAssignEmpty(t *testing.T) {
+	m := NewHungarianMatcher(StraightLineCost)
+	reqs, candidates := fixture(2, 2)
+	if out, _ := m.Assign(nil, candidates); out != nil {
+		t.Errorf("no requests: got %v", out)
+	}
+	if out, _ := m.Assign(reqs, nil); out != nil {
+		t.Errorf("no candidates: got %v", out)
+	}
+}
+
+func TestNewMatcher(t *testing.T) {
+	for _, name := range Strategies {
+		m, err := NewMatcher(name, MatcherOptions{ETA: func(a, b, c, d float64) (float64, error) { return 0, nil }})
+		if err != nil || m.Name() != name {
+			t.Errorf("NewMatcher(%q) = %v, %v", name, m, err)
+		}
+	}
+	for _, name := range []string{StrategyHungarian, "nearset"} {
+		if _, err := NewMatcher(name, MatcherOptions{}); err == nil {
+			t.Errorf("NewMatcher(%q) succeeded", name)
+		}
+	}
+}
+
+func TestRankByRatingWeight(t *testing.T) {
+	req := Request{Pickup: Point{Lat: 12.9, Lng: 77.6}}
+	near := Candidate{ID: "near", Location: Point{Lat: 12.9, Lng: 77.601}, Rating: 1}
+	far := Candidate{ID: "far", Location: Point{Lat: 12.9, Lng: 77.6015}, Rating: 5}
+
+	rank := func(weight float64) []string {
+		ranked, _ := NewRatingWeightedMatcher(weight).Rank(req, []Candidate{far, near})
+		ids := make([]string, len(ranked))
+		for i, c := range ranked {
+			ids[i] = c.ID
+		}
+		return ids
+	}
+	if got := rank(0); got[0] != "near" {
+		t.Errorf("weight 0 ranked %v, want the nearest first", got)
+	}
+	if got := rank(1); got[0] != "far" {
+		t.Errorf("weight 1 ranked %v, want the 5-star driver first", got)
+	}
+}
@@ -0,0 +1,189 @@
+package algo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Matching strategy names. The per-request ones are selected through the
+// MATCHER_STRATEGY setting; hungarian assigns whole rounds in batch dispatch.
+const (
+	StrategyNearest   = "nearest"
+	StrategyRoadETA   = "road_eta"
+	StrategyRating    = "rating"
+	StrategyHungarian = "hungarian"
+)
+
+// Strategies lists the names NewMatcher accepts
+var Strategies = []string{StrategyNearest, StrategyRoadETA, StrategyRating}
+
+// Point is a latitude/longitude pair in degrees
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+// Candidate is a driver that can be offered a ride
+type Candidate struct {
+	ID       string
+	Location Point
+	Rating   float64 // Average rider rating, 0 when unrated
+}
+
+// Request is a ride waiting for a driver
+type Request struct {
+	ID     string
+	Pickup Point
+}
+
+// Assignment pairs a request with the driver chosen for it
+type Assignment struct {
+	RequestID   string
+	CandidateID string
+	Cost        float64
+}
+
+// Matcher orders the drivers for a single ride request, best first
+type Matcher interface {
+	Name() string
+	Rank(req Request, candidates []Candidate) ([]Candidate, error)
+}
+
+// BatchMatcher assigns several pending requests to several drivers at once so that
+// the total cost of the round is minimal rather than greedy per request
+type BatchMatcher interface {
+	Matcher
+	Assign(reqs []Request, candidates []Candidate) ([]Assignment, error)
+}
+
+// CostFunc scores how expensive it is to send a candidate to a request; lower is better
+type CostFunc func(req Request, c Candidate) (float64, error)
+
+// ETAFunc returns the road travel time in minutes between two points
+type ETAFunc func(fromLat, fromLng, toLat, toLng float64) (float64, error)
+
+// StraightLineCost is the Vincenty distance in km between the driver and the pickup
+func StraightLineCost(req Request, c Candidate) (float64, error) {
+	return CalculateVincentyDistance(req.Pickup.Lat, req.Pickup.Lng, c.Location.Lat, c.Location.Lng), nil
+}
+
+// costMatcher ranks candidates by ascending cost
+type costMatcher struct {
+	name string
+	cost CostFunc
+}
+
+func (m *costMatcher) Name() string { return m.name }
+
+func (m *costMatcher) Rank(req Request, candidates []Candidate) ([]Candidate, error) {
+	return rankByCost(req, candidates, m.cost)
+}
+
+func rankByCost(req Request, candidates []Candidate, cost CostFunc) ([]Candidate, error) {
+	costs := make([]float64, len(candidates))
+	for i, c := range candidates {
+		v, err := cost(req, c)
+		if err != nil {
+			v = math.Inf(1) // Unscorable drivers go last rather than failing the request
+		}
+		costs[i] = v
+	}
+
+	idx := make([]int, len(candidates))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return costs[idx[a]] < costs[idx[b]] })
+
+	ranked := make([]Candidate, len(candidates))
+	for i, j := range idx {
+		ranked[i] = candidates[j]
+	}
+	return ranked, nil
+}
+
+// NewNearestMatcher picks the driver closest to the pickup in a straight line
+func NewNearestMatcher() Matcher {
+	return &costMatcher{name: StrategyNearest, cost: StraightLineCost}
+}
+
+// roadETAMatcher ranks by road ETA. Road lookups are slow and metered, so only the
+// shortlist nearest in a straight line is queried; the rest keep their straight-line order.
+type roadETAMatcher struct {
+	eta       ETAFunc
+	shortlist int
+}
+
+// NewRoadETAMatcher ranks the nearest shortlist drivers by road ETA to the pickup
+func NewRoadETAMatcher(eta ETAFunc, shortlist int) Matcher {
+	if shortlist <= 0 {
+		shortlist = 5
+	}
+	return &roadETAMatcher{eta: eta, shortlist: shortlist}
+}
+
+func (m *roadETAMatcher) Name() string { return StrategyRoadETA }
+
+func (m *roadETAMatcher) Rank(req Request, candidates []Candidate) ([]Candidate, error) {
+	ranked, _ := rankByCost(req, candidates, StraightLineCost)
+	n := m.shortlist
+	if n > len(ranked) {
+		n = len(ranked)
+	}
+
+	head, err := rankByCost(req, ranked[:n], func(req Request, c Candidate) (float64, error) {
+		return m.eta(c.Location.Lat, c.Location.Lng, req.Pickup.Lat, req.Pickup.Lng)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(head, ranked[n:]...), nil
+}
+
+// RatingWeightedCost returns a cost that inflates the straight-line distance for poorly
+// rated drivers. weight 0 ignores ratings; weight 1 doubles the distance of a 1-star
+// driver. Unrated drivers are treated as average (3 stars).
+func RatingWeightedCost(weight float64) CostFunc {
+	return func(req Request, c Candidate) (float64, error) {
+		dist, _ := StraightLineCost(req, c)
+		rating := c.Rating
+		if rating <= 0 {
+			rating = 3
+		}
+		penalty := (5 - math.Min(rating, 5)) / 4 // 0 for 5 stars, 1 for 1 star
+		return dist * (1 + weight*penalty), nil
+	}
+}
+
+// NewRatingWeightedMatcher trades off proximity against the driver's rating
+func NewRatingWeightedMatcher(weight float64) Matcher {
+	return &costMatcher{name: StrategyRating, cost: RatingWeightedCost(weight)}
+}
+
+// MatcherOptions carries the dependencies and tunables a strategy may need
+type MatcherOptions struct {
+	ETA          ETAFunc // Required for road_eta
+	ETAShortlist int
+	RatingWeight float64
+}
+
+// NewMatcher builds the per-request strategy with the given name. Hungarian is
+// refused: ranking the drivers of a single request by it is just nearest.
+func NewMatcher(name string, opts MatcherOptions) (Matcher, error) {
+	switch name {
+	case "", StrategyNearest:
+		return NewNearestMatcher(), nil
+	case StrategyRoadETA:
+		if opts.ETA == nil {
+			return nil, fmt.Errorf("matcher %q needs an ETA function", name)
+		}
+		return NewRoadETAMatcher(opts.ETA, opts.ETAShortlist), nil
+	case StrategyRating:
+		return NewRatingWeightedMatcher(opts.RatingWeight), nil
+	case StrategyHungarian:
+		return nil, fmt.Errorf("matcher %q assigns rounds of rides, use DISPATCH_MODE=batch", name)
+	default:
+		return nil, fmt.Errorf("unknown matcher %q", name)
+	}
+}
@@ -7,9 +7,9 @@ import (
 // CalculateVincentyDistance calculates the distance between two points (lat1, lon1) and (lat2, lon2) using Vincenty's formula
 func CalculateVincentyDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	// WGS-84 ellipsiod parameters
-	a := 6378137.0 // semi-major axis in meters
+	a := 6378137.0         // semi-major axis in meters
 	f := 1 / 298.257223563 // flattening
-	b := (1 - f) * a // semi-minor axis
+	b := (1 - f) * a       // semi-minor axis
 
 	// Convert degrees to radians
 	lat1Rad := lat1 * math.Pi / 180.0
@@ -35,23 +35,29 @@ func CalculateVincentyDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	sigma := 0.0
 	sinAlpha := 0.0
 	cos2Alpha := 0.0
-	 cos2SigmaM := 0.0
+	cos2SigmaM := 0.0
 	C := 0.0
 	lamda := L
-	for {
+	for i := 0; i < 200; i++ { // Bounded: nearly antipodal points may not converge
 		sinSigma = math.Sqrt(math.Pow(cosU2*math.Sin(lamda), 2) + math.Pow(cosU1*sinU2-math.Sin(U1)*cosU2*math.Cos(lamda), 2))
+		if sinSigma == 0 {
+			return 0 // Coincident points
+		}
 		cosSigma = sinU1*sinU2 + cosU1*cosU2*math.Cos(lamda)
 		sigma = math.Atan2(sinSigma, cosSigma)
 
 		sinAlpha = cosU1 * cosU2 * math.Sin(lamda) / sinSigma
 		cos2Alpha = 1 - sinAlpha*sinAlpha
-		cos2SigmaM = cosSigma - 2*sinU1*sinU2/cos2Alpha
-		C = f / 16 * cos2Alpha * (4 + f * (4 - 3*cos2Alpha))
+		cos2SigmaM = 0.0 // Equatorial line
+		if cos2Alpha != 0 {
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cos2Alpha
+		}
+		C = f / 16 * cos2Alpha * (4 + f*(4-3*cos2Alpha))
 
 		// Update lambda (the difference in longitude)
 		lamdaPrev := lamda
-		lamda = L + (1 - C) * f * sinAlpha *
-			(sigma + C*sinSigma*(cos2SigmaM + C*cosSigma*(-1 + 2*cos2SigmaM*cos2SigmaM)))
+		lamda = L + (1-C)*f*sinAlpha*
+			(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
 
 		if math.Abs(lamda-lamdaPrev) < 1e-12 {
 			break
@@ -61,9 +67,9 @@ func CalculateVincentyDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	// Calculate distance
 	u2 := cos2Alpha * (a*a - b*b) / (b * b)
 	A := 1 + u2/16384*(4096+u2*(-768+u2*(320-175*u2)))
-	B := u2 / 1024 * (256+u2*(-128+u2*(74-47*u2)))
-	distance := b * A * (sigma - B*sinSigma*(cos2SigmaM + B*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
-	
+	B := u2 / 1024 * (256 + u2*(-128+u2*(74-47*u2)))
+	distance := b * A * (sigma - B*sinSigma*(cos2SigmaM+B*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+
 	// Return distance in kilometers
 	return distance / 1000.0 // Convert from meters to kilometers
 }
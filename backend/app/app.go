@@ -0,0 +1,169 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"uber-clone/auth"
+	"uber-clone/config"
+	"uber-clone/controllers"
+	"uber-clone/db"
+	"uber-clone/payments"
+	"uber-clone/services"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// App owns every long-lived dependency of the API and the handlers built on them.
+// Nothing in the request path reaches for package-level state, so a test can
+// assemble an App around fakes and drive the router directly.
+type App struct {
+	Config   *config.Config
+	Mongo    *mongo.Client // nil when assembled around an in-memory store
+	Store    *store.Store
+	Hub      *websockets.Hub
+	Payments payments.Gateway
+	Maps     services.Maps
+	Tokens   *auth.Tokens
+	Zones    *services.SurgeZones
+
+	Tracker    *controllers.LocationTracker
+	Dispatcher *controllers.BatchDispatcher // nil unless DISPATCH_MODE=batch
+
+	Auth          *controllers.AuthHandler
+	Rides         *controllers.RideHandler
+	Notifications *controllers.NotificationHandler
+	Fares         *controllers.FareHandler
+	Surge         *controllers.SurgeHandler
+	Webhooks      *controllers.WebhookHandler
+}
+
+// New connects to MongoDB and wires the production dependencies: Stripe, Mapbox,
+// the notification inbox and, if configured, the hub backplane
+func New(cfg *config.Config) (*App, error) {
+	client, err := db.Connect(cfg.MongoURI)
+	if err != nil {
+		return nil, err
+	}
+	database := client.Database(cfg.DBName)
+
+	// Indexes and validators are versioned in schema_migrations; applied ones are skipped
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := db.Migrate(ctx, database); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	hub := websockets.NewHub()
+	hub.Inbox, err = services.NewMongoInbox(database, cfg.NotificationTTL)
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to set up notification inbox: %v", err)
+	}
+
+	// Replicas share notifications through a backplane so any of them can reach a user
+	switch cfg.HubBackplane {
+	case "mongo":
+		hub.Backplane = services.NewMongoBackplane(database)
+	case "memory":
+		hub.Backplane = websockets.NewMemoryBackplane()
+	}
+	if hub.Backplane != nil {
+		// Without a subscription this replica would publish notifications it never receives
+		if err := hub.SubscribeBackplane(); err != nil {
+			hub.Backplane.Close()
+			client.Disconnect(context.Background())
+			return nil, fmt.Errorf("failed to subscribe to hub backplane: %v", err)
+		}
+	}
+
+	a := Assemble(cfg, store.NewMongoStore(database), hub,
+		payments.NewStripeGateway(cfg.StripeSecretKey),
+		services.NewMapboxClient(cfg.MapboxToken),
+	)
+	a.Mongo = client
+	return a, nil
+}
+
+// Assemble builds the handlers around dependencies the caller already created,
+// e.g. store.NewMemoryStore(), a hub without inbox, payments.NewFakeGateway() and
+// services.NewFakeMaps()
+func Assemble(cfg *config.Config, st *store.Store, hub *websockets.Hub, gateway payments.Gateway, maps services.Maps) *App {
+	a := &App{
+		Config:   cfg,
+		Store:    st,
+		Hub:      hub,
+		Payments: gateway,
+		Maps:     maps,
+		Tokens:   auth.NewTokens(cfg.JWTSecret, cfg.TokenTTL),
+		Tracker:  controllers.NewLocationTracker(st, hub, cfg.LocationFlushInterval),
+		Zones: &services.SurgeZones{
+			Store:     st,
+			Precision: cfg.Pricing.SurgePrecision,
+			Window:    cfg.Pricing.SurgeWindow,
+			Interval:  cfg.Pricing.SurgeInterval,
+			Smoothing: cfg.Pricing.SurgeSmoothing,
+			Cap:       cfg.Pricing.SurgeCap,
+		},
+	}
+
+	a.Rides = &controllers.RideHandler{
+		Store:    st,
+		Hub:      hub,
+		Payments: gateway,
+		Maps:     maps,
+		Pricing: &services.Pricing{
+			Store:       st,
+			Zones:       a.Zones,
+			Rates:       cfg.Pricing.FareRates,
+			MinimumFare: cfg.Pricing.MinimumFare,
+		},
+		Tokens:   a.Tokens,
+		Quotes:   services.NewQuoteSigner(cfg.QuoteSecret, cfg.QuoteTTL),
+		Dispatch: cfg.Dispatch,
+		Cancellation: services.CancellationPolicy{
+			FreeWindow:   cfg.Cancellation.FreeWindow,
+			AcceptedFee:  cfg.Cancellation.AcceptedFee,
+			ArrivedFee:   cfg.Cancellation.ArrivedFee,
+			DriverNoShow: cfg.Cancellation.DriverNoShow,
+		},
+		Tracker: a.Tracker,
+	}
+	if cfg.DispatchMode == "batch" {
+		a.Dispatcher = controllers.NewBatchDispatcher(a.Rides)
+		a.Rides.Dispatcher = a.Dispatcher
+	}
+
+	a.Auth = &controllers.AuthHandler{Store: st, Tokens: a.Tokens}
+	a.Notifications = &controllers.NotificationHandler{Hub: hub}
+	a.Fares = &controllers.FareHandler{Store: st}
+	a.Surge = &controllers.SurgeHandler{Zones: a.Zones}
+	a.Webhooks = &controllers.WebhookHandler{Rides: a.Rides, Secret: cfg.StripeWebhookSecret}
+	return a
+}
+
+// Start launches the background workers: the hub, location persistence, surge
+// zones and, in batch mode, the matching rounds
+func (a *App) Start() {
+	go a.Hub.Run()
+	go a.Tracker.Run() // Persist driver locations in batches
+	go a.Zones.Run()   // Recompute surge per zone
+	if a.Dispatcher != nil {
+		go a.Dispatcher.Run() // Match queued rides in rounds
+	}
+}
+
+// Close releases the backplane and the MongoDB connection, if any
+func (a *App) Close(ctx context.Context) error {
+	if a.Hub.Backplane != nil {
+		a.Hub.Backplane.Close()
+	}
+	if a.Mongo == nil {
+		return nil
+	}
+	return a.Mongo.Disconnect(ctx)
+}
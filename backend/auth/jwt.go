@@ -1,53 +1,53 @@
 package auth
 
 import (
-	"fmt"
 	"time"
-	"uber-clone/config"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 )
 
 type Claims struct {
     UserID string `json:"user_id"`
     Role   string `json:"role"`
-    jwt.StandardClaims
+    jwt.RegisteredClaims
 }
 
-func GenerateToken(userID, role string) (string, error) {
-    expirationTime := time.Now().Add(24 * time.Hour)
+// Tokens issues and checks the JWTs clients authenticate with
+type Tokens struct {
+    secret []byte
+    ttl    time.Duration
+}
+
+// NewTokens signs tokens with secret; each stays valid for ttl
+func NewTokens(secret string, ttl time.Duration) *Tokens {
+    return &Tokens{secret: []byte(secret), ttl: ttl}
+}
+
+func (t *Tokens) GenerateToken(userID, role string) (string, error) {
+    expirationTime := time.Now().Add(t.ttl)
     claims := &Claims{
         UserID: userID,
         Role:   role,
-        StandardClaims: jwt.StandardClaims{
-            ExpiresAt: expirationTime.Unix(),
+        RegisteredClaims: jwt.RegisteredClaims{
+            ExpiresAt: jwt.NewNumericDate(expirationTime),
         },
     }
 
     token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString([]byte(config.MustGetEnv("JWT_SECRET")))
+    return token.SignedString(t.secret)
 }
 
-func ValidateToken(tokenString string) (*Claims, error) {
-    fmt.Println("Received Token:", tokenString) // Debug log
-
+func (t *Tokens) ValidateToken(tokenString string) (*Claims, error) {
     token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-        secret := config.MustGetEnv("JWT_SECRET")
-        fmt.Println("Using Secret Key:", secret) 
-        return []byte(secret), nil
-    })
-
+        return t.secret, nil
+    }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
     if err != nil {
-        fmt.Println("JWT Parsing Error:", err) // Debug log
         return nil, err
     }
 
     claims, ok := token.Claims.(*Claims)
     if !ok || !token.Valid {
-        fmt.Println("Invalid Token or Claims Error") // Debug log
         return nil, jwt.ErrSignatureInvalid
     }
-
-    fmt.Println("Extracted Claims:", claims) // Debug log
     return claims, nil
 }
@@ -0,0 +1,133 @@
+// Command migrate applies, reverts and lists the database migrations.
+//
+//	migrate [-dry-run] [-to N] up|down|status
+//
+// up applies pending migrations (up to N if given). down reverts the latest applied
+// migration, or every one above N if given. The server runs "up" itself at startup.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"uber-clone/config"
+	"uber-clone/db"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would change without writing")
+	target := flag.Int("to", -1, "version to migrate up or down to")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: migrate [-dry-run] [-to N] up|down|status\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Only the database settings matter here, so skip the server's full validation
+	cfg, err := config.Read()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.MongoURI == "" {
+		log.Fatal("MONGODB_URI is not set")
+	}
+
+	client, err := db.Connect(cfg.MongoURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	database := client.Database(cfg.DBName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	switch flag.Arg(0) {
+	case "up":
+		opts := db.MigrateOptions{DryRun: *dryRun}
+		if *target > 0 {
+			opts.Target = *target
+		}
+		ran, err := db.MigrateUp(ctx, database, opts)
+		report(ran, "Applied", "Would apply", *dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "down":
+		opts := db.MigrateOptions{DryRun: *dryRun, Target: *target}
+		if *target < 0 {
+			opts.Target, err = previousVersion(ctx, database)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		reverted, err := db.MigrateDown(ctx, database, opts)
+		report(reverted, "Reverted", "Would revert", *dryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		if err := status(ctx, database); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// previousVersion is the applied version just below the latest one, so a bare
+// "down" reverts a single migration
+func previousVersion(ctx context.Context, database *mongo.Database) (int, error) {
+	applied, err := db.Applied(ctx, database)
+	if err != nil {
+		return 0, err
+	}
+	if len(applied) < 2 {
+		return 0, nil
+	}
+	return applied[len(applied)-2].Version, nil
+}
+
+func report(migrations []db.Migration, verb, dryRunVerb string, dryRun bool) {
+	if dryRun {
+		verb = dryRunVerb
+	}
+	if len(migrations) == 0 {
+		fmt.Println("Nothing to do")
+		return
+	}
+	for _, m := range migrations {
+		fmt.Printf("%s %03d %s\n", verb, m.Version, m.Name)
+	}
+}
+
+func status(ctx context.Context, database *mongo.Database) error {
+	applied, err := db.Applied(ctx, database)
+	if err != nil {
+		return err
+	}
+	at := make(map[int]time.Time, len(applied))
+	for _, a := range applied {
+		at[a.Version] = a.AppliedAt
+	}
+
+	for _, m := range db.Migrations() {
+		state := "pending"
+		if t, ok := at[m.Version]; ok {
+			state = "applied " + t.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("%03d %-24s %s\n", m.Version, m.Name, state)
+	}
+	return nil
+}
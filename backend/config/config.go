@@ -0,0 +1,263 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"uber-clone/algo"
+
+	"github.com/joho/godotenv"
+)
+
+// Config holds the settings the application is assembled from. It is loaded once
+// at startup; nothing reads the environment after that.
+type Config struct {
+	Port                string
+	MongoURI            string
+	DBName              string
+	StripeSecretKey     string
+	StripeWebhookSecret string // Verifies POST /webhooks/stripe; webhooks are refused without it
+	PaymentGateway      string // Only "stripe"; tests inject a fake gateway through app.Assemble
+	MapboxToken         string
+
+	JWTSecret string
+	TokenTTL  time.Duration // How long a login token stays valid
+
+	QuoteSecret string        // Signs fare quotes; defaults to JWTSecret
+	QuoteTTL    time.Duration // How long a quoted fare is honoured
+
+	IdempotencyTTL time.Duration // How long a response is replayed for its Idempotency-Key
+
+	NotificationTTL       time.Duration
+	HubBackplane          string // "", "memory" or "mongo"
+	DispatchMode          string // "immediate" or "batch"
+	LocationFlushInterval time.Duration
+
+	Dispatch     Dispatch
+	Pricing      Pricing
+	Cancellation Cancellation
+}
+
+// Dispatch tunes how drivers are searched for and offered rides
+type Dispatch struct {
+	MaxAttempts     int           // Drivers a ride is offered to before giving up
+	ResponseTimeout time.Duration // How long a driver has to answer a ride_request
+	SearchRadii     []int         // Meters, searched in order until a driver is found
+
+	Matcher           string // Default matching strategy
+	ExperimentMatcher string // Strategy A/B tested against Matcher, if any
+	ExperimentShare   int    // Percentage of rides routed to ExperimentMatcher
+	ETAShortlist      int
+	RatingWeight      float64 // How much the rating strategy penalises poorly rated drivers
+
+	BatchWindow    time.Duration
+	BatchMaxRounds int
+	BatchCost      string // "straight" or "road"
+}
+
+// MaxRadius is the widest search radius in meters
+func (d Dispatch) MaxRadius() int {
+	return d.SearchRadii[len(d.SearchRadii)-1]
+}
+
+// Pricing holds the fallback fare table, used for vehicle types without a fare
+// card, and how zone surge is computed
+type Pricing struct {
+	FareRates   map[string]float64 // Per km, by vehicle type
+	MinimumFare float64
+
+	SurgeCap       float64
+	SurgePrecision int           // Geohash length of a surge zone
+	SurgeWindow    time.Duration // How far back ride requests count as demand
+	SurgeInterval  time.Duration // How often zones are recomputed
+	SurgeSmoothing float64       // Weight of the newest reading, in (0, 1]
+}
+
+// Cancellation sets what riders are charged for cancelling; drivers never are
+type Cancellation struct {
+	FreeWindow   time.Duration // After requesting, cancelling is free for this long
+	AcceptedFee  float64       // Once a driver has accepted
+	ArrivedFee   float64       // Once the driver is at the pickup
+	DriverNoShow time.Duration // Cancelling is free if the driver has not arrived this long after accepting
+}
+
+// DefaultFareRates is the per-km fare of each vehicle type
+var DefaultFareRates = map[string]float64{
+	"two_wheeler":   80,
+	"three_wheeler": 120,
+	"car":           150,
+	"premium_car":   250,
+}
+
+// Load reads the configuration and checks everything the server needs is set
+func Load() (*Config, error) {
+	cfg, err := Read()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Read resolves every setting from the environment, a .env file in the working
+// directory and the YAML or TOML file named by CONFIG_FILE, in that order of
+// precedence, falling back to the defaults. Both files are optional. Read only
+// reports malformed values; tools that need part of the config check it themselves.
+func Read() (*Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env: %v", err)
+	}
+	src, err := newSource(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		Port:                src.String("PORT", "8080"),
+		MongoURI:            src.String("MONGODB_URI", ""),
+		DBName:              src.String("DB_NAME", "uber_clone"),
+		StripeSecretKey:     src.String("STRIPE_SECRET_KEY", ""),
+		StripeWebhookSecret: src.String("STRIPE_WEBHOOK_SECRET", ""),
+		PaymentGateway:      src.String("PAYMENT_GATEWAY", "stripe"),
+		MapboxToken:         src.String("MAPBOX_ACCESS_TOKEN", ""),
+
+		JWTSecret: src.String("JWT_SECRET", ""),
+		TokenTTL:  src.Duration("TOKEN_TTL", 24*time.Hour),
+
+		QuoteSecret: src.String("QUOTE_SECRET", ""),
+		QuoteTTL:    src.Duration("QUOTE_TTL", 5*time.Minute),
+
+		IdempotencyTTL: src.Duration("IDEMPOTENCY_TTL", 24*time.Hour),
+
+		NotificationTTL:       src.Duration("NOTIFICATION_TTL", 7*24*time.Hour),
+		HubBackplane:          src.String("HUB_BACKPLANE", ""),
+		DispatchMode:          src.String("DISPATCH_MODE", "immediate"),
+		LocationFlushInterval: src.Duration("LOCATION_FLUSH_INTERVAL", 2*time.Second),
+
+		Dispatch: Dispatch{
+			MaxAttempts:     src.Int("DISPATCH_MAX_ATTEMPTS", 3),
+			ResponseTimeout: src.Duration("DISPATCH_RESPONSE_TIMEOUT", 30*time.Second),
+			SearchRadii:     src.Ints("DISPATCH_SEARCH_RADII", []int{5000, 10000, 15000}),
+			Matcher:         src.String("MATCHER_STRATEGY", "nearest"),
+			ETAShortlist:    src.Int("MATCHER_ETA_SHORTLIST", 5),
+			RatingWeight:    src.Float("MATCHER_RATING_WEIGHT", 1),
+			BatchWindow:     src.Duration("DISPATCH_BATCH_WINDOW", 3*time.Second),
+			BatchMaxRounds:  src.Int("DISPATCH_BATCH_MAX_ROUNDS", 10),
+			BatchCost:       src.String("DISPATCH_BATCH_COST", "straight"),
+		},
+		Pricing: Pricing{
+			FareRates:      src.Floats("FARE_RATE", DefaultFareRates),
+			MinimumFare:    src.Float("MINIMUM_FARE", 50),
+			SurgeCap:       src.Float("SURGE_CAP", 3.0),
+			SurgePrecision: src.Int("SURGE_PRECISION", 5),
+			SurgeWindow:    src.Duration("SURGE_WINDOW", 15*time.Minute),
+			SurgeInterval:  src.Duration("SURGE_INTERVAL", time.Minute),
+			SurgeSmoothing: src.Float("SURGE_SMOOTHING", 0.5),
+		},
+		Cancellation: Cancellation{
+			FreeWindow:   src.Duration("CANCELLATION_FREE_WINDOW", 2*time.Minute),
+			AcceptedFee:  src.Float("CANCELLATION_FEE", 25),
+			ArrivedFee:   src.Float("CANCELLATION_ARRIVED_FEE", 50),
+			DriverNoShow: src.Duration("CANCELLATION_DRIVER_NO_SHOW", 15*time.Minute),
+		},
+	}
+
+	if cfg.QuoteSecret == "" {
+		cfg.QuoteSecret = cfg.JWTSecret
+	}
+
+	// MATCHER_EXPERIMENT="<strategy>:<percent>" routes that share of rides to a second strategy
+	if exp := src.String("MATCHER_EXPERIMENT", ""); exp != "" {
+		name, pct, ok := strings.Cut(exp, ":")
+		share, err := strconv.Atoi(pct)
+		if !ok || name == "" || err != nil {
+			src.fail("MATCHER_EXPERIMENT", exp, "of the form <strategy>:<percent>")
+		}
+		cfg.Dispatch.ExperimentMatcher, cfg.Dispatch.ExperimentShare = name, share
+	}
+
+	if len(src.errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%v", errors.Join(src.errs...))
+	}
+	return cfg, nil
+}
+
+// Validate checks that required settings are present and tunables are in range,
+// reporting every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.MongoURI != "", "MONGODB_URI is not set")
+	check(c.PaymentGateway == "stripe", "PAYMENT_GATEWAY must be stripe, got %q", c.PaymentGateway)
+	check(c.StripeSecretKey != "", "STRIPE_SECRET_KEY is not set")
+	check(c.StripeWebhookSecret != "", "STRIPE_WEBHOOK_SECRET is not set")
+	check(c.MapboxToken != "", "MAPBOX_ACCESS_TOKEN is not set")
+	check(c.JWTSecret != "", "JWT_SECRET is not set")
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "PORT must be a port number, got %q", c.Port)
+	check(c.TokenTTL > 0, "TOKEN_TTL must be positive")
+	check(c.QuoteTTL > 0, "QUOTE_TTL must be positive")
+	check(c.IdempotencyTTL > 0, "IDEMPOTENCY_TTL must be positive")
+	check(c.NotificationTTL > 0, "NOTIFICATION_TTL must be positive")
+	check(c.LocationFlushInterval > 0, "LOCATION_FLUSH_INTERVAL must be positive")
+	check(c.HubBackplane == "" || c.HubBackplane == "memory" || c.HubBackplane == "mongo",
+		"HUB_BACKPLANE must be empty, memory or mongo, got %q", c.HubBackplane)
+	check(c.DispatchMode == "immediate" || c.DispatchMode == "batch",
+		"DISPATCH_MODE must be immediate or batch, got %q", c.DispatchMode)
+
+	d := c.Dispatch
+	check(d.MaxAttempts >= 1, "DISPATCH_MAX_ATTEMPTS must be at least 1")
+	check(d.ResponseTimeout > 0, "DISPATCH_RESPONSE_TIMEOUT must be positive")
+	increasing := len(d.SearchRadii) > 0 && d.SearchRadii[0] > 0
+	for i := 1; i < len(d.SearchRadii); i++ {
+		increasing = increasing && d.SearchRadii[i] > d.SearchRadii[i-1]
+	}
+	check(increasing, "DISPATCH_SEARCH_RADII must be positive and increasing, got %v", d.SearchRadii)
+	check(slices.Contains(algo.Strategies, d.Matcher),
+		"MATCHER_STRATEGY must be one of %s, got %q", strings.Join(algo.Strategies, ", "), d.Matcher)
+	check(d.ExperimentMatcher == "" || slices.Contains(algo.Strategies, d.ExperimentMatcher),
+		"MATCHER_EXPERIMENT strategy must be one of %s, got %q", strings.Join(algo.Strategies, ", "), d.ExperimentMatcher)
+	check(d.ExperimentShare >= 0 && d.ExperimentShare <= 100, "MATCHER_EXPERIMENT share must be a percentage")
+	check(d.ETAShortlist >= 1, "MATCHER_ETA_SHORTLIST must be at least 1")
+	check(d.RatingWeight >= 0, "MATCHER_RATING_WEIGHT must not be negative")
+	check(d.BatchWindow > 0, "DISPATCH_BATCH_WINDOW must be positive")
+	check(d.BatchMaxRounds >= 1, "DISPATCH_BATCH_MAX_ROUNDS must be at least 1")
+	check(d.BatchCost == "straight" || d.BatchCost == "road",
+		"DISPATCH_BATCH_COST must be straight or road, got %q", d.BatchCost)
+
+	p := c.Pricing
+	check(p.SurgeCap >= 1, "SURGE_CAP must be at least 1")
+	check(p.SurgePrecision >= 1 && p.SurgePrecision <= 12, "SURGE_PRECISION must be between 1 and 12")
+	check(p.SurgeWindow > 0, "SURGE_WINDOW must be positive")
+	check(p.SurgeInterval > 0, "SURGE_INTERVAL must be positive")
+	check(p.SurgeSmoothing > 0 && p.SurgeSmoothing <= 1, "SURGE_SMOOTHING must be in (0, 1]")
+	check(p.MinimumFare >= 0, "MINIMUM_FARE must not be negative")
+	for vehicle, rate := range p.FareRates {
+		check(rate > 0, "FARE_RATE_%s must be positive", strings.ToUpper(vehicle))
+	}
+
+	cn := c.Cancellation
+	check(cn.FreeWindow >= 0, "CANCELLATION_FREE_WINDOW must not be negative")
+	check(cn.AcceptedFee >= 0, "CANCELLATION_FEE must not be negative")
+	check(cn.ArrivedFee >= 0, "CANCELLATION_ARRIVED_FEE must not be negative")
+	check(cn.DriverNoShow > 0, "CANCELLATION_DRIVER_NO_SHOW must be positive")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%v", errors.Join(errs...))
+	}
+	return nil
+}
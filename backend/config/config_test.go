@@ -0,0 +1,66 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMatcher(t *testing.T) {
+	tests := []struct {
+		strategy, experiment string
+		wantErr              string
+	}{
+		{"nearest", "", ""},
+		{"rating", "road_eta:20", ""},
+		{"nearset", "", "MATCHER_STRATEGY"},
+		{"hungarian", "", "MATCHER_STRATEGY"},
+		{"nearest", "ratnig:10", "MATCHER_EXPERIMENT strategy"},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("MONGODB_URI", "mongodb://localhost")
+		t.Setenv("MAPBOX_ACCESS_TOKEN", "token")
+		t.Setenv("JWT_SECRET", "secret")
+		t.Setenv("STRIPE_SECRET_KEY", "sk_test")
+		t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_test")
+		t.Setenv("MATCHER_STRATEGY", tt.strategy)
+		t.Setenv("MATCHER_EXPERIMENT", tt.experiment)
+
+		_, err := Load()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s, %q: %v", tt.strategy, tt.experiment, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s, %q: got %v, want an error about %s", tt.strategy, tt.experiment, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidatePaymentGateway(t *testing.T) {
+	tests := []struct {
+		gateway, secretKey string
+		wantErr            string
+	}{
+		{"stripe", "sk_test", ""},
+		{"stripe", "", "STRIPE_SECRET_KEY"},
+		{"fake", "sk_test", "PAYMENT_GATEWAY"},
+		{"fake", "", "PAYMENT_GATEWAY"},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("MONGODB_URI", "mongodb://localhost")
+		t.Setenv("MAPBOX_ACCESS_TOKEN", "token")
+		t.Setenv("JWT_SECRET", "secret")
+		t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_test")
+		t.Setenv("PAYMENT_GATEWAY", tt.gateway)
+		t.Setenv("STRIPE_SECRET_KEY", tt.secretKey)
+
+		_, err := Load()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s, %q: %v", tt.gateway, tt.secretKey, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s, %q: got %v, want an error about %s", tt.gateway, tt.secretKey, err, tt.wantErr)
+		}
+	}
+}
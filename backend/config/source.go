@@ -0,0 +1,169 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// source resolves settings by their environment variable name. The environment
+// wins over the config file; nested file keys are joined with "_", so
+//
+//	dispatch:
+//	  batch:
+//	    window: 5s
+//
+// sets DISPATCH_BATCH_WINDOW. Malformed values are collected in errs.
+type source struct {
+	file map[string]string
+	errs []error
+}
+
+// newSource reads the optional YAML or TOML config file at path
+func newSource(path string) (*source, error) {
+	s := &source{file: map[string]string{}}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	var values map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format %q, use .yaml or .toml", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+
+	flatten("", values, s.file)
+	return s, nil
+}
+
+func flatten(prefix string, values map[string]interface{}, out map[string]string) {
+	for k, v := range values {
+		key := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flatten(key, v, out)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			out[key] = strings.Join(items, ",")
+		case nil:
+		default:
+			out[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+func (s *source) lookup(key string) (string, bool) {
+	if v := os.Getenv(key); v != "" {
+		return v, true
+	}
+	v, ok := s.file[key]
+	return v, ok && v != ""
+}
+
+func (s *source) fail(key, value, want string) {
+	s.errs = append(s.errs, fmt.Errorf("%s: %q is not %s", key, value, want))
+}
+
+func (s *source) String(key, def string) string {
+	if v, ok := s.lookup(key); ok {
+		return v
+	}
+	return def
+}
+
+func (s *source) Int(key string, def int) int {
+	v, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		s.fail(key, v, "an integer")
+		return def
+	}
+	return n
+}
+
+func (s *source) Float(key string, def float64) float64 {
+	v, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		s.fail(key, v, "a number")
+		return def
+	}
+	return f
+}
+
+// Duration reads a duration such as "30s" or "2m"
+func (s *source) Duration(key string, def time.Duration) time.Duration {
+	v, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil {
+		s.fail(key, v, "a duration such as 30s")
+		return def
+	}
+	return d
+}
+
+// Ints reads a comma-separated list of integers
+func (s *source) Ints(key string, def []int) []int {
+	v, ok := s.lookup(key)
+	if !ok {
+		return def
+	}
+	var list []int
+	for _, item := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			s.fail(key, v, "a comma-separated list of integers")
+			return def
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+// Floats reads one number per name, from key_NAME, e.g. FARE_RATE_CAR
+func (s *source) Floats(key string, def map[string]float64) map[string]float64 {
+	names := make([]string, 0, len(def))
+	for name := range def {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make(map[string]float64, len(def))
+	for _, name := range names {
+		values[name] = s.Float(key+"_"+strings.ToUpper(name), def[name])
+	}
+	return values
+}
@@ -2,29 +2,34 @@ package controllers
 
 import (
 	"context"
-	
+	"errors"
 	"log"
 	"net/http"
 	"time"
 	"uber-clone/auth"
-	"uber-clone/db"
 	"uber-clone/models"
+	"uber-clone/store"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// AuthHandler serves signup, login and the profile endpoint
+type AuthHandler struct {
+	Store  *store.Store
+	Tokens *auth.Tokens
+}
+
 // Signup handles user registration
-func Signup(c *gin.Context) {
+func (h *AuthHandler) Signup(c *gin.Context) {
 	var req struct {
 		Name          string  `json:"name" binding:"required"`
 		Email         string  `json:"email" binding:"required,email"`
 		Phone         string  `json:"phone" binding:"required"`
 		Password      string  `json:"password" binding:"required,min=6"`
 		Role          string  `json:"role" binding:"required,oneof=rider driver"`
-		VehicleType   string  `json:"vehicle_type,omitempty"` // Only for drivers
+		VehicleType   string  `json:"vehicle_type,omitempty" binding:"omitempty,oneof=two_wheeler three_wheeler car premium_car"` // Only for drivers
 		LicenseNumber string  `json:"license_number,omitempty"`
 		CarPlate      string  `json:"car_plate,omitempty"`
 		Lat           float64 `json:"lat" binding:"required"`
@@ -67,8 +72,11 @@ func Signup(c *gin.Context) {
 	}
 
 	// Insert user into the database
-	userColl := db.GetCollection("users")
-	result, err := userColl.InsertOne(context.Background(), user)
+	err = h.Store.Users.Insert(context.Background(), &user)
+	if errors.Is(err, store.ErrDuplicate) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email is already registered"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
@@ -76,15 +84,9 @@ func Signup(c *gin.Context) {
 
 	// If the user is a driver, create a driver profile
 	if req.Role == "driver" {
-		insertedID, ok := result.InsertedID.(primitive.ObjectID)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create driver profile"})
-			return
-		}
-
 		// Create the driver profile with the same location as the user
 		driver := models.Driver{
-			UserID:        insertedID,
+			UserID:        user.ID,
 			VehicleType:   req.VehicleType,
 			LicenseNumber: req.LicenseNumber,
 			CarPlate:      req.CarPlate,
@@ -96,9 +98,7 @@ func Signup(c *gin.Context) {
 			CreatedAt: time.Now().UTC(),
 		}
 
-		driverColl := db.GetCollection("drivers")
-		_, err := driverColl.InsertOne(context.Background(), driver)
-		if err != nil {
+		if err := h.Store.Drivers.Insert(context.Background(), &driver); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create driver profile"})
 			return
 		}
@@ -108,7 +108,7 @@ func Signup(c *gin.Context) {
 }
 
 // Login handles user authentication
-func Login(c *gin.Context) {
+func (h *AuthHandler) Login(c *gin.Context) {
 	var req struct {
 		Email    string  `json:"email" binding:"required,email"`
 		Password string  `json:"password" binding:"required,min=6"`
@@ -122,9 +122,7 @@ func Login(c *gin.Context) {
 	}
 
 	// Find user by email
-	userColl := db.GetCollection("users")
-	var user models.User
-	err := userColl.FindOne(context.Background(), bson.M{"email": req.Email}).Decode(&user)
+	user, err := h.Store.Users.FindByEmail(context.Background(), req.Email)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
@@ -137,34 +135,22 @@ func Login(c *gin.Context) {
 	}
 
 	// Update location and last_login
-	update := bson.M{
-		"$set": bson.M{
-			"location": models.GeoJSON{
-				Type:        "Point",
-				Coordinates: []float64{req.Lng, req.Lat},
-			},
-			"last_login": time.Now(),
-		},
+	location := models.GeoJSON{
+		Type:        "Point",
+		Coordinates: []float64{req.Lng, req.Lat},
 	}
-	userID, err := primitive.ObjectIDFromHex(user.ID.Hex())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+	err = h.Store.Users.RecordLogin(c, user.ID, location, time.Now())
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found to update"})
 		return
 	}
-
-	result, err := userColl.UpdateByID(c, userID, update)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update location and last login"})
 		return
 	}
 
-	if result.MatchedCount == 0 {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found to update"})
-		return
-	}
-
 	// Generate JWT token
-	token, err := auth.GenerateToken(user.ID.Hex(), user.Role)
+	token, err := h.Tokens.GenerateToken(user.ID.Hex(), user.Role)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
@@ -173,7 +159,7 @@ func Login(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"token": token, "role": user.Role})
 }
 
-func Profile(c *gin.Context) {
+func (h *AuthHandler) Profile(c *gin.Context) {
 	userIDValue, exists := c.Get("user_id")
 	if !exists {
 		log.Println("User ID not found in context")
@@ -188,9 +174,7 @@ func Profile(c *gin.Context) {
 		return
 	}
 
-	userColl := db.GetCollection("users")
-	var user models.User
-	err = userColl.FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	user, err := h.Store.Users.FindByID(context.Background(), userID)
 	if err != nil {
 		log.Println("User not found in database:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found"})
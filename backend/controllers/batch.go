@@ -0,0 +1,322 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"uber-clone/algo"
+	"uber-clone/config"
+	"uber-clone/models"
+	"uber-clone/services"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BatchDispatcher queues ride requests for a short window and then assigns all of
+// them at once with a min-cost bipartite matching against the available drivers.
+//
+// Every replica runs one. A searching ride is held by the dispatcher that queued it
+// through a lease on the ride, renewed each round; a ride whose lease ran out, e.g.
+// because its replica died, is adopted by whichever dispatcher claims it first.
+type BatchDispatcher struct {
+	Window    time.Duration
+	MaxRounds int // Rounds a ride may stay unmatched before the rider is told no driver was found
+
+	rides   *RideHandler
+	owner   string // Identifies this dispatcher on the rides it holds
+	mu      sync.Mutex
+	pending []*queuedRide
+}
+
+type queuedRide struct {
+	ride   models.Ride
+	rounds int
+}
+
+// NewBatchDispatcher builds the dispatcher from the batch settings of rides.Dispatch.
+// Matched rides go through the offer flow of rides.
+func NewBatchDispatcher(rides *RideHandler) *BatchDispatcher {
+	return &BatchDispatcher{
+		Window:    rides.Dispatch.BatchWindow,
+		MaxRounds: rides.Dispatch.BatchMaxRounds,
+		rides:     rides,
+		owner:     primitive.NewObjectID().Hex(),
+	}
+}
+
+// lease is how long a ride stays held without being renewed; a few rounds, so one
+// slow round does not hand rides to another replica
+func (d *BatchDispatcher) lease() time.Duration {
+	return 3 * d.Window
+}
+
+// hold marks a ride about to be inserted as held by this dispatcher
+func (d *BatchDispatcher) hold(ride *models.Ride, now time.Time) {
+	ride.DispatchOwner, ride.DispatchLeaseUntil = d.owner, now.Add(d.lease())
+}
+
+// Enqueue adds a searching ride to the next round
+func (d *BatchDispatcher) Enqueue(ride models.Ride) {
+	d.mu.Lock()
+	d.pending = append(d.pending, &queuedRide{ride: ride})
+	d.mu.Unlock()
+}
+
+// Run solves one round per window, first adopting searching rides nobody holds
+func (d *BatchDispatcher) Run() {
+	ticker := time.NewTicker(d.Window)
+	defer ticker.Stop()
+	for {
+		d.round(context.Background())
+		<-ticker.C
+	}
+}
+
+func (d *BatchDispatcher) round(ctx context.Context) {
+	d.adopt(ctx, time.Now())
+
+	d.mu.Lock()
+	queued := d.pending
+	d.pending = nil
+	d.mu.Unlock()
+
+	if round := d.renew(ctx, queued, time.Now()); len(round) > 0 {
+		d.dispatchRound(ctx, round)
+	}
+}
+
+// adopt queues the searching rides whose lease has run out, e.g. those left by a
+// previous process. Of several replicas only the first to claim a ride gets it.
+func (d *BatchDispatcher) adopt(ctx context.Context, now time.Time) {
+	rides, err := d.rides.Store.Rides.FindByStatus(ctx, RideSearching)
+	if err != nil {
+		log.Println("Failed to load searching rides:", err)
+		return
+	}
+	for _, ride := range rides {
+		if ride.DispatchOwner == d.owner || ride.DispatchLeaseUntil.After(now) {
+			continue // Already ours, or held by a live replica
+		}
+		claimed, err := d.rides.Store.Rides.Update(ctx, ride.ID,
+			store.RideMatch{Statuses: []string{RideSearching}, LeaseExpiredBy: now},
+			bson.M{"dispatch_owner": d.owner, "dispatch_lease_until": now.Add(d.lease())},
+		)
+		if err != nil {
+			if !errors.Is(err, store.ErrNotFound) {
+				log.Println("Failed to adopt searching ride:", err)
+			}
+			continue // Claimed by another replica, or no longer searching
+		}
+		d.Enqueue(*claimed)
+	}
+}
+
+// renew extends the lease of the queued rides and drops the ones this dispatcher
+// no longer holds: cancelled while queued, or adopted after a lapsed lease
+func (d *BatchDispatcher) renew(ctx context.Context, queued []*queuedRide, now time.Time) []*queuedRide {
+	kept := queued[:0]
+	for _, q := range queued {
+		ride, err := d.rides.Store.Rides.Update(ctx, q.ride.ID,
+			store.RideMatch{Statuses: []string{RideSearching}, DispatchOwner: d.owner},
+			bson.M{"dispatch_lease_until": now.Add(d.lease())},
+		)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			continue
+		case err != nil:
+			log.Println("Failed to renew the lease of a searching ride:", err)
+		default:
+			q.ride = *ride
+		}
+		kept = append(kept, q)
+	}
+	return kept
+}
+
+// batchCost is the assignment cost between a driver and a pickup. Pairs further apart
+// than the search radius are unassignable.
+func batchCost(maps services.Maps, cfg config.Dispatch) algo.CostFunc {
+	maxKm := float64(cfg.MaxRadius()) / 1000
+	if cfg.BatchCost == "road" {
+		return func(req algo.Request, c algo.Candidate) (float64, error) {
+			if d, _ := algo.StraightLineCost(req, c); d > maxKm {
+				return math.Inf(1), nil // Skip the maps call for hopeless pairs
+			}
+			distance, _, err := maps.Route(c.Location.Lat, c.Location.Lng, req.Pickup.Lat, req.Pickup.Lng)
+			return distance, err
+		}
+	}
+	return func(req algo.Request, c algo.Candidate) (float64, error) {
+		d, _ := algo.StraightLineCost(req, c)
+		if d > maxKm {
+			return math.Inf(1), nil
+		}
+		return d, nil
+	}
+}
+
+// batchRouteWorkers bounds the maps calls in flight while a round is costed by road
+const batchRouteWorkers = 8
+
+// precomputeCosts evaluates cost up front for each request and its shortlist nearest
+// candidates, up to batchRouteWorkers at a time, so a round costed by road does not
+// make one maps call after another. Pairs outside a shortlist are unassignable.
+func precomputeCosts(cost algo.CostFunc, reqs []algo.Request, candidates []algo.Candidate, shortlist int) algo.CostFunc {
+	type pair struct{ req, candidate string }
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		costs = make(map[pair]float64)
+		slots = make(chan struct{}, batchRouteWorkers)
+	)
+	for _, req := range reqs {
+		nearest, _ := algo.NewNearestMatcher().Rank(req, candidates)
+		if shortlist > 0 && len(nearest) > shortlist {
+			nearest = nearest[:shortlist]
+		}
+		for _, c := range nearest {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(req algo.Request, c algo.Candidate) {
+				defer func() { <-slots; wg.Done() }()
+				v, err := cost(req, c)
+				if err != nil {
+					v = math.Inf(1)
+				}
+				mu.Lock()
+				costs[pair{req.ID, c.ID}] = v
+				mu.Unlock()
+			}(req, c)
+		}
+	}
+	wg.Wait()
+
+	return func(req algo.Request, c algo.Candidate) (float64, error) {
+		if v, ok := costs[pair{req.ID, c.ID}]; ok {
+			return v, nil
+		}
+		return math.Inf(1), nil
+	}
+}
+
+func (d *BatchDispatcher) dispatchRound(ctx context.Context, round []*queuedRide) {
+	// Drivers only serve rides of their own vehicle type, so each type is its own problem
+	byType := make(map[string][]*queuedRide)
+	for _, q := range round {
+		byType[q.ride.VehicleType] = append(byType[q.ride.VehicleType], q)
+	}
+	for vehicleType, queued := range byType {
+		d.dispatchGroup(ctx, vehicleType, queued)
+	}
+}
+
+func (d *BatchDispatcher) dispatchGroup(ctx context.Context, vehicleType string, queued []*queuedRide) {
+	nearest := algo.NewNearestMatcher()
+	drivers := make(map[string]models.Driver)
+	var candidates []algo.Candidate
+	reqs := make([]algo.Request, 0, len(queued))
+	byRide := make(map[string]*queuedRide, len(queued))
+
+	for _, q := range queued {
+		start := q.ride.StartLocation.Coordinates
+		reqs = append(reqs, algo.Request{ID: q.ride.ID.Hex(), Pickup: algo.Point{Lat: start[1], Lng: start[0]}})
+		byRide[q.ride.ID.Hex()] = q
+
+		found, err := d.rides.findCandidateDrivers(ctx, nearest, start[1], start[0], vehicleType, d.rides.Dispatch.MaxRadius(), nil)
+		if err != nil {
+			log.Println("Driver search failed in batch round:", err)
+			continue
+		}
+		for _, driver := range found {
+			if _, seen := drivers[driver.ID.Hex()]; !seen {
+				drivers[driver.ID.Hex()] = driver
+				candidates = append(candidates, driverCandidate(driver))
+			}
+		}
+	}
+
+	cost := batchCost(d.rides.Maps, d.rides.Dispatch)
+	if d.rides.Dispatch.BatchCost == "road" {
+		cost = precomputeCosts(cost, reqs, candidates, d.rides.Dispatch.ETAShortlist)
+	}
+	assignments, err := algo.NewHungarianMatcher(cost).Assign(reqs, candidates)
+	if err != nil {
+		log.Println("Batch assignment failed:", err)
+	}
+	log.Printf("🧮 Batch round (%s): %d rides, %d drivers, %d assigned", vehicleType, len(reqs), len(candidates), len(assignments))
+
+	for _, a := range assignments {
+		q := byRide[a.RequestID]
+		driver := drivers[a.CandidateID]
+		if d.assign(ctx, q, driver) {
+			delete(byRide, a.RequestID)
+		}
+	}
+
+	// Whatever is left waits for the next round, up to MaxRounds
+	for _, q := range byRide {
+		q.rounds++
+		if q.rounds < d.MaxRounds {
+			d.mu.Lock()
+			d.pending = append(d.pending, q)
+			d.mu.Unlock()
+			continue
+		}
+		held := store.RideMatch{DispatchOwner: d.owner}
+		if ride, err := d.rides.transitionRideWhere(ctx, q.ride.ID, held, RideRejected, bson.M{"rejected_at": time.Now()}); err == nil {
+			d.rides.notifyNoDriverFound(ride, nil)
+		}
+	}
+}
+
+// assign reserves the driver and hands the ride over to the normal offer flow. It
+// returns false when the ride should be retried next round.
+func (d *BatchDispatcher) assign(ctx context.Context, q *queuedRide, driver models.Driver) bool {
+	claimed, err := d.rides.claimDriver(ctx, driver.ID)
+	if err != nil || !claimed {
+		return false // Taken by an immediate re-dispatch in the meantime
+	}
+
+	ride, err := d.rides.transitionRideWhere(ctx, q.ride.ID, store.RideMatch{DispatchOwner: d.owner}, RideRequested, bson.M{
+		"driver_id":         driver.ID,
+		"dispatch_attempts": 1,
+		"match_strategy":    algo.StrategyHungarian,
+	})
+	if err != nil {
+		// Cancelled while queued, or adopted by another replica; nothing left to retry
+		d.rides.setDriverAvailable(ctx, driver.ID, true)
+		return true
+	}
+
+	d.rides.Hub.Broadcast <- websockets.Notification{
+		Type:   "driver_assigned",
+		UserID: ride.RiderID.Hex(),
+		Payload: gin.H{
+			"ride_id":   ride.ID.Hex(),
+			"driver_id": driver.ID.Hex(),
+			"status":    ride.Status,
+		},
+	}
+
+	d.rides.offerRide(ride, &driver)
+	return true
+}
+
+// searchingRide inserts a ride without a driver and queues it for the next round
+func (h *RideHandler) searchingRide(ctx context.Context, ride models.Ride) (primitive.ObjectID, error) {
+	ride.Status = RideSearching
+	h.Dispatcher.hold(&ride, time.Now())
+	if err := h.Store.Rides.Insert(ctx, &ride); err != nil {
+		return primitive.NilObjectID, err
+	}
+	h.Dispatcher.Enqueue(ride)
+	return ride.ID, nil
+}
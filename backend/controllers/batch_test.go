@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"uber-clone/algo"
+	"uber-clone/config"
+	"uber-clone/models"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newBatchHandler(t *testing.T, st *store.Store) *RideHandler {
+	t.Helper()
+	hub := websockets.NewHub()
+	go hub.Run()
+	h := &RideHandler{Store: st, Hub: hub, Dispatch: config.Dispatch{
+		MaxAttempts:     3,
+		ResponseTimeout: time.Hour, // Offers stay open for the whole test
+		SearchRadii:     []int{5000},
+		Matcher:         algo.StrategyNearest,
+		BatchWindow:     time.Second,
+		BatchMaxRounds:  2,
+		BatchCost:       "straight",
+	}}
+	h.Dispatcher = NewBatchDispatcher(h)
+	return h
+}
+
+func addDriver(t *testing.T, st *store.Store, vehicleType string, lng float64) *models.Driver {
+	t.Helper()
+	d := &models.Driver{
+		UserID:      primitive.NewObjectID(),
+		VehicleType: vehicleType,
+		IsAvailable: true,
+		Location:    models.GeoJSON{Type: "Point", Coordinates: []float64{lng, 12.9}},
+	}
+	if err := st.Drivers.Insert(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func searching(t *testing.T, h *RideHandler, vehicleType string, lng float64) primitive.ObjectID {
+	t.Helper()
+	id, err := h.searchingRide(context.Background(), models.Ride{
+		RiderID:       primitive.NewObjectID(),
+		StartLocation: models.GeoJSON{Type: "Point", Coordinates: []float64{lng, 12.9}},
+		VehicleType:   vehicleType,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func rideOf(t *testing.T, st *store.Store, id primitive.ObjectID) *models.Ride {
+	t.Helper()
+	ride, err := st.Rides.FindByID(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ride
+}
+
+func (d *BatchDispatcher) queued() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+func TestBatchRoundGroupsByVehicleType(t *testing.T) {
+	st := store.NewMemoryStore()
+	h := newBatchHandler(t, st)
+	cars := []*models.Driver{addDriver(t, st, "car", 77.600), addDriver(t, st, "car", 77.610)}
+	bike := addDriver(t, st, "two_wheeler", 77.601)
+
+	carRides := []primitive.ObjectID{searching(t, h, "car", 77.600), searching(t, h, "car", 77.610)}
+	bikeRide := searching(t, h, "two_wheeler", 77.600)
+	premium := searching(t, h, "premium_car", 77.600) // No driver of that type
+
+	h.Dispatcher.round(context.Background())
+
+	for i, id := range carRides {
+		if ride := rideOf(t, st, id); ride.Status != RideRequested || ride.DriverID != cars[i].ID {
+			t.Errorf("car ride %d is %s with driver %s, want requested with the car next to it", i, ride.Status, ride.DriverID.Hex())
+		}
+	}
+	if ride := rideOf(t, st, bikeRide); ride.Status != RideRequested || ride.DriverID != bike.ID {
+		t.Errorf("two-wheeler ride is %s with driver %s, want the two-wheeler", ride.Status, ride.DriverID.Hex())
+	}
+	if ride := rideOf(t, st, premium); ride.Status != RideSearching {
+		t.Errorf("premium ride is %s, want still searching", ride.Status)
+	}
+	if n := h.Dispatcher.queued(); n != 1 {
+		t.Errorf("%d rides queued for the next round, want the premium one", n)
+	}
+}
+
+func TestBatchRoundRejectsAfterMaxRounds(t *testing.T) {
+	st := store.NewMemoryStore()
+	h := newBatchHandler(t, st)
+	id := searching(t, h, "car", 77.6)
+
+	h.Dispatcher.round(context.Background())
+	if ride := rideOf(t, st, id); ride.Status != RideSearching {
+		t.Fatalf("ride is %s after one round, want still searching", ride.Status)
+	}
+	h.Dispatcher.round(context.Background())
+	if ride := rideOf(t, st, id); ride.Status != RideRejected {
+		t.Fatalf("ride is %s after %d rounds, want rejected", ride.Status, h.Dispatcher.MaxRounds)
+	}
+	if n := h.Dispatcher.queued(); n != 0 {
+		t.Fatalf("%d rides still queued", n)
+	}
+}
+
+func TestBatchRoundDropsCancelledRides(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	h := newBatchHandler(t, st)
+	id := searching(t, h, "car", 77.6)
+	st.Rides.Update(ctx, id, store.RideMatch{}, bson.M{"status": RideCancelled})
+	driver := addDriver(t, st, "car", 77.6)
+
+	h.Dispatcher.round(ctx)
+	if n := h.Dispatcher.queued(); n != 0 {
+		t.Fatalf("%d rides still queued after the only one was cancelled", n)
+	}
+	if got, _ := st.Drivers.FindByID(ctx, driver.ID); !got.IsAvailable {
+		t.Fatal("the driver was reserved for a cancelled ride")
+	}
+}
+
+func TestBatchDispatchersAdoptEachRideOnce(t *testing.T) {
+	const rides, replicas = 20, 4
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	now := time.Now()
+	for i := 0; i < rides; i++ {
+		// Left behind by a replica whose lease ran out
+		st.Rides.Insert(ctx, &models.Ride{
+			RiderID:            primitive.NewObjectID(),
+			StartLocation:      models.GeoJSON{Type: "Point", Coordinates: []float64{77.6, 12.9}},
+			VehicleType:        "car",
+			Status:             RideSearching,
+			DispatchOwner:      "dead-replica",
+			DispatchLeaseUntil: now.Add(-time.Second),
+		})
+	}
+	held := newBatchHandler(t, st)
+	searching(t, held, "car", 77.6) // Held by a live replica
+
+	var wg sync.WaitGroup
+	dispatchers := make([]*BatchDispatcher, replicas)
+	for i := range dispatchers {
+		dispatchers[i] = newBatchHandler(t, st).Dispatcher
+		wg.Add(1)
+		go func(d *BatchDispatcher) {
+			defer wg.Done()
+			d.adopt(ctx, now)
+		}(dispatchers[i])
+	}
+	wg.Wait()
+
+	total := 0
+	for _, d := range dispatchers {
+		total += d.queued()
+	}
+	if total != rides {
+		t.Fatalf("%d rides adopted across replicas, want each of the %d orphaned ones once", total, rides)
+	}
+}
+
+func TestPrecomputeCostsShortlist(t *testing.T) {
+	reqs := []algo.Request{{ID: "r0", Pickup: algo.Point{Lat: 12.9, Lng: 77.6}}, {ID: "r1", Pickup: algo.Point{Lat: 12.9, Lng: 77.7}}}
+	var candidates []algo.Candidate
+	for i, lng := range []float64{77.60, 77.61, 77.62, 77.69, 77.70} {
+		candidates = append(candidates, algo.Candidate{ID: string(rune('a' + i)), Location: algo.Point{Lat: 12.9, Lng: lng}})
+	}
+
+	var calls atomic.Int32
+	cost := precomputeCosts(func(req algo.Request, c algo.Candidate) (float64, error) {
+		calls.Add(1)
+		return algo.StraightLineCost(req, c)
+	}, reqs, candidates, 2)
+
+	if n := calls.Load(); n != 4 {
+		t.Fatalf("%d cost calls, want 2 per request", n)
+	}
+	if v, _ := cost(reqs[0], candidates[1]); v <= 0 || v > 2 {
+		t.Errorf("cost of a shortlisted pair is %v", v)
+	}
+	if v, _ := cost(reqs[0], candidates[4]); v < 1e9 {
+		t.Errorf("cost of a pair outside the shortlist is %v, want unassignable", v)
+	}
+}
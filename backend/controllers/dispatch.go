@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"slices"
+	"time"
+
+	"uber-clone/algo"
+	"uber-clone/models"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// errNoDriverFound is returned when no available driver is within the search radius
+var errNoDriverFound = errors.New("no available drivers found")
+
+// rideMatcher picks the matching strategy for a new ride. MATCHER_STRATEGY is the
+// default; MATCHER_EXPERIMENT="<strategy>:<percent>" routes that share of rides to a
+// second strategy so ops can A/B them. The chosen name is stored on the ride.
+func (h *RideHandler) rideMatcher() algo.Matcher {
+	name := h.Dispatch.Matcher
+	if h.Dispatch.ExperimentMatcher != "" && rand.Intn(100) < h.Dispatch.ExperimentShare {
+		name = h.Dispatch.ExperimentMatcher
+	}
+
+	matcher, err := algo.NewMatcher(name, algo.MatcherOptions{
+		ETA: func(fromLat, fromLng, toLat, toLng float64) (float64, error) {
+			_, duration, err := h.Maps.Route(fromLat, fromLng, toLat, toLng)
+			return duration, err
+		},
+		ETAShortlist: h.Dispatch.ETAShortlist,
+		RatingWeight: h.Dispatch.RatingWeight,
+	})
+	if err != nil {
+		log.Printf("Invalid matcher %q, falling back to %s: %v", name, algo.StrategyNearest, err)
+		return algo.NewNearestMatcher()
+	}
+	return matcher
+}
+
+// driverCandidate converts a driver document into the matcher's view of it
+func driverCandidate(d models.Driver) algo.Candidate {
+	return algo.Candidate{
+		ID:       d.ID.Hex(),
+		Location: algo.Point{Lat: d.Location.Coordinates[1], Lng: d.Location.Coordinates[0]},
+		Rating:   d.AverageRating(),
+	}
+}
+
+// findCandidateDrivers returns the available drivers within radius meters of the pickup
+// point, skipping any driver in exclude, ordered best first by the matcher.
+func (h *RideHandler) findCandidateDrivers(ctx context.Context, matcher algo.Matcher, lat, lng float64, vehicleType string, radius int, exclude []primitive.ObjectID) ([]models.Driver, error) {
+	drivers, err := h.Store.Drivers.FindAvailableNear(ctx, lat, lng, radius, vehicleType, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]models.Driver, len(drivers))
+	var candidates []algo.Candidate
+	for _, driver := range drivers {
+		if len(driver.Location.Coordinates) != 2 {
+			continue
+		}
+		byID[driver.ID.Hex()] = driver
+		candidates = append(candidates, driverCandidate(driver))
+	}
+
+	ranked, err := matcher.Rank(algo.Request{Pickup: algo.Point{Lat: lat, Lng: lng}}, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := make([]models.Driver, 0, len(ranked))
+	for _, c := range ranked {
+		ordered = append(ordered, byID[c.ID])
+	}
+	return ordered, nil
+}
+
+// claimDriver atomically flips is_available from true to false. It returns false when
+// another request reserved the driver first.
+func (h *RideHandler) claimDriver(ctx context.Context, driverID primitive.ObjectID) (bool, error) {
+	return h.Store.Drivers.Claim(ctx, driverID)
+}
+
+// reserveBestDriver runs the expanding $nearSphere search around the pickup point, one
+// configured radius after the other, and claims the best-ranked driver that is still
+// free. Candidates lost to a concurrent request are skipped in favour of the next one,
+// so a driver is never assigned twice.
+func (h *RideHandler) reserveBestDriver(ctx context.Context, matcher algo.Matcher, lat, lng float64, vehicleType string, exclude []primitive.ObjectID) (*models.Driver, error) {
+	for _, searchRadius := range h.Dispatch.SearchRadii {
+		drivers, err := h.findCandidateDrivers(ctx, matcher, lat, lng, vehicleType, searchRadius, exclude)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range drivers {
+			claimed, err := h.claimDriver(ctx, drivers[i].ID)
+			if err != nil {
+				return nil, err
+			}
+			if claimed {
+				return &drivers[i], nil
+			}
+			// Taken by a concurrent request; try the next one
+		}
+	}
+
+	return nil, errNoDriverFound
+}
+
+// setDriverAvailable flips a driver's is_available flag
+func (h *RideHandler) setDriverAvailable(ctx context.Context, driverID primitive.ObjectID, available bool) error {
+	return h.Store.Drivers.SetAvailable(ctx, driverID, available)
+}
+
+// offerRide sends the ride_request to the assigned driver and starts the response timer
+func (h *RideHandler) offerRide(ride *models.Ride, driver *models.Driver) {
+	log.Printf("📤 Sending ride request to driver: %s (attempt %d)", driver.UserID.Hex(), ride.DispatchAttempts)
+
+	h.Hub.Broadcast <- websockets.Notification{
+		Type:   "ride_request",
+		UserID: driver.UserID.Hex(),
+
+		Payload: gin.H{
+			"ride_id":    ride.ID.Hex(),
+			"rider_id":   ride.RiderID.Hex(),
+			"distance":   ride.Distance,
+			"fare":       ride.Fare,
+			"pickup":     ride.StartLocation.Coordinates,
+			"expires_in": h.Dispatch.ResponseTimeout.Seconds(),
+		},
+	}
+
+	rideID, driverID, attempt := ride.ID, driver.ID, ride.DispatchAttempts
+	time.AfterFunc(h.Dispatch.ResponseTimeout, func() {
+		h.expireRideOffer(rideID, driverID, attempt)
+	})
+}
+
+// expireRideOffer treats a driver that never answered as a rejection. The conditional
+// update only matches if the same offer is still outstanding, so a late accept wins.
+func (h *RideHandler) expireRideOffer(rideID, driverID primitive.ObjectID, attempt int) {
+	ctx := context.Background()
+
+	ride, err := h.transitionRideWhere(ctx, rideID,
+		store.RideMatch{DriverID: driverID, DispatchAttempts: attempt},
+		RideRejected, bson.M{"rejected_at": time.Now()},
+	)
+	if err != nil {
+		return // Already answered, cancelled or re-dispatched
+	}
+
+	log.Printf("⏰ Driver %s did not answer ride %s in time", driverID.Hex(), rideID.Hex())
+
+	if driver, err := h.Store.Drivers.FindByID(ctx, driverID); err == nil {
+		h.Hub.Broadcast <- websockets.Notification{
+			Type:    "ride_request_expired",
+			UserID:  driver.UserID.Hex(),
+			Payload: gin.H{"ride_id": rideID.Hex()},
+		}
+	}
+
+	h.redispatchRide(ctx, ride, "timeout")
+}
+
+// redispatchRide releases the driver of a rejected ride, excludes them and offers the
+// ride to the next-best driver. After DISPATCH_MAX_ATTEMPTS the rider is told no driver
+// was found and the ride stays rejected.
+func (h *RideHandler) redispatchRide(ctx context.Context, ride *models.Ride, reason string) {
+	if err := h.setDriverAvailable(ctx, ride.DriverID, true); err != nil {
+		log.Println("Failed to release driver:", err)
+	}
+
+	// Copied so the append cannot write into the ride's backing array
+	exclude := append(slices.Clone(ride.RejectedDrivers), ride.DriverID)
+
+	if ride.DispatchAttempts >= h.Dispatch.MaxAttempts {
+		h.notifyNoDriverFound(ride, exclude)
+		return
+	}
+
+	start := ride.StartLocation.Coordinates
+	matcher := h.rideMatcher()
+	next, err := h.reserveBestDriver(ctx, matcher, start[1], start[0], ride.VehicleType, exclude)
+	if err != nil {
+		if !errors.Is(err, errNoDriverFound) {
+			log.Println("Driver search failed during re-dispatch:", err)
+		}
+		h.notifyNoDriverFound(ride, exclude)
+		return
+	}
+
+	updated, err := h.transitionRide(ctx, ride.ID, RideRequested, bson.M{
+		"driver_id":         next.ID,
+		"rejected_drivers":  exclude,
+		"dispatch_attempts": ride.DispatchAttempts + 1,
+		"match_strategy":    matcher.Name(),
+	})
+	if err != nil {
+		// The rider cancelled in the meantime; give the driver back
+		h.setDriverAvailable(ctx, next.ID, true)
+		return
+	}
+
+	h.Hub.Broadcast <- websockets.Notification{
+		Type:   "ride_redispatched",
+		UserID: updated.RiderID.Hex(),
+		Payload: gin.H{
+			"ride_id":      updated.ID.Hex(),
+			"reason":       reason, // "rejected" or "timeout"
+			"attempt":      updated.DispatchAttempts,
+			"max_attempts": h.Dispatch.MaxAttempts,
+			"driver_id":    next.ID.Hex(),
+		},
+	}
+
+	h.offerRide(updated, next)
+}
+
+// notifyNoDriverFound records the final excluded set and tells the rider dispatch gave up
+func (h *RideHandler) notifyNoDriverFound(ride *models.Ride, exclude []primitive.ObjectID) {
+	_, err := h.Store.Rides.Update(context.Background(), ride.ID,
+		store.RideMatch{Statuses: []string{RideRejected}},
+		bson.M{"rejected_drivers": exclude},
+	)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Println("Failed to record rejected drivers:", err)
+	}
+
+	h.Hub.Broadcast <- websockets.Notification{
+		Type:   "no_driver_found",
+		UserID: ride.RiderID.Hex(),
+		Payload: gin.H{
+			"ride_id":  ride.ID.Hex(),
+			"attempts": ride.DispatchAttempts,
+			"message":  "No driver accepted your ride. Please try again.",
+		},
+	}
+}
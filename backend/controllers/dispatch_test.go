@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"uber-clone/algo"
+	"uber-clone/config"
+	"uber-clone/models"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReserveBestDriverNeverAssignsTwice(t *testing.T) {
+	const drivers, requests = 10, 50
+
+	st := store.NewMemoryStore()
+	ctx := context.Background()
+	for i := 0; i < drivers; i++ {
+		err := st.Drivers.Insert(ctx, &models.Driver{
+			UserID:      primitive.NewObjectID(),
+			VehicleType: "car",
+			IsAvailable: true,
+			Location:    models.GeoJSON{Type: "Point", Coordinates: []float64{77.6 + float64(i)*0.001, 12.9}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := &RideHandler{Store: st, Dispatch: config.Dispatch{SearchRadii: []int{5000}}}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		assigned = make(map[primitive.ObjectID]int)
+		none     int
+	)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			driver, err := h.reserveBestDriver(ctx, algo.NewNearestMatcher(), 12.9, 77.6, "car", nil)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, errNoDriverFound):
+				none++
+			case err != nil:
+				t.Error(err)
+			default:
+				assigned[driver.ID]++
+			}
+		}()
+	}
+	wg.Wait()
+
+	for id, n := range assigned {
+		if n > 1 {
+			t.Errorf("driver %s assigned %d times", id.Hex(), n)
+		}
+	}
+	if len(assigned) != drivers || none != requests-drivers {
+		t.Errorf("got %d drivers assigned and %d requests without one, want %d and %d",
+			len(assigned), none, drivers, requests-drivers)
+	}
+	if n, _ := st.Drivers.CountAvailable(ctx); n != 0 {
+		t.Errorf("%d drivers still available", n)
+	}
+}
+
+// listen registers a client for userID and returns the types of the notifications
+// it receives
+func listen(hub *websockets.Hub, userID, role string) <-chan string {
+	client := websockets.NewClient(nil, userID, role)
+	hub.Register <- client
+	types := make(chan string, 64)
+	go func() {
+		for data := range client.Send {
+			var msg struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal(data, &msg)
+			types <- msg.Type
+		}
+	}()
+	return types
+}
+
+// expect waits for a notification of type want, skipping others
+func expect(t *testing.T, types <-chan string, want string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-types:
+			if got == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %s notification", want)
+		}
+	}
+}
+
+func TestUnansweredOffersRedispatchUntilMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	hub := websockets.NewHub()
+	go hub.Run()
+	h := &RideHandler{Store: st, Hub: hub, Dispatch: config.Dispatch{
+		MaxAttempts:     2,
+		ResponseTimeout: 20 * time.Millisecond,
+		SearchRadii:     []int{5000},
+		Matcher:         algo.StrategyNearest,
+	}}
+
+	var drivers []*models.Driver
+	for i := 0; i < 3; i++ {
+		d := &models.Driver{
+			UserID:      primitive.NewObjectID(),
+			VehicleType: "car",
+			IsAvailable: i > 0, // The first one is on this ride already
+			Location:    models.GeoJSON{Type: "Point", Coordinates: []float64{77.6 + float64(i)*0.001, 12.9}},
+		}
+		st.Drivers.Insert(ctx, d)
+		drivers = append(drivers, d)
+	}
+	ride := &models.Ride{
+		RiderID:          primitive.NewObjectID(),
+		DriverID:         drivers[0].ID,
+		DispatchAttempts: 1,
+		StartLocation:    models.GeoJSON{Type: "Point", Coordinates: []float64{77.6, 12.9}},
+		VehicleType:      "car",
+		Status:           RideRequested,
+	}
+	st.Rides.Insert(ctx, ride)
+	rider := listen(hub, ride.RiderID.Hex(), "rider")
+
+	// Nobody answers: the first offer times out, the ride goes to the next nearest
+	// driver, that offer times out too and the rider is told no driver was found
+	h.offerRide(ride, drivers[0])
+	expect(t, rider, "ride_redispatched")
+	expect(t, rider, "no_driver_found")
+
+	got, _ := st.Rides.FindByID(ctx, ride.ID)
+	if got.Status != RideRejected || got.DispatchAttempts != 2 || got.DriverID != drivers[1].ID {
+		t.Fatalf("ride ended %s after %d attempts with driver %s, want rejected after 2 with the second driver",
+			got.Status, got.DispatchAttempts, got.DriverID.Hex())
+	}
+	if len(got.RejectedDrivers) != 2 || got.RejectedDrivers[0] != drivers[0].ID || got.RejectedDrivers[1] != drivers[1].ID {
+		t.Fatalf("rejected drivers %v, want the two that were offered the ride", got.RejectedDrivers)
+	}
+	for _, d := range drivers[:2] {
+		if got, _ := st.Drivers.FindByID(ctx, d.ID); !got.IsAvailable {
+			t.Errorf("driver %s still reserved after the ride gave up", d.ID.Hex())
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"uber-clone/models"
+	"uber-clone/store"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FareHandler serves the admin API for fare cards
+type FareHandler struct {
+	Store *store.Store
+}
+
+// ListFareCards returns every fare card, or those of ?vehicle_type=
+func (h *FareHandler) ListFareCards(c *gin.Context) {
+	cards, err := h.Store.Fares.List(c, c.Query("vehicle_type"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load fare cards"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"fare_cards": cards})
+}
+
+// CreateFareCard adds the card for a city and vehicle type that has none yet
+func (h *FareHandler) CreateFareCard(c *gin.Context) {
+	card, ok := bindFareCard(c)
+	if !ok {
+		return
+	}
+	card.ID = primitive.NilObjectID
+
+	err := h.Store.Fares.Insert(c, card)
+	if errors.Is(err, store.ErrDuplicate) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A fare card for this city and vehicle type already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create fare card"})
+		return
+	}
+	c.JSON(http.StatusCreated, card)
+}
+
+// UpdateFareCard replaces a card; new rides are priced with it straight away
+func (h *FareHandler) UpdateFareCard(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("card_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid fare card ID"})
+		return
+	}
+	card, ok := bindFareCard(c)
+	if !ok {
+		return
+	}
+	card.ID = id
+
+	err = h.Store.Fares.Replace(c, card)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fare card not found"})
+	case errors.Is(err, store.ErrDuplicate):
+		c.JSON(http.StatusConflict, gin.H{"error": "A fare card for this city and vehicle type already exists"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update fare card"})
+	default:
+		c.JSON(http.StatusOK, card)
+	}
+}
+
+// DeleteFareCard removes a card. Rides already priced keep their breakdown.
+func (h *FareHandler) DeleteFareCard(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("card_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid fare card ID"})
+		return
+	}
+
+	err = h.Store.Fares.Delete(c, id)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fare card not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete fare card"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Fare card deleted"})
+}
+
+// bindFareCard decodes and checks a card from the body, answering 400 if it is invalid.
+// A city card needs the point and radius it covers; the default card has neither.
+func bindFareCard(c *gin.Context) (*models.FareCard, bool) {
+	var card models.FareCard
+	if err := c.ShouldBindJSON(&card); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	if card.City != "" {
+		if card.Center == nil || len(card.Center.Coordinates) != 2 || card.RadiusKm <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A city fare card needs a center point and a positive radius_km"})
+			return nil, false
+		}
+		card.Center.Type = "Point"
+	} else {
+		card.Center, card.RadiusKm = nil, 0
+	}
+
+	card.UpdatedAt = time.Now()
+	return &card, true
+}
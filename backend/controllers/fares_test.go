@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"uber-clone/store"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFareCardCRUD(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &FareHandler{Store: store.NewMemoryStore()}
+	r := gin.New()
+	r.GET("/fares", h.ListFareCards)
+	r.POST("/fares", h.CreateFareCard)
+	r.PUT("/fares/:card_id", h.UpdateFareCard)
+	r.DELETE("/fares/:card_id", h.DeleteFareCard)
+
+	// ids holds the cards created so far, by name; :name in a path is replaced by its ID
+	ids := map[string]string{}
+	serve := func(method, path, body string) (int, map[string]interface{}) {
+		for name, id := range ids {
+			path = strings.Replace(path, ":"+name, id, 1)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var out map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	const bangalore = `"city":"Bangalore","center":{"coordinates":[77.5946,12.9716]},"radius_km":30`
+	missing := primitive.NewObjectID().Hex()
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		want       int
+		createdAs  string // Remember the created card's ID under this name
+		wantListed int    // Cards listed by a GET, -1 to skip
+	}{
+		{"default card", "POST", "/fares", `{"vehicle_type":"car","per_km":10,"minimum_fare":80}`, http.StatusCreated, "default", -1},
+		{"city card", "POST", "/fares", `{` + bangalore + `,"vehicle_type":"car","per_km":12}`, http.StatusCreated, "bangalore", -1},
+		{"other vehicle type", "POST", "/fares", `{` + bangalore + `,"vehicle_type":"three_wheeler","per_km":8}`, http.StatusCreated, "auto", -1},
+		{"second default card", "POST", "/fares", `{"vehicle_type":"car","per_km":11}`, http.StatusConflict, "", -1},
+		{"city without center", "POST", "/fares", `{"city":"Mysore","vehicle_type":"car","per_km":9}`, http.StatusBadRequest, "", -1},
+		{"unknown vehicle type", "POST", "/fares", `{"vehicle_type":"rocket","per_km":9}`, http.StatusBadRequest, "", -1},
+		{"negative rate", "POST", "/fares", `{"vehicle_type":"premium_car","per_km":-1}`, http.StatusBadRequest, "", -1},
+		{"tax above 100%", "POST", "/fares", `{"vehicle_type":"premium_car","tax_rate":1.5}`, http.StatusBadRequest, "", -1},
+		{"list all", "GET", "/fares", "", http.StatusOK, "", 3},
+		{"list by vehicle type", "GET", "/fares?vehicle_type=car", "", http.StatusOK, "", 2},
+		{"update", "PUT", "/fares/:bangalore", `{` + bangalore + `,"vehicle_type":"car","per_km":14}`, http.StatusOK, "", -1},
+		{"update onto another card", "PUT", "/fares/:auto", `{` + bangalore + `,"vehicle_type":"car","per_km":14}`, http.StatusConflict, "", -1},
+		{"update missing card", "PUT", "/fares/" + missing, `{"vehicle_type":"premium_car"}`, http.StatusNotFound, "", -1},
+		{"update bad ID", "PUT", "/fares/nope", `{"vehicle_type":"premium_car"}`, http.StatusBadRequest, "", -1},
+		{"delete", "DELETE", "/fares/:auto", "", http.StatusOK, "", -1},
+		{"delete again", "DELETE", "/fares/:auto", "", http.StatusNotFound, "", -1},
+		{"list after delete", "GET", "/fares", "", http.StatusOK, "", 2},
+	}
+	for _, s := range steps {
+		code, out := serve(s.method, s.path, s.body)
+		if code != s.want {
+			t.Fatalf("%s: got %d, want %d: %v", s.name, code, s.want, out)
+		}
+		if s.createdAs != "" {
+			ids[s.createdAs] = out["id"].(string)
+		}
+		if s.wantListed >= 0 {
+			if listed := out["fare_cards"].([]interface{}); len(listed) != s.wantListed {
+				t.Fatalf("%s: listed %d cards, want %d", s.name, len(listed), s.wantListed)
+			}
+		}
+	}
+
+	// The update replaced the whole card
+	id, _ := primitive.ObjectIDFromHex(ids["bangalore"])
+	card, err := h.Store.Fares.FindByID(context.Background(), id)
+	if err != nil || card.PerKm != 14 || card.Center.Type != "Point" {
+		t.Fatalf("updated card %+v, %v", card, err)
+	}
+}
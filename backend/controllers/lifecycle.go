@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"uber-clone/models"
+	"uber-clone/store"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Ride lifecycle states, defined in models so services can decide on them too
+const (
+	RideSearching = models.RideSearching
+	RideRequested = models.RideRequested
+	RideAccepted  = models.RideAccepted
+	RideRejected  = models.RideRejected
+	RideOngoing   = models.RideOngoing
+	RideCompleted = models.RideCompleted
+	RideCancelled = models.RideCancelled
+)
+
+// Payment sub-states stored in rides.payment_status once a ride is completed
+const (
+	PaymentUnpaid  = ""
+	PaymentPending = "pending"
+	PaymentPaid    = "paid"
+	PaymentFailed  = "failed"
+
+	PaymentRefunded          = "refunded"
+	PaymentPartiallyRefunded = "partially_refunded"
+)
+
+// rideTransitions lists, for every target state, the states a ride may move from
+var rideTransitions = map[string][]string{
+	RideRequested: {RideSearching, RideRejected}, // batch assignment or re-dispatch
+	RideAccepted:  {RideRequested},
+	RideRejected:  {RideRequested, RideSearching},
+	RideOngoing:   {RideAccepted},
+	RideCompleted: {RideOngoing},
+	RideCancelled: {RideSearching, RideRequested, RideAccepted, RideOngoing},
+}
+
+// paymentTransitions lists, for every target payment state, the states it may move from
+var paymentTransitions = map[string][]string{
+	PaymentPending: {PaymentUnpaid, PaymentFailed},
+	PaymentPaid:    {PaymentPending, PaymentFailed}, // An earlier intent can still succeed
+	PaymentFailed:  {PaymentPending},
+
+	PaymentRefunded:          {PaymentPaid, PaymentPartiallyRefunded},
+	PaymentPartiallyRefunded: {PaymentPaid, PaymentPartiallyRefunded},
+}
+
+// TransitionError is returned when a ride is not in a state that allows the requested move
+type TransitionError struct {
+	RideID primitive.ObjectID
+	Field  string // "status" or "payment_status"
+	Status string // current ride status
+	From   string // current value of Field
+	To     string
+}
+
+func (e *TransitionError) Error() string {
+	if e.Field == "payment_status" && e.Status != RideCompleted && e.Status != RideCancelled {
+		return fmt.Sprintf("ride %s is %s, payment requires a completed or cancelled ride", e.RideID.Hex(), e.Status)
+	}
+	from := e.From
+	if from == "" {
+		from = "none"
+	}
+	return fmt.Sprintf("ride %s: cannot move %s from %q to %q", e.RideID.Hex(), e.Field, from, e.To)
+}
+
+// canTransition reports whether the table allows moving from -> to
+func canTransition(table map[string][]string, from, to string) bool {
+	for _, s := range table[to] {
+		if s == from {
+			return true
+		}
+	}
+	return false
+}
+
+// CanTransitionRide reports whether a ride in state from may move to state to
+func CanTransitionRide(from, to string) bool {
+	return canTransition(rideTransitions, from, to)
+}
+
+// CanTransitionPayment reports whether a completed ride's payment may move from -> to
+func CanTransitionPayment(from, to string) bool {
+	return canTransition(paymentTransitions, from, to)
+}
+
+// transitionRide moves a ride to the given status with a conditional update that only
+// matches while the ride is still in one of the allowed source states. Extra fields in
+// set are written in the same update. The updated ride is returned.
+func (h *RideHandler) transitionRide(ctx context.Context, rideID primitive.ObjectID, to string, set bson.M) (*models.Ride, error) {
+	return h.transitionRideWhere(ctx, rideID, store.RideMatch{}, to, set)
+}
+
+// transitionRideWhere is transitionRide with extra conditions, e.g. that the ride is
+// still assigned to a particular driver. Statuses in where narrow the allowed
+// source states further.
+func (h *RideHandler) transitionRideWhere(ctx context.Context, rideID primitive.ObjectID, where store.RideMatch, to string, set bson.M) (*models.Ride, error) {
+	from, ok := rideTransitions[to]
+	if !ok {
+		return nil, fmt.Errorf("unknown ride status %q", to)
+	}
+
+	fields := bson.M{"status": to}
+	for k, v := range set {
+		fields[k] = v
+	}
+
+	if len(where.Statuses) > 0 {
+		var narrowed []string
+		for _, s := range where.Statuses {
+			if slices.Contains(from, s) {
+				narrowed = append(narrowed, s)
+			}
+		}
+		if len(narrowed) == 0 {
+			return nil, fmt.Errorf("no ride in %v can move to %q", where.Statuses, to)
+		}
+		from = narrowed
+	}
+	where.Statuses = from
+	return h.applyTransition(ctx, rideID, where, fields, "status", to)
+}
+
+// transitionPayment moves the payment sub-state of a completed ride, or of a
+// cancelled one charged a cancellation fee
+func (h *RideHandler) transitionPayment(ctx context.Context, rideID primitive.ObjectID, to string, set bson.M) (*models.Ride, error) {
+	from, ok := paymentTransitions[to]
+	if !ok {
+		return nil, fmt.Errorf("unknown payment status %q", to)
+	}
+
+	fields := bson.M{"payment_status": to}
+	for k, v := range set {
+		fields[k] = v
+	}
+
+	match := store.RideMatch{Statuses: []string{RideCompleted, RideCancelled}, PaymentStatuses: from}
+	return h.applyTransition(ctx, rideID, match, fields, "payment_status", to)
+}
+
+func (h *RideHandler) applyTransition(ctx context.Context, rideID primitive.ObjectID, match store.RideMatch, fields bson.M, field, to string) (*models.Ride, error) {
+	ride, err := h.Store.Rides.Update(ctx, rideID, match, fields)
+	if !errors.Is(err, store.ErrNotFound) {
+		return ride, err
+	}
+
+	// Nothing matched: either the ride is missing or it is in the wrong state
+	current, err := h.Store.Rides.FindByID(ctx, rideID)
+	if err != nil {
+		return nil, err
+	}
+	te := &TransitionError{RideID: rideID, Field: field, Status: current.Status, From: current.Status, To: to}
+	if field == "payment_status" {
+		te.From = current.PaymentStatus
+	}
+	return nil, te
+}
+
+// respondTransitionError maps a transition failure to an HTTP response:
+// 409 for an illegal state change, 404 for a missing ride, 500 otherwise.
+func respondTransitionError(c *gin.Context, err error, fallback string) {
+	var te *TransitionError
+	switch {
+	case errors.As(err, &te):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          te.Error(),
+			"current_status": te.Status,
+		})
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"uber-clone/models"
+	"uber-clone/store"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A cancellation priced before the driver arrived must not go through once they have
+func TestCancelTransitionPinsStateAsRead(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	h := &RideHandler{Store: st}
+	ride := &models.Ride{RiderID: primitive.NewObjectID(), Status: RideAccepted, AcceptedAt: time.Now()}
+	st.Rides.Insert(ctx, ride)
+
+	arrived := false
+	asRead := store.RideMatch{Statuses: []string{RideAccepted}, Arrived: &arrived}
+	st.Rides.Update(ctx, ride.ID, store.RideMatch{}, bson.M{"arrived_at": time.Now()}) // Meanwhile
+
+	_, err := h.transitionRideWhere(ctx, ride.ID, asRead, RideCancelled, nil)
+	var te *TransitionError
+	if !errors.As(err, &te) {
+		t.Fatalf("cancel after a concurrent arrival = %v, want a TransitionError", err)
+	}
+
+	arrived = true
+	if _, err := h.transitionRideWhere(ctx, ride.ID, asRead, RideCancelled, nil); err != nil {
+		t.Fatalf("cancel with the arrival as read: %v", err)
+	}
+}
+
+func TestTransitionRideWhereNarrowsSources(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	h := &RideHandler{Store: st}
+	ride := &models.Ride{RiderID: primitive.NewObjectID(), Status: RideRequested}
+	st.Rides.Insert(ctx, ride)
+
+	// requested may be cancelled, but the caller read the ride as accepted
+	_, err := h.transitionRideWhere(ctx, ride.ID, store.RideMatch{Statuses: []string{RideAccepted}}, RideCancelled, nil)
+	var te *TransitionError
+	if !errors.As(err, &te) || te.From != RideRequested {
+		t.Fatalf("got %v, want a TransitionError from %s", err, RideRequested)
+	}
+
+	// A status that can never move there is a caller bug, not a conflict
+	if _, err := h.transitionRideWhere(ctx, ride.ID, store.RideMatch{Statuses: []string{RideCompleted}}, RideCancelled, nil); err == nil || errors.As(err, &te) {
+		t.Fatalf("got %v, want a plain error", err)
+	}
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NotificationHandler serves the stored notification inbox
+type NotificationHandler struct {
+	Hub *websockets.Hub
+}
+
+// GetNotifications returns the caller's stored notifications after the ?since= sequence
+// number, oldest first, so dashboards can catch up on anything missed while offline
+func (h *NotificationHandler) GetNotifications(c *gin.Context) {
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil || since < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a non-negative sequence number"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return
+	}
+
+	if h.Hub.Inbox == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Notification inbox is not enabled"})
+		return
+	}
+
+	entries, err := h.Hub.Inbox.Since(c.GetString("user_id"), since, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load notifications"})
+		return
+	}
+
+	lastSeq := since
+	if len(entries) > 0 {
+		lastSeq = entries[len(entries)-1].Seq
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"notifications": entries,
+		"last_seq":      lastSeq,
+		"has_more":      len(entries) == limit,
+	})
+}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"uber-clone/models"
+	"uber-clone/payments"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// amountDue is what the rider owes for a ride: the fare once it is completed, the
+// cancellation fee once it is cancelled and nothing before either
+func amountDue(ride *models.Ride) float64 {
+	switch ride.Status {
+	case RideCompleted:
+		return ride.Fare
+	case RideCancelled:
+		return ride.CancellationFee
+	}
+	return 0
+}
+
+// claimPayment moves a ride awaiting payment to pending, but only from the payment
+// status it was read in, so of two concurrent payment requests exactly one wins
+func (h *RideHandler) claimPayment(ctx context.Context, ride *models.Ride) error {
+	match := store.RideMatch{Statuses: []string{ride.Status}, PaymentStatuses: []string{ride.PaymentStatus}}
+	_, err := h.applyTransition(ctx, ride.ID, match, bson.M{"payment_status": PaymentPending}, "payment_status", PaymentPending)
+	return err
+}
+
+// releasePayment puts back the payment status claimPayment replaced, when no payment
+// was recorded for the claim and the rider has to be able to try again
+func (h *RideHandler) releasePayment(ctx context.Context, ride *models.Ride) {
+	match := store.RideMatch{Statuses: []string{ride.Status}, PaymentStatuses: []string{PaymentPending}}
+	if _, err := h.Store.Rides.Update(ctx, ride.ID, match, bson.M{"payment_status": ride.PaymentStatus}); err != nil {
+		log.Println("Failed to release the payment claim of ride", ride.ID.Hex(), err)
+	}
+}
+
+// startPayment creates the payment intent for amount of a ride claimPayment claimed
+// and records it. ride is the ride as claimed: on failure the claim is released to
+// its payment status, so the rider can try again.
+func (h *RideHandler) startPayment(ctx context.Context, ride *models.Ride, amount float64, idempotencyKey string) (*payments.Intent, error) {
+	pi, err := h.Payments.CreateIntent(payments.IntentParams{
+		Amount:   int64(math.Round(amount * 100)), // Convert to paise; fare cards set the minimum
+		Currency: "INR",
+		Metadata: map[string]string{"ride_id": ride.ID.Hex(), "user_id": ride.RiderID.Hex()},
+
+		// A retry that got past the Idempotency-Key check, e.g. after a server
+		// error, still gets the same intent
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		h.releasePayment(ctx, ride)
+		return nil, err
+	}
+
+	err = h.Store.Payments.Insert(ctx, &models.Payment{
+		RideID:        ride.ID,
+		Amount:        amount,
+		Currency:      "INR",
+		PaymentIntent: pi.ID,
+		Status:        pi.Status,
+		CreatedAt:     time.Now(),
+	})
+	if err != nil {
+		h.releasePayment(ctx, ride)
+		return nil, err
+	}
+	return pi, nil
+}
+
+// markPaid records that the intent of a ride's payment succeeded, marks the ride
+// paid and frees the driver of a completed ride. Both the client's confirm call
+// and the provider's webhook end up here; whichever comes second gets a
+// TransitionError.
+func (h *RideHandler) markPaid(ctx context.Context, rideID primitive.ObjectID, intentID string) (*models.Ride, error) {
+	err := h.Store.Payments.UpdateByIntent(ctx, intentID, bson.M{
+		"status":       "succeeded",
+		"completed_at": time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ride, err := h.transitionPayment(ctx, rideID, PaymentPaid, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The money is in; a missing driver only leaves them unavailable. The driver
+	// of a cancelled ride was freed when it was cancelled and may be busy again.
+	driver, driverUser, err := h.driverAndUser(ctx, ride.DriverID)
+	if err != nil {
+		log.Println("Failed to find the driver of paid ride", rideID.Hex(), err)
+		driverUser = nil
+	} else if ride.Status == RideCompleted {
+		if err := h.setDriverAvailable(ctx, driver.ID, true); err != nil {
+			log.Println("Failed to free the driver of paid ride", rideID.Hex(), err)
+		}
+	}
+
+	// Send WebSocket notifications to the rider and driver about the payment confirmation
+	payload := gin.H{
+		"ride_id":  rideID.Hex(),
+		"amount":   amountDue(ride),
+		"currency": "INR",
+	}
+	h.Hub.Broadcast <- websockets.Notification{Type: "payment_confirmed", UserID: ride.RiderID.Hex(), Payload: payload}
+	if driverUser != nil {
+		h.Hub.Broadcast <- websockets.Notification{Type: "payment_confirmed", UserID: driverUser.ID.Hex(), Payload: payload}
+	}
+	return ride, nil
+}
+
+// markPaymentFailed records that a payment failed or was canceled ("failed" or
+// "canceled") and, unless the rider has already started another one, moves the
+// ride's payment to failed so it can be retried
+func (h *RideHandler) markPaymentFailed(ctx context.Context, payment *models.Payment, status, reason string) error {
+	err := h.Store.Payments.UpdateByIntent(ctx, payment.PaymentIntent, bson.M{
+		"status":         status,
+		"failure_reason": reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	live, err := h.Store.Payments.FindLiveByRide(ctx, payment.RideID)
+	switch {
+	case err == nil && live.PaymentIntent != payment.PaymentIntent:
+		return nil // Superseded by a newer payment
+	case err != nil && !errors.Is(err, store.ErrNotFound):
+		return err
+	}
+
+	ride, err := h.transitionPayment(ctx, payment.RideID, PaymentFailed, nil)
+	var te *TransitionError
+	if errors.As(err, &te) {
+		return nil // Not pending, e.g. already failed
+	}
+	if err != nil {
+		return err
+	}
+
+	h.Hub.Broadcast <- websockets.Notification{
+		Type:   "payment_failed",
+		UserID: ride.RiderID.Hex(),
+		Payload: gin.H{
+			"ride_id": ride.ID.Hex(),
+			"amount":  amountDue(ride),
+			"reason":  reason,
+		},
+	}
+	return nil
+}
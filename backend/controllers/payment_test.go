@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"uber-clone/models"
+	"uber-clone/payments"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// slowGateway takes a while to create intents, like a real provider, which leaves
+// room for concurrent requests to overlap
+type slowGateway struct {
+	*payments.FakeGateway
+}
+
+func (g slowGateway) CreateIntent(p payments.IntentParams) (*payments.Intent, error) {
+	time.Sleep(20 * time.Millisecond)
+	return g.FakeGateway.CreateIntent(p)
+}
+
+// Without an Idempotency-Key nothing dedupes the requests but the ride itself
+func TestConcurrentPaymentRequests(t *testing.T) {
+	const requests = 10
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	hub := websockets.NewHub()
+	go hub.Run()
+	h := &RideHandler{Store: st, Hub: hub, Payments: slowGateway{payments.NewFakeGateway()}}
+
+	user := &models.User{Name: "Driver", Email: "driver@example.com", Password: "hash", Role: "driver"}
+	st.Users.Insert(ctx, user)
+	driver := &models.Driver{UserID: user.ID, VehicleType: "car"}
+	st.Drivers.Insert(ctx, driver)
+	ride := &models.Ride{RiderID: primitive.NewObjectID(), DriverID: driver.ID, Status: RideCompleted, Fare: 150}
+	st.Rides.Insert(ctx, ride)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, requests)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+			c.Params = gin.Params{{Key: "ride_id", Value: ride.ID.Hex()}}
+			c.Set("user_id", ride.RiderID.Hex())
+			h.HandlePayment(c)
+			statuses[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("concurrent payment request got %d", status)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d of %d concurrent payment requests created a payment, want 1", created, requests)
+	}
+	if list, _ := st.Payments.ListByRide(ctx, ride.ID); len(list) != 1 {
+		t.Fatalf("%d payments recorded for the ride, want 1", len(list))
+	}
+}
+
+func TestPaymentClaimReleasedOnFailure(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	gateway := payments.NewFakeGateway()
+	h := &RideHandler{Store: st, Payments: gateway}
+	user := &models.User{Name: "Driver", Email: "driver@example.com", Password: "hash", Role: "driver"}
+	st.Users.Insert(ctx, user)
+	driver := &models.Driver{UserID: user.ID, VehicleType: "car"}
+	st.Drivers.Insert(ctx, driver)
+	ride := &models.Ride{RiderID: primitive.NewObjectID(), DriverID: driver.ID, Status: RideCancelled, CancellationFee: 50, PaymentStatus: PaymentFailed}
+	st.Rides.Insert(ctx, ride)
+
+	gateway.SetScenario(payments.ScenarioNetworkError)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	c.Params = gin.Params{{Key: "ride_id", Value: ride.ID.Hex()}}
+	c.Set("user_id", ride.RiderID.Hex())
+	h.HandlePayment(c)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want 503", w.Code)
+	}
+	if got, _ := st.Rides.FindByID(ctx, ride.ID); got.PaymentStatus != PaymentFailed {
+		t.Fatalf("payment status %q after the gateway failed, want it back at %q", got.PaymentStatus, PaymentFailed)
+	}
+}
+
+// noIntents fails the test if an intent is created
+type noIntents struct {
+	*payments.FakeGateway
+	t *testing.T
+}
+
+func (g noIntents) CreateIntent(p payments.IntentParams) (*payments.Intent, error) {
+	g.t.Error("payment intent created")
+	return g.FakeGateway.CreateIntent(p)
+}
+
+func TestPaymentLooksUpDriverFirst(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	h := &RideHandler{Store: st, Payments: noIntents{payments.NewFakeGateway(), t}}
+	ride := &models.Ride{RiderID: primitive.NewObjectID(), DriverID: primitive.NewObjectID(), Status: RideCompleted, Fare: 150}
+	st.Rides.Insert(ctx, ride)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	c.Params = gin.Params{{Key: "ride_id", Value: ride.ID.Hex()}}
+	c.Set("user_id", ride.RiderID.Hex())
+	h.HandlePayment(c)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got %d, want 404 for a ride whose driver is gone", w.Code)
+	}
+	if got, _ := st.Rides.FindByID(ctx, ride.ID); got.PaymentStatus != PaymentUnpaid {
+		t.Fatalf("payment status %q, want the ride still unpaid", got.PaymentStatus)
+	}
+	if list, _ := st.Payments.ListByRide(ctx, ride.ID); len(list) != 0 {
+		t.Fatalf("%d payments recorded", len(list))
+	}
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"uber-clone/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// vehicleTypes are the vehicle types a trip is quoted for
+var vehicleTypes = []string{"two_wheeler", "three_wheeler", "car", "premium_car"}
+
+// QuoteRide prices a trip for every vehicle type with a single maps call and returns
+// a signed quote ID per type. Passing one to RequestRide locks in its fare and surge
+// until it expires.
+func (h *RideHandler) QuoteRide(c *gin.Context) {
+	var req struct {
+		StartLat float64 `json:"start_lat" binding:"required"`
+		StartLng float64 `json:"start_lng" binding:"required"`
+		EndLat   float64 `json:"end_lat" binding:"required"`
+		EndLng   float64 `json:"end_lng" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	distance, duration, err := h.Maps.Route(req.StartLat, req.StartLng, req.EndLat, req.EndLng)
+	if err != nil {
+		log.Println("Distance service failed:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch ride details"})
+		return
+	}
+
+	now := time.Now()
+	quotes := make([]gin.H, 0, len(vehicleTypes))
+	for _, vehicleType := range vehicleTypes {
+		fare, err := h.Pricing.Estimate(c, vehicleType, req.StartLat, req.StartLng, distance, duration)
+		if err != nil {
+			continue // Not offered here
+		}
+		quote := services.Quote{
+			RiderID:     c.GetString("user_id"),
+			VehicleType: vehicleType,
+			StartLat:    req.StartLat,
+			StartLng:    req.StartLng,
+			EndLat:      req.EndLat,
+			EndLng:      req.EndLng,
+			Distance:    distance,
+			Duration:    duration,
+			Fare:        *fare,
+		}
+		id, err := h.Quotes.Sign(&quote, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign quote"})
+			return
+		}
+		quotes = append(quotes, gin.H{
+			"quote_id":     id,
+			"vehicle_type": vehicleType,
+			"fare":         fare.Total,
+			"surge":        fare.SurgeMultiplier,
+			"breakdown":    fare,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"distance":   distance,
+		"duration":   duration,
+		"expires_at": now.Add(h.Quotes.TTL),
+		"quotes":     quotes,
+	})
+}
+
+// quotedTrip checks a quote ID from RequestRide against the caller and any trip
+// details they sent along, answering the request itself if the quote is unusable
+func (h *RideHandler) quotedTrip(c *gin.Context, quoteID, vehicleType string, startLat, startLng, endLat, endLng float64) (*services.Quote, bool) {
+	quote, err := h.Quotes.Verify(quoteID, time.Now())
+	if errors.Is(err, services.ErrQuoteExpired) {
+		c.JSON(http.StatusGone, gin.H{"error": "Quote has expired, please request a new one"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quote"})
+		return nil, false
+	}
+
+	same := func(sent, quoted float64) bool {
+		return sent == 0 || math.Abs(sent-quoted) < 1e-6
+	}
+	if quote.RiderID != c.GetString("user_id") ||
+		(vehicleType != "" && vehicleType != quote.VehicleType) ||
+		!same(startLat, quote.StartLat) || !same(startLng, quote.StartLng) ||
+		!same(endLat, quote.EndLat) || !same(endLng, quote.EndLng) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quote does not match this ride request"})
+		return nil, false
+	}
+	return quote, true
+}
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"uber-clone/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestQuotedTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &RideHandler{Quotes: services.NewQuoteSigner("secret", 5*time.Minute)}
+	quote := services.Quote{RiderID: "rider-1", VehicleType: "car", StartLat: 12.9, StartLng: 77.6, EndLat: 12.95, EndLng: 77.65}
+	id, _ := h.Quotes.Sign(&quote, time.Now())
+	expired, _ := h.Quotes.Sign(&quote, time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name        string
+		user        string
+		id          string
+		vehicleType string
+		trip        [4]float64
+		want        int // 0 when the quote is accepted
+	}{
+		{"quote alone", "rider-1", id, "", [4]float64{}, 0},
+		{"matching details", "rider-1", id, "car", [4]float64{12.9, 77.6, 12.95, 77.65}, 0},
+		{"another rider", "rider-2", id, "", [4]float64{}, http.StatusBadRequest},
+		{"another vehicle type", "rider-1", id, "premium_car", [4]float64{}, http.StatusBadRequest},
+		{"another destination", "rider-1", id, "", [4]float64{0, 0, 13.1, 77.65}, http.StatusBadRequest},
+		{"expired", "rider-1", expired, "", [4]float64{}, http.StatusGone},
+		{"tampered", "rider-1", id + "x", "", [4]float64{}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Set("user_id", tt.user)
+
+			got, ok := h.quotedTrip(c, tt.id, tt.vehicleType, tt.trip[0], tt.trip[1], tt.trip[2], tt.trip[3])
+			if tt.want == 0 {
+				if !ok || got.RiderID != "rider-1" || w.Body.Len() != 0 {
+					t.Fatalf("quote rejected with %d: %s", w.Code, w.Body)
+				}
+				return
+			}
+			if ok || w.Code != tt.want {
+				t.Fatalf("got ok=%v status %d, want %d", ok, w.Code, tt.want)
+			}
+		})
+	}
+}
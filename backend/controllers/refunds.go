@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"uber-clone/middleware"
+	"uber-clone/models"
+	"uber-clone/payments"
+	"uber-clone/services"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RefundRide returns money to the rider of a paid ride: the given amount, or all
+// that is left to refund. Admins and support agents only.
+func (h *RideHandler) RefundRide(c *gin.Context) {
+	var req struct {
+		Amount float64 `json:"amount" binding:"min=0"` // Zero refunds everything left
+		Reason string  `json:"reason" binding:"required,oneof=fare_dispute route_deviation driver_no_show service_quality duplicate_charge goodwill other"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rideID, err := primitive.ObjectIDFromHex(c.Param("ride_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Ride ID"})
+		return
+	}
+	ride, err := h.Store.Rides.FindByID(c, rideID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+		return
+	}
+	if ride.PaymentStatus != PaymentPaid && ride.PaymentStatus != PaymentPartiallyRefunded {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          "Ride has no payment left to refund",
+			"payment_status": ride.PaymentStatus,
+		})
+		return
+	}
+
+	charge, err := h.Store.Payments.FindLiveByRide(c, rideID)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Ride has no payment left to refund"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find the ride's payment"})
+		return
+	}
+
+	refundable := services.RoundPaise(charge.Amount - charge.Refunded)
+	amount := services.RoundPaise(req.Amount)
+	if amount == 0 {
+		amount = refundable
+	}
+	if amount <= 0 || amount > refundable {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refund amount exceeds what is left to refund", "refundable": refundable})
+		return
+	}
+
+	// Reserve the amount first, so concurrent refunds cannot together exceed the
+	// charge. Half a paisa absorbs the float error of the running total.
+	err = h.Store.Payments.AddRefunded(c, charge.PaymentIntent, amount, charge.Amount+0.005)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another refund of this ride changed what is left to refund, try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve the refund"})
+		return
+	}
+
+	issuedBy := c.GetString("user_id")
+	refund, err := h.Payments.Refund(payments.RefundParams{
+		IntentID:       charge.PaymentIntent,
+		Amount:         int64(math.Round(amount * 100)), // Convert to paise
+		Metadata:       map[string]string{"ride_id": rideID.Hex(), "reason": req.Reason, "issued_by": issuedBy},
+		IdempotencyKey: middleware.IdempotencyKey(c),
+	})
+	if err != nil {
+		if err := h.Store.Payments.AddRefunded(c, charge.PaymentIntent, -amount, math.Inf(1)); err != nil {
+			log.Println("Failed to release the refund reserved on", charge.PaymentIntent, err)
+		}
+	}
+	if errors.Is(err, payments.ErrUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payment provider unavailable, try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Refund failed: " + err.Error()})
+		return
+	}
+
+	issuer, _ := primitive.ObjectIDFromHex(issuedBy)
+	if _, err := h.recordRefund(c, charge, refund, req.Reason, issuer); err != nil {
+		// The provider's charge.refunded webhook records it instead
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Refund issued but not recorded", "refund_id": refund.ID})
+		return
+	}
+	ride, err = h.Store.Rides.FindByID(c, rideID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reload the ride"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"refund_id":      refund.ID,
+		"amount":         amount,
+		"currency":       refund.Currency,
+		"reason":         req.Reason,
+		"payment_status": ride.PaymentStatus,
+	})
+}
+
+// recordRefund stores a refund of a ride's charge as a negative payment, moves the
+// ride to refunded or partially_refunded and tells the rider. A refund recorded
+// before, e.g. by RefundRide ahead of its webhook, is skipped and reported as false;
+// only its completion is noted. Refunds issued by an agent through RefundRide have
+// their amount reserved on the charge already, others are added to it here.
+func (h *RideHandler) recordRefund(ctx context.Context, charge *models.Payment, refund *payments.Refund, reason string, issuedBy primitive.ObjectID) (bool, error) {
+	now := time.Now()
+	amount := float64(refund.Amount) / 100
+	record := &models.Payment{
+		RideID:        charge.RideID,
+		Amount:        -amount,
+		Currency:      refund.Currency,
+		PaymentIntent: refund.ID,
+		Status:        refund.Status,
+		CreatedAt:     now,
+		RefundOf:      charge.PaymentIntent,
+		Reason:        reason,
+		IssuedBy:      issuedBy,
+	}
+	if refund.Status == payments.StatusSucceeded {
+		record.CompletedAt = now
+	}
+	err := h.Store.Payments.Insert(ctx, record)
+	if errors.Is(err, store.ErrDuplicate) {
+		return false, h.completeRefund(ctx, refund, now)
+	}
+	if err != nil {
+		return false, err
+	}
+	if issuedBy.IsZero() {
+		if err := h.Store.Payments.AddRefunded(ctx, charge.PaymentIntent, amount, math.Inf(1)); err != nil {
+			return false, err
+		}
+	}
+
+	// Total from the records rather than the charge, which may be stale
+	records, err := h.Store.Payments.ListByRide(ctx, charge.RideID)
+	if err != nil {
+		return false, err
+	}
+	refunded := 0.0
+	for _, p := range records {
+		if p.RefundOf == charge.PaymentIntent {
+			refunded -= p.Amount
+		}
+	}
+	refunded = services.RoundPaise(refunded)
+
+	to := PaymentPartiallyRefunded
+	if refunded >= charge.Amount {
+		to = PaymentRefunded
+	}
+	ride, err := h.transitionPayment(ctx, charge.RideID, to, nil)
+	var te *TransitionError
+	if errors.As(err, &te) {
+		ride, err = h.Store.Rides.FindByID(ctx, charge.RideID) // Already fully refunded
+	}
+	if err != nil {
+		return false, err
+	}
+
+	h.Hub.Broadcast <- websockets.Notification{
+		Type:   "payment_refunded",
+		UserID: ride.RiderID.Hex(),
+		Payload: gin.H{
+			"ride_id":        ride.ID.Hex(),
+			"amount":         amount,
+			"refunded":       refunded,
+			"currency":       refund.Currency,
+			"reason":         reason,
+			"payment_status": ride.PaymentStatus,
+		},
+	}
+	return true, nil
+}
+
+// completeRefund notes that a refund recorded while pending has succeeded
+func (h *RideHandler) completeRefund(ctx context.Context, refund *payments.Refund, at time.Time) error {
+	if refund.Status != payments.StatusSucceeded {
+		return nil
+	}
+	recorded, err := h.Store.Payments.FindByIntent(ctx, refund.ID)
+	if err != nil || !recorded.CompletedAt.IsZero() {
+		return err
+	}
+	return h.Store.Payments.UpdateByIntent(ctx, refund.ID, bson.M{"status": refund.Status, "completed_at": at})
+}
@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"uber-clone/models"
+	"uber-clone/payments"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// refundGateway reports refunds in status, like a provider that settles them later
+type refundGateway struct {
+	*payments.FakeGateway
+	status string
+}
+
+func (g *refundGateway) Refund(p payments.RefundParams) (*payments.Refund, error) {
+	refund, err := g.FakeGateway.Refund(p)
+	if err == nil && g.status != "" {
+		refund.Status = g.status
+	}
+	return refund, err
+}
+
+// barrierPayments holds every FindLiveByRide until all readers have read, so
+// concurrent refunds all see the charge before any of them reserves
+type barrierPayments struct {
+	store.PaymentRepo
+	readers *sync.WaitGroup
+}
+
+func (r barrierPayments) FindLiveByRide(ctx context.Context, rideID primitive.ObjectID) (*models.Payment, error) {
+	charge, err := r.PaymentRepo.FindLiveByRide(ctx, rideID)
+	r.readers.Done()
+	r.readers.Wait()
+	return charge, err
+}
+
+type refundFixture struct {
+	h       *RideHandler
+	gateway *refundGateway
+	ride    *models.Ride
+	intent  string
+	agent   string
+}
+
+// newRefundFixture sets up a completed ride charged 150 in the given payment status
+func newRefundFixture(t *testing.T, paymentStatus string) *refundFixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	hub := websockets.NewHub()
+	go hub.Run()
+	f := &refundFixture{gateway: &refundGateway{FakeGateway: payments.NewFakeGateway()}, agent: primitive.NewObjectID().Hex()}
+	f.h = &RideHandler{Store: st, Hub: hub, Payments: f.gateway}
+
+	f.ride = &models.Ride{RiderID: primitive.NewObjectID(), Status: RideCompleted, PaymentStatus: paymentStatus, Fare: 150}
+	st.Rides.Insert(ctx, f.ride)
+	intent, err := f.gateway.CreateIntent(payments.IntentParams{Amount: 15000, Currency: "inr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paymentStatus != PaymentPending {
+		if _, err := f.gateway.Confirm(intent.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.Payments.Insert(ctx, &models.Payment{
+		RideID: f.ride.ID, Amount: 150, Currency: "INR", PaymentIntent: intent.ID, Status: "succeeded", CreatedAt: time.Now(),
+	})
+	f.intent = intent.ID
+	return f
+}
+
+func (f *refundFixture) refund(body string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	c.Params = gin.Params{{Key: "ride_id", Value: f.ride.ID.Hex()}}
+	c.Set("user_id", f.agent)
+	f.h.RefundRide(c)
+	var out map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return w.Code, out
+}
+
+func (f *refundFixture) charge(t *testing.T) *models.Payment {
+	t.Helper()
+	charge, err := f.h.Store.Payments.FindByIntent(context.Background(), f.intent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return charge
+}
+
+// refunds lists the refund records of the ride
+func (f *refundFixture) refunds(t *testing.T) []models.Payment {
+	t.Helper()
+	records, err := f.h.Store.Payments.ListByRide(context.Background(), f.ride.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refunds []models.Payment
+	for _, p := range records {
+		if p.RefundOf != "" {
+			refunds = append(refunds, p)
+		}
+	}
+	return refunds
+}
+
+func TestRefundRide(t *testing.T) {
+	tests := []struct {
+		name          string
+		paymentStatus string
+		bodies        []string // Refund requests in order
+		want          []int
+		wantStatus    string // Payment status of the ride at the end
+		wantRefunded  float64
+	}{
+		{"partial then full", PaymentPaid,
+			[]string{`{"amount":50,"reason":"goodwill"}`, `{"reason":"fare_dispute"}`, `{"reason":"other"}`},
+			[]int{http.StatusCreated, http.StatusCreated, http.StatusConflict}, PaymentRefunded, 150},
+		{"two partial refunds", PaymentPaid,
+			[]string{`{"amount":50.5,"reason":"goodwill"}`, `{"amount":49.5,"reason":"goodwill"}`},
+			[]int{http.StatusCreated, http.StatusCreated}, PaymentPartiallyRefunded, 100},
+		{"over-refund", PaymentPaid,
+			[]string{`{"amount":100,"reason":"goodwill"}`, `{"amount":60,"reason":"goodwill"}`},
+			[]int{http.StatusCreated, http.StatusBadRequest}, PaymentPartiallyRefunded, 100},
+		{"unpaid ride", PaymentPending,
+			[]string{`{"reason":"goodwill"}`},
+			[]int{http.StatusConflict}, PaymentPending, 0},
+		{"unknown reason", PaymentPaid,
+			[]string{`{"reason":"because"}`},
+			[]int{http.StatusBadRequest}, PaymentPaid, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newRefundFixture(t, tt.paymentStatus)
+			for i, body := range tt.bodies {
+				if code, out := f.refund(body); code != tt.want[i] {
+					t.Fatalf("refund %s: got %d, want %d: %v", body, code, tt.want[i], out)
+				}
+			}
+			ride, _ := f.h.Store.Rides.FindByID(context.Background(), f.ride.ID)
+			if ride.PaymentStatus != tt.wantStatus {
+				t.Fatalf("payment status %q, want %q", ride.PaymentStatus, tt.wantStatus)
+			}
+			if got := f.charge(t).Refunded; got != tt.wantRefunded {
+				t.Fatalf("refunded %v, want %v", got, tt.wantRefunded)
+			}
+		})
+	}
+}
+
+// Each refund is within what is left, but not both together
+func TestConcurrentPartialRefunds(t *testing.T) {
+	f := newRefundFixture(t, PaymentPaid)
+	codes := make([]int, 2)
+	var readers sync.WaitGroup
+	readers.Add(len(codes))
+	f.h.Store.Payments = barrierPayments{PaymentRepo: f.h.Store.Payments, readers: &readers}
+
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i], _ = f.refund(`{"amount":100,"reason":"goodwill"}`)
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("concurrent refund got %d", code)
+		}
+	}
+	if created != 1 || f.charge(t).Refunded != 100 {
+		t.Fatalf("%d refunds went through for %v, want 1 of 100", created, f.charge(t).Refunded)
+	}
+}
+
+// The charge.refunded webhook of a refund RefundRide recorded changes nothing
+func TestRefundWebhookAfterAPI(t *testing.T) {
+	ctx := context.Background()
+	f := newRefundFixture(t, PaymentPaid)
+	code, out := f.refund(`{"amount":50,"reason":"goodwill"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("refund: got %d: %v", code, out)
+	}
+
+	charge := f.charge(t)
+	issued := f.refunds(t)[0]
+	event := &payments.Event{
+		ID: "evt_1", Type: payments.EventChargeRefunded, IntentID: charge.PaymentIntent, AmountRefunded: 5000,
+		Refunds: []payments.Refund{{
+			ID: issued.PaymentIntent, IntentID: charge.PaymentIntent, Amount: 5000, Currency: "INR", Status: payments.StatusSucceeded,
+			Metadata: map[string]string{"ride_id": f.ride.ID.Hex(), "reason": "goodwill", "issued_by": f.agent},
+		}},
+	}
+	wh := &WebhookHandler{Rides: f.h, Secret: "whsec_test"}
+	if err := wh.handle(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	if refunds := f.refunds(t); len(refunds) != 1 || f.charge(t).Refunded != 50 {
+		t.Fatalf("%d refunds of %v after the webhook, want the refund of 50 once", len(refunds), f.charge(t).Refunded)
+	}
+}
+
+func TestPendingRefundCompletes(t *testing.T) {
+	ctx := context.Background()
+	f := newRefundFixture(t, PaymentPaid)
+	f.gateway.status = "pending"
+	if code, out := f.refund(`{"amount":50,"reason":"goodwill"}`); code != http.StatusCreated {
+		t.Fatalf("refund: got %d: %v", code, out)
+	}
+	refund := f.refunds(t)[0]
+	if refund.Status != "pending" || !refund.CompletedAt.IsZero() {
+		t.Fatalf("pending refund recorded as %q completed at %v", refund.Status, refund.CompletedAt)
+	}
+
+	// The provider settles it and reports it by webhook
+	settled := &payments.Refund{ID: refund.PaymentIntent, Amount: 5000, Currency: "INR", Status: payments.StatusSucceeded}
+	if _, err := f.h.recordRefund(ctx, f.charge(t), settled, "goodwill", primitive.NilObjectID); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := f.h.Store.Payments.FindByIntent(ctx, refund.PaymentIntent)
+	if got.Status != payments.StatusSucceeded || got.CompletedAt.IsZero() {
+		t.Fatalf("settled refund is %q completed at %v", got.Status, got.CompletedAt)
+	}
+	if f.charge(t).Refunded != 50 {
+		t.Fatalf("refunded %v after the refund settled, want 50", f.charge(t).Refunded)
+	}
+}
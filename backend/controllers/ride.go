@@ -2,38 +2,56 @@ package controllers
 
 import (
 	"context"
-	"log"
+	"errors"
 	"strings"
 
 	//"crypto/rand"
 	"fmt"
-	//"math"
+	"log"
+	"math"
 	"net/http"
 	"time"
-	"uber-clone/algo"
 	"uber-clone/auth"
-	"uber-clone/db"
+	"uber-clone/config"
+	"uber-clone/middleware"
 	"uber-clone/models"
+	"uber-clone/payments"
 	"uber-clone/services"
+	"uber-clone/store"
 	"uber-clone/websockets"
 
 	"math/rand"
 
 	"github.com/gin-gonic/gin"
-	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/paymentintent"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// RequestRide handles the ride request from a rider
-func RequestRide(c *gin.Context) {
+// RideHandler serves the ride endpoints and WebSocket messages and owns dispatch
+type RideHandler struct {
+	Store        *store.Store
+	Hub          *websockets.Hub
+	Payments     payments.Gateway
+	Maps         services.Maps
+	Pricing      *services.Pricing
+	Tokens       *auth.Tokens
+	Quotes       *services.QuoteSigner
+	Dispatch     config.Dispatch
+	Cancellation services.CancellationPolicy
+	Tracker      *LocationTracker
+	Dispatcher   *BatchDispatcher // nil when rides are matched immediately
+}
+
+// RequestRide handles the ride request from a rider. With a quote_id from QuoteRide
+// the trip and its fare come from the quote; otherwise the fare is computed now.
+func (h *RideHandler) RequestRide(c *gin.Context) {
 	var req struct {
-		StartLat    float64 `json:"start_lat" binding:"required"`
-		StartLng    float64 `json:"start_lng" binding:"required"`
-		EndLat      float64 `json:"end_lat" binding:"required"`
-		EndLng      float64 `json:"end_lng" binding:"required"`
-		VehicleType string  `json:"vehicle_type" binding:"required,oneof=two_wheeler three_wheeler car premium_car"`
+		QuoteID     string  `json:"quote_id"`
+		StartLat    float64 `json:"start_lat" binding:"required_without=QuoteID"`
+		StartLng    float64 `json:"start_lng" binding:"required_without=QuoteID"`
+		EndLat      float64 `json:"end_lat" binding:"required_without=QuoteID"`
+		EndLng      float64 `json:"end_lng" binding:"required_without=QuoteID"`
+		VehicleType string  `json:"vehicle_type" binding:"required_without=QuoteID,omitempty,oneof=two_wheeler three_wheeler car premium_car"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -42,142 +60,129 @@ func RequestRide(c *gin.Context) {
 	}
 	fmt.Println("✅ Received ride request:", req)
 
-	// Get distance, duration, and fare
-	distance, duration, fare, err := services.GetDistance(req.StartLat, req.StartLng, req.EndLat, req.EndLng, req.VehicleType)
-	if err != nil {
-		fmt.Println("❌ Distance service failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch ride details"})
-		return
-	}
-	fmt.Println("✅ Distance calculated:", distance, "km", duration, "mins", "Fare:", fare)
-
-	driverColl := db.GetCollection("drivers")
-
-	var bestDriver models.Driver
-	searchRadius := 5000 // Initial radius in meters
-
-	for searchRadius <= 15000 { // Expand search radius up to 15km if no drivers are found
-		filter := bson.M{
-			"location": bson.M{
-				"$nearSphere": bson.M{
-					"$geometry": bson.M{
-						"type":        "Point",
-						"coordinates": []float64{req.StartLng, req.StartLat},
-					},
-					"$maxDistance": searchRadius,
-				},
-			},
-			"is_available": true,
-			"vehicle_type": req.VehicleType,
+	var distance, duration float64
+	var fare *models.FareBreakdown
+	if req.QuoteID != "" {
+		// Honour the locked fare and surge of the quote
+		quote, ok := h.quotedTrip(c, req.QuoteID, req.VehicleType, req.StartLat, req.StartLng, req.EndLat, req.EndLng)
+		if !ok {
+			return
 		}
-
-		var drivers []models.Driver
-		fmt.Println("🔍 Searching drivers with radius:", searchRadius)
-		cursor, err := driverColl.Find(c, filter)
+		req.StartLat, req.StartLng, req.EndLat, req.EndLng = quote.StartLat, quote.StartLng, quote.EndLat, quote.EndLng
+		req.VehicleType = quote.VehicleType
+		distance, duration, fare = quote.Distance, quote.Duration, &quote.Fare
+	} else {
+		// Get distance, duration, and fare
+		var err error
+		distance, duration, fare, err = services.GetDistance(c, h.Maps, h.Pricing, req.StartLat, req.StartLng, req.EndLat, req.EndLng, req.VehicleType)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find drivers"})
+			fmt.Println("❌ Distance service failed:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch ride details"})
 			return
 		}
-		fmt.Println("✅ Mongo query executed, checking cursor...")
+	}
+	fmt.Println("✅ Distance calculated:", distance, "km", duration, "mins", "Fare:", fare.Total)
 
-		defer cursor.Close(c)
+	otp := generateOTP()
+	riderID, _ := primitive.ObjectIDFromHex(c.GetString("user_id"))
 
-		for cursor.Next(c) {
-			var driver models.Driver
-			if err := cursor.Decode(&driver); err != nil {
-				fmt.Println("⚠️ Decode driver failed:", err)
-				continue
-			}
-			drivers = append(drivers, driver)
-		}
-		fmt.Printf("🔍 Found %d drivers in %dm radius\n", len(drivers), searchRadius)
-
-		if len(drivers) > 0 {
-			bestDriver = drivers[0]
-			minDistance := algo.CalculateVincentyDistance(req.StartLat, req.StartLng, bestDriver.Location.Coordinates[1], bestDriver.Location.Coordinates[0])
-
-			for _, driver := range drivers {
-				d := algo.CalculateVincentyDistance(req.StartLat, req.StartLng, driver.Location.Coordinates[1], driver.Location.Coordinates[0])
-				if d < minDistance {
-					minDistance = d
-					bestDriver = driver
-				}
-			}
-			break // Stop searching once a driver is found
+	// In batch mode the ride waits for the next matching round instead
+	if h.Dispatcher != nil {
+		rideID, err := h.searchingRide(c, models.Ride{
+			RiderID:       riderID,
+			StartLocation: models.GeoJSON{Type: "Point", Coordinates: []float64{req.StartLng, req.StartLat}},
+			EndLocation:   models.GeoJSON{Type: "Point", Coordinates: []float64{req.EndLng, req.EndLat}},
+			Distance:      distance,
+			VehicleType:   req.VehicleType,
+			CreatedAt:     time.Now(),
+			OTP:           otp,
+			Fare:          fare.Total,
+			FareBreakdown: fare,
+
+			EstimatedFare:          fare.Total,
+			EstimatedFareBreakdown: fare,
+
+			SurgeMultiplier: fare.SurgeMultiplier,
+		})
+		if err != nil {
+			fmt.Println("❌ Failed to insert ride:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request ride"})
+			return
 		}
 
-		searchRadius += 5000 // Increase radius if no drivers are found
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":   "Searching for a driver",
+			"ride_id":   rideID.Hex(),
+			"status":    RideSearching,
+			"distance":  distance,
+			"duration":  duration,
+			"fare":      fare.Total,
+			"breakdown": fare,
+			"otp":       otp, // Send OTP for testing
+		})
+		return
 	}
 
-	if bestDriver.ID.IsZero() {
+	// Find and atomically reserve the nearest free driver
+	matcher := h.rideMatcher()
+	bestDriver, err := h.reserveBestDriver(c, matcher, req.StartLat, req.StartLng, req.VehicleType, nil)
+	if errors.Is(err, errNoDriverFound) {
 		fmt.Println("❌ No drivers found")
 		c.JSON(http.StatusNotFound, gin.H{"error": "No available drivers found"})
 		return
 	}
-
-	// Assign driver and update their status
-	update := bson.M{"$set": bson.M{"is_available": false}}
-	_, err = driverColl.UpdateOne(c, bson.M{"_id": bestDriver.ID}, update)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update driver availability"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve a driver"})
 		return
 	}
 
-	otp := generateOTP()
-	riderID, _ := primitive.ObjectIDFromHex(c.GetString("user_id"))
-
 	ride := models.Ride{
 		RiderID:       riderID,
 		StartLocation: models.GeoJSON{Type: "Point", Coordinates: []float64{req.StartLng, req.StartLat}},
 		EndLocation:   models.GeoJSON{Type: "Point", Coordinates: []float64{req.EndLng, req.EndLat}},
 		Distance:      distance,
 		VehicleType:   req.VehicleType,
-		Status:        "requested",
+		Status:        RideRequested,
 		CreatedAt:     time.Now(),
 		OTP:           otp,
 		DriverID:      bestDriver.ID,
-		Fare:          fare,
+		Fare:          fare.Total,
+		FareBreakdown: fare,
+
+		EstimatedFare:          fare.Total,
+		EstimatedFareBreakdown: fare,
+
+		SurgeMultiplier: fare.SurgeMultiplier,
+
+		DispatchAttempts: 1,
+		MatchStrategy:    matcher.Name(),
 	}
 
-	rideColl := db.GetCollection("rides")
-	result, err := rideColl.InsertOne(c, ride)
-	if err != nil {
+	if err := h.Store.Rides.Insert(c, &ride); err != nil {
 		fmt.Println("❌ Failed to insert ride:", err)
+		h.setDriverAvailable(c, bestDriver.ID, true) // Release the reservation
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request ride"})
 		return
 	}
 
-	ride.ID = result.InsertedID.(primitive.ObjectID)
 	fmt.Println("✅ Ride inserted with ID:", ride.ID.Hex())
 
-	// Notify the driver via WebSocket
-	log.Printf("📤 Sending ride request to driver: %s", bestDriver.UserID.Hex())
-
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
-		Type:   "ride_request",
-		UserID: bestDriver.UserID.Hex(),
-
-		Payload: gin.H{
-			"ride_id":  ride.ID.Hex(),
-			"rider_id": ride.RiderID.Hex(),
-			"distance": ride.Distance,
-			"fare":     ride.Fare,
-			"pickup":   ride.StartLocation.Coordinates,
-		},
-	}
+	// Notify the driver via WebSocket and wait for their response
+	h.offerRide(&ride, bestDriver)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message":   "Ride requested",
 		"ride_id":   ride.ID.Hex(),
 		"distance":  distance,
 		"duration":  duration,
-		"fare":      fare,
+		"fare":      fare.Total,
+		"breakdown": fare,
 		"driver_id": bestDriver.ID.Hex(),
 		"otp":       otp, // Send OTP for testing
 	})
 }
 
-func HandleDriverResponse(c *gin.Context) {
+func (h *RideHandler) HandleDriverResponse(c *gin.Context) {
 
 	rideIdParam := c.Param("ride_id")
 
@@ -191,72 +196,90 @@ func HandleDriverResponse(c *gin.Context) {
 		return
 	}
 
-	rideID, _ := primitive.ObjectIDFromHex(rideIdParam)
-	rideColl := db.GetCollection("rides")
-	userColl := db.GetCollection("users")
-	driverColl := db.GetCollection("drivers")
-
-	update := bson.M{
-		"$set": bson.M{
-			"status":      "accepted",
-			"accepted_at": time.Now(),
-		},
+	rideID, err := primitive.ObjectIDFromHex(rideIdParam)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Ride ID"})
+		return
 	}
-	if !req.Accept {
-		update = bson.M{
-			"$set": bson.M{
-				"status":      "rejected",
-				"rejected_at": time.Now(),
-			},
+
+	if _, err := h.respondToRide(c, c.GetString("user_id"), rideID, req.Accept); err != nil {
+		if errors.Is(err, errNotADriver) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only drivers can respond to ride requests"})
+			return
 		}
+		respondTransitionError(c, err, "Failed to update ride status")
+		return
 	}
 
-	_, err := rideColl.UpdateByID(c, rideID, update)
+	c.JSON(http.StatusOK, gin.H{"message": "Response recorded"})
+}
+
+// errNotADriver is returned when the caller has no driver profile
+var errNotADriver = errors.New("caller is not a driver")
+
+// respondToRide records a driver's accept/reject for the ride currently offered to
+// them, notifies the rider and, on rejection, re-dispatches in the background. It is
+// shared by the REST endpoint and the ride_response WebSocket message.
+func (h *RideHandler) respondToRide(ctx context.Context, driverUserID string, rideID primitive.ObjectID, accept bool) (*models.Ride, error) {
+	// Step 1: Get the driver document of the caller
+	userObjID, err := primitive.ObjectIDFromHex(driverUserID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update ride status"})
-		return
+		return nil, errNotADriver
 	}
-
-	// Fetch the updated ride data
-	var ride models.Ride
-	err = rideColl.FindOne(c, bson.M{"_id": rideID}).Decode(&ride)
+	driver, err := h.Store.Drivers.FindByUserID(ctx, userObjID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
-		return
+		return nil, errNotADriver
+	}
+
+	status, stampField := RideAccepted, "accepted_at"
+	if !accept {
+		status, stampField = RideRejected, "rejected_at"
 	}
 
-	// Step 1: Get the driver document
-	var driver models.Driver
-	err = driverColl.FindOne(c, bson.M{"_id": ride.DriverID}).Decode(&driver)
+	// Only the driver the ride is currently offered to can answer it
+	ride, err := h.transitionRideWhere(ctx, rideID, store.RideMatch{DriverID: driver.ID}, status, bson.M{stampField: time.Now()})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Driver not found"})
-		return
+		return nil, err
+	}
+
+	if ride.Status == RideRejected {
+		// Tell the rider and try the next driver in the background
+		h.Hub.Broadcast <- websockets.Notification{
+			Type:   "ride_response",
+			UserID: ride.RiderID.Hex(),
+			Payload: gin.H{
+				"status":  ride.Status,
+				"ride_id": rideID.Hex(),
+			},
+		}
+		go h.redispatchRide(context.Background(), ride, "rejected")
+		return ride, nil
 	}
 
 	// Step 2: Get the user linked to that driver (where the name is)
-	var user models.User
-	err = userColl.FindOne(c, bson.M{"_id": driver.UserID}).Decode(&user)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Driver user not found"})
-		return
+	var driverName string
+	if user, err := h.Store.Users.FindByID(ctx, driver.UserID); err == nil {
+		driverName = user.Name
+	} else {
+		fmt.Println("⚠️ Driver user not found:", err)
 	}
 
-	// Now you can use user.Name or whatever
-	fmt.Println("Driver Name:", user.Name)
+	// Drop the cached ride so the driver's next location update finds this one
+	h.Tracker.Forget(driver.UserID.Hex())
 
 	// Notify the rider via WebSocket
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
+	h.Hub.Broadcast <- websockets.Notification{
 		Type:   "ride_response",
 		UserID: ride.RiderID.Hex(),
 		Payload: gin.H{
-			"status":      update["$set"].(bson.M)["status"], // Either "accepted" or "rejected"
+			"status":      ride.Status, // "accepted"
 			"driver_id":   ride.DriverID.Hex(),
-			"driver_name": user.Name,
+			"driver_name": driverName,
 			"ride_id":     rideID.Hex(),
 		},
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Response recorded"})
+	return ride, nil
 }
 
 // generateOTP generates a six-digit random OTP
@@ -265,8 +288,21 @@ func generateOTP() string {
 	return fmt.Sprintf("%06d", rand.Intn(1000000)) // Generate a 6-digit OTP
 }
 
+// driverAndUser loads a driver profile together with the user account behind it
+func (h *RideHandler) driverAndUser(ctx context.Context, driverID primitive.ObjectID) (*models.Driver, *models.User, error) {
+	driver, err := h.Store.Drivers.FindByID(ctx, driverID)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := h.Store.Users.FindByID(ctx, driver.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return driver, user, nil
+}
+
 // VerifyOTP allows the rider to verify the OTP before starting the ride
-func VerifyOTP(c *gin.Context) {
+func (h *RideHandler) VerifyOTP(c *gin.Context) {
 	rideID := c.Param("ride_id")
 	var req struct {
 		OTP string `json:"otp" binding:"required"`
@@ -286,7 +322,7 @@ func VerifyOTP(c *gin.Context) {
 	}
 
 	// Validate the token and extract claims
-	claims, err := auth.ValidateToken(tokenString)
+	claims, err := h.Tokens.ValidateToken(tokenString)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 		return
@@ -305,19 +341,19 @@ func VerifyOTP(c *gin.Context) {
 	}
 
 	// Find ride from the database using the rideID
-	rideColl := db.GetCollection("rides")
-	objID, _ := primitive.ObjectIDFromHex(rideID)
-	var ride models.Ride
-	err = rideColl.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&ride)
+	objID, err := primitive.ObjectIDFromHex(rideID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Ride ID"})
+		return
+	}
+	ride, err := h.Store.Rides.FindByID(c, objID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
 		return
 	}
 
 	// Fetch the driver details from the drivers table using the driver_id in the ride
-	driverColl := db.GetCollection("drivers")
-	var driver models.Driver
-	err = driverColl.FindOne(context.Background(), bson.M{"_id": ride.DriverID}).Decode(&driver)
+	driver, err := h.Store.Drivers.FindByID(c, ride.DriverID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Driver not found"})
 		return
@@ -335,11 +371,15 @@ func VerifyOTP(c *gin.Context) {
 		return
 	}
 
-	// Mark the ride as "ongoing"
-	rideColl.UpdateByID(context.Background(), objID, bson.M{"$set": bson.M{"status": "ongoing"}})
+	// Mark the ride as "ongoing"; only an accepted ride can start
+	if _, err := h.transitionRide(c, objID, RideOngoing, bson.M{"started_at": time.Now()}); err != nil {
+		respondTransitionError(c, err, "Failed to start the ride")
+		return
+	}
+	h.Tracker.Forget(driver.UserID.Hex()) // Start measuring the trip
 
 	// Send a notification to the rider that the ride has started and is now ongoing
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
+	h.Hub.Broadcast <- websockets.Notification{
 		Type:   "ride_started",
 		UserID: ride.RiderID.Hex(), // Notify the rider
 		Payload: gin.H{
@@ -351,12 +391,23 @@ func VerifyOTP(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "OTP verified, ride is now ongoing"})
 }
 
-func CancelRide(c *gin.Context) {
+// CancelRide cancels a ride for its rider or driver and records the fee the
+// cancellation policy charges. The fee is not collected here: the rider owes it
+// until they pay it through POST /rides/:ride_id/pay, like a completed ride's fare.
+func (h *RideHandler) CancelRide(c *gin.Context) {
 	rideID := c.Param("ride_id")
 	var req struct {
 		Reason string `json:"reason"`
 	}
 
+	// The body is optional
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	// Extract JWT Token from Header
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
@@ -371,7 +422,7 @@ func CancelRide(c *gin.Context) {
 	}
 
 	// Validate the token and extract claims
-	claims, err := auth.ValidateToken(tokenString)
+	claims, err := h.Tokens.ValidateToken(tokenString)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 		return
@@ -385,78 +436,128 @@ func CancelRide(c *gin.Context) {
 	}
 
 	// Find ride from the database using the rideID
-	rideColl := db.GetCollection("rides")
-	var ride models.Ride
-	err = rideColl.FindOne(c, bson.M{"_id": objID}).Decode(&ride)
+	ride, err := h.Store.Rides.FindByID(c, objID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
 		return
 	}
 
-	// Check if the ride is already completed and prevent cancellation
-	if ride.Status == "completed" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Ride has already been completed and cannot be cancelled"})
+	// Check the ride can still be cancelled before doing any ownership lookups
+	if !CanTransitionRide(ride.Status, RideCancelled) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          "Ride can no longer be cancelled",
+			"current_status": ride.Status,
+		})
 		return
 	}
 
 	// Check if the user is either the rider or the driver
 	userID := claims.UserID
+	userObjID, _ := primitive.ObjectIDFromHex(userID)
+	cancelledBy := "rider"
 	if ride.RiderID.Hex() != userID {
 		// Check if the user is the driver, but we need to compare with the Driver's collection
-		driverColl := db.GetCollection("drivers")
-		var driver models.Driver
-		err = driverColl.FindOne(c, bson.M{"user_id": userID}).Decode(&driver)
-		if err != nil || ride.DriverID.Hex() != driver.ID.Hex() {
+		cancelledBy = "driver"
+		driver, err := h.Store.Drivers.FindByUserID(c, userObjID)
+		if err != nil || ride.DriverID != driver.ID {
 			c.JSON(http.StatusForbidden, gin.H{"error": "You are not authorized to cancel this ride"})
 			return
 		}
 	}
 
-	// Update the ride status to "cancelled"
-	update := bson.M{
-		"$set": bson.M{
-			"status":       "cancelled",
-			"cancelled_by": userID, // Store the user who cancelled the ride
-			"cancelled_at": time.Now(),
-			"reason":       req.Reason, // Add reason if provided
-		},
-	}
+	// The fee is decided on the state read above, so the transition only matches while
+	// the ride is still in that status and the driver's arrival is as read; a
+	// concurrent acceptance or arrival makes it fail instead of charging the wrong fee
+	now := time.Now()
+	fee, rule := h.Cancellation.CancellationFee(ride, cancelledBy, now)
+	arrived := !ride.ArrivedAt.IsZero()
+	asRead := store.RideMatch{Statuses: []string{ride.Status}, Arrived: &arrived}
 
-	// Perform the update in the database
-	_, err = rideColl.UpdateByID(c, objID, update)
+	// Update the ride status to "cancelled". A fee claims the payment in the same
+	// update, so the rider cannot start another payment of it meanwhile.
+	set := bson.M{
+		"cancelled_by":         cancelledBy,
+		"cancelled_by_user_id": userObjID, // Store the user who cancelled the ride
+		"cancelled_at":         now,
+		"reason":               req.Reason, // Add reason if provided
+		"cancellation_fee":     fee,
+		"cancellation_rule":    rule,
+	}
+	if fee > 0 {
+		set["payment_status"] = PaymentPending
+	}
+	cancelled, err := h.transitionRideWhere(c, objID, asRead, RideCancelled, set)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel the ride"})
+		respondTransitionError(c, err, "Failed to cancel the ride")
 		return
 	}
 
-	// Send a notification to the rider
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
-		Type:    "ride_cancelled",
-		UserID:  ride.RiderID.Hex(), // Notify the rider
-		Payload: gin.H{"ride_id": rideID, "message": "Your ride has been cancelled."},
+	// Charge the fee right away; the rider confirms the intent like a fare's. If it
+	// cannot be created, the claim is released and the rider pays through /pay.
+	var payment gin.H
+	if fee > 0 {
+		claimed := *cancelled
+		claimed.PaymentStatus = PaymentUnpaid // What the claim replaced
+		pi, err := h.startPayment(c, &claimed, fee, middleware.IdempotencyKey(c))
+		if err != nil {
+			log.Println("Failed to charge the cancellation fee of ride", rideID, err)
+		} else {
+			payment = gin.H{"client_secret": pi.ClientSecret, "payment_id": pi.ID}
+		}
 	}
 
-	// Get the driver’s user_id by looking up the driver in the drivers collection
-	driverColl := db.GetCollection("drivers")
-	var driver models.Driver
-	err = driverColl.FindOne(c, bson.M{"_id": ride.DriverID}).Decode(&driver)
-	if err != nil {
-		fmt.Println("Driver not found or error fetching driver details:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error finding driver for notification"})
-		return
+	// Send a notification to the rider
+	h.Hub.Broadcast <- websockets.Notification{
+		Type:   "ride_cancelled",
+		UserID: ride.RiderID.Hex(), // Notify the rider
+		Payload: gin.H{
+			"ride_id":           rideID,
+			"message":           "Your ride has been cancelled.",
+			"cancelled_by":      cancelledBy,
+			"cancellation_fee":  fee, // Charged in the response to the rider's cancel request
+			"cancellation_rule": rule,
+		},
 	}
 
-	// Now that we have the driver's user_id, send the notification to the driver
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
-		Type:    "ride_cancelled",
-		UserID:  driver.UserID.Hex(), // Use the user_id from the drivers collection
-		Payload: gin.H{"ride_id": rideID, "message": "The ride has been cancelled."},
+	// A ride still searching has no driver to tell
+	if !ride.DriverID.IsZero() {
+		// Get the driver’s user_id by looking up the driver in the drivers collection
+		driver, err := h.Store.Drivers.FindByID(c, ride.DriverID)
+		if err != nil {
+			fmt.Println("Driver not found or error fetching driver details:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error finding driver for notification"})
+			return
+		}
+
+		h.Tracker.Forget(driver.UserID.Hex())
+		h.Tracker.DropTrip(ride.ID) // A ride cancelled while ongoing is not priced by distance
+		if err := h.setDriverAvailable(c, driver.ID, true); err != nil {
+			fmt.Println("Failed to release driver of cancelled ride", rideID, err)
+		}
+
+		// Now that we have the driver's user_id, send the notification to the driver
+		h.Hub.Broadcast <- websockets.Notification{
+			Type:   "ride_cancelled",
+			UserID: driver.UserID.Hex(), // Use the user_id from the drivers collection
+			Payload: gin.H{
+				"ride_id":           rideID,
+				"message":           "The ride has been cancelled.",
+				"cancelled_by":      cancelledBy,
+				"cancellation_fee":  fee,
+				"cancellation_rule": rule,
+			},
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Ride cancelled"})
+	c.JSON(http.StatusOK, gin.H{
+		"message":           "Ride cancelled",
+		"cancellation_fee":  fee,
+		"cancellation_rule": rule,
+		"payment":           payment,
+	})
 }
 
-func SubmitFeedback(c *gin.Context) {
+func (h *RideHandler) SubmitFeedback(c *gin.Context) {
 	var req struct {
 		Rating  int    `json:"rating" binding:"required,min=1,max=5"`
 		Comment string `json:"comment"`
@@ -495,28 +596,39 @@ func SubmitFeedback(c *gin.Context) {
 		CreatedAt: time.Now(),
 	}
 
-	// Insert feedback into the "feedback" collection in MongoDB
-	feedbackColl := db.GetCollection("feedback")
-	_, err = feedbackColl.InsertOne(c, feedback)
+	exists, err := h.Store.Feedback.Exists(c, objID, userObjID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit feedback"})
 		return
 	}
+	if exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You have already submitted feedback for this ride"})
+		return
+	}
 
-	existingFeedback := feedbackColl.FindOne(c, bson.M{
-		"ride_id": objID,
-		"user_id": userObjID,
-	})
-	if existingFeedback.Err() == nil {
+	// Store the feedback
+	err = h.Store.Feedback.Insert(c, &feedback)
+	if errors.Is(err, store.ErrDuplicate) { // Lost a race with a concurrent submission
 		c.JSON(http.StatusBadRequest, gin.H{"error": "You have already submitted feedback for this ride"})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit feedback"})
+		return
+	}
+
+	// A rider's rating counts towards the driver's average used for matching
+	if ride, err := h.Store.Rides.FindByID(c, objID); err == nil && ride.RiderID == userObjID {
+		if err := h.Store.Drivers.AddRating(c, ride.DriverID, req.Rating); err != nil {
+			fmt.Println("⚠️ Failed to update driver rating:", err)
+		}
+	}
 
 	// Respond with success message
 	c.JSON(http.StatusOK, gin.H{"message": "Feedback submitted"})
 }
 
-func CompleteRide(c *gin.Context) {
+func (h *RideHandler) CompleteRide(c *gin.Context) {
 	rideID := c.Param("ride_id") // Ride ID passed as a URL parameter
 
 	// Extract JWT token from header
@@ -533,7 +645,7 @@ func CompleteRide(c *gin.Context) {
 	}
 
 	// Validate the token and extract claims
-	claims, err := auth.ValidateToken(tokenString)
+	claims, err := h.Tokens.ValidateToken(tokenString)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 		return
@@ -547,18 +659,14 @@ func CompleteRide(c *gin.Context) {
 	}
 
 	// Get ride details from the database
-	rideColl := db.GetCollection("rides")
-	var ride models.Ride
-	err = rideColl.FindOne(c, bson.M{"_id": rideObjID}).Decode(&ride)
+	ride, err := h.Store.Rides.FindByID(c, rideObjID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
 		return
 	}
 
 	// Fetch the driver details from the drivers table using the driver_id in the ride
-	driverColl := db.GetCollection("drivers")
-	var driver models.Driver
-	err = driverColl.FindOne(c, bson.M{"_id": ride.DriverID}).Decode(&driver)
+	driver, err := h.Store.Drivers.FindByID(c, ride.DriverID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Driver not found"})
 		return
@@ -570,37 +678,89 @@ func CompleteRide(c *gin.Context) {
 		return
 	}
 
-	// Update the ride status to "completed"
-	update := bson.M{
-		"$set": bson.M{
-			"status":       "completed",
-			"completed_at": time.Now(),
-		},
+	// Only an ongoing ride can complete; check before pricing ends the trip's tracking
+	if !CanTransitionRide(ride.Status, RideCompleted) {
+		respondTransitionError(c, &TransitionError{RideID: rideObjID, Field: "status", Status: ride.Status, From: ride.Status, To: RideCompleted}, "")
+		return
+	}
+
+	// Price the trip actually made; the estimate stands if that fails
+	completedAt := time.Now()
+	set := bson.M{"completed_at": completedAt}
+	if ride.EstimatedFare == 0 { // Requested before estimates were kept apart
+		set["estimated_fare"], set["estimated_fare_breakdown"] = ride.Fare, ride.FareBreakdown
+	}
+	if final, err := h.finalFare(c, ride, completedAt); err != nil {
+		log.Println("Failed to calculate the final fare, charging the estimate:", err)
+	} else {
+		set["fare"], set["fare_breakdown"] = final.Total, final
 	}
 
-	_, err = rideColl.UpdateByID(c, rideObjID, update)
+	// Update the ride status to "completed"; only an ongoing ride can complete
+	ride, err = h.transitionRide(c, rideObjID, RideCompleted, set)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete the ride"})
+		respondTransitionError(c, err, "Failed to complete the ride")
 		return
 	}
 
-	// Send a notification to the rider and driver about the ride completion
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
+	h.Tracker.Forget(driver.UserID.Hex())
+
+	fare := gin.H{
+		"estimated_fare":  ride.EstimatedFare,
+		"fare":            ride.Fare,
+		"fare_difference": math.Round((ride.Fare-ride.EstimatedFare)*100) / 100,
+		"breakdown":       ride.FareBreakdown,
+	}
+
+	// Send a notification to the rider and driver about the ride completion; the
+	// rider sees the final fare before paying
+	h.Hub.Broadcast <- websockets.Notification{
 		Type:    "ride_completed",
 		UserID:  ride.RiderID.Hex(), // Notify the rider
-		Payload: gin.H{"ride_id": rideObjID.Hex()},
+		Payload: gin.H{"ride_id": rideObjID.Hex(), "fare": fare},
 	}
 
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
+	h.Hub.Broadcast <- websockets.Notification{
 		Type:    "ride_completed",
 		UserID:  driver.UserID.Hex(), // Notify the driver
 		Payload: gin.H{"ride_id": rideObjID.Hex()},
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Ride completed"})
+	c.JSON(http.StatusOK, gin.H{"message": "Ride completed", "fare": fare})
 }
 
-func HandlePayment(c *gin.Context) {
+// minRecordedTripKm is the least recorded distance trusted over the planned route
+const minRecordedTripKm = 0.05
+
+// finalFare prices the trip recorded for an ongoing ride ending at completedAt.
+// Without enough location updates the planned distance is charged.
+func (h *RideHandler) finalFare(ctx context.Context, ride *models.Ride, completedAt time.Time) (*models.FareBreakdown, error) {
+	if err := h.Tracker.EndTrip(ctx, ride.ID); err != nil {
+		return nil, err
+	}
+	ride, err := h.Store.Rides.FindByID(ctx, ride.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	trip := services.Trip{Distance: ride.TripDistance}
+	if trip.Distance < minRecordedTripKm {
+		trip.Distance = ride.Distance
+	}
+	if ride.StartedAt.IsZero() {
+		if estimate := ride.EstimatedFareBreakdown; estimate != nil {
+			trip.Duration = estimate.DurationMin
+		}
+	} else {
+		trip.Duration = completedAt.Sub(ride.StartedAt).Minutes()
+	}
+	if !ride.ArrivedAt.IsZero() && ride.StartedAt.After(ride.ArrivedAt) {
+		trip.Waiting = ride.StartedAt.Sub(ride.ArrivedAt).Minutes()
+	}
+	return h.Pricing.FinalFare(ctx, ride, trip)
+}
+
+func (h *RideHandler) HandlePayment(c *gin.Context) {
 	rideID := c.Param("ride_id")
 	userID := c.GetString("user_id")
 
@@ -612,9 +772,8 @@ func HandlePayment(c *gin.Context) {
 	}
 
 	// Get ride details
-	rideColl := db.GetCollection("rides")
-	var ride models.Ride
-	if err := rideColl.FindOne(c, bson.M{"_id": rideObjID}).Decode(&ride); err != nil {
+	ride, err := h.Store.Rides.FindByID(c, rideObjID)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
 		return
 	}
@@ -625,105 +784,81 @@ func HandlePayment(c *gin.Context) {
 		return
 	}
 
-	// Check if the ride has already been paid for (check payment_status)
-	if ride.PaymentStatus != "" { // If the payment_status is not empty, payment has already been made
-		c.JSON(http.StatusConflict, gin.H{"error": "Payment already made for this ride"})
+	// Only a completed ride, or a cancelled one with a fee, that has not been paid
+	// for can request a payment
+	amount := amountDue(ride)
+	if amount <= 0 || !CanTransitionPayment(ride.PaymentStatus, PaymentPending) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          "Ride is not awaiting payment",
+			"current_status": ride.Status,
+			"payment_status": ride.PaymentStatus,
+		})
 		return
 	}
 
-	// Check if payment already exists in the payments collection
-	paymentColl := db.GetCollection("payments")
-	var existingPayment models.Payment
-	err = paymentColl.FindOne(c, bson.M{"ride_id": rideObjID}).Decode(&existingPayment)
-	if err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "Payment already exists for this ride"})
+	// Get the driver and the user account behind it before charging anything, so a
+	// failed lookup leaves no intent behind
+	_, driverUser, err := h.driverAndUser(c, ride.DriverID)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Driver not found"})
 		return
 	}
-
-	if ride.Fare < 50 {
-		ride.Fare = 50 // Set the fare to ₹50 if it's less than ₹50
-	}
-
-	// Create Stripe Payment Intent
-	params := &stripe.PaymentIntentParams{
-		Amount:             stripe.Int64(int64(ride.Fare * 100)), // Convert to cents
-		Currency:           stripe.String(string(stripe.CurrencyINR)),
-		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
-	}
-
-	// Add metadata using the AddMetadata method
-	params.AddMetadata("ride_id", rideID)
-	params.AddMetadata("user_id", userID)
-
-	pi, err := paymentintent.New(params)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment intent"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up the driver"})
 		return
 	}
 
-	// Save payment record
-	payment := models.Payment{
-		RideID:        rideObjID,
-		Amount:        ride.Fare,
-		Currency:      "INR",
-		PaymentIntent: pi.ID,
-		Status:        "requires_payment_method",
-		CreatedAt:     time.Now(),
-	}
-
-	if _, err := paymentColl.InsertOne(c, payment); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save payment record"})
+	// Move the ride payment status to "pending" before creating anything, so of two
+	// concurrent requests only one gets to charge the rider
+	if err := h.claimPayment(c, ride); err != nil {
+		respondTransitionError(c, err, "Failed to update ride payment status")
 		return
 	}
 
-	// Update the ride payment status to "pending" or similar, indicating payment is requested
-	updateRideResult, err := rideColl.UpdateOne(
-		c,
-		bson.M{"_id": rideObjID},
-		bson.M{
-			"$set": bson.M{
-				"payment_status": "pending",
-			},
-		},
-	)
-	if err != nil || updateRideResult.MatchedCount == 0 {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update ride payment status"})
+	// Check if a live payment already exists for the ride
+	_, err = h.Store.Payments.FindLiveByRide(c, rideObjID)
+	if err == nil {
+		h.releasePayment(c, ride)
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment already exists for this ride"})
 		return
 	}
-
-	// Get the driver's details from the drivers collection
-	driverColl := db.GetCollection("drivers")
-	var driver models.Driver
-	if err := driverColl.FindOne(c, bson.M{"_id": ride.DriverID}).Decode(&driver); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Driver not found"})
+	if !errors.Is(err, store.ErrNotFound) {
+		h.releasePayment(c, ride)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check existing payments"})
 		return
 	}
 
-	// Now, retrieve the actual user's details from the users collection using the driver.user_id
-	userColl := db.GetCollection("users")
-	var driverUser models.User
-	if err := userColl.FindOne(c, bson.M{"_id": driver.UserID}).Decode(&driverUser); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Driver user not found"})
+	// Create the payment intent with the gateway and record it
+	pi, err := h.startPayment(c, ride, amount, middleware.IdempotencyKey(c))
+	switch {
+	case errors.Is(err, payments.ErrUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payment provider unavailable, try again"})
+		return
+	case errors.Is(err, store.ErrDuplicate):
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment already exists for this ride"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create the payment"})
 		return
 	}
 
 	// Send WebSocket notifications to the rider and driver about the payment request
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
+	h.Hub.Broadcast <- websockets.Notification{
 		Type:   "payment_requested",
 		UserID: ride.RiderID.Hex(), // Notify the rider
 		Payload: gin.H{
 			"ride_id":  rideObjID.Hex(),
-			"amount":   ride.Fare,
+			"amount":   amount,
 			"currency": "INR",
 		},
 	}
 
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
+	h.Hub.Broadcast <- websockets.Notification{
 		Type:   "payment_requested",
 		UserID: driverUser.ID.Hex(), // Notify the driver
 		Payload: gin.H{
 			"ride_id":  rideObjID.Hex(),
-			"amount":   ride.Fare,
+			"amount":   amount,
 			"currency": "INR",
 		},
 	}
@@ -732,12 +867,12 @@ func HandlePayment(c *gin.Context) {
 	c.JSON(http.StatusCreated, gin.H{
 		"client_secret": pi.ClientSecret,
 		"payment_id":    pi.ID,
-		"amount":        ride.Fare,
+		"amount":        amount,
 		"currency":      "INR",
 	})
 }
 
-func ConfirmPayment(c *gin.Context) {
+func (h *RideHandler) ConfirmPayment(c *gin.Context) {
 	rideID := c.Param("ride_id")
 	var req struct {
 		PaymentIntentID string `json:"payment_intent_id" binding:"required"`
@@ -748,119 +883,68 @@ func ConfirmPayment(c *gin.Context) {
 		return
 	}
 
-	// Get payment intent details from Stripe
-	pi, err := paymentintent.Get(req.PaymentIntentID, nil)
+	rideObjID, err := primitive.ObjectIDFromHex(rideID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment intent"})
-		return
-	}
-
-	// Verify payment succeeded
-	if pi.Status != stripe.PaymentIntentStatusSucceeded {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Payment not completed"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Ride ID"})
 		return
 	}
 
-	// Update payment record
-	paymentColl := db.GetCollection("payments")
-	update := bson.M{
-		"$set": bson.M{
-			"status":       "succeeded",
-			"completed_at": time.Now(),
-		},
-	}
-
-	_, err = paymentColl.UpdateOne(c,
-		bson.M{"payment_intent": req.PaymentIntentID},
-		update,
-	)
+	ride, err := h.Store.Rides.FindByID(c, rideObjID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update payment status"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
 		return
 	}
 
-	// Update ride status
-	rideColl := db.GetCollection("rides")
-	rideObjID, err := primitive.ObjectIDFromHex(rideID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Ride ID"})
+	// Verify user is the rider
+	if ride.RiderID.Hex() != c.GetString("user_id") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only rider can confirm payment for this ride"})
 		return
 	}
 
-	// Retrieve the ride from the rides collection
-	var ride models.Ride
-	if err := rideColl.FindOne(c, bson.M{"_id": rideObjID}).Decode(&ride); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
+	// Get payment intent details from the gateway
+	pi, err := h.Payments.GetIntent(req.PaymentIntentID)
+	if errors.Is(err, payments.ErrUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payment provider unavailable, try again"})
 		return
 	}
-
-	// Now, we update the ride status and payment status
-	_, err = rideColl.UpdateOne(c,
-		bson.M{"_id": rideObjID},
-		bson.M{"$set": bson.M{
-			"payment_status": "paid",
-			"status":         "completed",
-		}},
-	)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update ride status"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment intent"})
 		return
 	}
 
-	// Retrieve the driver's user details from the drivers collection
-	driverColl := db.GetCollection("drivers")
-	var driver models.Driver
-	if err := driverColl.FindOne(c, bson.M{"_id": ride.DriverID}).Decode(&driver); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Driver not found"})
+	// The intent must have been created for this ride
+	if pi.Metadata["ride_id"] != rideID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payment intent does not belong to this ride"})
 		return
 	}
 
-	// Get the user details of the driver from the users collection
-	userColl := db.GetCollection("users")
-	var driverUser models.User
-	if err := userColl.FindOne(c, bson.M{"_id": driver.UserID}).Decode(&driverUser); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Driver user not found"})
+	// Verify payment succeeded
+	if pi.Status != payments.StatusSucceeded {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payment not completed"})
 		return
 	}
 
-	// Now, update the driver's availability status
-	_, err = driverColl.UpdateOne(c,
-		bson.M{"_id": driver.ID},
-		bson.M{"$set": bson.M{
-			"is_available": true, // Set the driver as available
-		}},
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update driver's availability"})
+	// Record the payment and mark the ride as paid; the ride must already be
+	// completed with a pending payment, unless the webhook got there first
+	_, err = h.markPaid(c, rideObjID, pi.ID)
+	var te *TransitionError
+	switch {
+	case errors.As(err, &te) && te.From == PaymentPaid:
+		c.JSON(http.StatusOK, gin.H{"message": "Payment already confirmed"})
+		return
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	case err != nil:
+		respondTransitionError(c, err, "Failed to update ride status")
 		return
-	}
-
-	// Send WebSocket notifications to the rider and driver about the payment confirmation
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
-		Type:   "payment_confirmed",
-		UserID: ride.RiderID.Hex(),
-		Payload: gin.H{
-			"ride_id":  rideObjID.Hex(),
-			"amount":   ride.Fare,
-			"currency": "INR",
-		},
-	}
-
-	websockets.WS_HUB.Broadcast <- websockets.Notification{
-		Type:   "payment_confirmed",
-		UserID: driverUser.ID.Hex(),
-		Payload: gin.H{
-			"ride_id":  rideObjID.Hex(),
-			"amount":   ride.Fare,
-			"currency": "INR",
-		},
 	}
 
 	// Respond with the success message
 	c.JSON(http.StatusOK, gin.H{"message": "Payment confirmed successfully"})
 }
 
-func GetRideDetails(c *gin.Context) {
+func (h *RideHandler) GetRideDetails(c *gin.Context) {
 	rideID := c.Param("ride_id")
 
 	// Convert rideID and userID to ObjectID
@@ -869,9 +953,7 @@ func GetRideDetails(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Ride ID"})
 		return
 	}
-	rideColl := db.GetCollection("rides")
-	var ride models.Ride
-	err = rideColl.FindOne(c, bson.M{"_id": rideObjID}).Decode(&ride)
+	ride, err := h.Store.Rides.FindByID(c, rideObjID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Ride not found"})
 		return
@@ -885,7 +967,12 @@ func GetRideDetails(c *gin.Context) {
 		"destination":    ride.EndLocation,
 		"status":         ride.Status,
 		"fare":           ride.Fare,
+		"fare_breakdown": ride.FareBreakdown, // Null for rides priced before fare cards
+		"estimated_fare": ride.EstimatedFare, // Fare quoted at request; Fare is final once completed
 		"payment_status": ride.PaymentStatus, // Paid, Pending
 		"created_at":     ride.CreatedAt,
+
+		"cancellation_fee":  ride.CancellationFee, // Owed instead of the fare when cancelled
+		"cancellation_rule": ride.CancellationRule,
 	})
 }
@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"uber-clone/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SurgeHandler serves the surge heatmap
+type SurgeHandler struct {
+	Zones *services.SurgeZones
+}
+
+// GetSurge returns the surge multiplier at ?lat=&lng= and the zones around it
+func (h *SurgeHandler) GetSurge(c *gin.Context) {
+	lat, errLat := strconv.ParseFloat(c.Query("lat"), 64)
+	lng, errLng := strconv.ParseFloat(c.Query("lng"), 64)
+	if errLat != nil || errLng != nil || (LocationUpdate{Lat: lat, Lng: lng}).Validate() != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "lat and lng must be valid coordinates"})
+		return
+	}
+
+	zones, computedAt := h.Zones.Around(lat, lng)
+	c.JSON(http.StatusOK, gin.H{
+		"surge":       h.Zones.At(lat, lng),
+		"zones":       zones,
+		"computed_at": computedAt,
+	})
+}
@@ -0,0 +1,370 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"uber-clone/algo"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LocationUpdate is a position report pushed by a driver over the WebSocket
+type LocationUpdate struct {
+	Lat     float64 `json:"lat" binding:"min=-90,max=90"`
+	Lng     float64 `json:"lng" binding:"min=-180,max=180"`
+	Heading float64 `json:"heading"` // Degrees clockwise from north
+	Speed   float64 `json:"speed"`   // km/h
+}
+
+var errInvalidLocation = errors.New("lat must be within [-90, 90] and lng within [-180, 180]")
+
+// Validate checks the coordinates are on the globe
+func (u LocationUpdate) Validate() error {
+	if u.Lat < -90 || u.Lat > 90 || u.Lng < -180 || u.Lng > 180 {
+		return errInvalidLocation
+	}
+	return nil
+}
+
+// Movement below odometerStepKm between updates is treated as GPS jitter, and a
+// driver within arrivalRadiusKm of the pickup has arrived
+const (
+	odometerStepKm  = 0.02
+	arrivalRadiusKm = 0.1
+)
+
+// LocationTracker keeps the latest position of every driver. Riders get each update
+// straight away; the drivers collection is written at most once per flush interval.
+// It also measures the distance of ongoing rides from the updates, for the final fare.
+type LocationTracker struct {
+	store         *store.Store
+	hub           *websockets.Hub
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	latest  map[string]trackedLocation // keyed by driver user ID
+	rides   map[string]activeRide      // keyed by driver user ID
+	rideTTL time.Duration
+
+	odometers map[primitive.ObjectID]*odometer // keyed by ride ID
+}
+
+// odometer sums the distance of an ongoing ride; pending is not yet in the store.
+// flushing is closed once a flush has finished writing the distance it took.
+type odometer struct {
+	lastLat, lastLng float64
+	pending          float64
+	flushing         chan struct{}
+}
+
+type trackedLocation struct {
+	LocationUpdate
+	At    time.Time
+	dirty bool
+	gone  bool // The driver disconnected; dropped once the position is written
+}
+
+// activeRide caches which rider a driver's updates should be relayed to
+type activeRide struct {
+	driverID primitive.ObjectID
+	rideID   primitive.ObjectID
+	riderID  primitive.ObjectID
+	status   string
+	pickup   []float64 // lng, lat
+	arrived  bool
+	expires  time.Time
+}
+
+// NewLocationTracker returns an empty tracker that writes positions every flushInterval
+// once Run is called
+func NewLocationTracker(st *store.Store, hub *websockets.Hub, flushInterval time.Duration) *LocationTracker {
+	return &LocationTracker{
+		store:         st,
+		hub:           hub,
+		flushInterval: flushInterval,
+		latest:        make(map[string]trackedLocation),
+		rides:         make(map[string]activeRide),
+		rideTTL:       10 * time.Second,
+		odometers:     make(map[primitive.ObjectID]*odometer),
+	}
+}
+
+// Update records a driver's position and relays it to the rider of their active ride
+func (t *LocationTracker) Update(driverUserID string, u LocationUpdate) error {
+	if err := u.Validate(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	t.latest[driverUserID] = trackedLocation{LocationUpdate: u, At: now, dirty: true}
+	t.mu.Unlock()
+	t.hub.Locate <- websockets.Location{UserID: driverUserID, Lat: u.Lat, Lng: u.Lng} // For area broadcasts
+
+	active, err := t.activeRide(driverUserID)
+	if err != nil || active.rideID.IsZero() {
+		return err
+	}
+
+	switch active.status {
+	case RideOngoing:
+		t.advanceOdometer(active.rideID, u.Lat, u.Lng)
+	case RideAccepted:
+		t.checkArrival(driverUserID, active, u, now)
+	}
+
+	t.hub.Broadcast <- websockets.Notification{
+		Type:      "driver_location",
+		UserID:    active.riderID.Hex(),
+		Ephemeral: true, // Too frequent to keep; the next update supersedes it
+		Payload: gin.H{
+			"ride_id":   active.rideID.Hex(),
+			"driver_id": active.driverID.Hex(),
+			"lat":       u.Lat,
+			"lng":       u.Lng,
+			"heading":   u.Heading,
+			"speed":     u.Speed,
+			"timestamp": now,
+		},
+	}
+	return nil
+}
+
+// advanceOdometer adds the distance from the last counted position of the ride
+func (t *LocationTracker) advanceOdometer(rideID primitive.ObjectID, lat, lng float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	odo, ok := t.odometers[rideID]
+	if !ok {
+		t.odometers[rideID] = &odometer{lastLat: lat, lastLng: lng}
+		return
+	}
+	km := algo.CalculateVincentyDistance(odo.lastLat, odo.lastLng, lat, lng)
+	if km < odometerStepKm {
+		return
+	}
+	odo.pending += km
+	odo.lastLat, odo.lastLng = lat, lng
+}
+
+// checkArrival records when the driver of an accepted ride reaches the pickup, which
+// starts the waiting time
+func (t *LocationTracker) checkArrival(driverUserID string, active activeRide, u LocationUpdate, now time.Time) {
+	if active.arrived || len(active.pickup) != 2 {
+		return
+	}
+	if algo.CalculateVincentyDistance(u.Lat, u.Lng, active.pickup[1], active.pickup[0]) > arrivalRadiusKm {
+		return
+	}
+
+	t.mu.Lock()
+	if cached, ok := t.rides[driverUserID]; ok && cached.rideID == active.rideID {
+		cached.arrived = true
+		t.rides[driverUserID] = cached
+	}
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := t.store.Rides.Update(ctx, active.rideID, store.RideMatch{Statuses: []string{RideAccepted}}, bson.M{"arrived_at": now})
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Println("Failed to record driver arrival:", err)
+		}
+		return
+	}
+
+	t.hub.Broadcast <- websockets.Notification{
+		Type:   "driver_arrived",
+		UserID: active.riderID.Hex(),
+		Payload: gin.H{
+			"ride_id":   active.rideID.Hex(),
+			"driver_id": active.driverID.Hex(),
+			"timestamp": now,
+		},
+	}
+}
+
+// EndTrip writes the distance still pending for a ride and stops measuring it. Call
+// it before pricing the ride from its recorded trip. It waits for a flush already
+// writing part of the distance, so the ride is never priced without it.
+func (t *LocationTracker) EndTrip(ctx context.Context, rideID primitive.ObjectID) error {
+	t.mu.Lock()
+	odo, ok := t.odometers[rideID]
+	for ok && odo.flushing != nil {
+		flushing := odo.flushing
+		t.mu.Unlock()
+		select {
+		case <-flushing:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		t.mu.Lock()
+		odo, ok = t.odometers[rideID]
+	}
+	delete(t.odometers, rideID)
+	t.mu.Unlock()
+	if !ok || odo.pending == 0 {
+		return nil
+	}
+	return t.store.Rides.AddTripDistance(ctx, rideID, odo.pending)
+}
+
+// DropTrip stops measuring a ride without recording the distance, e.g. when it is
+// cancelled. A flush already writing part of it finishes on its own.
+func (t *LocationTracker) DropTrip(rideID primitive.ObjectID) {
+	t.mu.Lock()
+	delete(t.odometers, rideID)
+	t.mu.Unlock()
+}
+
+// Disconnect forgets a driver whose connection closed. Their last position is still
+// written by the next flush if it has not been yet.
+func (t *LocationTracker) Disconnect(driverUserID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.rides, driverUserID)
+	loc, ok := t.latest[driverUserID]
+	if !ok {
+		return
+	}
+	if !loc.dirty {
+		delete(t.latest, driverUserID)
+		return
+	}
+	loc.gone = true
+	t.latest[driverUserID] = loc
+}
+
+// Forget drops the cached ride of a driver so the next update looks it up again,
+// e.g. after the ride is accepted, completed or cancelled
+func (t *LocationTracker) Forget(driverUserID string) {
+	t.mu.Lock()
+	delete(t.rides, driverUserID)
+	t.mu.Unlock()
+}
+
+// activeRide returns the accepted or ongoing ride of a driver, cached for rideTTL.
+// A zero rideID means the driver is not on a ride.
+func (t *LocationTracker) activeRide(driverUserID string) (activeRide, error) {
+	t.mu.Lock()
+	cached, ok := t.rides[driverUserID]
+	t.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	userID, err := primitive.ObjectIDFromHex(driverUserID)
+	if err != nil {
+		return activeRide{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	driver, err := t.store.Drivers.FindByUserID(ctx, userID)
+	if err != nil {
+		return activeRide{}, err
+	}
+
+	active := activeRide{driverID: driver.ID, expires: time.Now().Add(t.rideTTL)}
+	ride, err := t.store.Rides.FindActiveByDriver(ctx, driver.ID)
+	switch {
+	case err == nil:
+		active.rideID, active.riderID, active.status = ride.ID, ride.RiderID, ride.Status
+		active.pickup = ride.StartLocation.Coordinates
+		active.arrived = !ride.ArrivedAt.IsZero()
+	case !errors.Is(err, store.ErrNotFound):
+		return activeRide{}, err
+	}
+
+	t.mu.Lock()
+	t.rides[driverUserID] = active
+	t.mu.Unlock()
+	return active, nil
+}
+
+// Run writes pending positions to the drivers collection every LOCATION_FLUSH_INTERVAL
+func (t *LocationTracker) Run() {
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.flush()
+	}
+}
+
+func (t *LocationTracker) flush() {
+	t.mu.Lock()
+	var fixes []store.LocationFix
+	for userID, loc := range t.latest {
+		if !loc.dirty {
+			continue
+		}
+		uid, err := primitive.ObjectIDFromHex(userID)
+		if err != nil {
+			delete(t.latest, userID)
+			continue
+		}
+		fixes = append(fixes, store.LocationFix{
+			UserID:  uid,
+			Lat:     loc.Lat,
+			Lng:     loc.Lng,
+			Heading: loc.Heading,
+			Speed:   loc.Speed,
+			At:      loc.At,
+		})
+		if loc.gone {
+			delete(t.latest, userID)
+			continue
+		}
+		loc.dirty = false
+		t.latest[userID] = loc
+	}
+	// The odometers are kept rather than looked up again, as DropTrip may remove
+	// them while the distance is being written
+	taken := make(map[primitive.ObjectID]*odometer)
+	distances := make(map[primitive.ObjectID]float64)
+	for rideID, odo := range t.odometers {
+		if odo.pending > 0 && odo.flushing == nil {
+			taken[rideID] = odo
+			distances[rideID] = odo.pending
+			odo.pending = 0
+			odo.flushing = make(chan struct{})
+		}
+	}
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for rideID, km := range distances {
+		err := t.store.Rides.AddTripDistance(ctx, rideID, km)
+		t.mu.Lock()
+		odo := taken[rideID]
+		if errors.Is(err, store.ErrNotFound) {
+			if t.odometers[rideID] == odo {
+				delete(t.odometers, rideID) // No longer ongoing
+			}
+		} else if err != nil {
+			log.Println("Failed to persist trip distance:", err)
+			odo.pending += km // Retry on the next flush, or in EndTrip
+		}
+		close(odo.flushing)
+		odo.flushing = nil
+		t.mu.Unlock()
+	}
+
+	if len(fixes) == 0 {
+		return
+	}
+	if err := t.store.Drivers.UpdateLocations(ctx, fixes); err != nil {
+		log.Println("Failed to persist driver locations:", err)
+	}
+}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"uber-clone/auth"
+	"uber-clone/models"
+	"uber-clone/store"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// slowRides holds up AddTripDistance until release is closed
+type slowRides struct {
+	store.RideRepo
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *slowRides) AddTripDistance(ctx context.Context, id primitive.ObjectID, km float64) error {
+	select {
+	case r.started <- struct{}{}:
+		<-r.release
+	default: // Only the first write is slow
+	}
+	return r.RideRepo.AddTripDistance(ctx, id, km)
+}
+
+func TestEndTripWaitsForFlush(t *testing.T) {
+	st := store.NewMemoryStore()
+	rides := &slowRides{RideRepo: st.Rides, started: make(chan struct{}), release: make(chan struct{})}
+	st.Rides = rides
+	ctx := context.Background()
+	ride := &models.Ride{RiderID: primitive.NewObjectID(), Status: RideOngoing}
+	if err := st.Rides.Insert(ctx, ride); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := NewLocationTracker(st, nil, time.Minute)
+	tracker.odometers[ride.ID] = &odometer{pending: 1.5}
+	go tracker.flush()
+	<-rides.started // The flush has taken the 1.5 km and is writing it
+
+	tracker.mu.Lock()
+	tracker.odometers[ride.ID].pending = 0.5 // Counted since the flush began
+	tracker.mu.Unlock()
+
+	ended := make(chan error, 1)
+	go func() { ended <- tracker.EndTrip(ctx, ride.ID) }()
+	select {
+	case err := <-ended:
+		t.Fatalf("EndTrip returned %v while the flush was still writing", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(rides.release)
+	if err := <-ended; err != nil {
+		t.Fatal(err)
+	}
+	got, _ := st.Rides.FindByID(ctx, ride.ID)
+	if got.TripDistance != 2 {
+		t.Fatalf("trip distance %v when priced, want 2", got.TripDistance)
+	}
+}
+
+func TestEndTripGivesUpWithContext(t *testing.T) {
+	st := store.NewMemoryStore()
+	tracker := NewLocationTracker(st, nil, time.Minute)
+	rideID := primitive.NewObjectID()
+	tracker.odometers[rideID] = &odometer{flushing: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tracker.EndTrip(ctx, rideID); err != context.DeadlineExceeded {
+		t.Fatalf("EndTrip = %v, want the context's error", err)
+	}
+}
+
+func TestDropTripDuringFlush(t *testing.T) {
+	st := store.NewMemoryStore()
+	rides := &slowRides{RideRepo: st.Rides, started: make(chan struct{}), release: make(chan struct{})}
+	st.Rides = rides
+	ride := &models.Ride{RiderID: primitive.NewObjectID(), Status: RideOngoing}
+	if err := st.Rides.Insert(context.Background(), ride); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := NewLocationTracker(st, nil, time.Minute)
+	tracker.odometers[ride.ID] = &odometer{pending: 1.5}
+	flushed := make(chan struct{})
+	go func() { tracker.flush(); close(flushed) }()
+	<-rides.started
+
+	tracker.DropTrip(ride.ID) // Cancelled while the flush is writing
+	close(rides.release)
+	<-flushed
+
+	if len(tracker.odometers) != 0 {
+		t.Fatalf("odometers %v after the ride was dropped", tracker.odometers)
+	}
+}
+
+func TestDisconnectEvictsDriver(t *testing.T) {
+	st := store.NewMemoryStore()
+	tracker := NewLocationTracker(st, nil, time.Minute)
+	written, idle := primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()
+	tracker.latest[written] = trackedLocation{dirty: true}
+	tracker.latest[idle] = trackedLocation{}
+	tracker.rides[written] = activeRide{}
+
+	tracker.Disconnect(written)
+	tracker.Disconnect(idle)
+	if _, ok := tracker.rides[written]; ok {
+		t.Fatal("cached ride kept after disconnect")
+	}
+	if _, ok := tracker.latest[idle]; ok {
+		t.Fatal("written position kept after disconnect")
+	}
+	if _, ok := tracker.latest[written]; !ok {
+		t.Fatal("unwritten position dropped before the flush")
+	}
+
+	tracker.flush()
+	if len(tracker.latest) != 0 {
+		t.Fatalf("latest %v after the flush", tracker.latest)
+	}
+}
+
+func TestCompleteRideKeepsTrackingUntilOngoing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	driver := &models.Driver{UserID: primitive.NewObjectID()}
+	if err := st.Drivers.Insert(ctx, driver); err != nil {
+		t.Fatal(err)
+	}
+	ride := &models.Ride{RiderID: primitive.NewObjectID(), DriverID: driver.ID, Status: RideAccepted}
+	if err := st.Rides.Insert(ctx, ride); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := auth.NewTokens("test-secret", time.Hour)
+	h := &RideHandler{Store: st, Tokens: tokens, Tracker: NewLocationTracker(st, nil, time.Minute)}
+	h.Tracker.odometers[ride.ID] = &odometer{pending: 1.5}
+	r := gin.New()
+	r.POST("/rides/:ride_id/complete", h.CompleteRide)
+
+	token, _ := tokens.GenerateToken(driver.UserID.Hex(), "driver")
+	req := httptest.NewRequest("POST", "/rides/"+ride.ID.Hex()+"/complete", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("completing an accepted ride: got %d, want 409: %s", w.Code, w.Body)
+	}
+	if _, ok := h.Tracker.odometers[ride.ID]; !ok {
+		t.Fatal("the refused completion ended the trip's tracking")
+	}
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"uber-clone/models"
+	"uber-clone/payments"
+	"uber-clone/store"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxWebhookBytes bounds the payload read from a webhook request
+const maxWebhookBytes = 64 << 10
+
+// WebhookHandler receives payment provider events, the source of truth for payment
+// state: ConfirmPayment only lets a rider see the result sooner, and failures,
+// refunds and disputes arrive nowhere else
+type WebhookHandler struct {
+	Rides  *RideHandler
+	Secret string // Signing secret of the Stripe webhook endpoint
+}
+
+// StripeWebhook handles POST /webhooks/stripe. Each event is acted on once, keyed
+// by its ID; a failure releases it so Stripe's redelivery retries.
+func (h *WebhookHandler) StripeWebhook(c *gin.Context) {
+	if h.Secret == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Webhooks are not configured"})
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the request body"})
+		return
+	}
+	event, err := payments.ParseStripeEvent(payload, c.GetHeader("Stripe-Signature"), h.Secret)
+	if errors.Is(err, payments.ErrBadSignature) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed event"})
+		return
+	}
+
+	err = h.Rides.Store.Webhooks.Claim(c, &models.WebhookEvent{ID: event.ID, Type: event.Type, ReceivedAt: time.Now()})
+	if errors.Is(err, store.ErrDuplicate) {
+		c.JSON(http.StatusOK, gin.H{"received": true, "duplicate": true})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record the event"})
+		return
+	}
+
+	if err := h.handle(c, event); err != nil {
+		log.Printf("Failed to handle webhook event %s (%s): %v", event.ID, event.Type, err)
+		if err := h.Rides.Store.Webhooks.Release(c, event.ID); err != nil {
+			log.Println("Failed to release webhook event", event.ID, err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to handle the event"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// handle applies an event to the payment of its intent. Events about intents the
+// ride flow did not create, or of other types, are acknowledged and ignored.
+func (h *WebhookHandler) handle(ctx context.Context, event *payments.Event) error {
+	switch event.Type {
+	case payments.EventIntentSucceeded, payments.EventIntentFailed, payments.EventIntentCanceled,
+		payments.EventChargeRefunded, payments.EventDisputeCreated:
+	default:
+		return nil
+	}
+
+	payment, err := h.Rides.Store.Payments.FindByIntent(ctx, event.IntentID)
+	if errors.Is(err, store.ErrNotFound) {
+		log.Printf("Ignoring webhook event %s for unknown payment intent %q", event.ID, event.IntentID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rideID := event.Metadata["ride_id"]; rideID != "" && rideID != payment.RideID.Hex() {
+		log.Printf("Ignoring webhook event %s: intent %s is for ride %s, not %s",
+			event.ID, event.IntentID, payment.RideID.Hex(), rideID)
+		return nil
+	}
+
+	switch event.Type {
+	case payments.EventIntentSucceeded:
+		_, err := h.Rides.markPaid(ctx, payment.RideID, event.IntentID)
+		var te *TransitionError
+		if errors.As(err, &te) {
+			return nil // Already confirmed by the client
+		}
+		return err
+
+	case payments.EventIntentFailed:
+		return h.Rides.markPaymentFailed(ctx, payment, "failed", event.Reason)
+
+	case payments.EventIntentCanceled:
+		return h.Rides.markPaymentFailed(ctx, payment, "canceled", event.Reason)
+
+	case payments.EventChargeRefunded:
+		// Refunds issued through RefundRide are usually recorded already; this picks
+		// up the ones made on the Stripe dashboard, which name no agent
+		for i := range event.Refunds {
+			refund := &event.Refunds[i]
+			issuer, _ := primitive.ObjectIDFromHex(refund.Metadata["issued_by"])
+			if _, err := h.Rides.recordRefund(ctx, payment, refund, refund.Metadata["reason"], issuer); err != nil {
+				return err
+			}
+		}
+		if len(event.Refunds) == 0 {
+			log.Printf("Webhook event %s lists no refunds; recording only the refunded total", event.ID)
+			refunded := float64(event.AmountRefunded) / 100
+			return h.Rides.Store.Payments.UpdateByIntent(ctx, event.IntentID, bson.M{"refunded": refunded})
+		}
+
+	case payments.EventDisputeCreated:
+		log.Printf("Payment %s of ride %s disputed: %s", event.IntentID, payment.RideID.Hex(), event.Reason)
+		return h.Rides.Store.Payments.UpdateByIntent(ctx, event.IntentID, bson.M{
+			"disputed_at":    event.Created,
+			"dispute_reason": event.Reason,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package controllers
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"uber-clone/models"
+	"uber-clone/payments"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v72/webhook"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// flakyPayments fails the next UpdateByIntent while failNext is set
+type flakyPayments struct {
+	store.PaymentRepo
+	failNext bool
+}
+
+func (r *flakyPayments) UpdateByIntent(ctx context.Context, paymentIntent string, set bson.M) error {
+	if r.failNext {
+		r.failNext = false
+		return errors.New("db down")
+	}
+	return r.PaymentRepo.UpdateByIntent(ctx, paymentIntent, set)
+}
+
+// webhookFixture serves StripeWebhook for a completed ride charged 150 through
+// intent pi_1, in the given payment status
+type webhookFixture struct {
+	st       *store.Store
+	payments *flakyPayments
+	router   *gin.Engine
+	ride     *models.Ride
+}
+
+func newWebhookFixture(t *testing.T, paymentStatus string) *webhookFixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	f := &webhookFixture{st: st, payments: &flakyPayments{PaymentRepo: st.Payments}}
+	st.Payments = f.payments
+	hub := websockets.NewHub()
+	go hub.Run()
+
+	user := &models.User{Name: "Driver", Email: "driver@example.com", Password: "hash", Role: "driver"}
+	st.Users.Insert(ctx, user)
+	driver := &models.Driver{UserID: user.ID, VehicleType: "car"}
+	st.Drivers.Insert(ctx, driver)
+	f.ride = &models.Ride{RiderID: primitive.NewObjectID(), DriverID: driver.ID, Status: RideCompleted, PaymentStatus: paymentStatus, Fare: 150}
+	st.Rides.Insert(ctx, f.ride)
+	chargeStatus := "requires_payment_method"
+	if paymentStatus != PaymentPending {
+		chargeStatus = "succeeded"
+	}
+	st.Payments.Insert(ctx, &models.Payment{
+		RideID: f.ride.ID, Amount: 150, Currency: "INR", PaymentIntent: "pi_1", Status: chargeStatus, CreatedAt: time.Now(),
+	})
+
+	h := &WebhookHandler{Rides: &RideHandler{Store: st, Hub: hub}, Secret: testWebhookSecret}
+	f.router = gin.New()
+	f.router.POST("/webhooks/stripe", h.StripeWebhook)
+	return f
+}
+
+// deliver posts an event with the given data object, signed with secret unless it
+// is empty, and returns the response status and body
+func (f *webhookFixture) deliver(t *testing.T, eventID, eventType, object, secret string) (int, map[string]interface{}) {
+	t.Helper()
+	payload := fmt.Sprintf(`{"id":%q,"object":"event","type":%q,"created":%d,"data":{"object":%s}}`,
+		eventID, eventType, time.Now().Unix(), object)
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/stripe", strings.NewReader(payload))
+	if secret != "" {
+		now := time.Now()
+		sig := hex.EncodeToString(webhook.ComputeSignature(now, []byte(payload), secret))
+		req.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), sig))
+	}
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	var out map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return w.Code, out
+}
+
+func (f *webhookFixture) charge(t *testing.T) (*models.Ride, *models.Payment) {
+	t.Helper()
+	ride, err := f.st.Rides.FindByID(context.Background(), f.ride.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	charge, err := f.st.Payments.FindByIntent(context.Background(), "pi_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ride, charge
+}
+
+func intentObject(rideID primitive.ObjectID) string {
+	return fmt.Sprintf(`{"id":"pi_1","object":"payment_intent","currency":"inr","metadata":{"ride_id":%q},`+
+		`"last_payment_error":{"message":"Your card was declined."}}`, rideID.Hex())
+}
+
+const refundedCharge = `{"id":"ch_1","object":"charge","payment_intent":"pi_1","amount":15000,"amount_refunded":5000,"currency":"inr",` +
+	`"refunds":{"object":"list","data":[{"id":"re_1","object":"refund","amount":5000,"currency":"inr","status":"succeeded","metadata":{"reason":"goodwill"}}]}}`
+
+func TestStripeWebhook(t *testing.T) {
+	tests := []struct {
+		name          string
+		paymentStatus string // Of the ride before the event
+		eventType     string
+		object        func(rideID primitive.ObjectID) string
+		secret        string
+		want          int
+		check         func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment)
+	}{
+		{"missing signature", PaymentPending, payments.EventIntentSucceeded, intentObject, "", http.StatusBadRequest,
+			func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment) {
+				if ride.PaymentStatus != PaymentPending {
+					t.Fatalf("payment status %q after an unsigned event", ride.PaymentStatus)
+				}
+			}},
+		{"signed with another secret", PaymentPending, payments.EventIntentSucceeded, intentObject, "whsec_other", http.StatusBadRequest,
+			func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment) {
+				if ride.PaymentStatus != PaymentPending {
+					t.Fatalf("payment status %q after a forged event", ride.PaymentStatus)
+				}
+			}},
+		{"intent succeeded", PaymentPending, payments.EventIntentSucceeded, intentObject, testWebhookSecret, http.StatusOK,
+			func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment) {
+				if ride.PaymentStatus != PaymentPaid || charge.Status != "succeeded" {
+					t.Fatalf("payment status %q, charge %q; want paid and succeeded", ride.PaymentStatus, charge.Status)
+				}
+			}},
+		{"intent failed", PaymentPending, payments.EventIntentFailed, intentObject, testWebhookSecret, http.StatusOK,
+			func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment) {
+				if ride.PaymentStatus != PaymentFailed || charge.FailureReason != "Your card was declined." {
+					t.Fatalf("payment status %q, reason %q; want failed with the decline", ride.PaymentStatus, charge.FailureReason)
+				}
+			}},
+		{"intent of another ride", PaymentPending, payments.EventIntentSucceeded,
+			func(primitive.ObjectID) string { return intentObject(primitive.NewObjectID()) }, testWebhookSecret, http.StatusOK,
+			func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment) {
+				if ride.PaymentStatus != PaymentPending {
+					t.Fatalf("payment status %q after an event for another ride", ride.PaymentStatus)
+				}
+			}},
+		{"charge refunded", PaymentPaid, payments.EventChargeRefunded,
+			func(primitive.ObjectID) string { return refundedCharge }, testWebhookSecret, http.StatusOK,
+			func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment) {
+				if ride.PaymentStatus != PaymentPartiallyRefunded || charge.Refunded != 50 {
+					t.Fatalf("payment status %q, refunded %v; want partially_refunded and 50", ride.PaymentStatus, charge.Refunded)
+				}
+				var refund *models.Payment
+				for i := range records {
+					if records[i].PaymentIntent == "re_1" {
+						refund = &records[i]
+					}
+				}
+				if len(records) != 2 || refund == nil || refund.Amount != -50 || refund.Reason != "goodwill" {
+					t.Fatalf("records %+v, want the charge and refund re_1 of 50", records)
+				}
+			}},
+		{"charge refunded without the refund list", PaymentPaid, payments.EventChargeRefunded,
+			func(primitive.ObjectID) string {
+				return `{"id":"ch_1","object":"charge","payment_intent":"pi_1","amount":15000,"amount_refunded":15000,"currency":"inr"}`
+			}, testWebhookSecret, http.StatusOK,
+			func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment) {
+				if charge.Refunded != 150 || len(records) != 1 {
+					t.Fatalf("refunded %v with %d records; want the total of 150 and no refund record", charge.Refunded, len(records))
+				}
+			}},
+		{"dispute created", PaymentPaid, payments.EventDisputeCreated,
+			func(primitive.ObjectID) string {
+				return `{"id":"dp_1","object":"dispute","payment_intent":"pi_1","amount":15000,"currency":"inr","reason":"fraudulent"}`
+			}, testWebhookSecret, http.StatusOK,
+			func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment) {
+				if charge.DisputedAt.IsZero() || charge.DisputeReason != "fraudulent" {
+					t.Fatalf("disputed at %v for %q, want the dispute recorded", charge.DisputedAt, charge.DisputeReason)
+				}
+				if ride.PaymentStatus != PaymentPaid {
+					t.Fatalf("payment status %q, want paid until the dispute is decided", ride.PaymentStatus)
+				}
+			}},
+		{"other event type", PaymentPending, "customer.created",
+			func(primitive.ObjectID) string { return `{"id":"cus_1","object":"customer"}` }, testWebhookSecret, http.StatusOK,
+			func(t *testing.T, ride *models.Ride, charge *models.Payment, records []models.Payment) {
+				if ride.PaymentStatus != PaymentPending {
+					t.Fatalf("payment status %q after an ignored event", ride.PaymentStatus)
+				}
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newWebhookFixture(t, tt.paymentStatus)
+			code, out := f.deliver(t, "evt_1", tt.eventType, tt.object(f.ride.ID), tt.secret)
+			if code != tt.want {
+				t.Fatalf("got %d, want %d: %v", code, tt.want, out)
+			}
+			ride, charge := f.charge(t)
+			records, _ := f.st.Payments.ListByRide(context.Background(), f.ride.ID)
+			tt.check(t, ride, charge, records)
+		})
+	}
+}
+
+func TestStripeWebhookDuplicateEvent(t *testing.T) {
+	f := newWebhookFixture(t, PaymentPaid)
+	if code, out := f.deliver(t, "evt_1", payments.EventChargeRefunded, refundedCharge, testWebhookSecret); code != http.StatusOK || out["duplicate"] != nil {
+		t.Fatalf("first delivery: got %d, %v", code, out)
+	}
+
+	// Stripe redelivers; the refund total is moved back to see if it is recorded again
+	f.st.Payments.UpdateByIntent(context.Background(), "pi_1", bson.M{"refunded": 0.0})
+	code, out := f.deliver(t, "evt_1", payments.EventChargeRefunded, refundedCharge, testWebhookSecret)
+	if code != http.StatusOK || out["duplicate"] != true {
+		t.Fatalf("second delivery: got %d, %v; want 200 marked duplicate", code, out)
+	}
+	if _, charge := f.charge(t); charge.Refunded != 0 {
+		t.Fatalf("refunded %v, the duplicate was handled again", charge.Refunded)
+	}
+}
+
+func TestStripeWebhookReleasesClaimOnFailure(t *testing.T) {
+	f := newWebhookFixture(t, PaymentPending)
+	f.payments.failNext = true
+	if code, _ := f.deliver(t, "evt_1", payments.EventIntentSucceeded, intentObject(f.ride.ID), testWebhookSecret); code != http.StatusInternalServerError {
+		t.Fatalf("failed handling: got %d, want 500", code)
+	}
+	if ride, _ := f.charge(t); ride.PaymentStatus != PaymentPending {
+		t.Fatalf("payment status %q after a failed event", ride.PaymentStatus)
+	}
+
+	// The claim was released, so the redelivery is handled rather than skipped
+	code, out := f.deliver(t, "evt_1", payments.EventIntentSucceeded, intentObject(f.ride.ID), testWebhookSecret)
+	if code != http.StatusOK || out["duplicate"] != nil {
+		t.Fatalf("redelivery: got %d, %v", code, out)
+	}
+	if ride, _ := f.charge(t); ride.PaymentStatus != PaymentPaid {
+		t.Fatalf("payment status %q after the redelivery, want paid", ride.PaymentStatus)
+	}
+}
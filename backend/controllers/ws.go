@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RegisterWSHandlers wires the inbound WebSocket message types to their handlers
+func (h *RideHandler) RegisterWSHandlers(r *websockets.Router) {
+	r.Handle("ping", h.WSPing)
+	r.Handle("location_update", h.WSLocationUpdate, "driver")
+	r.Handle("ride_response", h.WSRideResponse, "driver")
+	r.Handle("chat_message", h.WSChatMessage)
+}
+
+// wsError maps the errors shared with the REST handlers onto WebSocket error codes
+func wsError(err error) error {
+	var te *TransitionError
+	switch {
+	case errors.As(err, &te):
+		return websockets.NewMessageError(websockets.CodeConflict, te.Error())
+	case errors.Is(err, store.ErrNotFound):
+		return websockets.NewMessageError(websockets.CodeNotFound, "ride not found")
+	case errors.Is(err, errNotADriver):
+		return websockets.NewMessageError(websockets.CodeForbidden, "only drivers can respond to ride requests")
+	}
+	return err
+}
+
+// WSPing answers {"type":"ping"} with {"type":"pong"}
+func (h *RideHandler) WSPing(m *websockets.Message) (interface{}, error) {
+	return websockets.Reply{Type: "pong"}, nil
+}
+
+// WSLocationUpdate accepts a driver position; see LocationTracker
+func (h *RideHandler) WSLocationUpdate(m *websockets.Message) (interface{}, error) {
+	var u LocationUpdate
+	if err := m.Bind(&u); err != nil {
+		return nil, err
+	}
+	if err := h.Tracker.Update(m.Client.UserID, u); err != nil {
+		return nil, websockets.NewMessageError(websockets.CodeBadRequest, err.Error())
+	}
+	return nil, nil
+}
+
+// WSRideResponse lets a driver accept or reject a ride_request over the socket
+func (h *RideHandler) WSRideResponse(m *websockets.Message) (interface{}, error) {
+	var req struct {
+		RideID string `json:"ride_id" binding:"required"`
+		Accept *bool  `json:"accept" binding:"required"`
+	}
+	if err := m.Bind(&req); err != nil {
+		return nil, err
+	}
+	rideID, err := primitive.ObjectIDFromHex(req.RideID)
+	if err != nil {
+		return nil, websockets.NewMessageError(websockets.CodeBadRequest, "invalid ride_id")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ride, err := h.respondToRide(ctx, m.Client.UserID, rideID, *req.Accept)
+	if err != nil {
+		return nil, wsError(err)
+	}
+	return gin.H{"ride_id": ride.ID.Hex(), "status": ride.Status}, nil
+}
+
+// WSChatMessage relays a chat line between the rider and driver of an active ride
+func (h *RideHandler) WSChatMessage(m *websockets.Message) (interface{}, error) {
+	var req struct {
+		RideID string `json:"ride_id" binding:"required"`
+		Text   string `json:"text" binding:"required,max=1000"`
+	}
+	if err := m.Bind(&req); err != nil {
+		return nil, err
+	}
+	rideID, err := primitive.ObjectIDFromHex(req.RideID)
+	if err != nil {
+		return nil, websockets.NewMessageError(websockets.CodeBadRequest, "invalid ride_id")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ride, err := h.Store.Rides.FindByID(ctx, rideID)
+	if err != nil {
+		return nil, wsError(err)
+	}
+	if ride.Status != RideAccepted && ride.Status != RideOngoing {
+		return nil, websockets.NewMessageError(websockets.CodeConflict, "chat is only open during an active ride")
+	}
+
+	driver, err := h.Store.Drivers.FindByID(ctx, ride.DriverID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Relay to whichever side did not send it
+	var to string
+	switch m.Client.UserID {
+	case ride.RiderID.Hex():
+		to = driver.UserID.Hex()
+	case driver.UserID.Hex():
+		to = ride.RiderID.Hex()
+	default:
+		return nil, websockets.NewMessageError(websockets.CodeForbidden, "you are not part of this ride")
+	}
+
+	sentAt := time.Now()
+	h.Hub.Broadcast <- websockets.Notification{
+		Type:   "chat_message",
+		UserID: to,
+		Payload: gin.H{
+			"ride_id": ride.ID.Hex(),
+			"from":    m.Client.UserID,
+			"role":    m.Client.Role,
+			"text":    req.Text,
+			"sent_at": sentAt,
+		},
+	}
+	return gin.H{"sent_at": sentAt}, nil
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var fareCardIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "city", Value: 1}, {Key: "vehicle_type", Value: 1}},
+	Options: options.Index().SetUnique(true),
+}
+
+var fareCardSchema = bson.M{
+	"bsonType": "object",
+	"required": bson.A{"city", "vehicle_type", "base_fare", "per_km", "per_minute", "minimum_fare", "booking_fee", "tax_rate"},
+	"properties": bson.M{
+		"city":         str,
+		"center":       point,
+		"radius_km":    bson.M{"bsonType": "number", "minimum": 0},
+		"vehicle_type": vehicleType,
+		"base_fare":    bson.M{"bsonType": "number", "minimum": 0},
+		"per_km":       bson.M{"bsonType": "number", "minimum": 0},
+		"per_minute":   bson.M{"bsonType": "number", "minimum": 0},
+		"minimum_fare": bson.M{"bsonType": "number", "minimum": 0},
+		"booking_fee":  bson.M{"bsonType": "number", "minimum": 0},
+		"tax_rate":     bson.M{"bsonType": "number", "minimum": 0, "maximum": 1},
+	},
+}
+
+// usersSchema is the users validator of migration 002 with the given roles allowed
+func usersSchema(roles ...string) bson.M {
+	schema := validators()["users"] // A fresh copy, safe to modify
+	enum := bson.A{}
+	for _, r := range roles {
+		enum = append(enum, r)
+	}
+	schema["properties"].(bson.M)["role"] = bson.M{"enum": enum}
+	return schema
+}
+
+// addFareCards creates the fare_cards collection and lets users be admins, who
+// edit the cards. Promote an account with
+//
+//	db.users.updateOne({email: "..."}, {$set: {role: "admin"}})
+func addFareCards(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would create fare_cards with its validator and (city, vehicle_type) index")
+		env.Logf("would allow the admin role on users")
+		return nil
+	}
+	if err := setValidator(ctx, env.DB, "fare_cards", bson.M{"$jsonSchema": fareCardSchema}); err != nil {
+		return err
+	}
+	if _, err := env.DB.Collection("fare_cards").Indexes().CreateOne(ctx, fareCardIndex); err != nil {
+		return err
+	}
+	return setValidator(ctx, env.DB, "users", bson.M{"$jsonSchema": usersSchema("rider", "driver", "admin")})
+}
+
+// dropFareCards reverts addFareCards. The cards themselves are kept.
+func dropFareCards(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would remove the fare_cards validator and index and the admin role")
+		return nil
+	}
+	if err := setValidator(ctx, env.DB, "users", bson.M{"$jsonSchema": usersSchema("rider", "driver")}); err != nil {
+		return err
+	}
+	if err := setValidator(ctx, env.DB, "fare_cards", bson.M{}); err != nil {
+		return err
+	}
+	return dropIndex(ctx, env.DB.Collection("fare_cards"), indexName(fareCardIndex.Keys.(bson.D)))
+}
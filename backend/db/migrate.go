@@ -0,0 +1,212 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// HistoryCollection records which migrations have been applied, one document per version
+const HistoryCollection = "schema_migrations"
+
+// Migration is one numbered change to the database. Up must be idempotent: replicas
+// starting together may both run it before either records it. Down reverts Up and
+// is nil for migrations that cannot be undone.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, env *MigrationEnv) error
+	Down    func(ctx context.Context, env *MigrationEnv) error
+}
+
+// MigrationEnv is what a migration step runs against
+type MigrationEnv struct {
+	DB     *mongo.Database
+	DryRun bool // Report what would change without writing anything
+}
+
+// Logf reports progress of the current step
+func (e *MigrationEnv) Logf(format string, args ...interface{}) {
+	prefix := "  "
+	if e.DryRun {
+		prefix = "  [dry-run] "
+	}
+	log.Printf(prefix+format, args...)
+}
+
+// UpdateMany runs the update, or in a dry run counts the documents it would touch
+func (e *MigrationEnv) UpdateMany(ctx context.Context, collection, what string, filter, update interface{}) error {
+	coll := e.DB.Collection(collection)
+	if e.DryRun {
+		n, err := coll.CountDocuments(ctx, filter)
+		if err != nil {
+			return err
+		}
+		e.Logf("%s: would update %d %s", what, n, collection)
+		return nil
+	}
+
+	result, err := coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	e.Logf("%s: updated %d %s", what, result.ModifiedCount, collection)
+	return nil
+}
+
+// AppliedMigration is an entry of the migration history
+type AppliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// MigrateOptions bounds a migration run
+type MigrateOptions struct {
+	// Target is the version to end at. For up, 0 means the latest; for down,
+	// every applied migration above Target is reverted.
+	Target int
+	DryRun bool
+}
+
+// Migrations returns the registered migrations in version order
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
+
+// Applied returns the migration history, oldest first
+func Applied(ctx context.Context, database *mongo.Database) ([]AppliedMigration, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := database.Collection(HistoryCollection).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var applied []AppliedMigration
+	if err := cursor.All(ctx, &applied); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Migrate applies every pending migration; it runs at startup
+func Migrate(ctx context.Context, database *mongo.Database) ([]Migration, error) {
+	return MigrateUp(ctx, database, MigrateOptions{})
+}
+
+// MigrateUp applies, in version order, the registered migrations missing from the
+// history up to opts.Target and returns the ones it ran
+func MigrateUp(ctx context.Context, database *mongo.Database, opts MigrateOptions) ([]Migration, error) {
+	env := &MigrationEnv{DB: database, DryRun: opts.DryRun}
+	return migrateUp(ctx, env, mongoHistory{database}, migrations, opts)
+}
+
+func migrateUp(ctx context.Context, env *MigrationEnv, hist history, list []Migration, opts MigrateOptions) ([]Migration, error) {
+	done, err := hist.versions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration history: %v", err)
+	}
+
+	var ran []Migration
+	for _, m := range list {
+		if done[m.Version] || (opts.Target > 0 && m.Version > opts.Target) {
+			continue
+		}
+		log.Printf("Applying migration %03d %s", m.Version, m.Name)
+		if err := m.Up(ctx, env); err != nil {
+			return ran, fmt.Errorf("migration %03d %s failed: %v", m.Version, m.Name, err)
+		}
+		ran = append(ran, m)
+		if opts.DryRun {
+			continue
+		}
+
+		if err := hist.record(ctx, m); err != nil {
+			return ran, fmt.Errorf("failed to record migration %03d: %v", m.Version, err)
+		}
+	}
+	return ran, nil
+}
+
+// MigrateDown reverts, newest first, every applied migration above opts.Target and
+// returns the ones it reverted. It stops at the first migration without a Down.
+func MigrateDown(ctx context.Context, database *mongo.Database, opts MigrateOptions) ([]Migration, error) {
+	env := &MigrationEnv{DB: database, DryRun: opts.DryRun}
+	return migrateDown(ctx, env, mongoHistory{database}, migrations, opts)
+}
+
+func migrateDown(ctx context.Context, env *MigrationEnv, hist history, list []Migration, opts MigrateOptions) ([]Migration, error) {
+	done, err := hist.versions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration history: %v", err)
+	}
+
+	var reverted []Migration
+	for i := len(list) - 1; i >= 0; i-- {
+		m := list[i]
+		if !done[m.Version] || m.Version <= opts.Target {
+			continue
+		}
+		if m.Down == nil {
+			return reverted, fmt.Errorf("migration %03d %s cannot be reverted", m.Version, m.Name)
+		}
+		log.Printf("Reverting migration %03d %s", m.Version, m.Name)
+		if err := m.Down(ctx, env); err != nil {
+			return reverted, fmt.Errorf("reverting migration %03d %s failed: %v", m.Version, m.Name, err)
+		}
+		reverted = append(reverted, m)
+		if opts.DryRun {
+			continue
+		}
+
+		if err := hist.remove(ctx, m.Version); err != nil {
+			return reverted, fmt.Errorf("failed to update migration history for %03d: %v", m.Version, err)
+		}
+	}
+	return reverted, nil
+}
+
+// history records which migrations have been applied
+type history interface {
+	versions(ctx context.Context) (map[int]bool, error)
+	record(ctx context.Context, m Migration) error
+	remove(ctx context.Context, version int) error
+}
+
+// mongoHistory keeps the history in HistoryCollection
+type mongoHistory struct {
+	db *mongo.Database
+}
+
+func (h mongoHistory) versions(ctx context.Context) (map[int]bool, error) {
+	applied, err := Applied(ctx, h.db)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+	return done, nil
+}
+
+func (h mongoHistory) record(ctx context.Context, m Migration) error {
+	_, err := h.db.Collection(HistoryCollection).InsertOne(ctx, AppliedMigration{
+		Version:   m.Version,
+		Name:      m.Name,
+		AppliedAt: time.Now(),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil // Another replica recorded it first
+	}
+	return err
+}
+
+func (h mongoHistory) remove(ctx context.Context, version int) error {
+	_, err := h.db.Collection(HistoryCollection).DeleteOne(ctx, bson.M{"_id": version})
+	return err
+}
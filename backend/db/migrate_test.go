@@ -0,0 +1,253 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// memoryHistory keeps the migration history in process
+type memoryHistory map[int]bool
+
+func (h memoryHistory) versions(ctx context.Context) (map[int]bool, error) {
+	done := make(map[int]bool, len(h))
+	for v := range h {
+		done[v] = true
+	}
+	return done, nil
+}
+
+func (h memoryHistory) record(ctx context.Context, m Migration) error {
+	h[m.Version] = true
+	return nil
+}
+
+func (h memoryHistory) remove(ctx context.Context, version int) error {
+	delete(h, version)
+	return nil
+}
+
+// steps builds migrations that log the steps they run; those listed in irreversible
+// have no Down and those in failing fail
+type steps struct {
+	ran                   []string
+	irreversible, failing map[int]bool
+}
+
+func (s *steps) migrations(versions ...int) []Migration {
+	var list []Migration
+	for _, v := range versions {
+		v := v
+		m := Migration{Version: v, Name: fmt.Sprintf("step_%d", v)}
+		m.Up = func(ctx context.Context, env *MigrationEnv) error {
+			s.ran = append(s.ran, fmt.Sprintf("up %d", v))
+			if s.failing[v] {
+				return errors.New("boom")
+			}
+			return nil
+		}
+		if !s.irreversible[v] {
+			m.Down = func(ctx context.Context, env *MigrationEnv) error {
+				s.ran = append(s.ran, fmt.Sprintf("down %d", v))
+				return nil
+			}
+		}
+		list = append(list, m)
+	}
+	return list
+}
+
+func versionsOf(list []Migration) []int {
+	out := []int{}
+	for _, m := range list {
+		out = append(out, m.Version)
+	}
+	return out
+}
+
+func TestMigrateUp(t *testing.T) {
+	ctx := context.Background()
+	s := &steps{}
+	list := s.migrations(1, 2, 3)
+	hist := memoryHistory{}
+	env := &MigrationEnv{}
+
+	ran, err := migrateUp(ctx, env, hist, list, MigrateOptions{Target: 2})
+	if err != nil || !reflect.DeepEqual(versionsOf(ran), []int{1, 2}) {
+		t.Fatalf("up to 2 ran %v, %v", versionsOf(ran), err)
+	}
+	ran, err = migrateUp(ctx, env, hist, list, MigrateOptions{})
+	if err != nil || !reflect.DeepEqual(versionsOf(ran), []int{3}) {
+		t.Fatalf("up to latest ran %v, %v", versionsOf(ran), err)
+	}
+	ran, err = migrateUp(ctx, env, hist, list, MigrateOptions{})
+	if err != nil || len(ran) != 0 {
+		t.Fatalf("re-run ran %v, %v", versionsOf(ran), err)
+	}
+
+	if want := []string{"up 1", "up 2", "up 3"}; !reflect.DeepEqual(s.ran, want) {
+		t.Fatalf("steps %v, want %v", s.ran, want)
+	}
+	if want := (memoryHistory{1: true, 2: true, 3: true}); !reflect.DeepEqual(hist, want) {
+		t.Fatalf("history %v, want %v", hist, want)
+	}
+}
+
+func TestMigrateUpStopsAtFailure(t *testing.T) {
+	s := &steps{failing: map[int]bool{2: true}}
+	hist := memoryHistory{}
+	ran, err := migrateUp(context.Background(), &MigrationEnv{}, hist, s.migrations(1, 2, 3), MigrateOptions{})
+	if err == nil || !strings.Contains(err.Error(), "migration 002 step_2 failed") {
+		t.Fatalf("error %v, want migration 002 to fail", err)
+	}
+	if !reflect.DeepEqual(versionsOf(ran), []int{1}) || !reflect.DeepEqual(hist, memoryHistory{1: true}) {
+		t.Fatalf("ran %v with history %v, want only 1 applied", versionsOf(ran), hist)
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	tests := []struct {
+		name         string
+		applied      []int
+		irreversible []int
+		target       int
+		wantReverted []int
+		wantHistory  memoryHistory
+		wantErr      string
+	}{
+		{"to target", []int{1, 2, 3}, nil, 1, []int{3, 2}, memoryHistory{1: true}, ""},
+		{"everything", []int{1, 2, 3}, nil, 0, []int{3, 2, 1}, memoryHistory{}, ""},
+		{"skips unapplied", []int{1, 3}, nil, 0, []int{3, 1}, memoryHistory{}, ""},
+		{"nothing above target", []int{1}, nil, 1, []int{}, memoryHistory{1: true}, ""},
+		{"stops at irreversible", []int{1, 2, 3}, []int{2}, 0, []int{3}, memoryHistory{1: true, 2: true}, "migration 002 step_2 cannot be reverted"},
+		{"irreversible below target", []int{1, 2, 3}, []int{1}, 1, []int{3, 2}, memoryHistory{1: true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &steps{irreversible: map[int]bool{}}
+			for _, v := range tt.irreversible {
+				s.irreversible[v] = true
+			}
+			hist := memoryHistory{}
+			for _, v := range tt.applied {
+				hist[v] = true
+			}
+
+			reverted, err := migrateDown(context.Background(), &MigrationEnv{}, hist, s.migrations(1, 2, 3), MigrateOptions{Target: tt.target})
+			if (err == nil) != (tt.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(versionsOf(reverted), tt.wantReverted) {
+				t.Fatalf("reverted %v, want %v", versionsOf(reverted), tt.wantReverted)
+			}
+			if !reflect.DeepEqual(hist, tt.wantHistory) {
+				t.Fatalf("history %v, want %v", hist, tt.wantHistory)
+			}
+		})
+	}
+}
+
+// The registered migrations against a real server: DB_TEST_MONGODB_URI=mongodb://localhost:27017
+// go test ./db. Needs MongoDB 5.0 or later for collMod on TTL indexes by key pattern.
+func TestMongoMigrations(t *testing.T) {
+	uri := os.Getenv("DB_TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("DB_TEST_MONGODB_URI is not set")
+	}
+	client, err := Connect(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	ctx := context.Background()
+	database := client.Database(fmt.Sprintf("db_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() { database.Drop(context.Background()) })
+
+	all := versionsOf(Migrations())
+	ran, err := Migrate(ctx, database)
+	if err != nil || !reflect.DeepEqual(versionsOf(ran), all) {
+		t.Fatalf("first run applied %v, %v; want %v", versionsOf(ran), err, all)
+	}
+	if ran, err := Migrate(ctx, database); err != nil || len(ran) != 0 {
+		t.Fatalf("second run applied %v, %v", versionsOf(ran), err)
+	}
+
+	// A changed TTL is applied in place instead of conflicting with the index
+	if err := SetTTL(ctx, database, "notifications", NotificationTTLField, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	reverted, err := MigrateDown(ctx, database, MigrateOptions{})
+	if err != nil || len(reverted) != len(all) {
+		t.Fatalf("reverted %v, %v", versionsOf(reverted), err)
+	}
+	if applied, err := Applied(ctx, database); err != nil || len(applied) != 0 {
+		t.Fatalf("history %v after reverting everything, %v", applied, err)
+	}
+}
+
+func TestDryRunRecordsNothing(t *testing.T) {
+	ctx := context.Background()
+	var dryRuns []bool
+	list := []Migration{{
+		Version: 1, Name: "step_1",
+		Up:   func(ctx context.Context, env *MigrationEnv) error { dryRuns = append(dryRuns, env.DryRun); return nil },
+		Down: func(ctx context.Context, env *MigrationEnv) error { dryRuns = append(dryRuns, env.DryRun); return nil },
+	}}
+
+	hist := memoryHistory{}
+	ran, err := migrateUp(ctx, &MigrationEnv{DryRun: true}, hist, list, MigrateOptions{DryRun: true})
+	if err != nil || len(ran) != 1 {
+		t.Fatalf("dry run reported %v, %v; want step_1", versionsOf(ran), err)
+	}
+	if len(hist) != 0 {
+		t.Fatalf("history %v after a dry run up", hist)
+	}
+
+	hist[1] = true
+	reverted, err := migrateDown(ctx, &MigrationEnv{DryRun: true}, hist, list, MigrateOptions{DryRun: true})
+	if err != nil || len(reverted) != 1 {
+		t.Fatalf("dry run reported %v, %v; want step_1", versionsOf(reverted), err)
+	}
+	if !reflect.DeepEqual(hist, memoryHistory{1: true}) {
+		t.Fatalf("history %v after a dry run down", hist)
+	}
+	if !reflect.DeepEqual(dryRuns, []bool{true, true}) {
+		t.Fatalf("steps saw dry run %v", dryRuns)
+	}
+}
+
+// Every registered migration honours DryRun: nothing is created, not even the history
+func TestMongoDryRun(t *testing.T) {
+	uri := os.Getenv("DB_TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("DB_TEST_MONGODB_URI is not set")
+	}
+	client, err := Connect(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	ctx := context.Background()
+	database := client.Database(fmt.Sprintf("db_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() { database.Drop(context.Background()) })
+
+	ran, err := MigrateUp(ctx, database, MigrateOptions{DryRun: true})
+	if err != nil || len(ran) != len(Migrations()) {
+		t.Fatalf("dry run reported %v, %v", versionsOf(ran), err)
+	}
+	if applied, err := Applied(ctx, database); err != nil || len(applied) != 0 {
+		t.Fatalf("history %v after a dry run, %v", applied, err)
+	}
+	names, err := database.ListCollectionNames(ctx, bson.M{})
+	if err != nil || len(names) != 0 {
+		t.Fatalf("dry run created collections %v, %v", names, err)
+	}
+}
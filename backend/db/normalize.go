@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	rideStatuses    = bson.A{"searching", "requested", "accepted", "rejected", "ongoing", "completed", "cancelled"}
+	paymentStatuses = bson.A{"", "pending", "paid", "failed"}
+)
+
+// rideStatusSynonyms maps the spellings older builds and manual fixes wrote to the
+// canonical ride status. Matching is case-insensitive.
+var rideStatusSynonyms = map[string][]string{
+	"cancelled": {"canceled"},
+	"ongoing":   {"in_progress", "in-progress", "started"},
+	"completed": {"complete", "finished"},
+	"requested": {"pending"},
+}
+
+// paymentStatusSynonyms does the same for payment_status, which was at times copied
+// straight from the Stripe intent status
+var paymentStatusSynonyms = map[string][]string{
+	"paid":    {"succeeded", "success", "completed"},
+	"pending": {"requires_payment_method", "requires_action", "processing", "requested"},
+	"failed":  {"canceled", "cancelled", "error"},
+}
+
+// normalizeRideEnums rewrites rides whose status, payment_status or cancelled_by
+// drifted from the enums the validators and handlers expect
+func normalizeRideEnums(ctx context.Context, env *MigrationEnv) error {
+	if err := normalizeField(ctx, env, "status", rideStatuses, rideStatusSynonyms); err != nil {
+		return err
+	}
+
+	// Rides created before payment tracking have no payment_status at all
+	err := env.UpdateMany(ctx, "rides", "payment_status missing",
+		bson.M{"$or": bson.A{
+			bson.M{"payment_status": bson.M{"$exists": false}},
+			bson.M{"payment_status": nil},
+		}},
+		bson.M{"$set": bson.M{"payment_status": ""}},
+	)
+	if err != nil {
+		return err
+	}
+	if err := normalizeField(ctx, env, "payment_status", paymentStatuses, paymentStatusSynonyms); err != nil {
+		return err
+	}
+
+	// cancelled_by used to hold the canceller's user ID. Keep the ID in its own field
+	// and record which side of the ride cancelled.
+	return env.UpdateMany(ctx, "rides", "cancelled_by user IDs",
+		bson.M{"cancelled_by": bson.M{"$exists": true, "$nin": bson.A{"", "rider", "driver", nil}}},
+		bson.A{bson.M{"$set": bson.M{
+			"cancelled_by_user_id": bson.M{"$convert": bson.M{
+				"input": "$cancelled_by", "to": "objectId", "onError": nil, "onNull": nil,
+			}},
+			"cancelled_by": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{"$cancelled_by", bson.M{"$toString": "$rider_id"}}},
+				"rider",
+				"driver",
+			}},
+		}}},
+	)
+}
+
+// normalizeField maps the synonyms of each canonical value to it, then lowercases
+// and trims whatever non-canonical values are left if that makes them canonical
+func normalizeField(ctx context.Context, env *MigrationEnv, field string, canonical bson.A, synonyms map[string][]string) error {
+	for value, aliases := range synonyms {
+		for _, alias := range aliases {
+			filter := bson.M{field: bson.M{"$regex": "^\\s*" + alias + "\\s*$", "$options": "i"}}
+			if err := env.UpdateMany(ctx, "rides", field+" "+alias, filter, bson.M{"$set": bson.M{field: value}}); err != nil {
+				return err
+			}
+		}
+	}
+
+	cleaned := bson.M{"$toLower": bson.M{"$trim": bson.M{"input": "$" + field}}}
+	return env.UpdateMany(ctx, "rides", field+" case",
+		bson.M{
+			field:   bson.M{"$type": "string", "$nin": canonical},
+			"$expr": bson.M{"$in": bson.A{cleaned, canonical}},
+		},
+		bson.A{bson.M{"$set": bson.M{field: cleaned}}},
+	)
+}
+
+// restoreCancelledBy puts the user IDs back into cancelled_by. The status and
+// payment_status rewrites are not undone: the old spellings were never valid.
+func restoreCancelledBy(ctx context.Context, env *MigrationEnv) error {
+	env.Logf("status and payment_status normalization is one-way; leaving them as they are")
+	return env.UpdateMany(ctx, "rides", "cancelled_by user IDs",
+		bson.M{"cancelled_by_user_id": bson.M{"$type": "objectId"}},
+		bson.A{
+			bson.M{"$set": bson.M{"cancelled_by": bson.M{"$toString": "$cancelled_by_user_id"}}},
+			bson.M{"$unset": "cancelled_by_user_id"},
+		},
+	)
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NotificationTTLField is the field of the notifications TTL index
+const NotificationTTLField = "created_at"
+
+// defaultNotificationTTL is the expiry migration 009 starts with; the server then
+// sets NOTIFICATION_TTL with SetTTL
+const defaultNotificationTTL = 7 * 24 * time.Hour
+
+// notificationsSeqIndex numbers each user's notifications; replay reads it in order
+var notificationsSeqIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "seq", Value: 1}},
+	Options: options.Index().SetUnique(true),
+}
+
+// addNotifications creates the indexes of the notification inbox. Servers before
+// this migration created them at startup, so the TTL index may already exist with
+// another expiry; SetTTL changes it in place.
+func addNotifications(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would ensure index user_id_1_seq_1 and TTL index %s_1 on notifications", NotificationTTLField)
+		return nil
+	}
+	if _, err := env.DB.Collection("notifications").Indexes().CreateOne(ctx, notificationsSeqIndex); err != nil {
+		return err
+	}
+	return SetTTL(ctx, env.DB, "notifications", NotificationTTLField, defaultNotificationTTL)
+}
+
+func dropNotifications(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would drop the indexes of notifications")
+		return nil
+	}
+	_, err := env.DB.Collection("notifications").Indexes().DropAll(ctx)
+	return err
+}
+
+// hubEventsTTL only needs to outlive the delay of every replica's change stream
+const hubEventsTTL = time.Minute
+
+// addHubEvents keeps the collection the replicas share notifications through small.
+// Servers before this migration created the index at startup.
+func addHubEvents(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would ensure TTL index created_at_1 on hub_events")
+		return nil
+	}
+	return SetTTL(ctx, env.DB, "hub_events", "created_at", hubEventsTTL)
+}
+
+func dropHubEvents(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would drop collection hub_events")
+		return nil
+	}
+	return env.DB.Collection("hub_events").Drop(ctx)
+}
+
+// SetTTL makes documents of the collection expire ttl after their field, changing
+// the expiry of an existing TTL index with collMod. Creating the index again with
+// another expiry would fail with IndexOptionsConflict.
+func SetTTL(ctx context.Context, database *mongo.Database, collection, field string, ttl time.Duration) error {
+	seconds := int32(ttl.Seconds())
+	err := database.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collection},
+		{Key: "index", Value: bson.D{
+			{Key: "keyPattern", Value: bson.D{{Key: field, Value: 1}}},
+			{Key: "expireAfterSeconds", Value: seconds},
+		}},
+	}).Err()
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Name == "NamespaceNotFound" || cmdErr.Name == "IndexNotFound") {
+		_, err = database.Collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: field, Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(seconds),
+		})
+	}
+	return err
+}
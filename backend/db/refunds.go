@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ridesSchema is the rides validator of migration 002 with the given payment
+// statuses allowed
+func ridesSchema(paymentStatuses ...string) bson.M {
+	schema := validators()["rides"] // A fresh copy, safe to modify
+	enum := bson.A{}
+	for _, s := range paymentStatuses {
+		enum = append(enum, s)
+	}
+	schema["properties"].(bson.M)["payment_status"] = bson.M{"enum": enum}
+	return schema
+}
+
+// addRefunds lets rides be refunded in full or in part, and users be support
+// agents, who issue refunds alongside admins
+func addRefunds(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would allow the refunded and partially_refunded payment statuses on rides")
+		env.Logf("would allow the support role on users")
+		return nil
+	}
+	rides := ridesSchema("", "pending", "paid", "failed", "refunded", "partially_refunded")
+	if err := setValidator(ctx, env.DB, "rides", bson.M{"$jsonSchema": rides}); err != nil {
+		return err
+	}
+	return setValidator(ctx, env.DB, "users", bson.M{"$jsonSchema": usersSchema("rider", "driver", "admin", "support")})
+}
+
+// removeRefunds reverts addRefunds. Refunded rides and support users are kept; the
+// moderate validation level does not check documents that no longer match.
+func removeRefunds(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would remove the refund payment statuses and the support role")
+		return nil
+	}
+	if err := setValidator(ctx, env.DB, "users", bson.M{"$jsonSchema": usersSchema("rider", "driver", "admin")}); err != nil {
+		return err
+	}
+	return setValidator(ctx, env.DB, "rides", bson.M{"$jsonSchema": ridesSchema("", "pending", "paid", "failed")})
+}
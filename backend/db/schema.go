@@ -0,0 +1,297 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrations is the ordered list of schema changes. Append new ones with the next
+// version; never renumber or edit one that has shipped.
+var migrations = []Migration{
+	{Version: 1, Name: "create_indexes", Up: createIndexes, Down: dropIndexes},
+	{Version: 2, Name: "collection_validators", Up: applyValidators, Down: removeValidators},
+	{Version: 3, Name: "normalize_ride_enums", Up: normalizeRideEnums, Down: restoreCancelledBy},
+	{Version: 4, Name: "fare_cards", Up: addFareCards, Down: dropFareCards},
+	{Version: 5, Name: "rides_created_at_index", Up: addRideCreatedAtIndex, Down: dropRideCreatedAtIndex},
+	{Version: 6, Name: "webhook_events", Up: addWebhookEvents, Down: dropWebhookEvents},
+	{Version: 7, Name: "idempotency_keys", Up: addIdempotencyKeys, Down: dropIdempotencyKeys},
+	{Version: 8, Name: "refunds", Up: addRefunds, Down: removeRefunds},
+	{Version: 9, Name: "notifications", Up: addNotifications, Down: dropNotifications},
+	{Version: 10, Name: "hub_events", Up: addHubEvents, Down: dropHubEvents},
+}
+
+// schemaIndexes are the indexes of migration 001, by collection
+func schemaIndexes() map[string][]mongo.IndexModel {
+	return map[string][]mongo.IndexModel{
+		"users": {
+			{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"drivers": {
+			{Keys: bson.D{{Key: "location", Value: "2dsphere"}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"rides": {
+			{Keys: bson.D{{Key: "start_loc", Value: "2dsphere"}}},
+			{Keys: bson.D{{Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "driver_id", Value: 1}, {Key: "status", Value: 1}}},
+		},
+		"payments": {
+			{Keys: bson.D{{Key: "payment_intent", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "ride_id", Value: 1}}},
+		},
+		"feedback": {
+			{Keys: bson.D{{Key: "ride_id", Value: 1}, {Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+	}
+}
+
+// createIndexes adds the geo indexes $nearSphere needs and the unique indexes that
+// back the store's duplicate checks. CreateMany is a no-op for existing indexes.
+func createIndexes(ctx context.Context, env *MigrationEnv) error {
+	for name, models := range schemaIndexes() {
+		if env.DryRun {
+			env.Logf("would ensure %d indexes on %s", len(models), name)
+			continue
+		}
+		if _, err := env.DB.Collection(name).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropIndexes(ctx context.Context, env *MigrationEnv) error {
+	for name, models := range schemaIndexes() {
+		for _, model := range models {
+			index := indexName(model.Keys.(bson.D))
+			if env.DryRun {
+				env.Logf("would drop index %s.%s", name, index)
+				continue
+			}
+			if err := dropIndex(ctx, env.DB.Collection(name), index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropIndex drops the named index, if it exists
+func dropIndex(ctx context.Context, coll *mongo.Collection, name string) error {
+	_, err := coll.Indexes().DropOne(ctx, name)
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound") {
+		return err
+	}
+	return nil
+}
+
+// indexName is the name MongoDB gives an index created without one, e.g. "user_id_1"
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		parts = append(parts, k.Key, fmt.Sprint(k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+var (
+	objectID = bson.M{"bsonType": "objectId"}
+	str      = bson.M{"bsonType": "string"}
+	number   = bson.M{"bsonType": "number"}
+	boolean  = bson.M{"bsonType": "bool"}
+	point    = bson.M{
+		"bsonType": "object",
+		"required": bson.A{"type", "coordinates"},
+		"properties": bson.M{
+			"type":        bson.M{"enum": bson.A{"Point"}},
+			"coordinates": bson.M{"bsonType": "array", "minItems": 2, "maxItems": 2, "items": number},
+		},
+	}
+	vehicleType = bson.M{"enum": bson.A{"two_wheeler", "three_wheeler", "car", "premium_car"}}
+)
+
+// validators are the $jsonSchema validators of each collection. They pin down the
+// fields the code relies on and leave everything else open.
+func validators() map[string]bson.M {
+	return map[string]bson.M{
+		"users": {
+			"bsonType": "object",
+			"required": bson.A{"name", "email", "password", "role"},
+			"properties": bson.M{
+				"name":     str,
+				"email":    str,
+				"password": str,
+				"role":     bson.M{"enum": bson.A{"rider", "driver"}},
+				"location": point,
+			},
+		},
+		"drivers": {
+			"bsonType": "object",
+			"required": bson.A{"user_id", "vehicle_type", "is_available", "location"},
+			"properties": bson.M{
+				"user_id":      objectID,
+				"vehicle_type": vehicleType,
+				"is_available": boolean,
+				"location":     point,
+				"rating_sum":   number,
+				"rating_count": number,
+			},
+		},
+		"rides": {
+			"bsonType": "object",
+			"required": bson.A{"rider_id", "start_loc", "end_loc", "vehicle_type", "status", "fare"},
+			"properties": bson.M{
+				"rider_id":     objectID,
+				"driver_id":    objectID,
+				"start_loc":    point,
+				"end_loc":      point,
+				"vehicle_type": vehicleType,
+				"status": bson.M{"enum": bson.A{
+					"searching", "requested", "accepted", "rejected", "ongoing", "completed", "cancelled",
+				}},
+				"payment_status": bson.M{"enum": bson.A{"", "pending", "paid", "failed"}},
+				"fare":           number,
+				"distance":       number,
+			},
+		},
+		"payments": {
+			"bsonType": "object",
+			"required": bson.A{"ride_id", "amount", "currency", "payment_intent", "status"},
+			"properties": bson.M{
+				"ride_id":        objectID,
+				"amount":         number,
+				"currency":       str,
+				"payment_intent": str,
+				"status":         str,
+			},
+		},
+		"feedback": {
+			"bsonType": "object",
+			"required": bson.A{"ride_id", "user_id", "rating"},
+			"properties": bson.M{
+				"ride_id": objectID,
+				"user_id": objectID,
+				"rating":  bson.M{"bsonType": "int", "minimum": 1, "maximum": 5},
+			},
+		},
+	}
+}
+
+// applyValidators installs the validators, creating collections that do not exist
+// yet. "moderate" validation leaves updates to already-invalid documents alone so
+// old data keeps working until a data migration fixes it.
+func applyValidators(ctx context.Context, env *MigrationEnv) error {
+	for name, schema := range validators() {
+		if env.DryRun {
+			env.Logf("would set the %s validator", name)
+			continue
+		}
+		if err := setValidator(ctx, env.DB, name, bson.M{"$jsonSchema": schema}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeValidators(ctx context.Context, env *MigrationEnv) error {
+	for name := range validators() {
+		if env.DryRun {
+			env.Logf("would remove the %s validator", name)
+			continue
+		}
+		if err := setValidator(ctx, env.DB, name, bson.M{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setValidator(ctx context.Context, database *mongo.Database, name string, validator bson.M) error {
+	err := database.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: name},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: "moderate"},
+	}).Err()
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceNotFound" {
+		opts := options.CreateCollection().SetValidator(validator).SetValidationLevel("moderate")
+		return database.CreateCollection(ctx, name, opts)
+	}
+	return err
+}
+
+// rideCreatedAtIndex backs the surge zones' scan of recent ride requests
+var rideCreatedAtIndex = mongo.IndexModel{Keys: bson.D{{Key: "created_at", Value: 1}}}
+
+func addRideCreatedAtIndex(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would ensure index created_at_1 on rides")
+		return nil
+	}
+	_, err := env.DB.Collection("rides").Indexes().CreateOne(ctx, rideCreatedAtIndex)
+	return err
+}
+
+func dropRideCreatedAtIndex(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would drop index rides.created_at_1")
+		return nil
+	}
+	return dropIndex(ctx, env.DB.Collection("rides"), indexName(rideCreatedAtIndex.Keys.(bson.D)))
+}
+
+// webhookEventsIndex expires handled webhook events once the provider has long
+// stopped redelivering them; Stripe retries for up to three days
+var webhookEventsIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "received_at", Value: 1}},
+	Options: options.Index().SetExpireAfterSeconds(int32((30 * 24 * time.Hour).Seconds())),
+}
+
+func addWebhookEvents(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would ensure TTL index received_at_1 on webhook_events")
+		return nil
+	}
+	_, err := env.DB.Collection("webhook_events").Indexes().CreateOne(ctx, webhookEventsIndex)
+	return err
+}
+
+func dropWebhookEvents(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would drop collection webhook_events")
+		return nil
+	}
+	return env.DB.Collection("webhook_events").Drop(ctx)
+}
+
+// idempotencyKeysIndex removes stored responses once their expires_at passes
+var idempotencyKeysIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "expires_at", Value: 1}},
+	Options: options.Index().SetExpireAfterSeconds(0),
+}
+
+func addIdempotencyKeys(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would ensure TTL index expires_at_1 on idempotency_keys")
+		return nil
+	}
+	_, err := env.DB.Collection("idempotency_keys").Indexes().CreateOne(ctx, idempotencyKeysIndex)
+	return err
+}
+
+func dropIdempotencyKeys(ctx context.Context, env *MigrationEnv) error {
+	if env.DryRun {
+		env.Logf("would drop collection idempotency_keys")
+		return nil
+	}
+	return env.DB.Collection("idempotency_keys").Drop(ctx)
+}
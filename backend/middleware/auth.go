@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 	"uber-clone/auth"
@@ -9,7 +10,8 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware rejects requests without a valid bearer token issued by tokens
+func AuthMiddleware(tokens *auth.Tokens) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get token from header
 		authHeader := c.GetHeader("Authorization")
@@ -34,24 +36,18 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		// Validate Token
-		claims, err := auth.ValidateToken(tokenString)
+		claims, err := tokens.ValidateToken(tokenString)
 		if err != nil {
-			if ve, ok := err.(*jwt.ValidationError); ok {
-                var errMsg string
-                if ve.Errors&jwt.ValidationErrorExpired != 0 {
-                    errMsg = "Token expired"
-                } else if ve.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
-                    errMsg = "Invalid token signature"
-                } else {
-
-                    errMsg = "Invalid token"
-                }
-                c.JSON(http.StatusUnauthorized, gin.H{"error": errMsg})
-                c.Abort()
-                return
-            }
-    }
-            
+			errMsg := "Invalid token"
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				errMsg = "Token expired"
+			} else if errors.Is(err, jwt.ErrSignatureInvalid) {
+				errMsg = "Invalid token signature"
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": errMsg})
+			c.Abort()
+			return
+		}
 
 		// Store user details in context
 		c.Set("user_id", claims.UserID)
@@ -61,3 +57,19 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// RequireRole rejects callers whose token does not carry one of roles. It runs
+// after AuthMiddleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		for _, r := range roles {
+			if r == role {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to do this"})
+		c.Abort()
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"uber-clone/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := auth.NewTokens("secret", time.Hour)
+	valid, _ := tokens.GenerateToken("user-1", "rider")
+	expired, _ := auth.NewTokens("secret", -time.Minute).GenerateToken("user-1", "rider")
+	forged, _ := auth.NewTokens("other", time.Hour).GenerateToken("user-1", "rider")
+	otherAlg, _ := jwt.NewWithClaims(jwt.SigningMethodHS512, &auth.Claims{UserID: "user-1", Role: "rider"}).SignedString([]byte("secret"))
+
+	r := gin.New()
+	r.GET("/", AuthMiddleware(tokens), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("user_id"))
+	})
+
+	tests := []struct {
+		name    string
+		header  string
+		want    int
+		wantErr string
+	}{
+		{"valid", "Bearer " + valid, http.StatusOK, ""},
+		{"missing header", "", http.StatusUnauthorized, "Authorization header required"},
+		{"not bearer", "Token " + valid, http.StatusUnauthorized, "Invalid token format"},
+		{"malformed", "Bearer not-a-jwt", http.StatusUnauthorized, "Invalid token"},
+		{"expired", "Bearer " + expired, http.StatusUnauthorized, "Token expired"},
+		{"wrong secret", "Bearer " + forged, http.StatusUnauthorized, "Invalid token signature"},
+		{"other algorithm", "Bearer " + otherAlg, http.StatusUnauthorized, "Invalid token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.wantErr != "" && !strings.Contains(w.Body.String(), `"error":"`+tt.wantErr+`"`) {
+				t.Fatalf("body %s, want error %q", w.Body, tt.wantErr)
+			}
+			if tt.want == http.StatusOK && w.Body.String() != "user-1" {
+				t.Fatalf("user_id %q in context", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"uber-clone/models"
+	"uber-clone/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IdempotencyHeader is the request header that makes a POST safe to retry
+const IdempotencyHeader = "Idempotency-Key"
+
+// idempotencyLock is how long a request may stay in flight before a retry with
+// the same key is let through, in case the first one died with its process
+const idempotencyLock = time.Minute
+
+// maxIdempotentBody bounds the request body read to fingerprint a request
+const maxIdempotentBody = 1 << 20
+
+// Idempotency makes retries of a request carrying an Idempotency-Key harmless. The
+// first response per user and key is stored for ttl and replayed to retries; a
+// retry while the first request is still running gets 409, and reusing a key
+// for a different request 422. Server errors are not stored, so the request can
+// be retried. It runs after AuthMiddleware; requests without the header pass.
+func Idempotency(repo store.IdempotencyRepo, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			c.Abort()
+			return
+		}
+
+		// One byte over the limit tells a body that is too large from one that fits
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxIdempotentBody+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the request body"})
+			c.Abort()
+			return
+		}
+		if len(body) > maxIdempotentBody {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now()
+		record := &models.IdempotencyRecord{
+			ID:          c.GetString("user_id") + ":" + key,
+			Fingerprint: fingerprint(c.Request.Method, c.Request.URL.Path, body),
+			LockedUntil: now.Add(idempotencyLock),
+			ExpiresAt:   now.Add(ttl),
+		}
+		existing, err := repo.Begin(c, record)
+		switch {
+		case errors.Is(err, store.ErrDuplicate):
+			replay(c, existing, record.Fingerprint)
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the idempotency key"})
+			c.Abort()
+			return
+		}
+
+		c.Set("idempotency_key", record.ID)
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		// Store the outcome even if the client has gone away
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if writer.Status() >= http.StatusInternalServerError {
+			err = repo.Release(ctx, record.ID)
+		} else {
+			err = repo.Complete(ctx, record.ID, writer.Status(), writer.Header().Get("Content-Type"), writer.body.Bytes())
+		}
+		if err != nil {
+			log.Println("Failed to store the idempotent response:", err)
+		}
+	}
+}
+
+// IdempotencyKey returns the key of the request, scoped to the caller, for passing
+// on to downstream providers; empty if the request has none
+func IdempotencyKey(c *gin.Context) string {
+	return c.GetString("idempotency_key")
+}
+
+// replay answers a retry from the stored record of the first request
+func replay(c *gin.Context, record *models.IdempotencyRecord, fingerprint string) {
+	defer c.Abort()
+	if record.Fingerprint != fingerprint {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+		return
+	}
+	if !record.Completed {
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+		return
+	}
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(record.Status, record.ContentType, record.Body)
+}
+
+// fingerprint identifies a request, so a key cannot be reused for another one
+func fingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, method+" "+path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the response body as it is written
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"uber-clone/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotencyBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/", Idempotency(store.NewMemoryStore().Idempotency, time.Hour), func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.JSON(http.StatusOK, gin.H{"read": len(body)})
+	})
+
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{"small", 10, http.StatusOK},
+		{"at the limit", maxIdempotentBody, http.StatusOK},
+		{"over the limit", maxIdempotentBody + 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", tt.size)))
+			req.Header.Set(IdempotencyHeader, tt.name)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("got %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), fmt.Sprintf(`"read":%d`, tt.size)) {
+				t.Fatalf("handler read %s, want the whole %d byte body", w.Body, tt.size)
+			}
+		})
+	}
+}
@@ -14,7 +14,7 @@ type User struct {
 	Email     string             `bson:"email" unique:"true"`
 	Phone     string             `bson:"phone"`
 	Password  string             `bson:"password"`
-	Role      string             `bson:"role"` // /rider/driver
+	Role      string             `bson:"role"` // /rider/driver/admin/support
 	Location  GeoJSON            `bson:"location"`
 	CreatedAt time.Time          `bson:"created_at"`
 }
@@ -28,29 +28,66 @@ type Driver struct {
 	CarPlate      string             `bson:"car_plate"`
 	IsAvailable   bool               `bson:"is_available"`
 	Location      GeoJSON            `bson:"location"`
+	Heading       float64            `bson:"heading"`                       // Last reported heading in degrees
+	Speed         float64            `bson:"speed"`                         // Last reported speed in km/h
+	LocationAt    time.Time          `bson:"location_updated_at,omitempty"` // When Location was last reported
+	RatingSum     float64            `bson:"rating_sum"`                    // Sum of rider ratings
+	RatingCount   int                `bson:"rating_count"`                  // Number of rider ratings
 	CreatedAt     time.Time          `json:"created_at"`
 }
 
+// AverageRating returns the driver's mean rider rating, or 0 when unrated
+func (d Driver) AverageRating() float64 {
+	if d.RatingCount == 0 {
+		return 0
+	}
+	return d.RatingSum / float64(d.RatingCount)
+}
+
+// Ride lifecycle states stored in rides.status
+const (
+	RideSearching = "searching" // queued for the batch dispatcher, no driver yet
+	RideRequested = "requested"
+	RideAccepted  = "accepted"
+	RideRejected  = "rejected"
+	RideOngoing   = "ongoing"
+	RideCompleted = "completed"
+	RideCancelled = "cancelled"
+)
+
 type Ride struct {
-	ID              primitive.ObjectID `bson:"_id,omitempty"`
-	RiderID         primitive.ObjectID `bson:"rider_id"`  // Reference to Users
-	DriverID        primitive.ObjectID `bson:"driver_id"` // Reference to Drivers
-	StartLocation   GeoJSON            `bson:"start_loc"` // GeoJSON Point
-	EndLocation     GeoJSON            `bson:"end_loc"`   // GeoJSON Point
-	Distance        float64            `bson:"distance"`  // In km (from DistanceMatrix.ai Maps)
-	Fare            float64            `bson:"fare"`      // Final calculated fare
-	VehicleType     string             `bson:"vehicle_type" validate:"required,oneof=two_wheeler three_wheeler car premium_car"`
-	Status          string             `bson:"status" validate:"oneof=requested pending ongoing completed cancelled"`
-	OTP             string             `bson:"otp"` // 6-digit code
-	SurgeMultiplier float64            `bson:"surge" default:"1.0"`
-	CancelledBy     string             `bson:"cancelled_by" validate:"omitempty,oneof=rider driver"`
-	CancellationFee float64            `bson:"cancellation_fee" default:"0"`
-	CreatedAt       time.Time          `bson:"created_at"`
-	CancelledAt     time.Time          `bson:"cancelled_at,omitempty"`
-	AcceptedAt      time.Time          `bson:"accepted_at,omitempty"`
-	RejectedAt      time.Time          `bson:"rejected_at,omitempty"`
-	CompletedAt     time.Time          `bson:"completed_at,omitempty"`
-	PaymentStatus   string             `bson:"payment_status" default:"pending"`
+	ID                     primitive.ObjectID   `bson:"_id,omitempty"`
+	RiderID                primitive.ObjectID   `bson:"rider_id"`                   // Reference to Users
+	DriverID               primitive.ObjectID   `bson:"driver_id"`                  // Reference to Drivers
+	RejectedDrivers        []primitive.ObjectID `bson:"rejected_drivers,omitempty"` // Drivers that declined or ignored the ride
+	DispatchAttempts       int                  `bson:"dispatch_attempts"`          // Number of drivers offered the ride so far
+	StartLocation          GeoJSON              `bson:"start_loc"`                  // GeoJSON Point
+	EndLocation            GeoJSON              `bson:"end_loc"`                    // GeoJSON Point
+	Distance               float64              `bson:"distance"`                   // In km (from DistanceMatrix.ai Maps)
+	Fare                   float64              `bson:"fare"`                       // Final calculated fare
+	EstimatedFare          float64              `bson:"estimated_fare"`             // Fare quoted when the ride was requested
+	TripDistance           float64              `bson:"trip_distance"`              // In km, travelled while ongoing as reported by the driver
+	VehicleType            string               `bson:"vehicle_type" validate:"required,oneof=two_wheeler three_wheeler car premium_car"`
+	Status                 string               `bson:"status" validate:"oneof=searching requested accepted rejected ongoing completed cancelled"`
+	OTP                    string               `bson:"otp"` // 6-digit code
+	SurgeMultiplier        float64              `bson:"surge" default:"1.0"`
+	CancelledBy            string               `bson:"cancelled_by" validate:"omitempty,oneof=rider driver"`
+	CancelledByUser        primitive.ObjectID   `bson:"cancelled_by_user_id,omitempty"` // Reference to Users
+	CancellationFee        float64              `bson:"cancellation_fee" default:"0"`
+	CancellationRule       string               `bson:"cancellation_rule,omitempty"` // Policy rule that set CancellationFee
+	CreatedAt              time.Time            `bson:"created_at"`
+	CancelledAt            time.Time            `bson:"cancelled_at,omitempty"`
+	AcceptedAt             time.Time            `bson:"accepted_at,omitempty"`
+	ArrivedAt              time.Time            `bson:"arrived_at,omitempty"` // When the driver reached the pickup point
+	RejectedAt             time.Time            `bson:"rejected_at,omitempty"`
+	CompletedAt            time.Time            `bson:"completed_at,omitempty"`
+	StartedAt              time.Time            `bson:"started_at,omitempty"`
+	DispatchOwner          string               `bson:"dispatch_owner,omitempty"`                                                                  // Batch dispatcher process holding a searching ride
+	DispatchLeaseUntil     time.Time            `bson:"dispatch_lease_until,omitempty"`                                                            // Until when DispatchOwner holds it
+	MatchStrategy          string               `bson:"match_strategy,omitempty"`                                                                  // Matcher that picked the driver, for A/B comparison
+	PaymentStatus          string               `bson:"payment_status" validate:"omitempty,oneof=pending paid failed refunded partially_refunded"` // Empty until payment is requested
+	FareBreakdown          *FareBreakdown       `bson:"fare_breakdown,omitempty"`                                                                  // Itemization of Fare
+	EstimatedFareBreakdown *FareBreakdown       `bson:"estimated_fare_breakdown,omitempty"`                                                        // Itemization of EstimatedFare
 }
 
 type GeoJSON struct {
@@ -60,13 +97,41 @@ type GeoJSON struct {
 
 type Payment struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty"`
-	RideID        primitive.ObjectID `bson:"ride_id"`        // Reference to Rides
-	Amount        float64            `bson:"amount"`         // Positive: Rider paid, Negative: Refund
-	Currency      string             `bson:"currency"`       // Currency code, e.g., "INR"
-	PaymentIntent string             `bson:"payment_intent"` // Stripe Payment Intent ID
-	Status        string             `bson:"status" validate:"oneof=pending completed failed"`
+	RideID        primitive.ObjectID `bson:"ride_id"`                                                                                                                       // Reference to Rides
+	Amount        float64            `bson:"amount"`                                                                                                                        // Positive: Rider paid, Negative: Refund
+	Currency      string             `bson:"currency"`                                                                                                                      // Currency code, e.g., "INR"
+	PaymentIntent string             `bson:"payment_intent"`                                                                                                                // Stripe Payment Intent ID, or Refund ID for a refund
+	Status        string             `bson:"status" validate:"oneof=requires_payment_method requires_action processing requires_capture succeeded canceled failed pending"` // The provider's intent or refund status; failed once a charge is declined
 	CreatedAt     time.Time          `bson:"created_at"`
+	CompletedAt   time.Time          `bson:"completed_at,omitempty"` // When the payment succeeded
 	StripeID      string             `bson:"stripe_id"`
+	FailureReason string             `bson:"failure_reason,omitempty"` // Why the provider failed or canceled it
+	Refunded      float64            `bson:"refunded,omitempty"`       // Refunded so far, as last reported by the provider
+	DisputedAt    time.Time          `bson:"disputed_at,omitempty"`
+	DisputeReason string             `bson:"dispute_reason,omitempty"`
+	RefundOf      string             `bson:"refund_of,omitempty"` // Payment intent a refund returns money from
+	Reason        string             `bson:"reason,omitempty"`    // Reason code of a refund
+	IssuedBy      primitive.ObjectID `bson:"issued_by,omitempty"` // Reference to Users; the agent who refunded
+}
+
+// IdempotencyRecord is the first response to a request carrying an Idempotency-Key,
+// replayed to retries of it. It is in flight until Completed.
+type IdempotencyRecord struct {
+	ID          string    `bson:"_id"`         // User ID and key
+	Fingerprint string    `bson:"fingerprint"` // Method, path and body hash of the first request
+	Completed   bool      `bson:"completed"`
+	Status      int       `bson:"status,omitempty"`
+	ContentType string    `bson:"content_type,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	LockedUntil time.Time `bson:"locked_until"` // An in-flight request past this is presumed dead
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+// WebhookEvent is a payment provider event that was handled, kept to drop redeliveries
+type WebhookEvent struct {
+	ID         string    `bson:"_id"` // The provider's event ID
+	Type       string    `bson:"type"`
+	ReceivedAt time.Time `bson:"received_at"`
 }
 
 type Feedback struct {
@@ -77,3 +142,43 @@ type Feedback struct {
 	Comment   string             `bson:"comment"`
 	CreatedAt time.Time          `bson:"created_at"`
 }
+
+// models/fare_card.go
+// FareCard is the tariff of a vehicle type in a city. A card with an empty City
+// applies wherever no city card does.
+type FareCard struct {
+	ID                 primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	City               string             `bson:"city" json:"city"`
+	Center             *GeoJSON           `bson:"center,omitempty" json:"center,omitempty"`       // City cards apply within RadiusKm of Center
+	RadiusKm           float64            `bson:"radius_km,omitempty" json:"radius_km,omitempty"` // Required with a City
+	VehicleType        string             `bson:"vehicle_type" json:"vehicle_type" binding:"required,oneof=two_wheeler three_wheeler car premium_car"`
+	BaseFare           float64            `bson:"base_fare" json:"base_fare" binding:"min=0"`
+	PerKm              float64            `bson:"per_km" json:"per_km" binding:"min=0"`
+	PerMinute          float64            `bson:"per_minute" json:"per_minute" binding:"min=0"`
+	MinimumFare        float64            `bson:"minimum_fare" json:"minimum_fare" binding:"min=0"`
+	BookingFee         float64            `bson:"booking_fee" json:"booking_fee" binding:"min=0"`
+	TaxRate            float64            `bson:"tax_rate" json:"tax_rate" binding:"min=0,max=1"`                   // Fraction, e.g. 0.05 for 5%
+	WaitingPerMinute   float64            `bson:"waiting_per_minute" json:"waiting_per_minute" binding:"min=0"`     // Charged for waiting at pickup
+	FreeWaitingMinutes float64            `bson:"free_waiting_minutes" json:"free_waiting_minutes" binding:"min=0"` // Waiting at pickup that is not charged
+	UpdatedAt          time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// FareBreakdown itemizes a fare. Surge multiplies the base, distance and time
+// components; the minimum fare, waiting charge, booking fee and taxes apply after it.
+type FareBreakdown struct {
+	FareCardID       primitive.ObjectID `bson:"fare_card_id,omitempty" json:"fare_card_id,omitempty"` // Empty for the configured fallback rates
+	City             string             `bson:"city" json:"city"`
+	DistanceKm       float64            `bson:"distance_km" json:"distance_km"`
+	DurationMin      float64            `bson:"duration_min" json:"duration_min"`
+	BaseFare         float64            `bson:"base_fare" json:"base_fare"`
+	DistanceFare     float64            `bson:"distance_fare" json:"distance_fare"`
+	TimeFare         float64            `bson:"time_fare" json:"time_fare"`
+	WaitingMin       float64            `bson:"waiting_min,omitempty" json:"waiting_min,omitempty"`
+	WaitingFare      float64            `bson:"waiting_fare,omitempty" json:"waiting_fare,omitempty"`
+	SurgeMultiplier  float64            `bson:"surge_multiplier" json:"surge_multiplier"`
+	SurgeAmount      float64            `bson:"surge_amount" json:"surge_amount"`
+	MinimumFareTopUp float64            `bson:"minimum_fare_top_up" json:"minimum_fare_top_up"`
+	BookingFee       float64            `bson:"booking_fee" json:"booking_fee"`
+	Tax              float64            `bson:"tax" json:"tax"`
+	Total            float64            `bson:"total" json:"total"`
+}
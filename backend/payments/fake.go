@@ -0,0 +1,269 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Scenario is how the fake gateway's payments play out
+type Scenario string
+
+// Scenarios the fake gateway can simulate
+const (
+	ScenarioSucceed        Scenario = "succeed"         // The card is charged
+	ScenarioDecline        Scenario = "decline"         // The card is declined
+	ScenarioRequiresAction Scenario = "requires_action" // The bank asks for 3D Secure first
+	ScenarioNetworkError   Scenario = "network_error"   // Every call fails with ErrUnavailable
+)
+
+var errFakeNotFound = errors.New("no such payment intent")
+
+// FakeGateway is an in-memory Gateway for tests. An intent takes the scenario set
+// when it was created; Confirm plays the rider's card payment and CompleteAction
+// the 3D Secure challenge, which Stripe.js would do in the browser.
+type FakeGateway struct {
+	mu       sync.Mutex
+	scenario Scenario
+	intents  map[string]*fakeIntent
+	keys     map[string]string  // Intent ID by idempotency key
+	refunds  map[string]*Refund // By idempotency key
+	lastID   int
+}
+
+type fakeIntent struct {
+	Intent
+	scenario  Scenario
+	manual    bool  // Held for CaptureIntent once paid
+	confirmed bool  // The rider has tried to pay
+	refunded  int64 // Refunded so far
+}
+
+// NewFakeGateway returns a gateway whose payments succeed until SetScenario
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		scenario: ScenarioSucceed,
+		intents:  make(map[string]*fakeIntent),
+		keys:     make(map[string]string),
+		refunds:  make(map[string]*Refund),
+	}
+}
+
+// SetScenario changes how intents created from now on play out. A network error
+// affects every call straight away, until another scenario is set.
+func (g *FakeGateway) SetScenario(s Scenario) {
+	g.mu.Lock()
+	g.scenario = s
+	g.mu.Unlock()
+}
+
+func (g *FakeGateway) newID(prefix string) string {
+	g.lastID++
+	return fmt.Sprintf("%s_fake_%d", prefix, g.lastID)
+}
+
+// CreateIntent implements Gateway
+func (g *FakeGateway) CreateIntent(p IntentParams) (*Intent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.scenario == ScenarioNetworkError {
+		return nil, ErrUnavailable
+	}
+	if p.Amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive, got %d", p.Amount)
+	}
+	if id, ok := g.keys[p.IdempotencyKey]; ok && p.IdempotencyKey != "" {
+		return g.intents[id].view(), nil
+	}
+
+	id := g.newID("pi")
+	intent := &fakeIntent{
+		Intent: Intent{
+			ID:           id,
+			ClientSecret: id + "_secret",
+			Amount:       p.Amount,
+			Currency:     p.Currency,
+			Status:       StatusRequiresPaymentMethod,
+			Metadata:     copyMetadata(p.Metadata),
+		},
+		scenario: g.scenario,
+		manual:   p.ManualCapture,
+	}
+	g.intents[id] = intent
+	if p.IdempotencyKey != "" {
+		g.keys[p.IdempotencyKey] = id
+	}
+	return intent.view(), nil
+}
+
+// GetIntent implements Gateway
+func (g *FakeGateway) GetIntent(id string) (*Intent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	intent, err := g.intent(id)
+	if err != nil {
+		return nil, err
+	}
+	return intent.view(), nil
+}
+
+// Confirm pays an intent with the rider's card, as the client would
+func (g *FakeGateway) Confirm(id string) (*Intent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	intent, err := g.intent(id)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != StatusRequiresPaymentMethod {
+		return nil, fmt.Errorf("intent %s cannot be confirmed in status %s", id, intent.Status)
+	}
+	if err := g.confirm(intent); err != nil {
+		return nil, err
+	}
+	return intent.view(), nil
+}
+
+func (g *FakeGateway) confirm(intent *fakeIntent) error {
+	intent.confirmed = true
+	switch intent.scenario {
+	case ScenarioDecline:
+		return fmt.Errorf("%w: your card was declined", ErrDeclined)
+	case ScenarioRequiresAction:
+		intent.Status = StatusRequiresAction
+	default:
+		g.authorize(intent)
+	}
+	return nil
+}
+
+// CompleteAction passes the 3D Secure challenge of an intent
+func (g *FakeGateway) CompleteAction(id string) (*Intent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	intent, err := g.intent(id)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != StatusRequiresAction {
+		return nil, fmt.Errorf("intent %s has no pending action", id)
+	}
+	g.authorize(intent)
+	return intent.view(), nil
+}
+
+// authorize moves a paid intent on: captured at once, or held for CaptureIntent
+func (g *FakeGateway) authorize(intent *fakeIntent) {
+	if intent.manual {
+		intent.Status = StatusRequiresCapture
+	} else {
+		intent.Status = StatusSucceeded
+	}
+}
+
+// CaptureIntent implements Gateway
+func (g *FakeGateway) CaptureIntent(id string, amount int64) (*Intent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	intent, err := g.intent(id)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != StatusRequiresCapture {
+		return nil, fmt.Errorf("intent %s cannot be captured in status %s", id, intent.Status)
+	}
+	if amount > intent.Amount {
+		return nil, fmt.Errorf("cannot capture %d of an intent for %d", amount, intent.Amount)
+	}
+	if amount > 0 {
+		intent.Amount = amount
+	}
+	intent.Status = StatusSucceeded
+	return intent.view(), nil
+}
+
+// CancelIntent implements Gateway
+func (g *FakeGateway) CancelIntent(id string) (*Intent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	intent, err := g.intent(id)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status == StatusSucceeded || intent.Status == StatusCanceled {
+		return nil, fmt.Errorf("intent %s cannot be canceled in status %s", id, intent.Status)
+	}
+	intent.Status = StatusCanceled
+	return intent.view(), nil
+}
+
+// Refund implements Gateway
+func (g *FakeGateway) Refund(p RefundParams) (*Refund, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	intent, err := g.intent(p.IntentID)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status != StatusSucceeded {
+		return nil, fmt.Errorf("intent %s cannot be refunded in status %s", p.IntentID, intent.Status)
+	}
+	if r, ok := g.refunds[p.IdempotencyKey]; ok && p.IdempotencyKey != "" {
+		refund := *r
+		return &refund, nil
+	}
+
+	left := intent.Amount - intent.refunded
+	amount := p.Amount
+	if amount == 0 {
+		amount = left
+	}
+	if amount <= 0 || amount > left {
+		return nil, fmt.Errorf("cannot refund %d of intent %s, %d left", amount, p.IntentID, left)
+	}
+	intent.refunded += amount
+
+	r := &Refund{
+		ID:       g.newID("re"),
+		IntentID: p.IntentID,
+		Amount:   amount,
+		Currency: intent.Currency,
+		Status:   StatusSucceeded,
+		Metadata: copyMetadata(p.Metadata),
+	}
+	if p.IdempotencyKey != "" {
+		g.refunds[p.IdempotencyKey] = r
+	}
+	refund := *r
+	return &refund, nil
+}
+
+// intent looks up an intent, failing like Stripe would in a network error scenario
+func (g *FakeGateway) intent(id string) (*fakeIntent, error) {
+	if g.scenario == ScenarioNetworkError {
+		return nil, ErrUnavailable
+	}
+	intent, ok := g.intents[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errFakeNotFound, id)
+	}
+	return intent, nil
+}
+
+// view copies the intent so callers cannot change the gateway's state
+func (i *fakeIntent) view() *Intent {
+	intent := i.Intent
+	intent.Metadata = copyMetadata(i.Metadata)
+	return &intent
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package payments
+
+import "errors"
+
+// Intent statuses, mirroring Stripe's PaymentIntent lifecycle
+const (
+	StatusRequiresPaymentMethod = "requires_payment_method"
+	StatusRequiresAction        = "requires_action"
+	StatusProcessing            = "processing"
+	StatusRequiresCapture       = "requires_capture"
+	StatusSucceeded             = "succeeded"
+	StatusCanceled              = "canceled"
+)
+
+var (
+	// ErrDeclined means the provider refused the payment, e.g. the card was declined
+	ErrDeclined = errors.New("payment declined")
+	// ErrUnavailable means the provider could not be reached; the call may be retried
+	ErrUnavailable = errors.New("payment provider unavailable")
+)
+
+// Intent is a provider-neutral view of a payment intent
+type Intent struct {
+	ID           string
+	ClientSecret string
+	Amount       int64 // In the currency's minor unit, e.g. paise
+	Currency     string
+	Status       string
+	Metadata     map[string]string
+}
+
+// IntentParams describes a payment to collect
+type IntentParams struct {
+	Amount        int64 // In the currency's minor unit
+	Currency      string
+	Metadata      map[string]string
+	ManualCapture bool // Only authorize; CaptureIntent collects the money later
+
+	// IdempotencyKey makes the provider return the intent first created with the
+	// key instead of creating another
+	IdempotencyKey string
+}
+
+// Refund is money returned on a succeeded intent
+type Refund struct {
+	ID       string
+	IntentID string
+	Amount   int64 // In the currency's minor unit
+	Currency string
+	Status   string
+	Metadata map[string]string
+}
+
+// RefundParams describes a refund; a zero Amount refunds whatever is left
+type RefundParams struct {
+	IntentID string
+	Amount   int64 // In the currency's minor unit
+	Metadata map[string]string
+
+	// IdempotencyKey makes the provider return the refund first created with the
+	// key instead of refunding again
+	IdempotencyKey string
+}
+
+// Gateway is the payment provider the ride flow charges through
+type Gateway interface {
+	CreateIntent(p IntentParams) (*Intent, error)
+	GetIntent(id string) (*Intent, error)
+	// CaptureIntent collects an authorized intent; a zero amount captures all of it
+	CaptureIntent(id string, amount int64) (*Intent, error)
+	// CancelIntent abandons an intent that has not succeeded
+	CancelIntent(id string) (*Intent, error)
+	Refund(p RefundParams) (*Refund, error)
+}
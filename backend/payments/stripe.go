@@ -0,0 +1,136 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/paymentintent"
+	"github.com/stripe/stripe-go/v72/refund"
+)
+
+// StripeGateway charges through Stripe PaymentIntents with its own API key rather
+// than the package-level stripe.Key
+type StripeGateway struct {
+	intents paymentintent.Client
+	refunds refund.Client
+}
+
+// NewStripeGateway returns a gateway authenticated with the given secret key
+func NewStripeGateway(secretKey string) *StripeGateway {
+	backend := stripe.GetBackend(stripe.APIBackend)
+	return &StripeGateway{
+		intents: paymentintent.Client{B: backend, Key: secretKey},
+		refunds: refund.Client{B: backend, Key: secretKey},
+	}
+}
+
+// CreateIntent implements Gateway
+func (g *StripeGateway) CreateIntent(p IntentParams) (*Intent, error) {
+	params := &stripe.PaymentIntentParams{
+		Amount:             stripe.Int64(p.Amount),
+		Currency:           stripe.String(strings.ToLower(p.Currency)),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+	}
+	if p.ManualCapture {
+		params.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+	}
+	for k, v := range p.Metadata {
+		params.AddMetadata(k, v)
+	}
+	if p.IdempotencyKey != "" {
+		params.SetIdempotencyKey(p.IdempotencyKey)
+	}
+
+	pi, err := g.intents.New(params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return fromStripe(pi), nil
+}
+
+// GetIntent implements Gateway
+func (g *StripeGateway) GetIntent(id string) (*Intent, error) {
+	pi, err := g.intents.Get(id, nil)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return fromStripe(pi), nil
+}
+
+// CaptureIntent implements Gateway
+func (g *StripeGateway) CaptureIntent(id string, amount int64) (*Intent, error) {
+	params := &stripe.PaymentIntentCaptureParams{}
+	if amount > 0 {
+		params.AmountToCapture = stripe.Int64(amount)
+	}
+	pi, err := g.intents.Capture(id, params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return fromStripe(pi), nil
+}
+
+// CancelIntent implements Gateway
+func (g *StripeGateway) CancelIntent(id string) (*Intent, error) {
+	pi, err := g.intents.Cancel(id, nil)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return fromStripe(pi), nil
+}
+
+// Refund implements Gateway
+func (g *StripeGateway) Refund(p RefundParams) (*Refund, error) {
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(p.IntentID)}
+	if p.Amount > 0 {
+		params.Amount = stripe.Int64(p.Amount)
+	}
+	for k, v := range p.Metadata {
+		params.AddMetadata(k, v)
+	}
+	if p.IdempotencyKey != "" {
+		params.SetIdempotencyKey(p.IdempotencyKey)
+	}
+
+	r, err := g.refunds.New(params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return &Refund{
+		ID:       r.ID,
+		IntentID: p.IntentID,
+		Amount:   r.Amount,
+		Currency: strings.ToUpper(string(r.Currency)),
+		Status:   string(r.Status),
+		Metadata: r.Metadata,
+	}, nil
+}
+
+func fromStripe(pi *stripe.PaymentIntent) *Intent {
+	return &Intent{
+		ID:           pi.ID,
+		ClientSecret: pi.ClientSecret,
+		Amount:       pi.Amount,
+		Currency:     strings.ToUpper(string(pi.Currency)),
+		Status:       string(pi.Status),
+		Metadata:     pi.Metadata,
+	}
+}
+
+// stripeError wraps declines in ErrDeclined and failures to reach Stripe in
+// ErrUnavailable; other API errors, e.g. invalid requests, pass through
+func stripeError(err error) error {
+	var se *stripe.Error
+	if !errors.As(err, &se) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	switch {
+	case se.Type == stripe.ErrorTypeCard:
+		return fmt.Errorf("%w: %s", ErrDeclined, se.Msg)
+	case se.HTTPStatusCode >= 500:
+		return fmt.Errorf("%w: %s", ErrUnavailable, se.Msg)
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// Webhook event types the ride flow acts on
+const (
+	EventIntentSucceeded = "payment_intent.succeeded"
+	EventIntentFailed    = "payment_intent.payment_failed"
+	EventIntentCanceled  = "payment_intent.canceled"
+	EventChargeRefunded  = "charge.refunded"
+	EventDisputeCreated  = "charge.dispute.created"
+)
+
+// ErrBadSignature is returned for a webhook that was not signed with our secret, or
+// was signed too long ago to rule out a replay
+var ErrBadSignature = errors.New("invalid webhook signature")
+
+// Event is a provider-neutral view of a webhook event about a payment intent
+type Event struct {
+	ID             string
+	Type           string
+	Created        time.Time
+	IntentID       string
+	Amount         int64 // Of the intent or charge, in the currency's minor unit
+	AmountRefunded int64 // charge.refunded only
+	Currency       string
+	Metadata       map[string]string // Of the intent or charge
+	Reason         string            // Why a payment failed or was disputed
+	Refunds        []Refund          // charge.refunded only, as far as the event lists them
+}
+
+// ParseStripeEvent verifies the Stripe-Signature header of a webhook payload and
+// decodes the event. Events of other types come back with only ID, Type and Created.
+func ParseStripeEvent(payload []byte, signature, secret string) (*Event, error) {
+	se, err := webhook.ConstructEvent(payload, signature, secret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+
+	event := &Event{ID: se.ID, Type: se.Type, Created: time.Unix(se.Created, 0)}
+	if se.Data == nil {
+		return event, nil
+	}
+	raw := se.Data.Raw
+
+	switch se.Type {
+	case EventIntentSucceeded, EventIntentFailed, EventIntentCanceled:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(raw, &pi); err != nil {
+			return nil, err
+		}
+		event.IntentID, event.Amount, event.Metadata = pi.ID, pi.Amount, pi.Metadata
+		event.Currency = strings.ToUpper(string(pi.Currency))
+		if pi.LastPaymentError != nil {
+			event.Reason = pi.LastPaymentError.Msg
+		} else if pi.CancellationReason != "" {
+			event.Reason = string(pi.CancellationReason)
+		}
+
+	case EventChargeRefunded:
+		var ch stripe.Charge
+		if err := json.Unmarshal(raw, &ch); err != nil {
+			return nil, err
+		}
+		if ch.PaymentIntent != nil {
+			event.IntentID = ch.PaymentIntent.ID
+		}
+		event.Amount, event.AmountRefunded, event.Metadata = ch.Amount, ch.AmountRefunded, ch.Metadata
+		event.Currency = strings.ToUpper(string(ch.Currency))
+		if ch.Refunds != nil {
+			for _, r := range ch.Refunds.Data {
+				event.Refunds = append(event.Refunds, Refund{
+					ID:       r.ID,
+					IntentID: event.IntentID,
+					Amount:   r.Amount,
+					Currency: strings.ToUpper(string(r.Currency)),
+					Status:   string(r.Status),
+					Metadata: r.Metadata,
+				})
+			}
+		}
+
+	case EventDisputeCreated:
+		var d stripe.Dispute
+		if err := json.Unmarshal(raw, &d); err != nil {
+			return nil, err
+		}
+		if d.PaymentIntent != nil {
+			event.IntentID = d.PaymentIntent.ID
+		}
+		event.Amount, event.Metadata, event.Reason = d.Amount, d.Metadata, string(d.Reason)
+		event.Currency = strings.ToUpper(string(d.Currency))
+	}
+	return event, nil
+}
@@ -0,0 +1,244 @@
+package routes
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"uber-clone/payments"
+	"uber-clone/websockets"
+
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+const webhookSecret = "whsec_test"
+
+// completedRide takes a ride from request to completion and returns the rider's
+// token and the ride ID
+func (ta *testApp) completedRide(t *testing.T) (string, string) {
+	t.Helper()
+	rider := ta.signup(t, "rider", "rider@example.com", 12.9716, 77.5946)
+	driver := ta.signup(t, "driver", "driver@example.com", 12.9720, 77.5950)
+
+	ride := ta.must(t, http.StatusCreated, "POST", "/rides/", rider, map[string]interface{}{
+		"start_lat": 12.9716, "start_lng": 77.5946, "end_lat": 12.9352, "end_lng": 77.6245, "vehicle_type": "car",
+	})
+	id := ride["ride_id"].(string)
+	ta.must(t, http.StatusOK, "POST", "/rides/"+id+"/respond", driver, map[string]interface{}{"accept": true})
+	ta.must(t, http.StatusOK, "POST", "/rides/"+id+"/verifyOTP", driver, map[string]interface{}{"otp": ride["otp"]})
+	ta.must(t, http.StatusOK, "POST", "/rides/"+id+"/complete", driver, nil)
+	return rider, id
+}
+
+// pay asks for a payment of the ride and returns the intent the rider pays
+func (ta *testApp) pay(t *testing.T, rider, rideID string) string {
+	t.Helper()
+	out := ta.must(t, http.StatusCreated, "POST", "/rides/"+rideID+"/pay", rider, nil)
+	return out["payment_id"].(string)
+}
+
+func (ta *testApp) confirm(t *testing.T, status int, rider, rideID, intentID string) {
+	t.Helper()
+	ta.must(t, status, "POST", "/rides/"+rideID+"/confirm-payment", rider, map[string]interface{}{"payment_intent_id": intentID})
+}
+
+func (ta *testApp) paymentStatus(t *testing.T, rider, rideID string) string {
+	t.Helper()
+	return ta.must(t, http.StatusOK, "GET", "/rides/"+rideID, rider, nil)["payment_status"].(string)
+}
+
+// webhook delivers a payment intent event signed like Stripe would
+func (ta *testApp) webhook(t *testing.T, eventType, intentID, rideID string) {
+	t.Helper()
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":   fmt.Sprintf("evt_%s_%d", intentID, time.Now().UnixNano()),
+		"type": eventType,
+		"data": map[string]interface{}{"object": map[string]interface{}{
+			"id": intentID, "object": "payment_intent", "currency": "inr",
+			"metadata":           map[string]string{"ride_id": rideID},
+			"last_payment_error": map[string]string{"message": "Your card was declined."},
+		}},
+	})
+	now := time.Now()
+	sig := hex.EncodeToString(webhook.ComputeSignature(now, payload, webhookSecret))
+	req, _ := http.NewRequest("POST", ta.srv.URL+"/webhooks/stripe", strings.NewReader(string(payload)))
+	req.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), sig))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("webhook %s: got %d", eventType, resp.StatusCode)
+	}
+}
+
+func newPaymentTestApp(t *testing.T) *testApp {
+	t.Setenv("STRIPE_WEBHOOK_SECRET", webhookSecret)
+	return newTestApp(t, websockets.NewHub())
+}
+
+func TestPaymentSucceeds(t *testing.T) {
+	ta := newPaymentTestApp(t)
+	rider, rideID := ta.completedRide(t)
+
+	intentID := ta.pay(t, rider, rideID)
+	if got := ta.paymentStatus(t, rider, rideID); got != "pending" {
+		t.Fatalf("payment status %q after /pay, want pending", got)
+	}
+	ta.must(t, http.StatusConflict, "POST", "/rides/"+rideID+"/pay", rider, nil) // Already asked for
+
+	ta.confirm(t, http.StatusBadRequest, rider, rideID, intentID) // Not paid yet
+	if _, err := ta.gateway.Confirm(intentID); err != nil {
+		t.Fatal(err)
+	}
+	other := ta.signup(t, "rider", "other@example.com", 12.9716, 77.5946)
+	ta.confirm(t, http.StatusForbidden, other, rideID, intentID) // Not their ride
+	ta.confirm(t, http.StatusOK, rider, rideID, intentID)
+	ta.confirm(t, http.StatusOK, rider, rideID, intentID) // Idempotent
+	if got := ta.paymentStatus(t, rider, rideID); got != "paid" {
+		t.Fatalf("payment status %q, want paid", got)
+	}
+	ta.must(t, http.StatusConflict, "POST", "/rides/"+rideID+"/pay", rider, nil)
+}
+
+func TestPaymentDeclined(t *testing.T) {
+	ta := newPaymentTestApp(t)
+	rider, rideID := ta.completedRide(t)
+
+	ta.gateway.SetScenario(payments.ScenarioDecline)
+	intentID := ta.pay(t, rider, rideID)
+	if _, err := ta.gateway.Confirm(intentID); !errors.Is(err, payments.ErrDeclined) {
+		t.Fatalf("Confirm = %v, want a decline", err)
+	}
+	ta.confirm(t, http.StatusBadRequest, rider, rideID, intentID)
+
+	// The failure arrives by webhook, after which the rider can pay again
+	ta.webhook(t, payments.EventIntentFailed, intentID, rideID)
+	if got := ta.paymentStatus(t, rider, rideID); got != "failed" {
+		t.Fatalf("payment status %q after the decline, want failed", got)
+	}
+
+	ta.gateway.SetScenario(payments.ScenarioSucceed)
+	retry := ta.pay(t, rider, rideID)
+	if retry == intentID {
+		t.Fatal("retry reused the declined intent")
+	}
+	ta.gateway.Confirm(retry)
+	ta.confirm(t, http.StatusOK, rider, rideID, retry)
+	if got := ta.paymentStatus(t, rider, rideID); got != "paid" {
+		t.Fatalf("payment status %q, want paid", got)
+	}
+}
+
+func TestPaymentRequiresAction(t *testing.T) {
+	ta := newPaymentTestApp(t)
+	rider, rideID := ta.completedRide(t)
+
+	ta.gateway.SetScenario(payments.ScenarioRequiresAction)
+	intentID := ta.pay(t, rider, rideID)
+	intent, err := ta.gateway.Confirm(intentID)
+	if err != nil || intent.Status != payments.StatusRequiresAction {
+		t.Fatalf("Confirm = %v, %v, want a 3D Secure challenge", intent, err)
+	}
+	ta.confirm(t, http.StatusBadRequest, rider, rideID, intentID)
+	if got := ta.paymentStatus(t, rider, rideID); got != "pending" {
+		t.Fatalf("payment status %q during the challenge, want pending", got)
+	}
+
+	if _, err := ta.gateway.CompleteAction(intentID); err != nil {
+		t.Fatal(err)
+	}
+	ta.confirm(t, http.StatusOK, rider, rideID, intentID)
+	if got := ta.paymentStatus(t, rider, rideID); got != "paid" {
+		t.Fatalf("payment status %q, want paid", got)
+	}
+}
+
+func TestPaymentGatewayUnavailable(t *testing.T) {
+	ta := newPaymentTestApp(t)
+	rider, rideID := ta.completedRide(t)
+
+	// Nothing is recorded when the intent cannot be created, so a retry works
+	ta.gateway.SetScenario(payments.ScenarioNetworkError)
+	ta.must(t, http.StatusServiceUnavailable, "POST", "/rides/"+rideID+"/pay", rider, nil)
+	if got := ta.paymentStatus(t, rider, rideID); got != "" {
+		t.Fatalf("payment status %q after a failed /pay, want none", got)
+	}
+
+	ta.gateway.SetScenario(payments.ScenarioSucceed)
+	intentID := ta.pay(t, rider, rideID)
+	ta.gateway.Confirm(intentID)
+
+	ta.gateway.SetScenario(payments.ScenarioNetworkError)
+	ta.confirm(t, http.StatusServiceUnavailable, rider, rideID, intentID)
+	ta.gateway.SetScenario(payments.ScenarioSucceed)
+	ta.confirm(t, http.StatusOK, rider, rideID, intentID)
+	if got := ta.paymentStatus(t, rider, rideID); got != "paid" {
+		t.Fatalf("payment status %q, want paid", got)
+	}
+}
+
+func TestCancellationFeeCharged(t *testing.T) {
+	t.Setenv("CANCELLATION_FREE_WINDOW", "0s")
+	ta := newPaymentTestApp(t)
+	rider := ta.signup(t, "rider", "rider@example.com", 12.9716, 77.5946)
+	driver := ta.signup(t, "driver", "driver@example.com", 12.9720, 77.5950)
+
+	ride := ta.must(t, http.StatusCreated, "POST", "/rides/", rider, map[string]interface{}{
+		"start_lat": 12.9716, "start_lng": 77.5946, "end_lat": 12.9352, "end_lng": 77.6245, "vehicle_type": "car",
+	})
+	rideID := ride["ride_id"].(string)
+	ta.must(t, http.StatusOK, "POST", "/rides/"+rideID+"/respond", driver, map[string]interface{}{"accept": true})
+
+	out := ta.must(t, http.StatusOK, "POST", "/rides/"+rideID+"/cancel", rider, nil)
+	if out["cancellation_fee"] != 25.0 || out["payment"] == nil {
+		t.Fatalf("cancel = %v, want the fee of 25 charged", out)
+	}
+	if got := ta.paymentStatus(t, rider, rideID); got != "pending" {
+		t.Fatalf("payment status %q after the cancellation, want pending", got)
+	}
+	ta.must(t, http.StatusConflict, "POST", "/rides/"+rideID+"/pay", rider, nil) // Already charged
+
+	intentID := out["payment"].(map[string]interface{})["payment_id"].(string)
+	ta.gateway.Confirm(intentID)
+	ta.confirm(t, http.StatusOK, rider, rideID, intentID)
+	if got := ta.paymentStatus(t, rider, rideID); got != "paid" {
+		t.Fatalf("payment status %q, want paid", got)
+	}
+}
+
+// A fee that could not be charged with the cancellation is paid through /pay
+func TestCancellationFeeChargeRetried(t *testing.T) {
+	t.Setenv("CANCELLATION_FREE_WINDOW", "0s")
+	ta := newPaymentTestApp(t)
+	rider := ta.signup(t, "rider", "rider@example.com", 12.9716, 77.5946)
+	driver := ta.signup(t, "driver", "driver@example.com", 12.9720, 77.5950)
+
+	ride := ta.must(t, http.StatusCreated, "POST", "/rides/", rider, map[string]interface{}{
+		"start_lat": 12.9716, "start_lng": 77.5946, "end_lat": 12.9352, "end_lng": 77.6245, "vehicle_type": "car",
+	})
+	rideID := ride["ride_id"].(string)
+	ta.must(t, http.StatusOK, "POST", "/rides/"+rideID+"/respond", driver, map[string]interface{}{"accept": true})
+
+	ta.gateway.SetScenario(payments.ScenarioNetworkError)
+	if out := ta.must(t, http.StatusOK, "POST", "/rides/"+rideID+"/cancel", rider, nil); out["payment"] != nil {
+		t.Fatalf("cancel = %v, want no payment while the gateway is down", out)
+	}
+	if got := ta.paymentStatus(t, rider, rideID); got != "" {
+		t.Fatalf("payment status %q after the failed charge, want none", got)
+	}
+
+	ta.gateway.SetScenario(payments.ScenarioSucceed)
+	intentID := ta.pay(t, rider, rideID)
+	ta.gateway.Confirm(intentID)
+	ta.confirm(t, http.StatusOK, rider, rideID, intentID)
+	if got := ta.paymentStatus(t, rider, rideID); got != "paid" {
+		t.Fatalf("payment status %q, want paid", got)
+	}
+}
@@ -3,8 +3,8 @@ package routes
 import (
 	"log"
 	"net/http"
-	"uber-clone/auth"
-	"uber-clone/controllers"
+	"strconv"
+	"uber-clone/app"
 	"uber-clone/middleware"
 	"uber-clone/websockets"
 
@@ -13,17 +13,22 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRouter(hub *websockets.Hub) *gin.Engine {
+// SetupRouter mounts the HTTP and WebSocket endpoints on the handlers owned by a
+func SetupRouter(a *app.App) *gin.Engine {
 	router := gin.Default()
 
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"}, // All
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", middleware.IdempotencyHeader},
+		ExposeHeaders:    []string{"Content-Length", "Idempotent-Replayed"},
 		AllowCredentials: true,
 	}))
 
+	// Inbound WebSocket messages are dispatched by their "type"
+	wsRouter := websockets.NewRouter()
+	a.Rides.RegisterWSHandlers(wsRouter)
+
 	// WebSocket endpoint
 	router.GET("/ws", func(c *gin.Context) {
 		tokenString := c.Query("token") // Changed from header to query param
@@ -34,7 +39,7 @@ func SetupRouter(hub *websockets.Hub) *gin.Engine {
 			return
 		}
 
-		claims, err := auth.ValidateToken(tokenString)
+		claims, err := a.Tokens.ValidateToken(tokenString)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			return
@@ -46,64 +51,69 @@ func SetupRouter(hub *websockets.Hub) *gin.Engine {
 			return
 		}
 
-		client := &websockets.Client{
-			Conn:   conn,
-			UserID: claims.UserID,
-			Role:   claims.Role,
-		}
+		client := websockets.NewClient(conn, claims.UserID, claims.Role)
+		a.Hub.Register <- client
+
+		// The write pump owns all writes; this goroutine only reads
+		go client.WritePump()
 
-		websockets.WS_HUB.Register <- client
-		defer func() {
-			websockets.WS_HUB.Unregister <- client
-		}()
-
-		for {
-			mt, msg, err := conn.ReadMessage()
-			if err != nil {
-				log.Println("WebSocket read error:", err)
-				break
-			}
-
-			log.Println("Message received:", string(msg))
-
-			// You can respond back to client to confirm it's alive
-			if string(msg) == `{"type":"ping"}` {
-				err = conn.WriteMessage(mt, []byte(`{"type":"pong"}`))
-				if err != nil {
-					log.Println("Write error:", err)
-					break
-				}
-			}
+		// Replay what the client missed while disconnected, paced by the write pump
+		if since, err := strconv.ParseInt(c.Query("since"), 10, 64); err == nil {
+			go a.Hub.Replay(client, since)
 		}
 
+		client.ReadPump(a.Hub, wsRouter)
+		if claims.Role == "driver" {
+			a.Tracker.Disconnect(claims.UserID)
+		}
 	})
 
 	// Auth routes
-	router.POST("/signup", controllers.Signup)
-	router.POST("/login", controllers.Login)
+	router.POST("/signup", a.Auth.Signup)
+	router.POST("/login", a.Auth.Login)
+
+	// Payment provider events, authenticated by their signature
+	router.POST("/webhooks/stripe", a.Webhooks.StripeWebhook)
 
 	// Protected routes
 	authGroup := router.Group("/")
-	authGroup.Use(middleware.AuthMiddleware())
+	authGroup.Use(middleware.AuthMiddleware(a.Tokens))
 	{
 
+		// Retries of these with the same Idempotency-Key get the first response
+		idempotent := middleware.Idempotency(a.Store.Idempotency, a.Config.IdempotencyTTL)
+
 		// Ride-related routes
 		rideGroup := authGroup.Group("/rides")
 		{
-			rideGroup.POST("/", controllers.RequestRide)
-			rideGroup.GET("/:ride_id", controllers.GetRideDetails)
-			rideGroup.POST("/:ride_id/verifyOTP", controllers.VerifyOTP)
-			rideGroup.POST("/:ride_id/respond", controllers.HandleDriverResponse)
-			rideGroup.POST("/:ride_id/complete", controllers.CompleteRide)
-			rideGroup.POST("/:ride_id/cancel", controllers.CancelRide)
-			rideGroup.POST("/:ride_id/pay", controllers.HandlePayment)
-			rideGroup.POST("/:ride_id/confirm-payment", controllers.ConfirmPayment)
+			rideGroup.POST("/", idempotent, a.Rides.RequestRide)
+			rideGroup.POST("/quote", a.Rides.QuoteRide)
+			rideGroup.GET("/:ride_id", a.Rides.GetRideDetails)
+			rideGroup.POST("/:ride_id/verifyOTP", a.Rides.VerifyOTP)
+			rideGroup.POST("/:ride_id/respond", a.Rides.HandleDriverResponse)
+			rideGroup.POST("/:ride_id/complete", a.Rides.CompleteRide)
+			rideGroup.POST("/:ride_id/cancel", a.Rides.CancelRide)
+			rideGroup.POST("/:ride_id/pay", idempotent, a.Rides.HandlePayment)
+			rideGroup.POST("/:ride_id/confirm-payment", a.Rides.ConfirmPayment)
+			rideGroup.POST("/:ride_id/refund", middleware.RequireRole("admin", "support"), idempotent, a.Rides.RefundRide)
 		}
 
-		authGroup.GET("/profile", controllers.Profile)
+		authGroup.GET("/profile", a.Auth.Profile)
+		authGroup.GET("/notifications", a.Notifications.GetNotifications)
+		authGroup.GET("/surge", a.Surge.GetSurge)
 
 		// Feedback route
-		authGroup.POST("/feedback/:ride_id", controllers.SubmitFeedback)
+		authGroup.POST("/feedback/:ride_id", a.Rides.SubmitFeedback)
+
+		// Admin routes
+		adminGroup := authGroup.Group("/admin")
+		adminGroup.Use(middleware.RequireRole("admin"))
+		{
+			adminGroup.GET("/fare-cards", a.Fares.ListFareCards)
+			adminGroup.POST("/fare-cards", a.Fares.CreateFareCard)
+			adminGroup.PUT("/fare-cards/:card_id", a.Fares.UpdateFareCard)
+			adminGroup.DELETE("/fare-cards/:card_id", a.Fares.DeleteFareCard)
+		}
 	}
 
 	return router
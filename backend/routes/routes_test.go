@@ -0,0 +1,197 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"uber-clone/app"
+	"uber-clone/config"
+	"uber-clone/payments"
+	"uber-clone/services"
+	"uber-clone/store"
+	"uber-clone/websockets"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// testApp is the API assembled around in-memory dependencies and served over HTTP
+type testApp struct {
+	*app.App
+	srv     *httptest.Server
+	maps    *services.FakeMaps
+	gateway *payments.FakeGateway
+}
+
+// newTestApp assembles and serves the API; settings come from env, set with t.Setenv
+func newTestApp(t *testing.T, hub *websockets.Hub) *testApp {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("JWT_SECRET", "test-secret")
+	cfg, err := config.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta := &testApp{maps: services.NewFakeMaps(), gateway: payments.NewFakeGateway()}
+	ta.App = app.Assemble(cfg, store.NewMemoryStore(), hub, ta.gateway, ta.maps)
+	ta.Start()
+	ta.srv = httptest.NewServer(SetupRouter(ta.App))
+	t.Cleanup(ta.srv.Close)
+	return ta
+}
+
+// call sends body as JSON and decodes the JSON response
+func (ta *testApp) call(t *testing.T, method, path, token string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, ta.srv.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+// must is call expecting the given status
+func (ta *testApp) must(t *testing.T, status int, method, path, token string, body interface{}) map[string]interface{} {
+	t.Helper()
+	got, out := ta.call(t, method, path, token, body)
+	if got != status {
+		t.Fatalf("%s %s: got %d %v, want %d", method, path, got, out, status)
+	}
+	return out
+}
+
+// signup registers and logs in an account at the point and returns its token
+func (ta *testApp) signup(t *testing.T, role, email string, lat, lng float64) string {
+	t.Helper()
+	body := map[string]interface{}{
+		"name": role, "email": email, "phone": email, "password": "secret1",
+		"role": role, "lat": lat, "lng": lng,
+	}
+	if role == "driver" {
+		body["vehicle_type"], body["license_number"], body["car_plate"] = "car", "L-"+email, "P-"+email
+	}
+	ta.must(t, http.StatusCreated, "POST", "/signup", "", body)
+	out := ta.must(t, http.StatusOK, "POST", "/login", "", map[string]interface{}{
+		"email": email, "password": "secret1", "lat": lat, "lng": lng,
+	})
+	return out["token"].(string)
+}
+
+func TestQuoteAndRequestRide(t *testing.T) {
+	ta := newTestApp(t, websockets.NewHub())
+	rider := ta.signup(t, "rider", "rider@example.com", 12.9716, 77.5946)
+	ta.signup(t, "driver", "driver@example.com", 12.9720, 77.5950)
+
+	trip := map[string]interface{}{"start_lat": 12.9716, "start_lng": 77.5946, "end_lat": 12.9352, "end_lng": 77.6245}
+	quote := ta.must(t, http.StatusOK, "POST", "/rides/quote", rider, trip)
+
+	// The trip is priced from the fake's route
+	km, minutes, _ := ta.maps.Route(12.9716, 77.5946, 12.9352, 77.6245)
+	if quote["distance"] != km || quote["duration"] != minutes {
+		t.Fatalf("quoted %v km in %v min, want %v km in %v min", quote["distance"], quote["duration"], km, minutes)
+	}
+
+	var quoteID string
+	var fare float64
+	for _, q := range quote["quotes"].([]interface{}) {
+		if q := q.(map[string]interface{}); q["vehicle_type"] == "car" {
+			quoteID, fare = q["quote_id"].(string), q["fare"].(float64)
+		}
+	}
+	if quoteID == "" {
+		t.Fatalf("no car quote in %v", quote)
+	}
+
+	ride := ta.must(t, http.StatusCreated, "POST", "/rides/", rider, map[string]interface{}{"quote_id": quoteID})
+	if ride["fare"] != fare || ride["driver_id"] == nil {
+		t.Fatalf("ride %v, want fare %v and a driver", ride, fare)
+	}
+}
+
+func TestQuoteWhenMapsFail(t *testing.T) {
+	ta := newTestApp(t, websockets.NewHub())
+	rider := ta.signup(t, "rider", "rider@example.com", 12.9716, 77.5946)
+	ta.maps.Err = errors.New("maps unavailable")
+
+	trip := map[string]interface{}{"start_lat": 12.9716, "start_lng": 77.5946, "end_lat": 12.9352, "end_lng": 77.6245}
+	ta.must(t, http.StatusInternalServerError, "POST", "/rides/quote", rider, trip)
+}
+
+func TestWebSocketReplaysMissedNotifications(t *testing.T) {
+	const missed = 150 // More than a client's send queue holds
+
+	hub := websockets.NewHub()
+	hub.Inbox = websockets.NewMemoryInbox()
+	for i := 0; i < missed; i++ {
+		hub.Inbox.Save(websockets.Notification{Type: "ride_update", UserID: "rider-1", Payload: i}, false)
+	}
+	ta := newTestApp(t, hub)
+
+	token, err := ta.Tokens.GenerateToken("rider-1", "rider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ws" + strings.TrimPrefix(ta.srv.URL, "http") + "/ws?since=0&token=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for want := int64(1); want <= missed; want++ {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg struct {
+			Seq      int64 `json:"seq"`
+			Replayed bool  `json:"replayed"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("after %d of %d replayed notifications: %v", want-1, missed, err)
+		}
+		if !msg.Replayed || msg.Seq != want {
+			t.Fatalf("got seq %d (replayed %v), want %d", msg.Seq, msg.Replayed, want)
+		}
+	}
+}
+
+// A driver account is only created with a vehicle type the drivers collection accepts
+func TestSignupRejectsUnknownVehicleType(t *testing.T) {
+	ta := newTestApp(t, websockets.NewHub())
+	body := map[string]interface{}{
+		"name": "driver", "email": "driver@example.com", "phone": "1", "password": "secret1",
+		"role": "driver", "lat": 12.97, "lng": 77.59,
+		"vehicle_type": "rocket", "license_number": "L-1", "car_plate": "P-1",
+	}
+	ta.must(t, http.StatusBadRequest, "POST", "/signup", "", body)
+
+	// Nothing was stored, so the email is still free
+	body["vehicle_type"] = "three_wheeler"
+	ta.must(t, http.StatusCreated, "POST", "/signup", "", body)
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"uber-clone/websockets"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoBackplane relays hub notifications between replicas through the "hub_events"
+// collection: publishing inserts a document and every replica tails the collection
+// with a change stream. Change streams need MongoDB running as a replica set.
+type MongoBackplane struct {
+	coll   *mongo.Collection
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type hubEvent struct {
+	Data      string    `bson:"data"` // JSON-encoded websockets.Notification
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// NewMongoBackplane publishes through hub_events, whose TTL index (migration 010)
+// keeps it small; events only need to live long enough for every replica's change
+// stream to see them
+func NewMongoBackplane(database *mongo.Database) *MongoBackplane {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MongoBackplane{coll: database.Collection("hub_events"), ctx: ctx, cancel: cancel}
+}
+
+// Publish implements websockets.Backplane
+func (b *MongoBackplane) Publish(n websockets.Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
+	defer cancel()
+	_, err = b.coll.InsertOne(ctx, hubEvent{Data: string(data), CreatedAt: time.Now()})
+	return err
+}
+
+// Subscribe implements websockets.Backplane. The change stream is reopened from the
+// last resume token if it drops, so a blip does not lose events.
+func (b *MongoBackplane) Subscribe(handler func(websockets.Notification)) error {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}}
+
+	stream, err := b.coll.Watch(b.ctx, pipeline)
+	if err != nil {
+		return err
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			b.drain(stream, handler)
+			if b.ctx.Err() != nil {
+				return
+			}
+
+			token := stream.ResumeToken()
+			stream.Close(context.Background())
+			log.Println("Hub backplane change stream dropped, reconnecting:", stream.Err())
+
+			for {
+				time.Sleep(time.Second)
+				opts := options.ChangeStream()
+				if token != nil {
+					opts.SetResumeAfter(token)
+				}
+				stream, err = b.coll.Watch(b.ctx, pipeline, opts)
+				if err == nil || b.ctx.Err() != nil {
+					break
+				}
+			}
+			if b.ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *MongoBackplane) drain(stream *mongo.ChangeStream, handler func(websockets.Notification)) {
+	for stream.Next(b.ctx) {
+		var event struct {
+			FullDocument hubEvent `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			log.Println("Invalid hub event:", err)
+			continue
+		}
+
+		var n websockets.Notification
+		if err := json.Unmarshal([]byte(event.FullDocument.Data), &n); err != nil {
+			log.Println("Invalid hub event payload:", err)
+			continue
+		}
+		handler(n)
+	}
+}
+
+// Close implements websockets.Backplane
+func (b *MongoBackplane) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	return nil
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"time"
+
+	"uber-clone/models"
+)
+
+// Rules a cancellation fee is decided by, stored on the ride as cancellation_rule
+const (
+	CancelBeforeAcceptance = "before_acceptance" // No driver had accepted yet
+	CancelFreeWindow       = "free_window"       // Rider changed their mind straight after requesting
+	CancelByDriver         = "driver_cancelled"
+	CancelDriverNoShow     = "driver_no_show"   // Driver took too long to reach the pickup
+	CancelAfterAcceptance  = "after_acceptance" // Driver was on the way
+	CancelAfterArrival     = "after_arrival"    // Driver was waiting at the pickup, or the trip had started
+)
+
+// CancellationPolicy decides what a rider owes for a cancelled ride. Once the
+// driver is at the pickup the fee is ArrivedFee. Before that it is AcceptedFee,
+// unless no driver had accepted, the rider cancels within FreeWindow of requesting,
+// or the driver has not arrived DriverNoShow after accepting. Drivers cancelling
+// never cause a fee.
+type CancellationPolicy struct {
+	FreeWindow   time.Duration
+	AcceptedFee  float64
+	ArrivedFee   float64
+	DriverNoShow time.Duration
+}
+
+// CancellationFee returns the fee for cancelling the ride at now, by "rider" or
+// "driver", and the rule that set it
+func (p CancellationPolicy) CancellationFee(ride *models.Ride, cancelledBy string, now time.Time) (float64, string) {
+	arrived := !ride.ArrivedAt.IsZero() || ride.Status == models.RideOngoing
+	switch {
+	case cancelledBy == "driver":
+		return 0, CancelByDriver
+	case ride.AcceptedAt.IsZero() || ride.Status == models.RideSearching || ride.Status == models.RideRequested:
+		return 0, CancelBeforeAcceptance
+	case arrived:
+		return p.ArrivedFee, CancelAfterArrival
+	case now.Sub(ride.CreatedAt) <= p.FreeWindow:
+		return 0, CancelFreeWindow
+	case now.Sub(ride.AcceptedAt) > p.DriverNoShow:
+		return 0, CancelDriverNoShow
+	}
+	return p.AcceptedFee, CancelAfterAcceptance
+}
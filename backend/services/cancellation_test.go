@@ -0,0 +1,51 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"uber-clone/models"
+)
+
+func TestCancellationFee(t *testing.T) {
+	policy := CancellationPolicy{FreeWindow: 2 * time.Minute, AcceptedFee: 50, ArrivedFee: 75, DriverNoShow: 10 * time.Minute}
+	now := time.Now()
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	tests := []struct {
+		name        string
+		ride        models.Ride
+		cancelledBy string
+		wantFee     float64
+		wantRule    string
+	}{
+		{"driver cancels", models.Ride{Status: models.RideAccepted, CreatedAt: ago(5 * time.Minute), AcceptedAt: ago(4 * time.Minute)},
+			"driver", 0, CancelByDriver},
+		{"driver cancels at the pickup", models.Ride{Status: models.RideAccepted, CreatedAt: ago(5 * time.Minute), AcceptedAt: ago(4 * time.Minute), ArrivedAt: ago(time.Minute)},
+			"driver", 0, CancelByDriver},
+		{"searching", models.Ride{Status: models.RideSearching, CreatedAt: ago(5 * time.Minute)},
+			"rider", 0, CancelBeforeAcceptance},
+		{"offered to a driver", models.Ride{Status: models.RideRequested, CreatedAt: ago(5 * time.Minute)},
+			"rider", 0, CancelBeforeAcceptance},
+		{"within the free window", models.Ride{Status: models.RideAccepted, CreatedAt: ago(time.Minute), AcceptedAt: ago(30 * time.Second)},
+			"rider", 0, CancelFreeWindow},
+		{"driver on the way", models.Ride{Status: models.RideAccepted, CreatedAt: ago(5 * time.Minute), AcceptedAt: ago(4 * time.Minute)},
+			"rider", 50, CancelAfterAcceptance},
+		{"driver at the pickup", models.Ride{Status: models.RideAccepted, CreatedAt: ago(5 * time.Minute), AcceptedAt: ago(4 * time.Minute), ArrivedAt: ago(time.Minute)},
+			"rider", 75, CancelAfterArrival},
+		{"arrival ends the free window", models.Ride{Status: models.RideAccepted, CreatedAt: ago(time.Minute), AcceptedAt: ago(50 * time.Second), ArrivedAt: ago(10 * time.Second)},
+			"rider", 75, CancelAfterArrival},
+		{"ongoing", models.Ride{Status: models.RideOngoing, CreatedAt: ago(20 * time.Minute), AcceptedAt: ago(19 * time.Minute)},
+			"rider", 75, CancelAfterArrival},
+		{"driver no-show", models.Ride{Status: models.RideAccepted, CreatedAt: ago(15 * time.Minute), AcceptedAt: ago(12 * time.Minute)},
+			"rider", 0, CancelDriverNoShow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fee, rule := policy.CancellationFee(&tt.ride, tt.cancelledBy, now)
+			if fee != tt.wantFee || rule != tt.wantRule {
+				t.Fatalf("got %v under %s, want %v under %s", fee, rule, tt.wantFee, tt.wantRule)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package services
+
+import (
+	"uber-clone/algo"
+)
+
+// FakeMaps answers routes without a maps provider, e.g. in tests. The road distance
+// is the straight-line distance and the duration assumes a constant speed.
+type FakeMaps struct {
+	SpeedKmh float64 // Defaults to 30
+	Err      error   // Returned by every call when set, to simulate an outage
+}
+
+// NewFakeMaps returns a fake whose trips run at 30 km/h
+func NewFakeMaps() *FakeMaps {
+	return &FakeMaps{SpeedKmh: 30}
+}
+
+// Route implements Maps
+func (m *FakeMaps) Route(originLat, originLng, destLat, destLng float64) (float64, float64, error) {
+	if m.Err != nil {
+		return 0, 0, m.Err
+	}
+	speed := m.SpeedKmh
+	if speed <= 0 {
+		speed = 30
+	}
+	km := algo.CalculateVincentyDistance(originLat, originLng, destLat, destLng)
+	return km, km / speed * 60, nil
+}
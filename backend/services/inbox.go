@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"uber-clone/db"
+	"uber-clone/websockets"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoInbox stores notifications in the "notifications" collection, numbered per user
+// through the "notification_counters" collection. Entries expire after the TTL.
+type MongoInbox struct {
+	TTL time.Duration
+	db  *mongo.Database
+}
+
+type inboxDoc struct {
+	UserID    string    `bson:"user_id"`
+	Seq       int64     `bson:"seq"`
+	Type      string    `bson:"type"`
+	Payload   bson.M    `bson:"payload"`
+	Delivered bool      `bson:"delivered"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// NewMongoInbox sets the expiry of the notifications TTL index, which migration 009
+// creates, to ttl
+func NewMongoInbox(database *mongo.Database, ttl time.Duration) (*MongoInbox, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := db.SetTTL(ctx, database, "notifications", db.NotificationTTLField, ttl); err != nil {
+		return nil, err
+	}
+	return &MongoInbox{TTL: ttl, db: database}, nil
+}
+
+// Save implements websockets.Inbox
+func (i *MongoInbox) Save(n websockets.Notification, delivered bool) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := i.db.Collection("notification_counters").FindOneAndUpdate(ctx,
+		bson.M{"_id": n.UserID},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+
+	// Store the payload exactly as clients receive it over the socket
+	payload, err := jsonDocument(n.Payload)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = i.db.Collection("notifications").InsertOne(ctx, inboxDoc{
+		UserID:    n.UserID,
+		Seq:       counter.Seq,
+		Type:      n.Type,
+		Payload:   payload,
+		Delivered: delivered,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq, nil
+}
+
+// Since implements websockets.Inbox
+func (i *MongoInbox) Since(userID string, seq int64, limit int) ([]websockets.InboxEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := i.db.Collection("notifications").Find(ctx, bson.M{
+		"user_id": userID,
+		"seq":     bson.M{"$gt": seq},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []inboxDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	entries := make([]websockets.InboxEntry, 0, len(docs))
+	for _, d := range docs {
+		entries = append(entries, websockets.InboxEntry{
+			Seq:       d.Seq,
+			Type:      d.Type,
+			Payload:   d.Payload,
+			Delivered: d.Delivered,
+			CreatedAt: d.CreatedAt,
+		})
+	}
+	return entries, nil
+}
+
+// jsonDocument round-trips v through JSON so IDs and times are stored in the same
+// form the client saw
+func jsonDocument(v interface{}) (bson.M, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	if string(data) == "null" {
+		return doc, nil
+	}
+	if err := json.Unmarshal(data, &doc); err == nil {
+		return doc, nil
+	}
+
+	// Not an object; keep it under a single key
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return bson.M{"value": raw}, nil
+}
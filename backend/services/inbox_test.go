@@ -0,0 +1,34 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestJSONDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		want    bson.M
+		wantErr bool
+	}{
+		{"object", map[string]interface{}{"ride_id": "r1", "fare": 120.5}, bson.M{"ride_id": "r1", "fare": 120.5}, false},
+		{"null", nil, nil, false},
+		{"scalar kept under value", "arrived", bson.M{"value": "arrived"}, false},
+		{"list kept under value", []int{1, 2}, bson.M{"value": []interface{}{1.0, 2.0}}, false},
+		{"not encodable", make(chan int), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jsonDocument(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,12 +2,23 @@
 package services
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
     "net/http"
-    "uber-clone/config"
+    "net/url"
+    "time"
+
+    "uber-clone/models"
 )
 
+// Maps answers routing questions; MapboxClient is the production implementation
+type Maps interface {
+    // Route returns the driving distance (km) and duration (minutes) between two points
+    Route(originLat, originLng, destLat, destLng float64) (float64, float64, error)
+}
+
 // Mapbox Directions API Response Structure
 type DirectionsResponse struct {
     Routes []struct {
@@ -20,47 +31,68 @@ type DirectionsResponse struct {
     Code    string `json:"code"`
 }
 
-// GetDistance calculates distance and duration using Mapbox Directions API
-func GetDistance(originLat, originLng, destLat, destLng float64, vehicleType string) (float64, float64, float64, error) {
-    apiKey := config.MustGetEnv("MAPBOX_ACCESS_TOKEN")
-    url := fmt.Sprintf(
+// GetDistance calculates distance, duration and the itemized fare for a trip
+func GetDistance(ctx context.Context, maps Maps, pricing *Pricing, originLat, originLng, destLat, destLng float64, vehicleType string) (float64, float64, *models.FareBreakdown, error) {
+    distance, duration, err := maps.Route(originLat, originLng, destLat, destLng)
+    if err != nil {
+        return 0, 0, nil, err
+    }
+
+    fare, err := pricing.Estimate(ctx, vehicleType, originLat, originLng, distance, duration)
+    if err != nil {
+        return 0, 0, nil, err
+    }
+
+    return distance, duration, fare, nil
+}
+
+// MapboxClient queries the Mapbox Directions API
+type MapboxClient struct {
+    Token  string
+    Client *http.Client
+}
+
+// NewMapboxClient returns a client authenticated with the given access token
+func NewMapboxClient(token string) *MapboxClient {
+    return &MapboxClient{Token: token, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Route implements Maps
+func (m *MapboxClient) Route(originLat, originLng, destLat, destLng float64) (float64, float64, error) {
+    if m.Token == "" {
+        return 0, 0, errors.New("mapbox access token is not configured")
+    }
+    endpoint := fmt.Sprintf(
         "https://api.mapbox.com/directions/v5/mapbox/driving/%f,%f;%f,%f"+
             "?geometries=geojson"+
             "&access_token=%s",
         originLng, originLat, // Mapbox uses lng,lat order
         destLng, destLat,
-        apiKey,
+        url.QueryEscape(m.Token),
     )
 
-    resp, err := http.Get(url)
+    resp, err := m.Client.Get(endpoint)
     if err != nil {
-        return 0, 0, 0, fmt.Errorf("mapbox API request failed: %v", err)
+        return 0, 0, fmt.Errorf("mapbox API request failed: %v", err)
     }
     defer resp.Body.Close()
 
     var data DirectionsResponse
     if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-        return 0, 0, 0, fmt.Errorf("failed to parse Mapbox response: %v", err)
+        return 0, 0, fmt.Errorf("failed to parse Mapbox response: %v", err)
     }
 
     if data.Code != "Ok" {
-        return 0, 0, 0, fmt.Errorf("mapbox API error: %s", data.Code)
+        return 0, 0, fmt.Errorf("mapbox API error: %s", data.Code)
     }
 
     if len(data.Routes) == 0 {
-        return 0, 0, 0, fmt.Errorf("no routes found in Mapbox response")
+        return 0, 0, fmt.Errorf("no routes found in Mapbox response")
     }
 
     // Convert to kilometers and minutes
     distance := data.Routes[0].Distance / 1000
     duration := data.Routes[0].Duration / 60
 
-    surge, err := CalculateSurge()
-    if err != nil {
-        return 0, 0, 0, fmt.Errorf("failed to calculate surge: %v", err)
-    }
-
-    fare := CalculateFare(distance, vehicleType, surge)
-    
-    return distance, duration, fare, nil
+    return distance, duration, nil
 }
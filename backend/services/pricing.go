@@ -2,45 +2,151 @@ package services
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math"
-	"uber-clone/db"
 
-	"go.mongodb.org/mongo-driver/bson"
+	"uber-clone/algo"
+	"uber-clone/models"
+	"uber-clone/store"
 )
 
-// CalculateSurge returns a surge multiplier based on demand/supply
-func CalculateSurge() (float64, error) {
-	rideColl := db.GetCollection("rides")
-	driverColl := db.GetCollection("drivers")
+// Pricing prices trips from the fare cards in the store and the surge of the pickup
+// zone. Rates and MinimumFare are the fallback for vehicle types without any card,
+// e.g. before an admin set them up.
+type Pricing struct {
+	Store       *store.Store
+	Zones       *SurgeZones
+	Rates       map[string]float64 // Per km, by vehicle type
+	MinimumFare float64
+}
 
-	// Demand: Number of active ride requests
-	demand, _ := rideColl.CountDocuments(context.Background(), bson.M{
-		"status": bson.M{"$in": []string{"requested", "ongoing"}},
-	})
+// Trip is what a fare is charged for: the planned route when estimating, the
+// recorded one at completion
+type Trip struct {
+	Distance float64 // km
+	Duration float64 // Minutes
+	Waiting  float64 // Minutes the driver waited at pickup
+}
 
-	// Supply: Number of available drivers
-	supply, _ := driverColl.CountDocuments(context.Background(), bson.M{"is_available": true})
+// FareCard returns the card that prices a trip of the vehicle type starting at the
+// point: the nearest city card covering it, else the card without a city
+func (p *Pricing) FareCard(ctx context.Context, vehicleType string, lat, lng float64) (*models.FareCard, error) {
+	cards, err := p.Store.Fares.List(ctx, vehicleType)
+	if err != nil {
+		return nil, err
+	}
 
-	if supply == 0 {
-		return 3.0, nil // Max surge if no drivers
+	var best, fallback *models.FareCard
+	bestKm := math.Inf(1)
+	for i := range cards {
+		card := &cards[i]
+		if card.City == "" {
+			fallback = card
+			continue
+		}
+		if card.Center == nil || len(card.Center.Coordinates) != 2 {
+			continue
+		}
+		km := algo.CalculateVincentyDistance(lat, lng, card.Center.Coordinates[1], card.Center.Coordinates[0])
+		if km <= card.RadiusKm && km < bestKm {
+			best, bestKm = card, km
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if fallback != nil {
+		return fallback, nil
 	}
 
-	surge := 1.0 + (float64(demand)/float64(supply))*0.5
-	return math.Min(surge, 3.0), nil // Cap surge at 3x
+	rate, ok := p.Rates[vehicleType]
+	if !ok {
+		return nil, fmt.Errorf("no fare card for vehicle type %q", vehicleType)
+	}
+	return &models.FareCard{VehicleType: vehicleType, PerKm: rate, MinimumFare: p.MinimumFare}, nil
 }
 
-// CalculateFare computes the total fare
-func CalculateFare(distance float64, vehicleType string, surge float64) float64 {
-	baseRate := map[string]float64{
-		"two_wheeler":   80,
-		"three_wheeler": 120,
-		"car":           150,
-		"premium_car":   250,
+// Estimate prices a trip of distance km and duration minutes starting at the point
+func (p *Pricing) Estimate(ctx context.Context, vehicleType string, lat, lng, distance, duration float64) (*models.FareBreakdown, error) {
+	card, err := p.FareCard(ctx, vehicleType, lat, lng)
+	if err != nil {
+		return nil, err
 	}
+	fare := CalculateFare(card, Trip{Distance: distance, Duration: duration}, p.Zones.At(lat, lng))
+	return &fare, nil
+}
 
-	// Ensure a valid vehicle type
-	if rate, exists := baseRate[vehicleType]; exists {
-		return rate * distance * surge
+// FinalFare prices the trip a ride actually made. It uses the card and surge the
+// ride was estimated with, so only the trip itself can change the price; a card
+// deleted since is replaced by the one now covering the pickup.
+func (p *Pricing) FinalFare(ctx context.Context, ride *models.Ride, trip Trip) (*models.FareBreakdown, error) {
+	surge := ride.SurgeMultiplier
+	var card *models.FareCard
+	if estimate := ride.FareBreakdown; estimate != nil {
+		surge = estimate.SurgeMultiplier
+		if !estimate.FareCardID.IsZero() {
+			found, err := p.Store.Fares.FindByID(ctx, estimate.FareCardID)
+			if err != nil && !errors.Is(err, store.ErrNotFound) {
+				return nil, err
+			}
+			card = found
+		}
+	}
+	if card == nil {
+		c := ride.StartLocation.Coordinates
+		if len(c) != 2 {
+			return nil, fmt.Errorf("ride %s has no pickup location", ride.ID.Hex())
+		}
+		found, err := p.FareCard(ctx, ride.VehicleType, c[1], c[0])
+		if err != nil {
+			return nil, err
+		}
+		card = found
 	}
-	return 0.0 // Invalid vehicle type
+	if surge < 1 {
+		surge = 1.0 // Rides from before surge was recorded
+	}
+
+	fare := CalculateFare(card, trip, surge)
+	return &fare, nil
+}
+
+// CalculateFare itemizes the fare of a trip under card. Surge applies to the base,
+// distance and time components; the minimum fare tops that up before waiting beyond
+// the free minutes and the booking fee, and tax is charged on the total.
+func CalculateFare(card *models.FareCard, trip Trip, surge float64) models.FareBreakdown {
+	fare := models.FareBreakdown{
+		FareCardID:      card.ID,
+		City:            card.City,
+		DistanceKm:      RoundPaise(trip.Distance),
+		DurationMin:     RoundPaise(trip.Duration),
+		BaseFare:        RoundPaise(card.BaseFare),
+		DistanceFare:    RoundPaise(card.PerKm * trip.Distance),
+		TimeFare:        RoundPaise(card.PerMinute * trip.Duration),
+		WaitingMin:      RoundPaise(trip.Waiting),
+		SurgeMultiplier: surge,
+		BookingFee:      RoundPaise(card.BookingFee),
+	}
+	if billable := trip.Waiting - card.FreeWaitingMinutes; billable > 0 {
+		fare.WaitingFare = RoundPaise(card.WaitingPerMinute * billable)
+	}
+
+	subtotal := fare.BaseFare + fare.DistanceFare + fare.TimeFare
+	fare.SurgeAmount = RoundPaise(subtotal * (surge - 1))
+	subtotal += fare.SurgeAmount
+	if subtotal < card.MinimumFare {
+		fare.MinimumFareTopUp = RoundPaise(card.MinimumFare - subtotal)
+		subtotal += fare.MinimumFareTopUp
+	}
+	subtotal += fare.WaitingFare + fare.BookingFee
+
+	fare.Tax = RoundPaise(subtotal * card.TaxRate)
+	fare.Total = RoundPaise(subtotal + fare.Tax)
+	return fare
+}
+
+// RoundPaise rounds an amount in rupees to paise
+func RoundPaise(amount float64) float64 {
+	return math.Round(amount*100) / 100
 }
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"uber-clone/algo"
+	"uber-clone/models"
+	"uber-clone/store"
+)
+
+func TestCalculateFare(t *testing.T) {
+	card := &models.FareCard{
+		BaseFare: 50, PerKm: 12, PerMinute: 1.5, MinimumFare: 80, BookingFee: 10, TaxRate: 0.05,
+		WaitingPerMinute: 2, FreeWaitingMinutes: 3,
+	}
+	tests := []struct {
+		name  string
+		trip  Trip
+		surge float64
+		want  models.FareBreakdown // Only the charged amounts are compared
+	}{
+		{"plain", Trip{Distance: 10, Duration: 20}, 1,
+			models.FareBreakdown{Tax: 10.5, Total: 220.5}},
+		{"surge on base, distance and time", Trip{Distance: 10, Duration: 20}, 1.5,
+			models.FareBreakdown{SurgeAmount: 100, Tax: 15.5, Total: 325.5}},
+		{"minimum fare", Trip{Distance: 1, Duration: 2}, 1,
+			models.FareBreakdown{MinimumFareTopUp: 15, Tax: 4.5, Total: 94.5}},
+		{"surge lifts above the minimum", Trip{Distance: 1, Duration: 2}, 1.5,
+			models.FareBreakdown{SurgeAmount: 32.5, Tax: 5.38, Total: 112.88}},
+		{"waiting beyond the free minutes", Trip{Distance: 10, Duration: 20, Waiting: 5}, 1,
+			models.FareBreakdown{WaitingFare: 4, Tax: 10.7, Total: 224.7}},
+		{"waiting within the free minutes", Trip{Distance: 10, Duration: 20, Waiting: 2}, 1,
+			models.FareBreakdown{Tax: 10.5, Total: 220.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CalculateFare(card, tt.trip, tt.surge)
+			if got.SurgeAmount != tt.want.SurgeAmount || got.MinimumFareTopUp != tt.want.MinimumFareTopUp ||
+				got.WaitingFare != tt.want.WaitingFare || got.Tax != tt.want.Tax || got.Total != tt.want.Total {
+				t.Fatalf("got surge %v, top-up %v, waiting %v, tax %v, total %v; want %+v",
+					got.SurgeAmount, got.MinimumFareTopUp, got.WaitingFare, got.Tax, got.Total, tt.want)
+			}
+			if got.SurgeMultiplier != tt.surge {
+				t.Fatalf("surge multiplier %v, want %v", got.SurgeMultiplier, tt.surge)
+			}
+		})
+	}
+}
+
+// fareCards stores a default car card and city cards for Bangalore, its airport
+// and Mysore
+func fareCards(t *testing.T, st *store.Store) map[string]*models.FareCard {
+	t.Helper()
+	cards := map[string]*models.FareCard{
+		"default":   {VehicleType: "car", PerKm: 10},
+		"bangalore": {City: "Bangalore", Center: &models.GeoJSON{Type: "Point", Coordinates: []float64{77.5946, 12.9716}}, RadiusKm: 30, VehicleType: "car", PerKm: 12},
+		"airport":   {City: "Bangalore Airport", Center: &models.GeoJSON{Type: "Point", Coordinates: []float64{77.7066, 13.1986}}, RadiusKm: 30, VehicleType: "car", PerKm: 15},
+		"mysore":    {City: "Mysore", Center: &models.GeoJSON{Type: "Point", Coordinates: []float64{76.6394, 12.2958}}, RadiusKm: 20, VehicleType: "car", PerKm: 9},
+		"auto":      {City: "Bangalore", Center: &models.GeoJSON{Type: "Point", Coordinates: []float64{77.5946, 12.9716}}, RadiusKm: 30, VehicleType: "three_wheeler", PerKm: 8},
+	}
+	for _, card := range cards {
+		if err := st.Fares.Insert(context.Background(), card); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cards
+}
+
+func TestFareCardSelection(t *testing.T) {
+	st := store.NewMemoryStore()
+	cards := fareCards(t, st)
+	p := &Pricing{Store: st, Rates: map[string]float64{"two_wheeler": 6}, MinimumFare: 30}
+
+	tests := []struct {
+		name        string
+		vehicleType string
+		lat, lng    float64
+		want        string  // Key in cards; empty for the fallback rates
+		wantPerKm   float64 // For the fallback rates
+		wantErr     bool
+	}{
+		{"city card", "car", 12.9352, 77.6245, "bangalore", 0, false},
+		{"nearest of overlapping cities", "car", 13.1986, 77.7066, "airport", 0, false},
+		{"another city", "car", 12.3100, 76.6500, "mysore", 0, false},
+		{"outside every city", "car", 13.0827, 80.2707, "default", 0, false},
+		{"card of the vehicle type", "three_wheeler", 12.9716, 77.5946, "auto", 0, false},
+		{"no default card for the vehicle type", "three_wheeler", 13.0827, 80.2707, "", 0, true},
+		{"fallback rates", "two_wheeler", 12.9716, 77.5946, "", 6, false},
+		{"no card and no rate", "premium_car", 12.9716, 77.5946, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.FareCard(context.Background(), tt.vehicleType, tt.lat, tt.lng)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			switch {
+			case tt.wantErr:
+			case tt.want != "":
+				if got.ID != cards[tt.want].ID {
+					t.Fatalf("got the %q card, want %s", got.City, tt.want)
+				}
+			default:
+				if !got.ID.IsZero() || got.PerKm != tt.wantPerKm || got.MinimumFare != p.MinimumFare {
+					t.Fatalf("got %+v, want the fallback rate %v", got, tt.wantPerKm)
+				}
+			}
+		})
+	}
+}
+
+func TestEstimateAppliesZoneSurge(t *testing.T) {
+	st := store.NewMemoryStore()
+	cards := fareCards(t, st)
+	zones := &SurgeZones{Store: st, Precision: 5}
+	zones.zones = map[string]Zone{algo.EncodeGeohash(12.9716, 77.5946, 5): {Surge: 1.5}}
+	p := &Pricing{Store: st, Zones: zones}
+
+	surged, err := p.Estimate(context.Background(), "car", 12.9716, 77.5946, 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if surged.FareCardID != cards["bangalore"].ID || surged.SurgeMultiplier != 1.5 || surged.Total != 180 {
+		t.Fatalf("got card %v, surge %v, total %v; want Bangalore at 1.5x for 180", surged.City, surged.SurgeMultiplier, surged.Total)
+	}
+
+	// Mysore has no surge
+	calm, err := p.Estimate(context.Background(), "car", 12.2958, 76.6394, 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calm.SurgeMultiplier != 1 || calm.Total != 90 {
+		t.Fatalf("got surge %v, total %v; want 1x for 90", calm.SurgeMultiplier, calm.Total)
+	}
+}
+
+func TestFinalFareKeepsEstimateCard(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	cards := fareCards(t, st)
+	p := &Pricing{Store: st}
+	ride := &models.Ride{
+		VehicleType:   "car",
+		StartLocation: models.GeoJSON{Type: "Point", Coordinates: []float64{77.5946, 12.9716}},
+		FareBreakdown: &models.FareBreakdown{FareCardID: cards["airport"].ID, SurgeMultiplier: 1.2},
+	}
+
+	fare, err := p.FinalFare(ctx, ride, Trip{Distance: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fare.FareCardID != cards["airport"].ID || fare.Total != 180 {
+		t.Fatalf("got card %v, total %v; want the estimate's card and surge for 180", fare.City, fare.Total)
+	}
+
+	// A card deleted since the estimate is replaced by the one covering the pickup
+	if err := st.Fares.Delete(ctx, cards["airport"].ID); err != nil {
+		t.Fatal(err)
+	}
+	fare, err = p.FinalFare(ctx, ride, Trip{Distance: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fare.FareCardID != cards["bangalore"].ID || fare.Total != 144 {
+		t.Fatalf("got card %v, total %v; want Bangalore at 1.2x for 144", fare.City, fare.Total)
+	}
+}
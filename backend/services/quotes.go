@@ -0,0 +1,88 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"uber-clone/models"
+)
+
+var (
+	// ErrQuoteInvalid is returned for a quote ID that was not signed by us or was altered
+	ErrQuoteInvalid = errors.New("invalid quote")
+	// ErrQuoteExpired is returned for a genuine quote past its expiry
+	ErrQuoteExpired = errors.New("quote expired")
+)
+
+// Quote is an upfront price for a trip, locked until ExpiresAt
+type Quote struct {
+	RiderID     string               `json:"rider_id"`
+	VehicleType string               `json:"vehicle_type"`
+	StartLat    float64              `json:"start_lat"`
+	StartLng    float64              `json:"start_lng"`
+	EndLat      float64              `json:"end_lat"`
+	EndLng      float64              `json:"end_lng"`
+	Distance    float64              `json:"distance"` // km
+	Duration    float64              `json:"duration"` // minutes
+	Fare        models.FareBreakdown `json:"fare"`
+	ExpiresAt   int64                `json:"exp"` // Unix seconds
+}
+
+// QuoteSigner turns quotes into tamper-proof IDs, so a quote needs no storage: the ID
+// is the quote itself, base64url-encoded, followed by its HMAC-SHA256
+type QuoteSigner struct {
+	secret []byte
+	TTL    time.Duration
+}
+
+// NewQuoteSigner signs quotes with secret; each stays valid for ttl
+func NewQuoteSigner(secret string, ttl time.Duration) *QuoteSigner {
+	return &QuoteSigner{secret: []byte(secret), TTL: ttl}
+}
+
+// Sign sets the quote's expiry and returns its ID
+func (s *QuoteSigner) Sign(q *Quote, now time.Time) (string, error) {
+	q.ExpiresAt = now.Add(s.TTL).Unix()
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded)), nil
+}
+
+// Verify checks a quote ID and returns the quote it carries
+func (s *QuoteSigner) Verify(id string, now time.Time) (*Quote, error) {
+	encoded, sig, ok := strings.Cut(id, ".")
+	if !ok {
+		return nil, ErrQuoteInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.mac(encoded)) {
+		return nil, ErrQuoteInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrQuoteInvalid
+	}
+	var q Quote
+	if err := json.Unmarshal(payload, &q); err != nil {
+		return nil, ErrQuoteInvalid
+	}
+	if now.Unix() >= q.ExpiresAt {
+		return nil, ErrQuoteExpired
+	}
+	return &q, nil
+}
+
+func (s *QuoteSigner) mac(encoded string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte("quote:" + encoded))
+	return h.Sum(nil)
+}
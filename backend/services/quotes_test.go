@@ -0,0 +1,58 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"uber-clone/models"
+)
+
+func TestQuoteSigner(t *testing.T) {
+	signer := NewQuoteSigner("secret", 5*time.Minute)
+	now := time.Now()
+	quote := Quote{RiderID: "rider-1", VehicleType: "car", StartLat: 12.9, StartLng: 77.6, Fare: models.FareBreakdown{Total: 150}}
+	id, err := signer.Sign(&quote, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := signer.Verify(id, now.Add(4*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RiderID != "rider-1" || got.VehicleType != "car" || got.Fare.Total != 150 {
+		t.Fatalf("Verify = %+v, want the signed quote", got)
+	}
+
+	encoded, sig, _ := strings.Cut(id, ".")
+	cheaper := quote
+	cheaper.Fare = models.FareBreakdown{Total: 1}
+	cheaperID, _ := signer.Sign(&cheaper, now)
+	cheaperEncoded, _, _ := strings.Cut(cheaperID, ".")
+	forged, _ := NewQuoteSigner("other", 5*time.Minute).Sign(&quote, now)
+
+	tests := []struct {
+		name string
+		id   string
+		at   time.Time
+		want error
+	}{
+		{"expired", id, now.Add(5 * time.Minute), ErrQuoteExpired},
+		{"payload swapped under the signature", cheaperEncoded + "." + sig, now, ErrQuoteInvalid},
+		{"payload edited", base64.RawURLEncoding.EncodeToString([]byte(`{"rider_id":"rider-1"}`)) + "." + sig, now, ErrQuoteInvalid},
+		{"signature dropped", encoded, now, ErrQuoteInvalid},
+		{"signature not base64", encoded + ".!!", now, ErrQuoteInvalid},
+		{"signed with another secret", forged, now, ErrQuoteInvalid},
+		{"empty", "", now, ErrQuoteInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := signer.Verify(tt.id, tt.at); !errors.Is(err, tt.want) {
+				t.Fatalf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"uber-clone/algo"
+	"uber-clone/store"
+)
+
+// SurgeZones keeps a surge multiplier per geohash cell. Run recomputes them every
+// Interval from the rides requested in the last Window and the drivers available
+// in each cell, so a spike in one neighbourhood only raises prices there. Each
+// reading moves the multiplier by Smoothing of the way, so one burst of requests
+// does not whipsaw prices; quotes read the cached value.
+type SurgeZones struct {
+	Store     *store.Store
+	Precision int           // Geohash length of a zone; 5 is roughly 5x5 km
+	Window    time.Duration // How far back requests count as demand
+	Interval  time.Duration
+	Smoothing float64 // Weight of the newest reading, in (0, 1]
+	Cap       float64
+
+	mu         sync.RWMutex
+	zones      map[string]Zone
+	computedAt time.Time
+}
+
+// Zone is the surge of one geohash cell
+type Zone struct {
+	Geohash string     `json:"geohash"`
+	Surge   float64    `json:"surge"`
+	Demand  int        `json:"demand"` // Rides requested in the window
+	Supply  int        `json:"supply"` // Available drivers
+	Bounds  [4]float64 `json:"bounds"` // min lat, min lng, max lat, max lng
+}
+
+// Run recomputes the zones straight away and then every Interval
+func (z *SurgeZones) Run() {
+	z.refresh()
+	ticker := time.NewTicker(z.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		z.refresh()
+	}
+}
+
+func (z *SurgeZones) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), z.Interval)
+	defer cancel()
+	if err := z.Recompute(ctx, time.Now()); err != nil {
+		log.Println("Failed to recompute surge zones:", err)
+	}
+}
+
+// Recompute takes a new reading of every zone with demand, or still surging from
+// an earlier one
+func (z *SurgeZones) Recompute(ctx context.Context, now time.Time) error {
+	rides, err := z.Store.Rides.FindCreatedSince(ctx, now.Add(-z.Window))
+	if err != nil {
+		return err
+	}
+	drivers, err := z.Store.Drivers.FindAvailable(ctx)
+	if err != nil {
+		return err
+	}
+
+	demand := make(map[string]int)
+	for _, ride := range rides {
+		if c := ride.StartLocation.Coordinates; len(c) == 2 {
+			demand[algo.EncodeGeohash(c[1], c[0], z.Precision)]++
+		}
+	}
+	supply := make(map[string]int)
+	for _, driver := range drivers {
+		if c := driver.Location.Coordinates; len(c) == 2 {
+			supply[algo.EncodeGeohash(c[1], c[0], z.Precision)]++
+		}
+	}
+
+	z.mu.RLock()
+	previous := z.zones
+	z.mu.RUnlock()
+
+	cells := make(map[string]bool, len(demand)+len(previous))
+	for hash := range demand {
+		cells[hash] = true
+	}
+	for hash := range previous {
+		cells[hash] = true
+	}
+
+	zones := make(map[string]Zone, len(cells))
+	for hash := range cells {
+		prev := 1.0
+		if p, ok := previous[hash]; ok {
+			prev = p.Surge
+		}
+		surge := prev + z.Smoothing*(z.rawSurge(demand[hash], supply[hash])-prev)
+		if demand[hash] == 0 && surge < 1.01 {
+			continue // Settled back to normal pricing
+		}
+		zone := z.zone(hash)
+		zone.Surge = math.Round(surge*100) / 100
+		zone.Demand, zone.Supply = demand[hash], supply[hash]
+		zones[hash] = zone
+	}
+
+	z.mu.Lock()
+	z.zones, z.computedAt = zones, now
+	z.mu.Unlock()
+	return nil
+}
+
+// rawSurge is the multiplier the current demand and supply of a zone call for
+func (z *SurgeZones) rawSurge(demand, supply int) float64 {
+	if demand == 0 {
+		return 1.0
+	}
+	if supply == 0 {
+		return z.Cap // Max surge if no drivers
+	}
+	surge := 1.0 + (float64(demand)/float64(supply))*0.5
+	return math.Min(surge, z.Cap)
+}
+
+// zone returns a zone without surge for the cell
+func (z *SurgeZones) zone(hash string) Zone {
+	zone := Zone{Geohash: hash, Surge: 1.0}
+	if cell, err := algo.DecodeGeohash(hash); err == nil {
+		zone.Bounds = [4]float64{cell.MinLat, cell.MinLng, cell.MaxLat, cell.MaxLng}
+	}
+	return zone
+}
+
+// At returns the surge multiplier of the zone containing the point
+func (z *SurgeZones) At(lat, lng float64) float64 {
+	hash := algo.EncodeGeohash(lat, lng, z.Precision)
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if zone, ok := z.zones[hash]; ok {
+		return zone.Surge
+	}
+	return 1.0
+}
+
+// Around returns the zone containing the point and its eight neighbours, for the
+// client heatmap, along with when they were computed
+func (z *SurgeZones) Around(lat, lng float64) ([]Zone, time.Time) {
+	hashes, _ := algo.GeohashNeighbours(algo.EncodeGeohash(lat, lng, z.Precision))
+
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	zones := make([]Zone, 0, len(hashes))
+	for _, hash := range hashes {
+		zone, ok := z.zones[hash]
+		if !ok {
+			zone = z.zone(hash)
+		}
+		zones = append(zones, zone)
+	}
+	return zones, z.computedAt
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"uber-clone/models"
+	"uber-clone/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func point(lat, lng float64) models.GeoJSON {
+	return models.GeoJSON{Type: "Point", Coordinates: []float64{lng, lat}}
+}
+
+func TestSurgeSmoothing(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+	z := &SurgeZones{Store: st, Precision: 5, Window: 10 * time.Minute, Smoothing: 0.5, Cap: 3}
+
+	// Four requests and two drivers in ezs42 call for 1 + 4/2*0.5 = 2x
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		st.Rides.Insert(ctx, &models.Ride{RiderID: primitive.NewObjectID(), StartLocation: point(42.6, -5.6), Status: "requested", CreatedAt: start})
+	}
+	for i := 0; i < 2; i++ {
+		st.Drivers.Insert(ctx, &models.Driver{UserID: primitive.NewObjectID(), VehicleType: "car", IsAvailable: true, Location: point(42.6, -5.6)})
+	}
+
+	// Each reading moves halfway towards 2x while the requests are in the window,
+	// then halfway back to 1x once they age out
+	readings := []struct {
+		after time.Duration
+		want  float64
+	}{
+		{0, 1.5},
+		{time.Minute, 1.75},
+		{2 * time.Minute, 1.88},
+		{20 * time.Minute, 1.44},
+		{21 * time.Minute, 1.22},
+		{22 * time.Minute, 1.11},
+	}
+	for _, r := range readings {
+		if err := z.Recompute(ctx, start.Add(r.after)); err != nil {
+			t.Fatal(err)
+		}
+		if got := z.At(42.6, -5.6); got != r.want {
+			t.Fatalf("surge %v after %v, want %v", got, r.after, r.want)
+		}
+		if got := z.At(42.7, -5.6); got != 1 {
+			t.Fatalf("neighbouring zone surged to %v", got)
+		}
+	}
+
+	// The zone is dropped once it settles back to normal pricing
+	for i := 0; i < 10; i++ {
+		z.Recompute(ctx, start.Add(30*time.Minute))
+	}
+	if got := z.At(42.6, -5.6); got != 1 {
+		t.Fatalf("surge %v long after demand stopped, want 1", got)
+	}
+	if zones, _ := z.Around(42.6, -5.6); len(zones) != 9 || zones[4].Geohash != "ezs42" {
+		t.Fatalf("Around returned %v, want ezs42 in the middle of nine zones", zones)
+	}
+}
+
+func TestRawSurge(t *testing.T) {
+	z := &SurgeZones{Cap: 2.5}
+	tests := []struct {
+		demand, supply int
+		want           float64
+	}{
+		{0, 0, 1},
+		{0, 5, 1},
+		{1, 2, 1.25},
+		{4, 2, 2},
+		{10, 1, 2.5}, // Capped
+		{3, 0, 2.5},  // No drivers at all
+	}
+	for _, tt := range tests {
+		if got := z.rawSurge(tt.demand, tt.supply); got != tt.want {
+			t.Errorf("rawSurge(%d, %d) = %v, want %v", tt.demand, tt.supply, got, tt.want)
+		}
+	}
+}
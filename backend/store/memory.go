@@ -0,0 +1,676 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"uber-clone/algo"
+	"uber-clone/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewMemoryStore returns repositories that keep everything in process memory. They
+// honour the same conditions and unique keys as the Mongo ones, e.g. a Claim only
+// succeeds once, so handlers behave the same in tests. Values are copied in and out.
+func NewMemoryStore() *Store {
+	m := &memory{
+		users:    make(map[primitive.ObjectID]models.User),
+		drivers:  make(map[primitive.ObjectID]models.Driver),
+		rides:    make(map[primitive.ObjectID]models.Ride),
+		payments: make(map[primitive.ObjectID]models.Payment),
+		feedback: make(map[primitive.ObjectID]models.Feedback),
+		fares:    make(map[primitive.ObjectID]models.FareCard),
+		webhooks: make(map[string]models.WebhookEvent),
+		requests: make(map[string]models.IdempotencyRecord),
+	}
+	return &Store{
+		Users:    (*memoryUsers)(m),
+		Drivers:  (*memoryDrivers)(m),
+		Rides:    (*memoryRides)(m),
+		Payments: (*memoryPayments)(m),
+		Feedback: (*memoryFeedback)(m),
+		Fares:    (*memoryFareCards)(m),
+		Webhooks: (*memoryWebhookEvents)(m),
+
+		Idempotency: (*memoryIdempotency)(m),
+	}
+}
+
+// memory holds every collection behind one lock so cross-collection reads are consistent
+type memory struct {
+	mu       sync.Mutex
+	users    map[primitive.ObjectID]models.User
+	drivers  map[primitive.ObjectID]models.Driver
+	rides    map[primitive.ObjectID]models.Ride
+	payments map[primitive.ObjectID]models.Payment
+	feedback map[primitive.ObjectID]models.Feedback
+	fares    map[primitive.ObjectID]models.FareCard
+	webhooks map[string]models.WebhookEvent
+	requests map[string]models.IdempotencyRecord
+}
+
+// clone deep-copies a model through its bson form, the same way a database round trip would
+func clone[T any](v T) T {
+	var out T
+	data, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	if err := bson.Unmarshal(data, &out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// applySet writes fields, keyed by their bson names, onto a model
+func applySet[T any](v T, set bson.M) (T, error) {
+	var doc bson.M
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return v, err
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return v, err
+	}
+	for k, val := range set {
+		doc[k] = val
+	}
+
+	var out T
+	if data, err = bson.Marshal(doc); err != nil {
+		return v, err
+	}
+	if err := bson.Unmarshal(data, &out); err != nil {
+		return v, err
+	}
+	return out, nil
+}
+
+func newID(id primitive.ObjectID) primitive.ObjectID {
+	if id.IsZero() {
+		return primitive.NewObjectID()
+	}
+	return id
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryUsers memory
+
+func (r *memoryUsers) Insert(ctx context.Context, user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.Email == user.Email {
+			return ErrDuplicate
+		}
+	}
+	user.ID = newID(user.ID)
+	r.users[user.ID] = clone(*user)
+	return nil
+}
+
+func (r *memoryUsers) FindByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user = clone(user)
+	return &user, nil
+}
+
+func (r *memoryUsers) FindByEmail(ctx context.Context, email string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.Email == email {
+			user = clone(user)
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryUsers) RecordLogin(ctx context.Context, id primitive.ObjectID, location models.GeoJSON, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Location = clone(location)
+	r.users[id] = user
+	return nil
+}
+
+type memoryDrivers memory
+
+func (r *memoryDrivers) Insert(ctx context.Context, driver *models.Driver) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.drivers {
+		if d.UserID == driver.UserID {
+			return ErrDuplicate
+		}
+	}
+	driver.ID = newID(driver.ID)
+	r.drivers[driver.ID] = clone(*driver)
+	return nil
+}
+
+func (r *memoryDrivers) FindByID(ctx context.Context, id primitive.ObjectID) (*models.Driver, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	driver, ok := r.drivers[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	driver = clone(driver)
+	return &driver, nil
+}
+
+func (r *memoryDrivers) FindByUserID(ctx context.Context, userID primitive.ObjectID) (*models.Driver, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, driver := range r.drivers {
+		if driver.UserID == userID {
+			driver = clone(driver)
+			return &driver, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryDrivers) FindAvailableNear(ctx context.Context, lat, lng float64, radius int, vehicleType string, exclude []primitive.ObjectID) ([]models.Driver, error) {
+	skip := make(map[primitive.ObjectID]bool, len(exclude))
+	for _, id := range exclude {
+		skip[id] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type near struct {
+		driver models.Driver
+		km     float64
+	}
+	var found []near
+	for _, driver := range r.drivers {
+		if !driver.IsAvailable || driver.VehicleType != vehicleType || skip[driver.ID] {
+			continue
+		}
+		if len(driver.Location.Coordinates) != 2 {
+			continue
+		}
+		km := algo.CalculateVincentyDistance(lat, lng, driver.Location.Coordinates[1], driver.Location.Coordinates[0])
+		if km*1000 <= float64(radius) {
+			found = append(found, near{clone(driver), km})
+		}
+	}
+
+	// $nearSphere returns the closest first
+	sort.Slice(found, func(i, j int) bool { return found[i].km < found[j].km })
+	drivers := make([]models.Driver, 0, len(found))
+	for _, n := range found {
+		drivers = append(drivers, n.driver)
+	}
+	return drivers, nil
+}
+
+func (r *memoryDrivers) CountAvailable(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, driver := range r.drivers {
+		if driver.IsAvailable {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memoryDrivers) FindAvailable(ctx context.Context) ([]models.Driver, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var drivers []models.Driver
+	for _, driver := range r.drivers {
+		if driver.IsAvailable {
+			drivers = append(drivers, clone(driver))
+		}
+	}
+	return drivers, nil
+}
+
+func (r *memoryDrivers) Claim(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	driver, ok := r.drivers[id]
+	if !ok || !driver.IsAvailable {
+		return false, nil
+	}
+	driver.IsAvailable = false
+	r.drivers[id] = driver
+	return true, nil
+}
+
+func (r *memoryDrivers) SetAvailable(ctx context.Context, id primitive.ObjectID, available bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if driver, ok := r.drivers[id]; ok {
+		driver.IsAvailable = available
+		r.drivers[id] = driver
+	}
+	return nil
+}
+
+func (r *memoryDrivers) AddRating(ctx context.Context, id primitive.ObjectID, rating int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if driver, ok := r.drivers[id]; ok {
+		driver.RatingSum += float64(rating)
+		driver.RatingCount++
+		r.drivers[id] = driver
+	}
+	return nil
+}
+
+func (r *memoryDrivers) UpdateLocations(ctx context.Context, fixes []LocationFix) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byUser := make(map[primitive.ObjectID]primitive.ObjectID, len(r.drivers))
+	for id, driver := range r.drivers {
+		byUser[driver.UserID] = id
+	}
+	for _, f := range fixes {
+		id, ok := byUser[f.UserID]
+		if !ok {
+			continue
+		}
+		driver := r.drivers[id]
+		driver.Location = models.GeoJSON{Type: "Point", Coordinates: []float64{f.Lng, f.Lat}}
+		driver.Heading = f.Heading
+		driver.Speed = f.Speed
+		driver.LocationAt = f.At
+		r.drivers[id] = driver
+	}
+	return nil
+}
+
+type memoryRides memory
+
+func (r *memoryRides) Insert(ctx context.Context, ride *models.Ride) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ride.ID = newID(ride.ID)
+	r.rides[ride.ID] = clone(*ride)
+	return nil
+}
+
+func (r *memoryRides) FindByID(ctx context.Context, id primitive.ObjectID) (*models.Ride, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ride, ok := r.rides[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	ride = clone(ride)
+	return &ride, nil
+}
+
+func (r *memoryRides) FindByStatus(ctx context.Context, status string) ([]models.Ride, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rides []models.Ride
+	for _, ride := range r.rides {
+		if ride.Status == status {
+			rides = append(rides, clone(ride))
+		}
+	}
+	return rides, nil
+}
+
+func (r *memoryRides) FindActiveByDriver(ctx context.Context, driverID primitive.ObjectID) (*models.Ride, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ride := range r.rides {
+		if ride.DriverID == driverID && (ride.Status == "accepted" || ride.Status == "ongoing") {
+			ride = clone(ride)
+			return &ride, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryRides) CountByStatus(ctx context.Context, statuses ...string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, ride := range r.rides {
+		if contains(statuses, ride.Status) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memoryRides) FindCreatedSince(ctx context.Context, since time.Time) ([]models.Ride, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var rides []models.Ride
+	for _, ride := range r.rides {
+		if !ride.CreatedAt.Before(since) {
+			rides = append(rides, clone(ride))
+		}
+	}
+	return rides, nil
+}
+
+func (r *memoryRides) Update(ctx context.Context, id primitive.ObjectID, match RideMatch, set bson.M) (*models.Ride, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ride, ok := r.rides[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if len(match.Statuses) > 0 && !contains(match.Statuses, ride.Status) {
+		return nil, ErrNotFound
+	}
+	if len(match.PaymentStatuses) > 0 && !contains(match.PaymentStatuses, ride.PaymentStatus) {
+		return nil, ErrNotFound
+	}
+	if !match.DriverID.IsZero() && ride.DriverID != match.DriverID {
+		return nil, ErrNotFound
+	}
+	if match.DispatchAttempts > 0 && ride.DispatchAttempts != match.DispatchAttempts {
+		return nil, ErrNotFound
+	}
+	if match.Arrived != nil && ride.ArrivedAt.IsZero() == *match.Arrived {
+		return nil, ErrNotFound
+	}
+	if match.DispatchOwner != "" && ride.DispatchOwner != match.DispatchOwner {
+		return nil, ErrNotFound
+	}
+	if !match.LeaseExpiredBy.IsZero() && !ride.DispatchLeaseUntil.Before(match.LeaseExpiredBy) {
+		return nil, ErrNotFound
+	}
+
+	updated, err := applySet(ride, set)
+	if err != nil {
+		return nil, err
+	}
+	r.rides[id] = updated
+	updated = clone(updated)
+	return &updated, nil
+}
+
+func (r *memoryRides) AddTripDistance(ctx context.Context, id primitive.ObjectID, km float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ride, ok := r.rides[id]
+	if !ok || ride.Status != "ongoing" {
+		return ErrNotFound
+	}
+	ride.TripDistance += km
+	r.rides[id] = ride
+	return nil
+}
+
+type memoryPayments memory
+
+func (r *memoryPayments) Insert(ctx context.Context, payment *models.Payment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.payments {
+		if p.PaymentIntent == payment.PaymentIntent {
+			return ErrDuplicate
+		}
+	}
+	payment.ID = newID(payment.ID)
+	r.payments[payment.ID] = clone(*payment)
+	return nil
+}
+
+func (r *memoryPayments) FindLiveByRide(ctx context.Context, rideID primitive.ObjectID) (*models.Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, payment := range r.payments {
+		if payment.RideID == rideID && payment.Amount > 0 && payment.Status != "failed" && payment.Status != "canceled" {
+			payment = clone(payment)
+			return &payment, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryPayments) ListByRide(ctx context.Context, rideID primitive.ObjectID) ([]models.Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var payments []models.Payment
+	for _, payment := range r.payments {
+		if payment.RideID == rideID {
+			payments = append(payments, clone(payment))
+		}
+	}
+	sort.Slice(payments, func(i, j int) bool { return payments[i].CreatedAt.Before(payments[j].CreatedAt) })
+	return payments, nil
+}
+
+func (r *memoryPayments) FindByIntent(ctx context.Context, paymentIntent string) (*models.Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, payment := range r.payments {
+		if payment.PaymentIntent == paymentIntent {
+			payment = clone(payment)
+			return &payment, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryPayments) UpdateByIntent(ctx context.Context, paymentIntent string, set bson.M) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, payment := range r.payments {
+		if payment.PaymentIntent != paymentIntent {
+			continue
+		}
+		updated, err := applySet(payment, set)
+		if err != nil {
+			return err
+		}
+		r.payments[id] = updated
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (r *memoryPayments) AddRefunded(ctx context.Context, paymentIntent string, amount, limit float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, payment := range r.payments {
+		if payment.PaymentIntent != paymentIntent {
+			continue
+		}
+		if payment.Refunded+amount > limit {
+			return ErrNotFound
+		}
+		payment.Refunded += amount
+		r.payments[id] = payment
+		return nil
+	}
+	return ErrNotFound
+}
+
+type memoryFeedback memory
+
+func (r *memoryFeedback) Insert(ctx context.Context, feedback *models.Feedback) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.feedback {
+		if f.RideID == feedback.RideID && f.UserID == feedback.UserID {
+			return ErrDuplicate
+		}
+	}
+	feedback.ID = newID(feedback.ID)
+	r.feedback[feedback.ID] = clone(*feedback)
+	return nil
+}
+
+func (r *memoryFeedback) Exists(ctx context.Context, rideID, userID primitive.ObjectID) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.feedback {
+		if f.RideID == rideID && f.UserID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type memoryFareCards memory
+
+// conflicts reports whether another card already covers the city and vehicle type
+func (r *memoryFareCards) conflicts(card *models.FareCard) bool {
+	for id, c := range r.fares {
+		if id != card.ID && c.City == card.City && c.VehicleType == card.VehicleType {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memoryFareCards) Insert(ctx context.Context, card *models.FareCard) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conflicts(card) {
+		return ErrDuplicate
+	}
+	card.ID = newID(card.ID)
+	r.fares[card.ID] = clone(*card)
+	return nil
+}
+
+func (r *memoryFareCards) FindByID(ctx context.Context, id primitive.ObjectID) (*models.FareCard, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	card, ok := r.fares[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	card = clone(card)
+	return &card, nil
+}
+
+func (r *memoryFareCards) List(ctx context.Context, vehicleType string) ([]models.FareCard, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cards := []models.FareCard{}
+	for _, card := range r.fares {
+		if vehicleType == "" || card.VehicleType == vehicleType {
+			cards = append(cards, clone(card))
+		}
+	}
+	sort.Slice(cards, func(i, j int) bool {
+		if cards[i].City != cards[j].City {
+			return cards[i].City < cards[j].City
+		}
+		return cards[i].VehicleType < cards[j].VehicleType
+	})
+	return cards, nil
+}
+
+func (r *memoryFareCards) Replace(ctx context.Context, card *models.FareCard) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.fares[card.ID]; !ok {
+		return ErrNotFound
+	}
+	if r.conflicts(card) {
+		return ErrDuplicate
+	}
+	r.fares[card.ID] = clone(*card)
+	return nil
+}
+
+func (r *memoryFareCards) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.fares[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.fares, id)
+	return nil
+}
+
+type memoryWebhookEvents memory
+
+func (r *memoryWebhookEvents) Claim(ctx context.Context, event *models.WebhookEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.webhooks[event.ID]; ok {
+		return ErrDuplicate
+	}
+	r.webhooks[event.ID] = *event
+	return nil
+}
+
+func (r *memoryWebhookEvents) Release(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.webhooks, id)
+	return nil
+}
+
+type memoryIdempotency memory
+
+func (r *memoryIdempotency) Begin(ctx context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if existing, ok := r.requests[record.ID]; ok {
+		stale := !existing.ExpiresAt.After(now) || (!existing.Completed && !existing.LockedUntil.After(now))
+		if !stale {
+			existing = clone(existing)
+			return &existing, ErrDuplicate
+		}
+	}
+	r.requests[record.ID] = clone(*record)
+	return nil, nil
+}
+
+func (r *memoryIdempotency) Complete(ctx context.Context, id string, status int, contentType string, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, ok := r.requests[id]
+	if !ok || record.Completed {
+		return ErrNotFound
+	}
+	record.Completed, record.Status, record.ContentType = true, status, contentType
+	record.Body = append([]byte(nil), body...)
+	r.requests[id] = record
+	return nil
+}
+
+func (r *memoryIdempotency) Release(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if record, ok := r.requests[id]; ok && !record.Completed {
+		delete(r.requests, id)
+	}
+	return nil
+}
@@ -0,0 +1,557 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"uber-clone/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongoStore returns repositories backed by the collections of database
+func NewMongoStore(database *mongo.Database) *Store {
+	return &Store{
+		Users:    &mongoUsers{coll: database.Collection("users")},
+		Drivers:  &mongoDrivers{coll: database.Collection("drivers")},
+		Rides:    &mongoRides{coll: database.Collection("rides")},
+		Payments: &mongoPayments{coll: database.Collection("payments")},
+		Feedback: &mongoFeedback{coll: database.Collection("feedback")},
+		Fares:    &mongoFareCards{coll: database.Collection("fare_cards")},
+		Webhooks: &mongoWebhookEvents{coll: database.Collection("webhook_events")},
+
+		Idempotency: &mongoIdempotency{coll: database.Collection("idempotency_keys")},
+	}
+}
+
+// findOne decodes the first match into v, mapping "no documents" to ErrNotFound
+func findOne(ctx context.Context, coll *mongo.Collection, filter bson.M, v interface{}) error {
+	err := coll.FindOne(ctx, filter).Decode(v)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// insert stores v and returns its new ID, mapping unique index violations to ErrDuplicate
+func insert(ctx context.Context, coll *mongo.Collection, v interface{}) (primitive.ObjectID, error) {
+	result, err := coll.InsertOne(ctx, v)
+	if mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, ErrDuplicate
+	}
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	id, _ := result.InsertedID.(primitive.ObjectID)
+	return id, nil
+}
+
+type mongoUsers struct {
+	coll *mongo.Collection
+}
+
+func (r *mongoUsers) Insert(ctx context.Context, user *models.User) error {
+	id, err := insert(ctx, r.coll, user)
+	if err != nil {
+		return err
+	}
+	user.ID = id
+	return nil
+}
+
+func (r *mongoUsers) FindByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	var user models.User
+	if err := findOne(ctx, r.coll, bson.M{"_id": id}, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *mongoUsers) FindByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user models.User
+	if err := findOne(ctx, r.coll, bson.M{"email": email}, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *mongoUsers) RecordLogin(ctx context.Context, id primitive.ObjectID, location models.GeoJSON, at time.Time) error {
+	result, err := r.coll.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{"location": location, "last_login": at},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoDrivers struct {
+	coll *mongo.Collection
+}
+
+func (r *mongoDrivers) Insert(ctx context.Context, driver *models.Driver) error {
+	id, err := insert(ctx, r.coll, driver)
+	if err != nil {
+		return err
+	}
+	driver.ID = id
+	return nil
+}
+
+func (r *mongoDrivers) FindByID(ctx context.Context, id primitive.ObjectID) (*models.Driver, error) {
+	var driver models.Driver
+	if err := findOne(ctx, r.coll, bson.M{"_id": id}, &driver); err != nil {
+		return nil, err
+	}
+	return &driver, nil
+}
+
+func (r *mongoDrivers) FindByUserID(ctx context.Context, userID primitive.ObjectID) (*models.Driver, error) {
+	var driver models.Driver
+	if err := findOne(ctx, r.coll, bson.M{"user_id": userID}, &driver); err != nil {
+		return nil, err
+	}
+	return &driver, nil
+}
+
+func (r *mongoDrivers) FindAvailableNear(ctx context.Context, lat, lng float64, radius int, vehicleType string, exclude []primitive.ObjectID) ([]models.Driver, error) {
+	filter := bson.M{
+		"location": bson.M{
+			"$nearSphere": bson.M{
+				"$geometry": bson.M{
+					"type":        "Point",
+					"coordinates": []float64{lng, lat},
+				},
+				"$maxDistance": radius,
+			},
+		},
+		"is_available": true,
+		"vehicle_type": vehicleType,
+	}
+	if len(exclude) > 0 {
+		filter["_id"] = bson.M{"$nin": exclude}
+	}
+
+	cursor, err := r.coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var drivers []models.Driver
+	if err := cursor.All(ctx, &drivers); err != nil {
+		return nil, err
+	}
+	return drivers, nil
+}
+
+func (r *mongoDrivers) CountAvailable(ctx context.Context) (int64, error) {
+	return r.coll.CountDocuments(ctx, bson.M{"is_available": true})
+}
+
+func (r *mongoDrivers) FindAvailable(ctx context.Context) ([]models.Driver, error) {
+	cursor, err := r.coll.Find(ctx, bson.M{"is_available": true})
+	if err != nil {
+		return nil, err
+	}
+	var drivers []models.Driver
+	if err := cursor.All(ctx, &drivers); err != nil {
+		return nil, err
+	}
+	return drivers, nil
+}
+
+func (r *mongoDrivers) Claim(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	err := r.coll.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "is_available": true},
+		bson.M{"$set": bson.M{"is_available": false}},
+	).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *mongoDrivers) SetAvailable(ctx context.Context, id primitive.ObjectID, available bool) error {
+	_, err := r.coll.UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"is_available": available}},
+	)
+	return err
+}
+
+func (r *mongoDrivers) AddRating(ctx context.Context, id primitive.ObjectID, rating int) error {
+	_, err := r.coll.UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$inc": bson.M{"rating_sum": rating, "rating_count": 1}},
+	)
+	return err
+}
+
+func (r *mongoDrivers) UpdateLocations(ctx context.Context, fixes []LocationFix) error {
+	if len(fixes) == 0 {
+		return nil
+	}
+	writes := make([]mongo.WriteModel, 0, len(fixes))
+	for _, f := range fixes {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"user_id": f.UserID}).
+			SetUpdate(bson.M{"$set": bson.M{
+				"location": models.GeoJSON{
+					Type:        "Point",
+					Coordinates: []float64{f.Lng, f.Lat},
+				},
+				"heading":             f.Heading,
+				"speed":               f.Speed,
+				"location_updated_at": f.At,
+			}}))
+	}
+	_, err := r.coll.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+type mongoRides struct {
+	coll *mongo.Collection
+}
+
+func (r *mongoRides) Insert(ctx context.Context, ride *models.Ride) error {
+	id, err := insert(ctx, r.coll, ride)
+	if err != nil {
+		return err
+	}
+	ride.ID = id
+	return nil
+}
+
+func (r *mongoRides) FindByID(ctx context.Context, id primitive.ObjectID) (*models.Ride, error) {
+	var ride models.Ride
+	if err := findOne(ctx, r.coll, bson.M{"_id": id}, &ride); err != nil {
+		return nil, err
+	}
+	return &ride, nil
+}
+
+func (r *mongoRides) FindByStatus(ctx context.Context, status string) ([]models.Ride, error) {
+	cursor, err := r.coll.Find(ctx, bson.M{"status": status})
+	if err != nil {
+		return nil, err
+	}
+	var rides []models.Ride
+	if err := cursor.All(ctx, &rides); err != nil {
+		return nil, err
+	}
+	return rides, nil
+}
+
+func (r *mongoRides) FindActiveByDriver(ctx context.Context, driverID primitive.ObjectID) (*models.Ride, error) {
+	var ride models.Ride
+	err := findOne(ctx, r.coll, bson.M{
+		"driver_id": driverID,
+		"status":    bson.M{"$in": []string{"accepted", "ongoing"}},
+	}, &ride)
+	if err != nil {
+		return nil, err
+	}
+	return &ride, nil
+}
+
+func (r *mongoRides) CountByStatus(ctx context.Context, statuses ...string) (int64, error) {
+	return r.coll.CountDocuments(ctx, bson.M{"status": bson.M{"$in": statuses}})
+}
+
+func (r *mongoRides) FindCreatedSince(ctx context.Context, since time.Time) ([]models.Ride, error) {
+	cursor, err := r.coll.Find(ctx, bson.M{"created_at": bson.M{"$gte": since}})
+	if err != nil {
+		return nil, err
+	}
+	var rides []models.Ride
+	if err := cursor.All(ctx, &rides); err != nil {
+		return nil, err
+	}
+	return rides, nil
+}
+
+func (r *mongoRides) Update(ctx context.Context, id primitive.ObjectID, match RideMatch, set bson.M) (*models.Ride, error) {
+	filter := bson.M{"_id": id}
+	if len(match.Statuses) > 0 {
+		filter["status"] = bson.M{"$in": match.Statuses}
+	}
+	if len(match.PaymentStatuses) > 0 {
+		// Rides inserted before payment tracking may not have the field at all
+		allowed := bson.A{}
+		for _, s := range match.PaymentStatuses {
+			allowed = append(allowed, s)
+			if s == "" {
+				allowed = append(allowed, nil)
+			}
+		}
+		filter["payment_status"] = bson.M{"$in": allowed}
+	}
+	if !match.DriverID.IsZero() {
+		filter["driver_id"] = match.DriverID
+	}
+	if match.DispatchAttempts > 0 {
+		filter["dispatch_attempts"] = match.DispatchAttempts
+	}
+	if match.Arrived != nil {
+		filter["arrived_at"] = bson.M{"$exists": *match.Arrived}
+	}
+	if match.DispatchOwner != "" {
+		filter["dispatch_owner"] = match.DispatchOwner
+	}
+	if !match.LeaseExpiredBy.IsZero() {
+		filter["$or"] = bson.A{
+			bson.M{"dispatch_lease_until": bson.M{"$exists": false}},
+			bson.M{"dispatch_lease_until": bson.M{"$lt": match.LeaseExpiredBy}},
+		}
+	}
+
+	var ride models.Ride
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := r.coll.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&ride)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ride, nil
+}
+
+func (r *mongoRides) AddTripDistance(ctx context.Context, id primitive.ObjectID, km float64) error {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.M{"_id": id, "status": "ongoing"},
+		bson.M{"$inc": bson.M{"trip_distance": km}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoPayments struct {
+	coll *mongo.Collection
+}
+
+func (r *mongoPayments) Insert(ctx context.Context, payment *models.Payment) error {
+	id, err := insert(ctx, r.coll, payment)
+	if err != nil {
+		return err
+	}
+	payment.ID = id
+	return nil
+}
+
+func (r *mongoPayments) FindLiveByRide(ctx context.Context, rideID primitive.ObjectID) (*models.Payment, error) {
+	var payment models.Payment
+	err := findOne(ctx, r.coll, bson.M{
+		"ride_id": rideID,
+		"amount":  bson.M{"$gt": 0}, // Not a refund
+		"status":  bson.M{"$nin": bson.A{"failed", "canceled"}},
+	}, &payment)
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (r *mongoPayments) ListByRide(ctx context.Context, rideID primitive.ObjectID) ([]models.Payment, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := r.coll.Find(ctx, bson.M{"ride_id": rideID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var payments []models.Payment
+	if err := cursor.All(ctx, &payments); err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+func (r *mongoPayments) FindByIntent(ctx context.Context, paymentIntent string) (*models.Payment, error) {
+	var payment models.Payment
+	if err := findOne(ctx, r.coll, bson.M{"payment_intent": paymentIntent}, &payment); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+func (r *mongoPayments) UpdateByIntent(ctx context.Context, paymentIntent string, set bson.M) error {
+	result, err := r.coll.UpdateOne(ctx, bson.M{"payment_intent": paymentIntent}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoPayments) AddRefunded(ctx context.Context, paymentIntent string, amount, limit float64) error {
+	within := bson.A{bson.M{"refunded": bson.M{"$lte": limit - amount}}}
+	if amount <= limit {
+		// Nothing refunded yet leaves the field out
+		within = append(within, bson.M{"refunded": bson.M{"$exists": false}})
+	}
+	filter := bson.M{"payment_intent": paymentIntent, "$or": within}
+	result, err := r.coll.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"refunded": amount}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoFeedback struct {
+	coll *mongo.Collection
+}
+
+func (r *mongoFeedback) Insert(ctx context.Context, feedback *models.Feedback) error {
+	id, err := insert(ctx, r.coll, feedback)
+	if err != nil {
+		return err
+	}
+	feedback.ID = id
+	return nil
+}
+
+func (r *mongoFeedback) Exists(ctx context.Context, rideID, userID primitive.ObjectID) (bool, error) {
+	n, err := r.coll.CountDocuments(ctx, bson.M{"ride_id": rideID, "user_id": userID},
+		options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+type mongoFareCards struct {
+	coll *mongo.Collection
+}
+
+func (r *mongoFareCards) Insert(ctx context.Context, card *models.FareCard) error {
+	id, err := insert(ctx, r.coll, card)
+	if err != nil {
+		return err
+	}
+	card.ID = id
+	return nil
+}
+
+func (r *mongoFareCards) FindByID(ctx context.Context, id primitive.ObjectID) (*models.FareCard, error) {
+	var card models.FareCard
+	if err := findOne(ctx, r.coll, bson.M{"_id": id}, &card); err != nil {
+		return nil, err
+	}
+	return &card, nil
+}
+
+func (r *mongoFareCards) List(ctx context.Context, vehicleType string) ([]models.FareCard, error) {
+	filter := bson.M{}
+	if vehicleType != "" {
+		filter["vehicle_type"] = vehicleType
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "city", Value: 1}, {Key: "vehicle_type", Value: 1}})
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	cards := []models.FareCard{}
+	if err := cursor.All(ctx, &cards); err != nil {
+		return nil, err
+	}
+	return cards, nil
+}
+
+func (r *mongoFareCards) Replace(ctx context.Context, card *models.FareCard) error {
+	result, err := r.coll.ReplaceOne(ctx, bson.M{"_id": card.ID}, card)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoFareCards) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := r.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoWebhookEvents struct {
+	coll *mongo.Collection
+}
+
+func (r *mongoWebhookEvents) Claim(ctx context.Context, event *models.WebhookEvent) error {
+	_, err := r.coll.InsertOne(ctx, event)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (r *mongoWebhookEvents) Release(ctx context.Context, id string) error {
+	_, err := r.coll.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+type mongoIdempotency struct {
+	coll *mongo.Collection
+}
+
+func (r *mongoIdempotency) Begin(ctx context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+	// Take over a record that expired before the TTL monitor removed it, or whose
+	// request died in flight; otherwise the upsert collides with it on _id
+	now := time.Now()
+	filter := bson.M{"_id": record.ID, "$or": bson.A{
+		bson.M{"expires_at": bson.M{"$lte": now}},
+		bson.M{"completed": false, "locked_until": bson.M{"$lte": now}},
+	}}
+	_, err := r.coll.ReplaceOne(ctx, filter, record, options.Replace().SetUpsert(true))
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var existing models.IdempotencyRecord
+	if err := findOne(ctx, r.coll, bson.M{"_id": record.ID}, &existing); err != nil {
+		return nil, err
+	}
+	return &existing, ErrDuplicate
+}
+
+func (r *mongoIdempotency) Complete(ctx context.Context, id string, status int, contentType string, body []byte) error {
+	result, err := r.coll.UpdateOne(ctx, bson.M{"_id": id, "completed": false}, bson.M{"$set": bson.M{
+		"completed":    true,
+		"status":       status,
+		"content_type": contentType,
+		"body":         body,
+	}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mongoIdempotency) Release(ctx context.Context, id string) error {
+	_, err := r.coll.DeleteOne(ctx, bson.M{"_id": id, "completed": false})
+	return err
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"uber-clone/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned when no document matches, including a conditional update
+// whose conditions no longer hold
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate is returned when an insert violates a unique index, e.g. a second
+// account with the same email
+var ErrDuplicate = errors.New("duplicate")
+
+// Store groups the repositories the handlers persist through
+type Store struct {
+	Users       UserRepo
+	Drivers     DriverRepo
+	Rides       RideRepo
+	Payments    PaymentRepo
+	Feedback    FeedbackRepo
+	Fares       FareCardRepo
+	Webhooks    WebhookEventRepo
+	Idempotency IdempotencyRepo
+}
+
+// UserRepo persists riders' and drivers' accounts
+type UserRepo interface {
+	// Insert stores the user and sets its ID
+	Insert(ctx context.Context, user *models.User) error
+	FindByID(ctx context.Context, id primitive.ObjectID) (*models.User, error)
+	FindByEmail(ctx context.Context, email string) (*models.User, error)
+	// RecordLogin stores the location a user logged in from
+	RecordLogin(ctx context.Context, id primitive.ObjectID, location models.GeoJSON, at time.Time) error
+}
+
+// DriverRepo persists driver profiles, their availability and last known position
+type DriverRepo interface {
+	// Insert stores the driver and sets its ID
+	Insert(ctx context.Context, driver *models.Driver) error
+	FindByID(ctx context.Context, id primitive.ObjectID) (*models.Driver, error)
+	FindByUserID(ctx context.Context, userID primitive.ObjectID) (*models.Driver, error)
+	// FindAvailableNear returns available drivers of the vehicle type within radius
+	// meters of the point, nearest first, skipping any driver in exclude
+	FindAvailableNear(ctx context.Context, lat, lng float64, radius int, vehicleType string, exclude []primitive.ObjectID) ([]models.Driver, error)
+	CountAvailable(ctx context.Context) (int64, error)
+	// FindAvailable returns every available driver
+	FindAvailable(ctx context.Context) ([]models.Driver, error)
+	// Claim atomically marks an available driver unavailable. It returns false when
+	// the driver was not available.
+	Claim(ctx context.Context, id primitive.ObjectID) (bool, error)
+	SetAvailable(ctx context.Context, id primitive.ObjectID, available bool) error
+	// AddRating adds one rider rating to the driver's running average
+	AddRating(ctx context.Context, id primitive.ObjectID, rating int) error
+	// UpdateLocations writes a batch of reported positions, keyed by driver user ID
+	UpdateLocations(ctx context.Context, fixes []LocationFix) error
+}
+
+// LocationFix is a reported driver position
+type LocationFix struct {
+	UserID  primitive.ObjectID
+	Lat     float64
+	Lng     float64
+	Heading float64
+	Speed   float64
+	At      time.Time
+}
+
+// RideRepo persists rides. Status changes go through Update so the caller's
+// preconditions and the write are a single atomic step.
+type RideRepo interface {
+	// Insert stores the ride and sets its ID
+	Insert(ctx context.Context, ride *models.Ride) error
+	FindByID(ctx context.Context, id primitive.ObjectID) (*models.Ride, error)
+	FindByStatus(ctx context.Context, status string) ([]models.Ride, error)
+	// FindActiveByDriver returns the driver's accepted or ongoing ride
+	FindActiveByDriver(ctx context.Context, driverID primitive.ObjectID) (*models.Ride, error)
+	CountByStatus(ctx context.Context, statuses ...string) (int64, error)
+	// FindCreatedSince returns the rides requested at or after since, in any status
+	FindCreatedSince(ctx context.Context, since time.Time) ([]models.Ride, error)
+	// Update sets the given fields, keyed by their bson names, if the ride matches and
+	// returns the updated ride. ErrNotFound means the ride is missing or did not match.
+	Update(ctx context.Context, id primitive.ObjectID, match RideMatch, set bson.M) (*models.Ride, error)
+	// AddTripDistance adds km to the distance travelled on an ongoing ride
+	AddTripDistance(ctx context.Context, id primitive.ObjectID, km float64) error
+}
+
+// RideMatch lists the conditions of a conditional ride update. Zero fields are not checked.
+type RideMatch struct {
+	Statuses         []string           // status is one of these
+	PaymentStatuses  []string           // payment_status is one of these; "" also matches a missing field
+	DriverID         primitive.ObjectID // still assigned to this driver
+	DispatchAttempts int                // still on this dispatch attempt
+	Arrived          *bool              // arrived_at is set when true, unset when false
+	DispatchOwner    string             // dispatch_owner equals this
+	LeaseExpiredBy   time.Time          // dispatch_lease_until is unset or before this
+}
+
+// PaymentRepo persists payment records, one per payment intent
+type PaymentRepo interface {
+	// Insert stores the payment and sets its ID
+	Insert(ctx context.Context, payment *models.Payment) error
+	// FindLiveByRide returns the ride's charge that has not failed or been canceled
+	FindLiveByRide(ctx context.Context, rideID primitive.ObjectID) (*models.Payment, error)
+	// ListByRide returns the ride's charges and refunds, oldest first
+	ListByRide(ctx context.Context, rideID primitive.ObjectID) ([]models.Payment, error)
+	FindByIntent(ctx context.Context, paymentIntent string) (*models.Payment, error)
+	// UpdateByIntent sets the given fields on the payment of a payment intent
+	UpdateByIntent(ctx context.Context, paymentIntent string, set bson.M) error
+	// AddRefunded adds amount to the refunded total of a payment intent as long as
+	// the total stays within limit; ErrNotFound if the intent is missing or it would not
+	AddRefunded(ctx context.Context, paymentIntent string, amount, limit float64) error
+}
+
+// FeedbackRepo persists ride ratings
+type FeedbackRepo interface {
+	Insert(ctx context.Context, feedback *models.Feedback) error
+	// Exists reports whether the user already rated the ride
+	Exists(ctx context.Context, rideID, userID primitive.ObjectID) (bool, error)
+}
+
+// FareCardRepo persists the fare cards pricing reads, unique per city and vehicle type
+type FareCardRepo interface {
+	// Insert stores the card and sets its ID
+	Insert(ctx context.Context, card *models.FareCard) error
+	FindByID(ctx context.Context, id primitive.ObjectID) (*models.FareCard, error)
+	// List returns the cards of a vehicle type, or every card if vehicleType is empty,
+	// ordered by city
+	List(ctx context.Context, vehicleType string) ([]models.FareCard, error)
+	// Replace overwrites the card with the same ID
+	Replace(ctx context.Context, card *models.FareCard) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// IdempotencyRepo keeps the responses to requests made with an Idempotency-Key
+type IdempotencyRepo interface {
+	// Begin stores an in-flight record. If one with the ID exists it is returned
+	// with ErrDuplicate, unless it expired or is in flight past its LockedUntil,
+	// in which case it is replaced.
+	Begin(ctx context.Context, record *models.IdempotencyRecord) (*models.IdempotencyRecord, error)
+	// Complete stores the response of the in-flight record
+	Complete(ctx context.Context, id string, status int, contentType string, body []byte) error
+	// Release deletes an in-flight record so the request can be retried
+	Release(ctx context.Context, id string) error
+}
+
+// WebhookEventRepo remembers the provider webhook events already handled, so a
+// redelivered event is acted on once
+type WebhookEventRepo interface {
+	// Claim records the event; ErrDuplicate means it was claimed before
+	Claim(ctx context.Context, event *models.WebhookEvent) error
+	// Release forgets a claimed event whose handling failed, so a redelivery retries it
+	Release(ctx context.Context, id string) error
+}
@@ -0,0 +1,432 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"uber-clone/db"
+	"uber-clone/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The same contract runs against every implementation, so the memory store handlers
+// are tested with behaves like the Mongo one. The Mongo run needs a server and a
+// scratch database: STORE_TEST_MONGODB_URI=mongodb://localhost:27017 go test ./store
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) *Store { return NewMemoryStore() })
+}
+
+func TestMongoStore(t *testing.T) {
+	uri := os.Getenv("STORE_TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("STORE_TEST_MONGODB_URI is not set")
+	}
+	client, err := db.Connect(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+
+	testStore(t, func(t *testing.T) *Store {
+		database := client.Database(fmt.Sprintf("store_test_%d", time.Now().UnixNano()))
+		t.Cleanup(func() { database.Drop(context.Background()) })
+		if _, err := db.Migrate(context.Background(), database); err != nil {
+			t.Fatal(err)
+		}
+		return NewMongoStore(database)
+	})
+}
+
+func testStore(t *testing.T, newStore func(t *testing.T) *Store) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, st *Store)
+	}{
+		{"users", testUsers},
+		{"driver claim", testDriverClaim},
+		{"concurrent driver claims", testConcurrentClaims},
+		{"drivers near", testDriversNear},
+		{"conditional ride update", testRideUpdate},
+		{"trip distance", testTripDistance},
+		{"payments", testPayments},
+		{"feedback", testFeedback},
+		{"fare cards", testFareCards},
+		{"webhook events", testWebhookEvents},
+		{"idempotency", testIdempotency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { tt.run(t, newStore(t)) })
+	}
+}
+
+func wantErr(t *testing.T, what string, got, want error) {
+	t.Helper()
+	if !errors.Is(got, want) {
+		t.Fatalf("%s: got error %v, want %v", what, got, want)
+	}
+}
+
+func point(lat, lng float64) models.GeoJSON {
+	return models.GeoJSON{Type: "Point", Coordinates: []float64{lng, lat}}
+}
+
+func newDriver(t *testing.T, st *Store, lat, lng float64) *models.Driver {
+	t.Helper()
+	driver := &models.Driver{
+		UserID:      primitive.NewObjectID(),
+		VehicleType: "car",
+		IsAvailable: true,
+		Location:    point(lat, lng),
+	}
+	if err := st.Drivers.Insert(context.Background(), driver); err != nil {
+		t.Fatal(err)
+	}
+	return driver
+}
+
+func newRide(t *testing.T, st *Store, status string) *models.Ride {
+	t.Helper()
+	ride := &models.Ride{
+		RiderID:       primitive.NewObjectID(),
+		DriverID:      primitive.NewObjectID(),
+		StartLocation: point(12.97, 77.59),
+		EndLocation:   point(12.93, 77.62),
+		VehicleType:   "car",
+		Status:        status,
+		Fare:          120,
+		CreatedAt:     time.Now(),
+	}
+	if err := st.Rides.Insert(context.Background(), ride); err != nil {
+		t.Fatal(err)
+	}
+	return ride
+}
+
+func testUsers(t *testing.T, st *Store) {
+	ctx := context.Background()
+	user := &models.User{Name: "Asha", Email: "asha@example.com", Password: "hash", Role: "rider"}
+	if err := st.Users.Insert(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID.IsZero() {
+		t.Fatal("Insert did not set the ID")
+	}
+
+	dup := &models.User{Name: "Other", Email: "asha@example.com", Password: "hash", Role: "driver"}
+	wantErr(t, "second account with the same email", st.Users.Insert(ctx, dup), ErrDuplicate)
+
+	found, err := st.Users.FindByEmail(ctx, "asha@example.com")
+	if err != nil || found.ID != user.ID {
+		t.Fatalf("FindByEmail = %v, %v", found, err)
+	}
+	_, err = st.Users.FindByID(ctx, primitive.NewObjectID())
+	wantErr(t, "FindByID of a missing user", err, ErrNotFound)
+	_, err = st.Users.FindByEmail(ctx, "nobody@example.com")
+	wantErr(t, "FindByEmail of a missing user", err, ErrNotFound)
+
+	// Values are copied: changing what was returned does not change the store
+	found.Name = "Changed"
+	if again, _ := st.Users.FindByID(ctx, user.ID); again.Name != "Asha" {
+		t.Fatalf("stored user changed to %q through a returned copy", again.Name)
+	}
+}
+
+func testDriverClaim(t *testing.T, st *Store) {
+	ctx := context.Background()
+	driver := newDriver(t, st, 12.97, 77.59)
+
+	dup := &models.Driver{UserID: driver.UserID, VehicleType: "car", Location: point(0, 0)}
+	wantErr(t, "second driver profile for a user", st.Drivers.Insert(ctx, dup), ErrDuplicate)
+
+	if ok, err := st.Drivers.Claim(ctx, driver.ID); !ok || err != nil {
+		t.Fatalf("first Claim = %v, %v", ok, err)
+	}
+	if ok, err := st.Drivers.Claim(ctx, driver.ID); ok || err != nil {
+		t.Fatalf("Claim of a claimed driver = %v, %v, want false, nil", ok, err)
+	}
+	if ok, err := st.Drivers.Claim(ctx, primitive.NewObjectID()); ok || err != nil {
+		t.Fatalf("Claim of a missing driver = %v, %v, want false, nil", ok, err)
+	}
+
+	if err := st.Drivers.SetAvailable(ctx, driver.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := st.Drivers.Claim(ctx, driver.ID); !ok {
+		t.Fatal("Claim failed after the driver was made available again")
+	}
+	_, err := st.Drivers.FindByID(ctx, primitive.NewObjectID())
+	wantErr(t, "FindByID of a missing driver", err, ErrNotFound)
+}
+
+func testConcurrentClaims(t *testing.T, st *Store) {
+	ctx := context.Background()
+	driver := newDriver(t, st, 12.97, 77.59)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wins := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := st.Drivers.Claim(ctx, driver.ID)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mu.Lock()
+				wins++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Fatalf("%d concurrent claims succeeded, want 1", wins)
+	}
+}
+
+func testDriversNear(t *testing.T, st *Store) {
+	ctx := context.Background()
+	near := newDriver(t, st, 12.9700, 77.5900)
+	nearer := newDriver(t, st, 12.9705, 77.5905)
+	newDriver(t, st, 13.2, 77.9) // Far away
+	busy := newDriver(t, st, 12.9702, 77.5902)
+	st.Drivers.SetAvailable(ctx, busy.ID, false)
+	excluded := newDriver(t, st, 12.9701, 77.5901)
+
+	found, err := st.Drivers.FindAvailableNear(ctx, 12.9706, 77.5906, 2000, "car", []primitive.ObjectID{excluded.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].ID != nearer.ID || found[1].ID != near.ID {
+		t.Fatalf("got %d drivers, want the two available ones nearest first", len(found))
+	}
+	if found, _ := st.Drivers.FindAvailableNear(ctx, 12.97, 77.59, 2000, "premium_car", nil); len(found) != 0 {
+		t.Fatalf("got %d drivers of another vehicle type", len(found))
+	}
+}
+
+func testRideUpdate(t *testing.T, st *Store) {
+	ctx := context.Background()
+	ride := newRide(t, st, "requested")
+
+	updated, err := st.Rides.Update(ctx, ride.ID, RideMatch{Statuses: []string{"requested"}}, bson.M{"status": "accepted"})
+	if err != nil || updated.Status != "accepted" || updated.Fare != 120 {
+		t.Fatalf("Update = %+v, %v", updated, err)
+	}
+
+	// The second of two racing transitions loses
+	_, err = st.Rides.Update(ctx, ride.ID, RideMatch{Statuses: []string{"requested"}}, bson.M{"status": "cancelled"})
+	wantErr(t, "Update from a status the ride left", err, ErrNotFound)
+	_, err = st.Rides.Update(ctx, primitive.NewObjectID(), RideMatch{}, bson.M{"status": "cancelled"})
+	wantErr(t, "Update of a missing ride", err, ErrNotFound)
+	_, err = st.Rides.Update(ctx, ride.ID, RideMatch{DriverID: primitive.NewObjectID()}, bson.M{"status": "rejected"})
+	wantErr(t, "Update for another driver", err, ErrNotFound)
+	_, err = st.Rides.Update(ctx, ride.ID, RideMatch{DispatchAttempts: 3}, bson.M{"status": "rejected"})
+	wantErr(t, "Update for another dispatch attempt", err, ErrNotFound)
+
+	// A ride that never asked for payment matches the empty payment status
+	if _, err := st.Rides.Update(ctx, ride.ID, RideMatch{PaymentStatuses: []string{"", "failed"}}, bson.M{"payment_status": "pending"}); err != nil {
+		t.Fatalf("Update from no payment status: %v", err)
+	}
+	_, err = st.Rides.Update(ctx, ride.ID, RideMatch{PaymentStatuses: []string{"", "failed"}}, bson.M{"payment_status": "pending"})
+	wantErr(t, "Update from a payment status the ride left", err, ErrNotFound)
+
+	// Arrived pins whether the driver had reached the pickup
+	arrived, notArrived := true, false
+	_, err = st.Rides.Update(ctx, ride.ID, RideMatch{Arrived: &arrived}, bson.M{"reason": "late"})
+	wantErr(t, "Update expecting an arrival that has not happened", err, ErrNotFound)
+	if _, err := st.Rides.Update(ctx, ride.ID, RideMatch{Arrived: &notArrived}, bson.M{"arrived_at": time.Now()}); err != nil {
+		t.Fatalf("Update before arrival: %v", err)
+	}
+	_, err = st.Rides.Update(ctx, ride.ID, RideMatch{Arrived: &notArrived}, bson.M{"reason": "late"})
+	wantErr(t, "Update expecting no arrival after the driver arrived", err, ErrNotFound)
+
+	// A dispatch lease is claimed only once it has run out, and renewed only by its owner
+	now := time.Now()
+	if _, err := st.Rides.Update(ctx, ride.ID, RideMatch{LeaseExpiredBy: now}, bson.M{"dispatch_owner": "a", "dispatch_lease_until": now.Add(time.Minute)}); err != nil {
+		t.Fatalf("claiming a ride never leased: %v", err)
+	}
+	_, err = st.Rides.Update(ctx, ride.ID, RideMatch{LeaseExpiredBy: now}, bson.M{"dispatch_owner": "b"})
+	wantErr(t, "claiming a ride under lease", err, ErrNotFound)
+	_, err = st.Rides.Update(ctx, ride.ID, RideMatch{DispatchOwner: "b"}, bson.M{"dispatch_lease_until": now})
+	wantErr(t, "renewing another owner's lease", err, ErrNotFound)
+	if _, err := st.Rides.Update(ctx, ride.ID, RideMatch{LeaseExpiredBy: now.Add(2 * time.Minute)}, bson.M{"dispatch_owner": "b"}); err != nil {
+		t.Fatalf("claiming a lapsed lease: %v", err)
+	}
+
+	if got, _ := st.Rides.FindByID(ctx, ride.ID); got.Status != "accepted" || got.PaymentStatus != "pending" {
+		t.Fatalf("stored ride is %s/%s, want accepted/pending", got.Status, got.PaymentStatus)
+	}
+}
+
+func testTripDistance(t *testing.T, st *Store) {
+	ctx := context.Background()
+	ride := newRide(t, st, "ongoing")
+	for i := 0; i < 3; i++ {
+		if err := st.Rides.AddTripDistance(ctx, ride.ID, 1.5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := st.Rides.FindByID(ctx, ride.ID); got.TripDistance != 4.5 {
+		t.Fatalf("trip distance %v, want 4.5", got.TripDistance)
+	}
+
+	done := newRide(t, st, "completed")
+	wantErr(t, "AddTripDistance on a completed ride", st.Rides.AddTripDistance(ctx, done.ID, 1), ErrNotFound)
+}
+
+func testPayments(t *testing.T, st *Store) {
+	ctx := context.Background()
+	rideID := primitive.NewObjectID()
+	payment := func(intent string, amount float64, status string, at time.Time) *models.Payment {
+		return &models.Payment{RideID: rideID, Amount: amount, Currency: "INR", PaymentIntent: intent, Status: status, CreatedAt: at}
+	}
+
+	now := time.Now()
+	if err := st.Payments.Insert(ctx, payment("pi_failed", 120, "failed", now)); err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, "second payment for an intent", st.Payments.Insert(ctx, payment("pi_failed", 120, "failed", now)), ErrDuplicate)
+
+	_, err := st.Payments.FindLiveByRide(ctx, rideID)
+	wantErr(t, "FindLiveByRide with only a failed payment", err, ErrNotFound)
+
+	st.Payments.Insert(ctx, payment("pi_live", 120, "requires_payment_method", now.Add(time.Second)))
+	st.Payments.Insert(ctx, payment("re_1", -20, "succeeded", now.Add(2*time.Second)))
+	live, err := st.Payments.FindLiveByRide(ctx, rideID)
+	if err != nil || live.PaymentIntent != "pi_live" {
+		t.Fatalf("FindLiveByRide = %v, %v, want the charge and not the refund", live, err)
+	}
+
+	if err := st.Payments.UpdateByIntent(ctx, "pi_live", bson.M{"status": "succeeded"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := st.Payments.FindByIntent(ctx, "pi_live"); got.Status != "succeeded" {
+		t.Fatalf("status %q after UpdateByIntent", got.Status)
+	}
+	if err := st.Payments.AddRefunded(ctx, "pi_live", 100, 120); err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, "AddRefunded beyond the limit", st.Payments.AddRefunded(ctx, "pi_live", 30, 120), ErrNotFound)
+	if err := st.Payments.AddRefunded(ctx, "pi_live", -100, 120); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := st.Payments.FindByIntent(ctx, "pi_live"); got.Refunded != 0 {
+		t.Fatalf("refunded %v after adding and taking back 100", got.Refunded)
+	}
+	wantErr(t, "AddRefunded of a missing intent", st.Payments.AddRefunded(ctx, "pi_missing", 10, 120), ErrNotFound)
+	wantErr(t, "UpdateByIntent of a missing intent", st.Payments.UpdateByIntent(ctx, "pi_missing", bson.M{"status": "failed"}), ErrNotFound)
+	_, err = st.Payments.FindByIntent(ctx, "pi_missing")
+	wantErr(t, "FindByIntent of a missing intent", err, ErrNotFound)
+
+	list, err := st.Payments.ListByRide(ctx, rideID)
+	if err != nil || len(list) != 3 || list[0].PaymentIntent != "pi_failed" || list[2].PaymentIntent != "re_1" {
+		t.Fatalf("ListByRide = %d payments, %v, want 3 oldest first", len(list), err)
+	}
+}
+
+func testFeedback(t *testing.T, st *Store) {
+	ctx := context.Background()
+	rideID, userID := primitive.NewObjectID(), primitive.NewObjectID()
+	if err := st.Feedback.Insert(ctx, &models.Feedback{RideID: rideID, UserID: userID, Rating: 5}); err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, "second rating of a ride", st.Feedback.Insert(ctx, &models.Feedback{RideID: rideID, UserID: userID, Rating: 1}), ErrDuplicate)
+	if ok, _ := st.Feedback.Exists(ctx, rideID, userID); !ok {
+		t.Fatal("Exists is false after Insert")
+	}
+	if ok, _ := st.Feedback.Exists(ctx, rideID, primitive.NewObjectID()); ok {
+		t.Fatal("Exists is true for another user")
+	}
+}
+
+func testFareCards(t *testing.T, st *Store) {
+	ctx := context.Background()
+	card := &models.FareCard{City: "Pune", VehicleType: "car", PerKm: 12}
+	if err := st.Fares.Insert(ctx, card); err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, "second card for a city and vehicle type",
+		st.Fares.Insert(ctx, &models.FareCard{City: "Pune", VehicleType: "car", PerKm: 14}), ErrDuplicate)
+
+	other := &models.FareCard{City: "Mumbai", VehicleType: "car", PerKm: 15}
+	st.Fares.Insert(ctx, other)
+	other.City = "Pune"
+	wantErr(t, "Replace onto another card's city", st.Fares.Replace(ctx, other), ErrDuplicate)
+
+	missing := &models.FareCard{ID: primitive.NewObjectID(), City: "Goa", VehicleType: "car"}
+	wantErr(t, "Replace of a missing card", st.Fares.Replace(ctx, missing), ErrNotFound)
+	wantErr(t, "Delete of a missing card", st.Fares.Delete(ctx, missing.ID), ErrNotFound)
+
+	if cards, _ := st.Fares.List(ctx, "car"); len(cards) != 2 || cards[0].City != "Mumbai" {
+		t.Fatalf("List = %v, want both cards ordered by city", cards)
+	}
+	if err := st.Fares.Delete(ctx, card.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err := st.Fares.FindByID(ctx, card.ID)
+	wantErr(t, "FindByID of a deleted card", err, ErrNotFound)
+}
+
+func testWebhookEvents(t *testing.T, st *Store) {
+	ctx := context.Background()
+	event := &models.WebhookEvent{ID: "evt_1", Type: "payment_intent.succeeded", ReceivedAt: time.Now()}
+	if err := st.Webhooks.Claim(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, "redelivered event", st.Webhooks.Claim(ctx, event), ErrDuplicate)
+
+	// A released event can be claimed again by the retry
+	if err := st.Webhooks.Release(ctx, "evt_1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Webhooks.Claim(ctx, event); err != nil {
+		t.Fatalf("Claim after Release: %v", err)
+	}
+}
+
+func testIdempotency(t *testing.T, st *Store) {
+	ctx := context.Background()
+	now := time.Now()
+	record := func(id string, lockedUntil time.Time) *models.IdempotencyRecord {
+		return &models.IdempotencyRecord{ID: id, Fingerprint: "POST /rides", LockedUntil: lockedUntil, ExpiresAt: now.Add(time.Hour)}
+	}
+
+	if _, err := st.Idempotency.Begin(ctx, record("u:1", now.Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := st.Idempotency.Begin(ctx, record("u:1", now.Add(time.Minute)))
+	wantErr(t, "Begin while in flight", err, ErrDuplicate)
+	if existing == nil || existing.Completed {
+		t.Fatalf("Begin returned %+v, want the in-flight record", existing)
+	}
+
+	if err := st.Idempotency.Complete(ctx, "u:1", 201, "application/json", []byte(`{"ok":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, "second Complete", st.Idempotency.Complete(ctx, "u:1", 500, "", nil), ErrNotFound)
+	wantErr(t, "Complete of a missing record", st.Idempotency.Complete(ctx, "u:2", 201, "", nil), ErrNotFound)
+
+	// Release leaves completed records alone
+	st.Idempotency.Release(ctx, "u:1")
+	existing, err = st.Idempotency.Begin(ctx, record("u:1", now.Add(time.Minute)))
+	wantErr(t, "Begin after completion", err, ErrDuplicate)
+	if !existing.Completed || existing.Status != 201 || string(existing.Body) != `{"ok":true}` {
+		t.Fatalf("Begin returned %+v, want the stored response", existing)
+	}
+
+	// A request that died in flight past its lock is taken over
+	st.Idempotency.Begin(ctx, record("u:3", now.Add(-time.Second)))
+	if _, err := st.Idempotency.Begin(ctx, record("u:3", now.Add(time.Minute))); err != nil {
+		t.Fatalf("Begin over a stale lock: %v", err)
+	}
+}
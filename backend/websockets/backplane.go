@@ -0,0 +1,55 @@
+package websockets
+
+import (
+	"sync"
+)
+
+// Backplane carries notifications between backend replicas. Every replica publishes
+// through it and delivers whatever it receives to the connections it holds, so a
+// notification reaches the user whichever replica their socket landed on.
+type Backplane interface {
+	Publish(n Notification) error
+	// Subscribe calls handler for every notification published by any replica,
+	// including this one, until Close
+	Subscribe(handler func(Notification)) error
+	Close() error
+}
+
+// MemoryBackplane connects hubs living in the same process, e.g. in tests
+type MemoryBackplane struct {
+	mu       sync.RWMutex
+	handlers []func(Notification)
+}
+
+// NewMemoryBackplane returns an in-process backplane
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+// Publish hands n to every subscriber in subscription order
+func (b *MemoryBackplane) Publish(n Notification) error {
+	b.mu.RLock()
+	handlers := append([]func(Notification){}, b.handlers...)
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(n)
+	}
+	return nil
+}
+
+// Subscribe registers handler
+func (b *MemoryBackplane) Subscribe(handler func(Notification)) error {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+	return nil
+}
+
+// Close drops all subscribers
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	b.handlers = nil
+	b.mu.Unlock()
+	return nil
+}
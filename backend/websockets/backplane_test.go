@@ -0,0 +1,146 @@
+package websockets
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackplaneReachesOtherReplicas(t *testing.T) {
+	bp := NewMemoryBackplane()
+	a, b := NewHub(), NewHub()
+	for _, h := range []*Hub{a, b} {
+		h.Backplane = bp
+		if err := h.SubscribeBackplane(); err != nil {
+			t.Fatal(err)
+		}
+		go h.Run()
+	}
+
+	onA, onB := NewClient(nil, "rider-1", "rider"), NewClient(nil, "driver-1", "driver")
+	a.Register <- onA
+	b.Register <- onB
+
+	// Sent from replica A to a user whose socket is on replica B, and the other way.
+	// Each is delivered once, by the replica holding the socket, so the marker sent
+	// after it is the next message.
+	a.Broadcast <- Notification{Type: "ride_request", UserID: "driver-1"}
+	a.Broadcast <- Notification{Type: "marker", UserID: "driver-1"}
+	b.Broadcast <- Notification{Type: "ride_accepted", UserID: "rider-1"}
+	b.Broadcast <- Notification{Type: "marker", UserID: "rider-1"}
+	for _, c := range []*Client{onB, onA} {
+		for _, want := range []string{"ride_", "marker"} {
+			select {
+			case msg := <-c.Send:
+				if !strings.Contains(string(msg), `"type":"`+want) {
+					t.Errorf("%s got %s, want a %s message", c.UserID, msg, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s is missing a %s message", c.UserID, want)
+			}
+		}
+	}
+}
+
+type brokenBackplane struct{ published int }
+
+func (b *brokenBackplane) Publish(n Notification) error {
+	b.published++
+	return nil
+}
+
+func (b *brokenBackplane) Subscribe(handler func(Notification)) error {
+	return errors.New("change streams need a replica set")
+}
+
+func (b *brokenBackplane) Close() error { return nil }
+
+func TestUnsubscribedBackplaneDeliversLocally(t *testing.T) {
+	bp := &brokenBackplane{}
+	h := NewHub()
+	h.Backplane = bp
+	if err := h.SubscribeBackplane(); err == nil {
+		t.Fatal("SubscribeBackplane succeeded on a broken backplane")
+	}
+	go h.Run()
+
+	c := NewClient(nil, "rider-1", "rider")
+	h.Register <- c
+	h.Broadcast <- Notification{Type: "ride_accepted", UserID: "rider-1"}
+
+	select {
+	case <-c.Send:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification was not delivered")
+	}
+	if bp.published != 0 {
+		t.Errorf("published %d notifications to a backplane nobody receives from", bp.published)
+	}
+}
+
+// countingBackplane is a MemoryBackplane that counts what goes through it
+type countingBackplane struct {
+	*MemoryBackplane
+	published chan Notification
+}
+
+func (b *countingBackplane) Publish(n Notification) error {
+	b.published <- n
+	return b.MemoryBackplane.Publish(n)
+}
+
+func TestBackplaneCoalescesEphemeral(t *testing.T) {
+	bp := &countingBackplane{MemoryBackplane: NewMemoryBackplane(), published: make(chan Notification, 100)}
+	h := NewHub()
+	h.coalesce = 50 * time.Millisecond
+	h.Backplane = bp
+	if err := h.SubscribeBackplane(); err != nil {
+		t.Fatal(err)
+	}
+	go h.Run()
+
+	rider := NewClient(nil, "rider-1", "rider")
+	h.Register <- rider
+
+	// A burst of pings within one interval goes out once, as the latest position
+	for i := 1; i <= 10; i++ {
+		h.Broadcast <- Notification{Type: "driver_location", UserID: "rider-1", Payload: i, Ephemeral: true}
+	}
+	h.Broadcast <- Notification{Type: "driver_location", UserID: "rider-2", Payload: 1, Ephemeral: true}
+
+	published := map[string]interface{}{}
+	for len(published) < 2 {
+		select {
+		case n := <-bp.published:
+			if _, dup := published[n.UserID]; dup {
+				t.Fatalf("published twice for %s", n.UserID)
+			}
+			published[n.UserID] = n.Payload
+		case <-time.After(5 * time.Second):
+			t.Fatalf("published %v, want one ping per rider", published)
+		}
+	}
+	if published["rider-1"] != 10 {
+		t.Errorf("published position %v for rider-1, want the latest", published["rider-1"])
+	}
+	select {
+	case msg := <-rider.Send:
+		if !strings.Contains(string(msg), `"payload":10`) {
+			t.Errorf("rider got %s, want the latest position", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the coalesced position never reached the rider")
+	}
+
+	// Other notifications are not held back
+	h.Broadcast <- Notification{Type: "ride_completed", UserID: "rider-1"}
+	select {
+	case n := <-bp.published:
+		if n.Type != "ride_completed" {
+			t.Errorf("published %s, want ride_completed", n.Type)
+		}
+	case <-time.After(h.coalesce / 2):
+		t.Error("ride_completed waited for the coalesce interval")
+	}
+}
@@ -0,0 +1,206 @@
+package websockets
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a message to the peer
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer
+	pongWait = 60 * time.Second
+
+	// Send pings to peer with this period; must be less than pongWait
+	pingPeriod = (pongWait * 9) / 10
+
+	// Maximum inbound message size
+	maxMessageSize = 8192
+
+	// Outbound messages buffered per client before it counts as a slow consumer
+	sendBufferSize = 64
+)
+
+// Client represents a WebSocket connection. Only WritePump writes to Conn; everyone
+// else queues messages on Send, which gorilla/websocket's single-writer rule requires.
+type Client struct {
+	Conn   *websocket.Conn
+	UserID string
+	Role   string // "rider" or "driver"
+	Send   chan []byte
+
+	mu     sync.Mutex
+	closed bool
+
+	// Inbox sequences of the first notification delivered live and the last one
+	// replayed, so a notification is never sent both ways
+	firstLive, replayed int64
+
+	// Last reported position and its cell, guarded by the hub's Mu
+	cell     string
+	lat, lng float64
+}
+
+// NewClient wraps an upgraded connection
+func NewClient(conn *websocket.Conn, userID, role string) *Client {
+	return &Client{
+		Conn:   conn,
+		UserID: userID,
+		Role:   role,
+		Send:   make(chan []byte, sendBufferSize),
+	}
+}
+
+// enqueue queues msg without blocking. It returns false when the client is closed or
+// its buffer is full, in which case the caller should evict it.
+func (c *Client) enqueue(msg []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.Send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// claimLive reports whether a stored notification should be delivered live: not when
+// Replay already sent it. Replay stops at the first one delivered live.
+func (c *Client) claimLive(seq int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq <= c.replayed {
+		return false
+	}
+	if c.firstLive == 0 {
+		c.firstLive = seq
+	}
+	return true
+}
+
+// claimReplay reports whether Replay should send a stored notification, i.e. it is
+// older than the first one delivered live
+func (c *Client) claimReplay(seq int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.firstLive > 0 && seq >= c.firstLive {
+		return false
+	}
+	c.replayed = seq
+	return true
+}
+
+// enqueueWait queues msg once the client's queue is at most half full, leaving the
+// rest for live notifications, and waits up to timeout for the write pump to make
+// room. It returns false when the client closed or the wait timed out.
+func (c *Client) enqueueWait(msg []byte, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return false
+		}
+		if len(c.Send) < cap(c.Send)/2 {
+			c.Send <- msg // Only enqueue and close send, both under mu
+			c.mu.Unlock()
+			return true
+		}
+		c.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// SendJSON queues v for delivery; a client that cannot keep up is closed
+func (c *Client) SendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if !c.enqueue(data) {
+		log.Printf("Client %s is not keeping up, closing", c.UserID)
+		c.close()
+	}
+	return nil
+}
+
+// close stops the write pump; safe to call more than once
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.Send)
+	}
+}
+
+// ReadPump reads frames until the connection fails, dispatching each to router, and
+// then unregisters the client. Pongs from the peer extend the read deadline.
+func (c *Client) ReadPump(hub *Hub, router *Router) {
+	defer func() {
+		hub.Unregister <- c
+	}()
+
+	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, msg, err := c.Conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("WebSocket read error:", err)
+			}
+			return
+		}
+		router.Dispatch(c, msg)
+	}
+}
+
+// WritePump drains Send to the connection and pings the peer to keep it alive. It
+// closes the connection when Send is closed or a write fails.
+func (c *Client) WritePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Println("Error sending message:", err)
+				c.close()
+				return
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
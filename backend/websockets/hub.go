@@ -1,9 +1,15 @@
 package websockets
 
 import (
+	"encoding/json"
 	"log"
+	"math"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"uber-clone/algo"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -19,82 +25,290 @@ var Upgrader = websocket.Upgrader{
 	},
 }
 
-// Client represents a WebSocket connection
-type Client struct {
-	Conn   *websocket.Conn
-	UserID string
-	Role   string // "rider" or "driver"
-}
-
-// Hub manages all WebSocket connections
+// Hub manages all WebSocket connections, indexed by user, by role and by last known
+// position so delivering a notification never scans unrelated clients
 type Hub struct {
-	Clients    map[*Client]bool
+	Users      map[string]map[*Client]bool // user ID -> that user's devices
+	Roles      map[string]map[*Client]bool // "rider"/"driver" -> connected clients
+	Cells      map[string]map[*Client]bool // geohash cell -> clients last located there
 	Broadcast  chan Notification
 	Register   chan *Client
 	Unregister chan *Client
+	Locate     chan Location
 	Mu         sync.Mutex
+
+	// Inbox, when set, stores user notifications so offline clients can replay them
+	Inbox Inbox
+	// Backplane, when set, routes notifications through the other replicas' hubs
+	// once SubscribeBackplane succeeded; until then they are delivered locally
+	Backplane  Backplane
+	subscribed atomic.Bool
+	coalesce   time.Duration // How often coalesced ephemeral notifications are published
+	deliveries chan Notification
 }
 
-// Notification struct for messages
+// Notification struct for messages. It is delivered to every device of UserID and
+// UserIDs; with Role set and no user targets it goes to every client with that role,
+// and with both it goes only to the listed users' clients having that role. Area
+// further limits it to clients located within the area, e.g. all drivers near a
+// pickup; clients that never reported a position are left out.
 type Notification struct {
 	Type    string      `json:"type"` // ride_request, ride_response, payment_request
 	UserID  string      `json:"user_id"`
+	UserIDs []string    `json:"user_ids,omitempty"`
+	Role    string      `json:"role,omitempty"`
+	Area    *Area       `json:"area,omitempty"`
 	Payload interface{} `json:"payload"`
+
+	Ephemeral bool  `json:"-"`             // Not stored in the inbox, e.g. live locations
+	Seq       int64 `json:"seq,omitempty"` // Per-user sequence assigned by the inbox
+}
+
+// Area is a circle around a point
+type Area struct {
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	RadiusKm float64 `json:"radius_km"`
+}
+
+// Location is a position reported for every device of a user, e.g. by the driver
+// location tracker
+type Location struct {
+	UserID   string
+	Lat, Lng float64
 }
 
-// Global WebSocket hub instance
-var WS_HUB *Hub
+// Clients are indexed by geohash cells of roughly 5x5 km
+const cellPrecision = 5
 
 // Initialize WebSocket Hub
 func NewHub() *Hub {
 	return &Hub{
-		Clients:    make(map[*Client]bool),
+		Users:      make(map[string]map[*Client]bool),
+		Roles:      make(map[string]map[*Client]bool),
+		Cells:      make(map[string]map[*Client]bool),
 		Broadcast:  make(chan Notification),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
+		Locate:     make(chan Location),
+		coalesce:   time.Second,
+		deliveries: make(chan Notification, 256),
 	}
 }
 
+// SubscribeBackplane starts receiving the notifications published by every replica.
+// Notifications only go through the backplane after it succeeded, so a replica that
+// cannot receive them does not publish them either.
+func (h *Hub) SubscribeBackplane() error {
+	err := h.Backplane.Subscribe(func(n Notification) {
+		h.deliveries <- n
+	})
+	if err != nil {
+		return err
+	}
+	h.subscribed.Store(true)
+	return nil
+}
+
 // Run the WebSocket Hub
 func (h *Hub) Run() {
+	go h.persist()
+
 	for {
 
 		select {
 		case client := <-h.Register:
 			h.Mu.Lock()
 			log.Printf("🚗 New WebSocket: %s (%s)", client.UserID, client.Role)
-
-			h.Clients[client] = true
+			h.add(client)
 			h.Mu.Unlock()
-			log.Printf("Client %s connected", client.UserID)
 
 		case client := <-h.Unregister:
 			h.Mu.Lock()
-			if _, ok := h.Clients[client]; ok {
-				delete(h.Clients, client)
-				client.Conn.Close()
+			if h.remove(client) {
 				log.Printf("Client %s disconnected", client.UserID)
 			}
 			h.Mu.Unlock()
 
-		case notification := <-h.Broadcast:
+		case loc := <-h.Locate:
 			h.Mu.Lock()
-			for client := range h.Clients {
-				log.Printf("📡 Client in Hub: %s | Broadcast target: %s", client.UserID, notification.UserID)
-				if client.UserID == notification.UserID {
-					err := client.Conn.WriteJSON(gin.H{
-						"type":    notification.Type,
-						"payload": notification.Payload,
-					})
-
-					if err != nil {
-						log.Println("Error sending message:", err)
-						client.Conn.Close()
-						delete(h.Clients, client)
+			h.locate(loc)
+			h.Mu.Unlock()
+
+		case notification := <-h.deliveries:
+			h.Mu.Lock()
+			h.deliver(notification)
+			h.Mu.Unlock()
+		}
+	}
+}
+
+func (h *Hub) add(client *Client) {
+	if h.Users[client.UserID] == nil {
+		h.Users[client.UserID] = make(map[*Client]bool)
+	}
+	h.Users[client.UserID][client] = true
+
+	if h.Roles[client.Role] == nil {
+		h.Roles[client.Role] = make(map[*Client]bool)
+	}
+	h.Roles[client.Role][client] = true
+}
+
+// remove drops the client from both indexes and stops its write pump
+func (h *Hub) remove(client *Client) bool {
+	devices, ok := h.Users[client.UserID]
+	if !ok || !devices[client] {
+		return false
+	}
+	delete(devices, client)
+	if len(devices) == 0 {
+		delete(h.Users, client.UserID)
+	}
+	delete(h.Roles[client.Role], client)
+	h.unlocate(client)
+	client.close()
+	return true
+}
+
+// locate moves the user's clients to the cell of their new position
+func (h *Hub) locate(loc Location) {
+	cell := algo.EncodeGeohash(loc.Lat, loc.Lng, cellPrecision)
+	for client := range h.Users[loc.UserID] {
+		client.lat, client.lng = loc.Lat, loc.Lng
+		if client.cell == cell {
+			continue
+		}
+		h.unlocate(client)
+		if h.Cells[cell] == nil {
+			h.Cells[cell] = make(map[*Client]bool)
+		}
+		h.Cells[cell][client] = true
+		client.cell = cell
+	}
+}
+
+func (h *Hub) unlocate(client *Client) {
+	if client.cell == "" {
+		return
+	}
+	delete(h.Cells[client.cell], client)
+	if len(h.Cells[client.cell]) == 0 {
+		delete(h.Cells, client.cell)
+	}
+	client.cell = ""
+}
+
+// inArea reports whether the client's last position is within the area
+func inArea(client *Client, area *Area) bool {
+	return client.cell != "" &&
+		algo.CalculateVincentyDistance(area.Lat, area.Lng, client.lat, client.lng) <= area.RadiusKm
+}
+
+// areaCells returns the cells covering the bounding box of the area, or false when
+// there are more than limit of them
+func areaCells(area *Area, limit int) ([]string, bool) {
+	center, err := algo.DecodeGeohash(algo.EncodeGeohash(area.Lat, area.Lng, cellPrecision))
+	if err != nil {
+		return nil, false
+	}
+	height, width := center.MaxLat-center.MinLat, center.MaxLng-center.MinLng
+
+	// A degree of latitude is about 111 km; degrees of longitude shrink towards the poles
+	dLat := area.RadiusKm / 111
+	dLng := dLat / math.Max(math.Cos(area.Lat*math.Pi/180), 0.01)
+	minLat, maxLat := math.Max(area.Lat-dLat, -90), math.Min(area.Lat+dLat, 90)
+	dLng = math.Min(dLng, 180)
+	rows := int(math.Ceil((maxLat-minLat)/height)) + 1
+	cols := int(math.Ceil(2*dLng/width)) + 1
+	if rows*cols > limit {
+		return nil, false
+	}
+
+	seen := make(map[string]bool, rows*cols)
+	var cells []string
+	for r := 0; r < rows; r++ {
+		lat := math.Min(minLat+float64(r)*height, maxLat)
+		for c := 0; c < cols; c++ {
+			lng := math.Min(area.Lng-dLng+float64(c)*width, area.Lng+dLng)
+			if lng >= 180 { // Wrap around the antimeridian
+				lng -= 360
+			} else if lng < -180 {
+				lng += 360
+			}
+			cell := algo.EncodeGeohash(lat, lng, cellPrecision)
+			if !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells, true
+}
+
+// deliver queues the notification on every targeted client. Cost is proportional to
+// the number of recipients, not to the number of connected clients.
+func (h *Hub) deliver(notification Notification) {
+	msg := gin.H{
+		"type":    notification.Type,
+		"payload": notification.Payload,
+	}
+	if notification.Seq > 0 {
+		msg["seq"] = notification.Seq
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("Error encoding notification:", err)
+		return
+	}
+
+	send := func(client *Client) {
+		if notification.Seq > 0 && !client.claimLive(notification.Seq) {
+			return // Already replayed
+		}
+		// Never block the hub on one connection: evict slow consumers
+		if !client.enqueue(data) {
+			log.Printf("Client %s is not keeping up, evicting", client.UserID)
+			h.remove(client)
+		}
+	}
+
+	targets := notification.UserIDs
+	if notification.UserID != "" {
+		targets = append([]string{notification.UserID}, targets...)
+	}
+
+	area := notification.Area
+	if len(targets) == 0 && area != nil {
+		// Look only at the cells under the area, unless that is more work than
+		// checking every client with the role
+		role := h.Roles[notification.Role]
+		if cells, ok := areaCells(area, len(role)); ok {
+			for _, cell := range cells {
+				for client := range h.Cells[cell] {
+					if client.Role == notification.Role && inArea(client, area) {
+						send(client)
 					}
 				}
 			}
-			h.Mu.Unlock()
+			return
+		}
+	}
+
+	if len(targets) == 0 {
+		for client := range h.Roles[notification.Role] {
+			if area == nil || inArea(client, area) {
+				send(client)
+			}
+		}
+		return
+	}
+
+	for _, userID := range targets {
+		for client := range h.Users[userID] {
+			if (notification.Role == "" || client.Role == notification.Role) && (area == nil || inArea(client, area)) {
+				send(client)
+			}
 		}
 	}
 }
@@ -0,0 +1,275 @@
+package websockets
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drain reads a client's queue until the hub closes it and reports how many
+// messages arrived
+func drain(c *Client) <-chan int {
+	done := make(chan int, 1)
+	go func() {
+		n := 0
+		for range c.Send {
+			n++
+		}
+		done <- n
+	}()
+	return done
+}
+
+// connected counts the clients in the role index
+func connected(h *Hub) int {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	n := 0
+	for _, clients := range h.Roles {
+		n += len(clients)
+	}
+	return n
+}
+
+// Run with -race: registration, delivery and removal all touch the indexes and the
+// clients' queues from different goroutines
+func TestHubConcurrentClients(t *testing.T) {
+	const clients, users, perClient = 500, 100, 5
+
+	h := NewHub()
+	go h.Run()
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			role := "rider"
+			if i%2 == 0 {
+				role = "driver"
+			}
+			c := NewClient(nil, fmt.Sprintf("user-%d", i%users), role)
+			h.Register <- c
+			done := drain(c)
+
+			for j := 0; j < perClient; j++ {
+				h.Broadcast <- Notification{Type: "ping", UserID: c.UserID, Payload: j}
+			}
+			h.Broadcast <- Notification{Type: "all_drivers", Role: "driver"}
+			h.Broadcast <- Notification{Type: "some_riders", UserIDs: []string{"user-1", "user-3"}, Role: "rider"}
+
+			h.Unregister <- c
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Errorf("client %d was never closed", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := connected(h); n != 0 {
+		t.Fatalf("%d clients still registered", n)
+	}
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	if len(h.Users) != 0 {
+		t.Fatalf("%d users still indexed", len(h.Users))
+	}
+}
+
+// receive waits for the next n messages queued for c
+func receive(t *testing.T, c *Client, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case _, ok := <-c.Send:
+			if !ok {
+				t.Fatalf("%s was closed after %d of %d messages", c.UserID, i, n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s got %d of %d messages", c.UserID, i, n)
+		}
+	}
+}
+
+func TestHubDeliversToEveryDevice(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	phone, browser := NewClient(nil, "rider-1", "rider"), NewClient(nil, "rider-1", "rider")
+	other := NewClient(nil, "rider-2", "rider")
+	for _, c := range []*Client{phone, browser, other} {
+		h.Register <- c
+	}
+
+	h.Broadcast <- Notification{Type: "ride_accepted", UserID: "rider-1"}
+	h.Broadcast <- Notification{Type: "ride_accepted", UserID: "rider-2"}
+	receive(t, phone, 1)
+	receive(t, browser, 1)
+	receive(t, other, 1)
+
+	// Deliveries are in order, so nothing else reached rider-2 before its own message
+	select {
+	case msg := <-other.Send:
+		t.Errorf("rider-2 got an extra message %s", msg)
+	default:
+	}
+}
+
+func TestHubEvictsSlowConsumer(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	// Nobody reads slow's queue; it fills up and the hub drops it instead of blocking
+	const sent = sendBufferSize + 10
+	slow, fast := NewClient(nil, "slow", "driver"), NewClient(nil, "fast", "driver")
+	fast.Send = make(chan []byte, sent)
+	h.Register <- slow
+	h.Register <- fast
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < sent; i++ {
+			h.Broadcast <- Notification{Type: "tick", Role: "driver"}
+		}
+	}()
+	receive(t, fast, sent)
+	<-done
+
+	if n := <-drain(slow); n != sendBufferSize {
+		t.Errorf("slow client had %d messages queued when evicted, want %d", n, sendBufferSize)
+	}
+	if n := connected(h); n != 1 {
+		t.Errorf("%d clients registered, want only the fast one", n)
+	}
+}
+
+func TestHubDeliversToArea(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	// Pickup in central Bangalore; far is about 15 km north
+	near, far := NewClient(nil, "driver-near", "driver"), NewClient(nil, "driver-far", "driver")
+	unlocated := NewClient(nil, "driver-new", "driver")
+	rider, sentinel := NewClient(nil, "rider-near", "rider"), NewClient(nil, "sentinel", "admin")
+	for _, c := range []*Client{near, far, unlocated, rider, sentinel} {
+		h.Register <- c
+	}
+	// Idle drivers elsewhere make small areas cheaper to look up by cell than by role
+	for i := 0; i < 50; i++ {
+		h.Register <- NewClient(nil, fmt.Sprintf("driver-%d", i), "driver")
+	}
+	h.Locate <- Location{UserID: "driver-near", Lat: 12.9720, Lng: 77.5950}
+	h.Locate <- Location{UserID: "driver-far", Lat: 13.1070, Lng: 77.5946}
+	h.Locate <- Location{UserID: "rider-near", Lat: 12.9716, Lng: 77.5946}
+
+	pickup := func(radiusKm float64) *Area { return &Area{Lat: 12.9716, Lng: 77.5946, RadiusKm: radiusKm} }
+	got := func() map[string]bool {
+		// Deliveries are in order, so everything before the sentinel's message arrived
+		h.Broadcast <- Notification{Type: "flush", UserID: "sentinel"}
+		receive(t, sentinel, 1)
+		seen := make(map[string]bool)
+		for _, c := range []*Client{near, far, unlocated, rider} {
+			for len(c.Send) > 0 {
+				<-c.Send
+				seen[c.UserID] = true
+			}
+		}
+		return seen
+	}
+
+	tests := []struct {
+		name string
+		n    Notification
+		want []string
+	}{
+		{"drivers near", Notification{Type: "demand", Role: "driver", Area: pickup(2)}, []string{"driver-near"}},
+		{"rider near", Notification{Type: "demand", Role: "rider", Area: pickup(2)}, []string{"rider-near"}},
+		{"wider area", Notification{Type: "demand", Role: "driver", Area: pickup(20)}, []string{"driver-near", "driver-far"}},
+		{"whole globe", Notification{Type: "demand", Role: "driver", Area: pickup(30000)}, []string{"driver-near", "driver-far"}},
+		{"listed users", Notification{Type: "demand", UserIDs: []string{"driver-far", "driver-new"}, Area: pickup(20)}, []string{"driver-far"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.Broadcast <- tt.n
+			seen := got()
+			if len(seen) != len(tt.want) {
+				t.Fatalf("delivered to %v, want %v", seen, tt.want)
+			}
+			for _, id := range tt.want {
+				if !seen[id] {
+					t.Fatalf("delivered to %v, want %v", seen, tt.want)
+				}
+			}
+		})
+	}
+
+	// The index follows the clients as they move and disconnect
+	h.Locate <- Location{UserID: "driver-near", Lat: 13.1070, Lng: 77.5946}
+	h.Broadcast <- Notification{Type: "demand", Role: "driver", Area: pickup(2)}
+	if seen := got(); len(seen) != 0 {
+		t.Fatalf("delivered to %v after the driver moved away", seen)
+	}
+	h.Unregister <- near
+	h.Unregister <- far
+	got()
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	for cell, clients := range h.Cells {
+		if clients[near] || clients[far] {
+			t.Fatalf("disconnected client still indexed in %s", cell)
+		}
+	}
+}
+
+// benchmarkDeliver measures delivering n to a single client while others clients are
+// connected; the cost should not grow with others
+func benchmarkDeliver(b *testing.B, others int, n Notification) {
+	h := NewHub()
+	for i := 0; i < others; i++ {
+		rider := NewClient(nil, fmt.Sprintf("rider-%d", i), "rider")
+		h.add(rider)
+		h.locate(Location{UserID: rider.UserID, Lat: float64(i%90) - 45, Lng: float64(i%180) - 90})
+	}
+	target := NewClient(nil, "target", "driver")
+	h.add(target)
+	h.locate(Location{UserID: "target", Lat: 12.9716, Lng: 77.5946})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.deliver(n)
+		select {
+		case <-target.Send: // Keep the queue from filling up and evicting the target
+		default:
+			b.Fatalf("target missed message %d", i)
+		}
+	}
+}
+func BenchmarkDeliverToUser(b *testing.B) {
+	for _, others := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("clients=%d", others), func(b *testing.B) {
+			benchmarkDeliver(b, others, Notification{Type: "ride_accepted", UserID: "target"})
+		})
+	}
+}
+
+func BenchmarkDeliverToRole(b *testing.B) {
+	for _, others := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("clients=%d", others), func(b *testing.B) {
+			benchmarkDeliver(b, others, Notification{Type: "surge_update", Role: "driver"})
+		})
+	}
+}
+
+func BenchmarkDeliverToArea(b *testing.B) {
+	for _, others := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("clients=%d", others), func(b *testing.B) {
+			area := &Area{Lat: 12.9716, Lng: 77.5946, RadiusKm: 3}
+			benchmarkDeliver(b, others, Notification{Type: "demand", Role: "driver", Area: area})
+		})
+	}
+}
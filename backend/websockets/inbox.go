@@ -0,0 +1,191 @@
+package websockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Inbox persists user notifications with a per-user sequence number so a client that
+// was offline can replay what it missed
+type Inbox interface {
+	// Save stores the notification for n.UserID and returns its sequence number
+	Save(n Notification, delivered bool) (int64, error)
+	// Since returns up to limit notifications for userID with a sequence above seq
+	Since(userID string, seq int64, limit int) ([]InboxEntry, error)
+}
+
+// InboxEntry is a stored notification as returned to clients
+type InboxEntry struct {
+	Seq       int64       `json:"seq"`
+	Type      string      `json:"type"`
+	Payload   interface{} `json:"payload"`
+	Delivered bool        `json:"delivered"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// replayLimit caps how many missed notifications are pushed on reconnect; clients
+// needing more page through GET /notifications
+const replayLimit = 200
+
+// persist numbers and stores user notifications before handing them to Run for
+// delivery, through the backplane when the hub is subscribed to one. It runs in its own goroutine so
+// slow writes never stall registration. With a backplane, "delivered" only reflects
+// whether the user is connected to this replica.
+//
+// Ephemeral notifications, such as a driver's location every second or two, are
+// coalesced before going through the backplane: only the latest one per type and
+// recipient is published each coalesce interval.
+func (h *Hub) persist() {
+	ticker := time.NewTicker(h.coalesce)
+	defer ticker.Stop()
+	latest := make(map[string]Notification)
+
+	for {
+		select {
+		case n := <-h.Broadcast:
+			if n.Ephemeral && h.Backplane != nil && h.subscribed.Load() {
+				latest[coalesceKey(n)] = n // Supersedes the one still waiting
+				continue
+			}
+			for _, n := range h.save(n) {
+				h.publish(n)
+			}
+
+		case <-ticker.C:
+			for key, n := range latest {
+				h.publish(n)
+				delete(latest, key)
+			}
+		}
+	}
+}
+
+// coalesceKey identifies the notifications a later one supersedes
+func coalesceKey(n Notification) string {
+	key := append([]string{n.Type, n.Role, n.UserID}, n.UserIDs...)
+	if n.Area != nil {
+		key = append(key, fmt.Sprint(*n.Area))
+	}
+	return strings.Join(key, "\x00")
+}
+
+// publish sends n through the backplane, or straight to Run without one
+func (h *Hub) publish(n Notification) {
+	if h.Backplane == nil || !h.subscribed.Load() {
+		h.deliveries <- n
+		return
+	}
+	if err := h.Backplane.Publish(n); err != nil {
+		log.Println("Backplane publish failed, delivering locally only:", err)
+		h.deliveries <- n
+	}
+}
+
+// save stores a notification once per addressed user, since each user numbers their
+// notifications separately, and returns the copies to deliver. Role broadcasts and
+// ephemeral notifications are not stored.
+func (h *Hub) save(n Notification) []Notification {
+	targets := n.UserIDs
+	if n.UserID != "" {
+		targets = append([]string{n.UserID}, targets...)
+	}
+	if h.Inbox == nil || n.Ephemeral || len(targets) == 0 {
+		return []Notification{n}
+	}
+
+	out := make([]Notification, 0, len(targets))
+	for _, userID := range targets {
+		m := n
+		m.UserID, m.UserIDs = userID, nil
+		seq, err := h.Inbox.Save(m, h.online(userID))
+		if err != nil {
+			log.Println("Failed to store notification:", err)
+		}
+		m.Seq = seq
+		out = append(out, m)
+	}
+	return out
+}
+
+func (h *Hub) online(userID string) bool {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	return len(h.Users[userID]) > 0
+}
+
+// Replay pushes the client's notifications with a sequence above since, oldest first.
+// The client's write pump must be running: Replay waits for it to drain the queue
+// rather than overflowing it, and closes the client if it stops draining.
+func (h *Hub) Replay(client *Client, since int64) {
+	if h.Inbox == nil {
+		return
+	}
+	entries, err := h.Inbox.Since(client.UserID, since, replayLimit)
+	if err != nil {
+		log.Println("Failed to load missed notifications:", err)
+		return
+	}
+	for _, e := range entries {
+		if !client.claimReplay(e.Seq) {
+			return // Delivered live from here on
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"type":     e.Type,
+			"payload":  e.Payload,
+			"seq":      e.Seq,
+			"replayed": true,
+		})
+		if err != nil {
+			log.Println("Error encoding notification:", err)
+			continue
+		}
+		if !client.enqueueWait(data, writeWait) {
+			log.Printf("Client %s stopped reading during replay, closing", client.UserID)
+			client.close()
+			return
+		}
+	}
+}
+
+// MemoryInbox keeps notifications in process, e.g. in tests. Entries never expire.
+type MemoryInbox struct {
+	mu      sync.Mutex
+	entries map[string][]InboxEntry // by user ID, in sequence order
+}
+
+// NewMemoryInbox returns an empty in-process inbox
+func NewMemoryInbox() *MemoryInbox {
+	return &MemoryInbox{entries: make(map[string][]InboxEntry)}
+}
+
+// Save implements Inbox
+func (i *MemoryInbox) Save(n Notification, delivered bool) (int64, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	seq := int64(len(i.entries[n.UserID]) + 1)
+	i.entries[n.UserID] = append(i.entries[n.UserID], InboxEntry{
+		Seq:       seq,
+		Type:      n.Type,
+		Payload:   n.Payload,
+		Delivered: delivered,
+		CreatedAt: time.Now(),
+	})
+	return seq, nil
+}
+
+// Since implements Inbox
+func (i *MemoryInbox) Since(userID string, seq int64, limit int) ([]InboxEntry, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var out []InboxEntry
+	for _, e := range i.entries[userID] {
+		if e.Seq > seq && len(out) < limit {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
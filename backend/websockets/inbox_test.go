@@ -0,0 +1,191 @@
+package websockets
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestReplayMoreThanQueueSize(t *testing.T) {
+	const missed, live = 3 * sendBufferSize, 20
+
+	h := NewHub()
+	h.Inbox = NewMemoryInbox()
+	for i := 0; i < missed; i++ {
+		h.Inbox.Save(Notification{Type: "missed", UserID: "rider-1", Payload: i}, false)
+	}
+	go h.Run()
+
+	c := NewClient(nil, "rider-1", "rider")
+	h.Register <- c
+
+	// Stand-in for a write pump on a slow network
+	replayed, liveSeen := 0, 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for data := range c.Send {
+			var msg struct {
+				Type     string `json:"type"`
+				Seq      int64  `json:"seq"`
+				Replayed bool   `json:"replayed"`
+			}
+			json.Unmarshal(data, &msg)
+			if msg.Replayed {
+				replayed++
+				if msg.Seq != int64(replayed) {
+					t.Errorf("replayed seq %d in position %d", msg.Seq, replayed)
+				}
+			} else {
+				liveSeen++
+			}
+			if replayed == missed && liveSeen == live {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// Live notifications keep arriving while the backlog is replayed
+	go func() {
+		for i := 0; i < live; i++ {
+			h.Broadcast <- Notification{Type: "live", UserID: "rider-1"}
+		}
+	}()
+	h.Replay(c, 0)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out") // The reader may still be running; don't touch its counts
+	}
+	if replayed != missed || liveSeen != live {
+		t.Fatalf("got %d replayed and %d live, want %d and %d", replayed, liveSeen, missed, live)
+	}
+}
+
+func TestReplayStopsWhenClientCloses(t *testing.T) {
+	h := NewHub()
+	h.Inbox = NewMemoryInbox()
+	for i := 0; i < 2*sendBufferSize; i++ {
+		h.Inbox.Save(Notification{Type: "missed", UserID: "rider-1"}, false)
+	}
+
+	c := NewClient(nil, "rider-1", "rider")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.close() // Nobody drains; the connection goes away mid-replay
+	}()
+
+	finished := make(chan struct{})
+	go func() {
+		h.Replay(c, 0)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Replay kept waiting on a closed client")
+	}
+}
+
+// next returns the type and seq of the next message queued for c
+func next(t *testing.T, c *Client) (string, int64) {
+	t.Helper()
+	select {
+	case data := <-c.Send:
+		var msg struct {
+			Type string `json:"type"`
+			Seq  int64  `json:"seq"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg.Type, msg.Seq
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing queued for %s", c.UserID)
+		return "", 0
+	}
+}
+
+func TestReplaySkipsLiveDeliveries(t *testing.T) {
+	h := NewHub()
+	h.Inbox = NewMemoryInbox()
+	for i := 0; i < 3; i++ {
+		h.Inbox.Save(Notification{Type: "missed", UserID: "rider-1"}, false)
+	}
+	go h.Run()
+
+	c := NewClient(nil, "rider-1", "rider")
+	h.Register <- c
+
+	// Seq 4 is stored and delivered live before the replay reads the inbox
+	h.Broadcast <- Notification{Type: "live", UserID: "rider-1"}
+	if typ, seq := next(t, c); typ != "live" || seq != 4 {
+		t.Fatalf("got %s %d, want live 4", typ, seq)
+	}
+
+	h.Replay(c, 0)
+	for want := int64(1); want <= 3; want++ {
+		if typ, seq := next(t, c); typ != "missed" || seq != want {
+			t.Fatalf("got %s %d, want missed %d", typ, seq, want)
+		}
+	}
+	if len(c.Send) != 0 {
+		t.Fatalf("%d more messages; seq 4 was replayed after being delivered live", len(c.Send))
+	}
+}
+
+func TestClientSequenceCursor(t *testing.T) {
+	c := NewClient(nil, "rider-1", "rider")
+
+	// Replayed first: live delivery of the same notifications is skipped
+	if !c.claimReplay(1) || !c.claimReplay(2) {
+		t.Fatal("replay refused before anything was delivered live")
+	}
+	if c.claimLive(2) {
+		t.Fatal("seq 2 delivered live after it was replayed")
+	}
+
+	// Delivered live first: replay stops there
+	if !c.claimLive(5) {
+		t.Fatal("seq 5 refused live")
+	}
+	if !c.claimReplay(3) || c.claimReplay(5) || c.claimReplay(6) {
+		t.Fatal("replay went past the first live delivery")
+	}
+	if !c.claimLive(6) {
+		t.Fatal("seq 6 refused live")
+	}
+}
+
+func TestHubStoresEveryRecipient(t *testing.T) {
+	h := NewHub()
+	inbox := NewMemoryInbox()
+	h.Inbox = inbox
+	inbox.Save(Notification{Type: "earlier", UserID: "driver-2"}, false)
+	go h.Run()
+
+	d1, d2 := NewClient(nil, "driver-1", "driver"), NewClient(nil, "driver-2", "driver")
+	h.Register <- d1
+	h.Register <- d2
+	for !h.online("driver-1") || !h.online("driver-2") {
+		time.Sleep(time.Millisecond) // Registered once Run has indexed them
+	}
+
+	h.Broadcast <- Notification{Type: "ride_request", UserIDs: []string{"driver-1", "driver-2", "driver-3"}}
+	if typ, seq := next(t, d1); typ != "ride_request" || seq != 1 {
+		t.Fatalf("driver-1 got %s %d, want ride_request 1", typ, seq)
+	}
+	if typ, seq := next(t, d2); typ != "ride_request" || seq != 2 {
+		t.Fatalf("driver-2 got %s %d, want ride_request 2", typ, seq)
+	}
+
+	for userID, delivered := range map[string]bool{"driver-1": true, "driver-2": true, "driver-3": false} {
+		entries, _ := inbox.Since(userID, 0, replayLimit)
+		last := entries[len(entries)-1]
+		if last.Type != "ride_request" || last.Delivered != delivered {
+			t.Errorf("%s stored %+v, want ride_request delivered=%v", userID, last, delivered)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package websockets
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Envelope is the shape of every client-to-server message. Replies to a message carry
+// the same ID so the client can correlate them.
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Error codes sent in "error" replies
+const (
+	CodeBadRequest  = "bad_request"
+	CodeUnknownType = "unknown_type"
+	CodeForbidden   = "forbidden"
+	CodeNotFound    = "not_found"
+	CodeConflict    = "conflict"
+	CodeInternal    = "internal"
+)
+
+// MessageError is a handler failure reported back to the client
+type MessageError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *MessageError) Error() string { return e.Code + ": " + e.Message }
+
+// NewMessageError builds a MessageError
+func NewMessageError(code, message string) *MessageError {
+	return &MessageError{Code: code, Message: message}
+}
+
+// Message is an inbound envelope together with the client that sent it
+type Message struct {
+	Envelope
+	Client *Client
+}
+
+// Bind decodes the payload into v and validates it with its `binding` struct tags,
+// the same rules gin applies to REST request bodies.
+func (m *Message) Bind(v interface{}) error {
+	if len(m.Payload) == 0 {
+		return NewMessageError(CodeBadRequest, "payload required")
+	}
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return NewMessageError(CodeBadRequest, err.Error())
+	}
+	if err := binding.Validator.ValidateStruct(v); err != nil {
+		return NewMessageError(CodeBadRequest, err.Error())
+	}
+	return nil
+}
+
+// HandlerFunc handles one message type. The result is sent back in an "ack", or as
+// is when it is a Reply; an error is sent back as an "error" reply.
+type HandlerFunc func(m *Message) (interface{}, error)
+
+// Reply lets a handler answer with its own message type instead of "ack"
+type Reply struct {
+	Type    string
+	Payload interface{}
+}
+
+type route struct {
+	handler HandlerFunc
+	roles   []string
+}
+
+// Router dispatches inbound WebSocket messages to handlers registered by type
+type Router struct {
+	routes map[string]route
+}
+
+// NewRouter returns an empty router
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]route)}
+}
+
+// Handle registers h for msgType. When roles are given, only clients with one of
+// those roles may send the message.
+func (r *Router) Handle(msgType string, h HandlerFunc, roles ...string) {
+	r.routes[msgType] = route{handler: h, roles: roles}
+}
+
+// Dispatch decodes a raw frame, runs its handler and writes the ack or error reply.
+// Frames without a payload field are treated as flat, e.g. {"type":"ping"}.
+func (r *Router) Dispatch(client *Client, raw []byte) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		client.reply(Envelope{Type: "error"}, NewMessageError(CodeBadRequest, "invalid JSON envelope"))
+		return
+	}
+	if env.Type == "" {
+		client.reply(env, NewMessageError(CodeBadRequest, "type required"))
+		return
+	}
+	if len(env.Payload) == 0 {
+		env.Payload = raw
+	}
+
+	rt, ok := r.routes[env.Type]
+	if !ok {
+		client.reply(env, NewMessageError(CodeUnknownType, "unknown message type "+env.Type))
+		return
+	}
+	if !roleAllowed(client.Role, rt.roles) {
+		client.reply(env, NewMessageError(CodeForbidden, env.Type+" is not allowed for "+client.Role))
+		return
+	}
+
+	result, err := rt.handler(&Message{Envelope: env, Client: client})
+	if err != nil {
+		client.reply(env, err)
+		return
+	}
+	if result == nil && env.ID == "" {
+		return // Fire-and-forget frames such as location updates need no ack
+	}
+	client.reply(env, result)
+}
+
+func roleAllowed(role string, roles []string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// reply sends an "ack" with the result or an "error" correlated with the request ID
+func (c *Client) reply(req Envelope, result interface{}) {
+	out := gin.H{"type": "ack", "id": req.ID, "payload": result}
+	if r, ok := result.(Reply); ok {
+		out = gin.H{"type": r.Type, "id": req.ID}
+		if r.Payload != nil {
+			out["payload"] = r.Payload
+		}
+	}
+	if err, ok := result.(error); ok {
+		var me *MessageError
+		if !errors.As(err, &me) {
+			log.Printf("WebSocket handler %s failed: %v", req.Type, err)
+			me = NewMessageError(CodeInternal, "internal error")
+		}
+		out = gin.H{"type": "error", "id": req.ID, "payload": me}
+	}
+	if req.ID == "" {
+		delete(out, "id")
+	}
+
+	if err := c.SendJSON(out); err != nil {
+		log.Println("WebSocket reply error:", err)
+	}
+}
@@ -0,0 +1,118 @@
+package websockets
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type point struct {
+	Lat float64 `json:"lat" binding:"required,min=-90,max=90"`
+}
+
+func testRouter() *Router {
+	r := NewRouter()
+	r.Handle("echo", func(m *Message) (interface{}, error) {
+		var p point
+		if err := m.Bind(&p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	})
+	r.Handle("location", func(m *Message) (interface{}, error) { return nil, nil }, "driver")
+	r.Handle("ping", func(m *Message) (interface{}, error) { return Reply{Type: "pong"}, nil })
+	r.Handle("lookup", func(m *Message) (interface{}, error) {
+		return nil, NewMessageError(CodeNotFound, "ride not found")
+	})
+	r.Handle("crash", func(m *Message) (interface{}, error) { return nil, errors.New("db down") })
+	return r
+}
+
+// reply is what the router sent back, decoded
+type reply struct {
+	Type    string          `json:"type"`
+	ID      *string         `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func TestRouterDispatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		frame    string
+		wantType string // Empty when no reply is expected
+		wantID   string
+		wantCode string
+		wantBody string
+	}{
+		{"invalid json", "rider", `{"type":`, "error", "", CodeBadRequest, ""},
+		{"missing type", "rider", `{"id":"1"}`, "error", "1", CodeBadRequest, ""},
+		{"unknown type", "rider", `{"type":"teleport","id":"2"}`, "error", "2", CodeUnknownType, ""},
+		{"role not allowed", "rider", `{"type":"location","id":"3"}`, "error", "3", CodeForbidden, ""},
+		{"ack with payload", "rider", `{"type":"echo","id":"4","payload":{"lat":12.5}}`, "ack", "4", "", `{"lat":12.5}`},
+		{"flat frame", "rider", `{"type":"echo","id":"5","lat":1}`, "ack", "5", "", `{"lat":1}`},
+		{"bind json error", "rider", `{"type":"echo","id":"6","payload":{"lat":"north"}}`, "error", "6", CodeBadRequest, ""},
+		{"bind validation error", "rider", `{"type":"echo","id":"7","payload":{"lat":120}}`, "error", "7", CodeBadRequest, ""},
+		{"own reply type", "rider", `{"type":"ping","id":"8"}`, "pong", "8", "", ""},
+		{"handler message error", "rider", `{"type":"lookup","id":"9"}`, "error", "9", CodeNotFound, ""},
+		{"internal error hidden", "rider", `{"type":"crash","id":"10"}`, "error", "10", CodeInternal, ""},
+		{"fire and forget", "driver", `{"type":"location","payload":{"lat":1}}`, "", "", "", ""},
+		{"ack for nil result with id", "driver", `{"type":"location","id":"11"}`, "ack", "11", "", "null"},
+	}
+
+	router := testRouter()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(nil, "user-1", tt.role)
+			router.Dispatch(c, []byte(tt.frame))
+
+			if tt.wantType == "" {
+				if len(c.Send) != 0 {
+					t.Fatalf("unexpected reply %s", <-c.Send)
+				}
+				return
+			}
+			if len(c.Send) != 1 {
+				t.Fatalf("%d replies, want 1", len(c.Send))
+			}
+			var got reply
+			if err := json.Unmarshal(<-c.Send, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Type != tt.wantType {
+				t.Fatalf("type %q, want %q", got.Type, tt.wantType)
+			}
+			switch {
+			case tt.wantID == "" && got.ID != nil:
+				t.Fatalf("id %q on a request without one", *got.ID)
+			case tt.wantID != "" && (got.ID == nil || *got.ID != tt.wantID):
+				t.Fatalf("id %v, want %q", got.ID, tt.wantID)
+			}
+			if tt.wantCode != "" {
+				var me MessageError
+				if err := json.Unmarshal(got.Payload, &me); err != nil {
+					t.Fatal(err)
+				}
+				if me.Code != tt.wantCode {
+					t.Fatalf("code %q, want %q (%s)", me.Code, tt.wantCode, me.Message)
+				}
+				if me.Code == CodeInternal && me.Message != "internal error" {
+					t.Fatalf("internal error leaked %q", me.Message)
+				}
+			}
+			if tt.wantBody != "" && string(got.Payload) != tt.wantBody {
+				t.Fatalf("payload %s, want %s", got.Payload, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestBindRequiresPayload(t *testing.T) {
+	m := &Message{Envelope: Envelope{Type: "echo"}}
+	var p point
+	err := m.Bind(&p)
+	var me *MessageError
+	if !errors.As(err, &me) || me.Code != CodeBadRequest {
+		t.Fatalf("Bind without payload: %v", err)
+	}
+}